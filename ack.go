@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// Points in handling a task at which its message can be acknowledged to the
+// queue. Acking earlier trades at-least-once for at-most-once delivery.
+const (
+	ackAfterWebhook = "after_webhook"
+	ackAfterExec    = "after_exec"
+	ackBeforeExec   = "before_exec"
+)
+
+// ackFunc acknowledges a task to the queue before its handling has finished.
+// Only the first call has any effect.
+type ackFunc func(requeue bool, err error)
+
+type ackResult struct {
+	requeue bool
+	err     error
+}
+
+type ackJob struct {
+	ctx    context.Context
+	task   kewpie.Task
+	result chan ackResult
+}
+
+// earlyAcker is a Kewpie handler that returns, and so acknowledges the
+// message, as soon as the task reaches its ack point while a worker carries
+// on with the rest of the task. Tasks are still run one at a time, as the
+// handler can't accept a task until the worker is free.
+type earlyAcker struct {
+	ctx     context.Context
+	handle  func(context.Context, kewpie.Task, ackFunc) (bool, error)
+	jobs    chan ackJob
+	running sync.WaitGroup
+}
+
+func newEarlyAcker(ctx context.Context, handle func(context.Context, kewpie.Task, ackFunc) (bool, error)) *earlyAcker {
+	acker := &earlyAcker{
+		ctx:    ctx,
+		handle: handle,
+		jobs:   make(chan ackJob),
+	}
+
+	go acker.work()
+
+	return acker
+}
+
+func (a *earlyAcker) Handle(task kewpie.Task) (bool, error) {
+	return a.handleIn(a.ctx, task)
+}
+
+/*
+ * Hand a task to the worker to be handled in ctx, returning once it's
+ * acknowledged.
+ */
+func (a *earlyAcker) handleIn(ctx context.Context, task kewpie.Task) (bool, error) {
+	job := ackJob{ctx: ctx, task: task, result: make(chan ackResult, 1)}
+
+	a.running.Add(1)
+	select {
+	case a.jobs <- job:
+	case <-a.ctx.Done():
+		a.running.Done()
+		return true, a.ctx.Err()
+	}
+
+	result := <-job.result
+	return result.requeue, result.err
+}
+
+func (a *earlyAcker) work() {
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case job := <-a.jobs:
+			a.run(job)
+		}
+	}
+}
+
+func (a *earlyAcker) run(job ackJob) {
+	defer a.running.Done()
+
+	acked := false
+	var once sync.Once
+	ack := func(requeue bool, err error) {
+		once.Do(func() {
+			acked = true
+			job.result <- ackResult{requeue: requeue, err: err}
+		})
+	}
+
+	requeue, err := a.handle(job.ctx, job.task, ack)
+	if acked && err != nil {
+		log.Printf("ERROR task %s failed after it was acknowledged, it will not be requeued: %s \n", job.task.ID, err.Error())
+	}
+	ack(requeue, err)
+}
+
+/*
+ * Block until the task currently being worked on, if any, is finished.
+ */
+func (a *earlyAcker) wait() {
+	a.running.Wait()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEarlyAcker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	finished := make(chan struct{})
+	acker := newEarlyAcker(ctx, func(ctx context.Context, task kewpie.Task, ack ackFunc) (bool, error) {
+		ack(false, nil)
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		return true, context.Canceled
+	})
+
+	requeue, err := acker.Handle(kewpie.Task{Body: "sleep 1"})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+
+	select {
+	case <-finished:
+		t.Fatal("the task was acked only once it finished")
+	default:
+	}
+
+	acker.wait()
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("wait returned before the task finished")
+	}
+}
+
+func TestEarlyAckerWithoutAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acker := newEarlyAcker(ctx, func(ctx context.Context, task kewpie.Task, ack ackFunc) (bool, error) {
+		return true, context.Canceled
+	})
+
+	requeue, err := acker.Handle(kewpie.Task{Body: "sleep 1"})
+	assert.True(t, requeue)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+const maxCPUs = 1024
+
+/*
+ * Work out the CPUs a task is pinned to. The cpu_affinity tag narrows
+ * CPU_AFFINITY, and must be a subset of it when it's set. An empty result
+ * means the task may run on any CPU.
+ */
+func taskAffinity(task kewpie.Task) ([]int, error) {
+	allowed := []int{}
+	if config.CPU_AFFINITY != "" {
+		cpus, err := parseCPUList(config.CPU_AFFINITY)
+		if err != nil {
+			return nil, err
+		}
+		allowed = cpus
+	}
+
+	if task.Tags["cpu_affinity"] == "" {
+		if len(allowed) == 0 {
+			return nil, nil
+		}
+		return allowed, nil
+	}
+
+	cpus, err := parseCPUList(task.Tags["cpu_affinity"])
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) > 0 {
+		permitted := map[int]bool{}
+		for _, cpu := range allowed {
+			permitted[cpu] = true
+		}
+		for _, cpu := range cpus {
+			if !permitted[cpu] {
+				return nil, fmt.Errorf("The cpu_affinity tag %q isn't within CPU_AFFINITY %q", task.Tags["cpu_affinity"], config.CPU_AFFINITY)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+/*
+ * Parse a CPU list in the format used by taskset and cpusets, eg. 0-3,6.
+ */
+func parseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CPU list %q", list)
+			}
+		}
+
+		if first < 0 || last < first || last >= maxCPUs {
+			return nil, fmt.Errorf("Invalid CPU range %q in %q", part, list)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+/*
+ * Pin a running process to the given CPUs with sched_setaffinity. Threads
+ * and children it creates afterwards inherit the mask.
+ */
+func applyAffinity(pid int, cpus []int) error {
+	if len(cpus) == 0 {
+		return nil
+	}
+
+	var mask [maxCPUs / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
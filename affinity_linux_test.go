@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyAffinity(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	assert.Nil(t, cmd.Start())
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	assert.Nil(t, applyAffinity(cmd.Process.Pid, []int{0}))
+
+	status, err := ioutil.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/status")
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`Cpus_allowed_list:\s+0\n`), string(status))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// ErrAffinityUnsupported is returned when CPU pinning is requested on a
+// platform without sched_setaffinity.
+var ErrAffinityUnsupported = fmt.Errorf("CPU affinity is only supported on linux")
+
+func applyAffinity(pid int, cpus []int) error {
+	if len(cpus) > 0 {
+		return ErrAffinityUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-3,6")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 6}, cpus)
+
+	for _, invalid := range []string{"", "a", "3-1", "-1", "0-2048"} {
+		_, err := parseCPUList(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTaskAffinity(t *testing.T) {
+	config.CPU_AFFINITY = "0-1"
+	defer func() {
+		config.CPU_AFFINITY = ""
+	}()
+
+	cpus, err := taskAffinity(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 1}, cpus)
+
+	cpus, err = taskAffinity(kewpie.Task{
+		Tags: kewpie.Tags{
+			"cpu_affinity": "0",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0}, cpus)
+}
+
+func TestTaskAffinityMustBeWithinConfig(t *testing.T) {
+	config.CPU_AFFINITY = "0-1,4"
+	defer func() {
+		config.CPU_AFFINITY = ""
+	}()
+
+	for _, tag := range []string{"2", "0-2", "1,3"} {
+		_, err := taskAffinity(kewpie.Task{Tags: kewpie.Tags{"cpu_affinity": tag}})
+		assert.Error(t, err, tag)
+	}
+
+	cpus, err := taskAffinity(kewpie.Task{Tags: kewpie.Tags{"cpu_affinity": "1,4"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 4}, cpus)
+
+	config.CPU_AFFINITY = ""
+	cpus, err = taskAffinity(kewpie.Task{Tags: kewpie.Tags{"cpu_affinity": "2-3"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+
+	cpus, err = taskAffinity(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.Nil(t, cpus)
+}
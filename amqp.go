@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// amqpHeartbeat is the longest heartbeat interval Sonic will agree to. The
+// server's is used if it's shorter.
+const amqpHeartbeat = 60 * time.Second
+
+// ErrAMQPClosed is returned for operations on a closed AMQP connection.
+var ErrAMQPClosed = fmt.Errorf("The connection to RabbitMQ is closed")
+
+// amqpQueue is a queue backend on RabbitMQ, or any AMQP 0-9-1 server. Tasks
+// are published to AMQP_EXCHANGE with the queue name as the routing key, and
+// consumed with manual acks from the existing queue of that name, at most
+// AMQP_PREFETCH at a time. Delayed tasks wait in a queue of their own,
+// <queue>.delayed, until they expire into the exchange.
+type amqpQueue struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+
+	publishMu sync.Mutex
+	returns   chan amqp.Return
+
+	mu        sync.Mutex
+	consumers map[string]<-chan amqp.Delivery
+	closed    chan struct{}
+	err       error
+}
+
+/*
+ * Connect to AMQP_URL, open a channel with publisher confirms and check each
+ * queue exists. amqp:// URLs connect in plain text and amqps:// URLs over
+ * TLS. Credentials default to guest:guest and the vhost to /.
+ */
+func (a *amqpQueue) Connect(backend string, queues []string, connection interface{}) error {
+	if _, err := amqp.ParseURI(config.AMQP_URL); err != nil {
+		return fmt.Errorf("AMQP_URL must be an amqp:// or amqps:// URL")
+	}
+
+	conn, err := amqp.DialConfig(config.AMQP_URL, amqp.Config{
+		Heartbeat: amqpHeartbeat,
+		Locale:    "en_US",
+		Dial:      amqp.DefaultDial(10 * time.Second),
+		Properties: amqp.Table{
+			"product":  "sonic",
+			"version":  currentVersion,
+			"platform": "Go",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	a.conn = conn
+	a.channel = channel
+	a.consumers = map[string]<-chan amqp.Delivery{}
+	a.closed = make(chan struct{})
+	a.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+	go a.watch(
+		conn.NotifyClose(make(chan *amqp.Error, 1)),
+		channel.NotifyClose(make(chan *amqp.Error, 1)),
+		channel.NotifyCancel(make(chan string, 1)),
+	)
+
+	if err := channel.Qos(config.AMQP_PREFETCH, 0, false); err != nil {
+		a.Disconnect()
+		return err
+	}
+	if err := channel.Confirm(false); err != nil {
+		a.Disconnect()
+		return err
+	}
+
+	for _, name := range queues {
+		if err := a.declare(name); err != nil {
+			a.Disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *amqpQueue) Disconnect() error {
+	if a.conn == nil || a.conn.IsClosed() {
+		return nil
+	}
+	return a.conn.Close()
+}
+
+/*
+ * Check the connection and channel are still open.
+ */
+func (a *amqpQueue) Healthy(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+/*
+ * Wait for the connection or channel to close, or the server to cancel a
+ * consumer, and record why, so everything waiting on the server gives up.
+ */
+func (a *amqpQueue) watch(connClosed, channelClosed chan *amqp.Error, cancelled chan string) {
+	var err error
+	select {
+	case reason, ok := <-connClosed:
+		if ok && reason != nil {
+			err = fmt.Errorf("RabbitMQ closed the connection: %d %s", reason.Code, reason.Reason)
+		}
+	case reason, ok := <-channelClosed:
+		if ok && reason != nil {
+			err = fmt.Errorf("RabbitMQ closed the channel: %d %s", reason.Code, reason.Reason)
+		}
+	case consumer := <-cancelled:
+		err = fmt.Errorf("RabbitMQ cancelled consumer %s, the queue may have been deleted", consumer)
+		a.conn.Close()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = ErrAMQPClosed
+	if err != nil {
+		log.Printf("ERROR RabbitMQ connection failed: %s \n", err.Error())
+		a.err = err
+	}
+	close(a.closed)
+}
+
+/*
+ * Publish a task to a queue, waiting for the server to confirm it's been
+ * routed to one. Delayed tasks go to the queue's delay queue instead, with
+ * an expiration that releases them to the exchange when they're due.
+ */
+func (a *amqpQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if ms := (payload.Delay + time.Millisecond - 1) / time.Millisecond; ms > 0 {
+		return a.publish(ctx, "", amqpDelayed(queueName), body, payload.ID, strconv.FormatInt(int64(ms), 10))
+	}
+	return a.publish(ctx, config.AMQP_EXCHANGE, queueName, body, payload.ID, "")
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done.
+ */
+func (a *amqpQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := a.Pop(ctx, queueName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the next task on a queue and handle it. Once it's handled it's
+ * acked. If the handler failed and asked for a requeue it's published again
+ * first, with its attempts counted and Kewpie's usual backoff, and if it
+ * failed without asking for one it's rejected, so it goes to the queue's
+ * dead letter exchange if it has one.
+ */
+func (a *amqpQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	deliveries, err := a.consume(queueName)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var delivery amqp.Delivery
+		var ok bool
+		select {
+		case delivery, ok = <-deliveries:
+			if !ok {
+				<-a.closed
+				return a.Healthy(ctx)
+			}
+		case <-a.closed:
+			return a.Healthy(ctx)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if ctx.Err() != nil {
+			delivery.Nack(false, true)
+			return ctx.Err()
+		}
+
+		task := kewpie.Task{}
+		if err := json.Unmarshal(delivery.Body, &task); err != nil {
+			log.Printf("ERROR rejecting a message on %s that isn't a task: %s \n", queueName, err.Error())
+			if err := delivery.Nack(false, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if time.Until(task.RunAt) > 0 {
+			if err := a.Publish(ctx, queueName, &task); err != nil {
+				delivery.Nack(false, true)
+				return err
+			}
+			if err := delivery.Ack(false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// A redelivery after a worker died counts as an attempt too
+		if delivery.Redelivered {
+			task.Attempts++
+		}
+
+		return a.handle(queueName, delivery, task, handler)
+	}
+}
+
+func (a *amqpQueue) handle(queueName string, delivery amqp.Delivery, task kewpie.Task, handler types.Handler) error {
+	requeue, err := handler.Handle(task)
+	if err == nil {
+		return delivery.Ack(false)
+	}
+
+	log.Println("ERROR kewpie task handler", err)
+	if !requeue {
+		return delivery.Nack(false, false)
+	}
+
+	task.Attempts++
+	task.RunAt = time.Time{}
+	task.Delay = 0
+	if !task.NoExpBackoff {
+		task.Delay = util.CalcBackoff(task.Attempts + 1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.Publish(ctx, queueName, &task); err != nil {
+		// Leave it to RabbitMQ to redeliver instead
+		log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+		return delivery.Nack(false, true)
+	}
+	return delivery.Ack(false)
+}
+
+/*
+ * Check a queue exists, and declare its delay queue. Sonic doesn't declare
+ * the queue itself, so its durability, dead lettering and bindings are left
+ * to whoever set it up.
+ */
+func (a *amqpQueue) declare(queueName string) error {
+	if _, err := a.channel.QueueDeclarePassive(queueName, false, false, false, false, nil); err != nil {
+		return fmt.Errorf("Checking RabbitMQ queue %s exists: %s", queueName, err)
+	}
+
+	_, err := a.channel.QueueDeclare(amqpDelayed(queueName), true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    config.AMQP_EXCHANGE,
+		"x-dead-letter-routing-key": queueName,
+	})
+	return err
+}
+
+/*
+ * Start consuming from a queue, unless Sonic already is, returning the
+ * channel its deliveries arrive on.
+ */
+func (a *amqpQueue) consume(queueName string) (<-chan amqp.Delivery, error) {
+	tag := "sonic." + queueName
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if deliveries, ok := a.consumers[tag]; ok {
+		return deliveries, nil
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	deliveries, err := a.channel.Consume(queueName, tag, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.consumers[tag] = deliveries
+	return deliveries, nil
+}
+
+/*
+ * Publish a message with mandatory routing and wait for the server to
+ * confirm it. A message that can't be routed to a queue is returned by the
+ * server ahead of its confirmation, and is an error. Publishes are made one
+ * at a time, so a return always belongs to the publish in flight.
+ */
+func (a *amqpQueue) publish(ctx context.Context, exchange, routingKey string, body []byte, id, expiration string) error {
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+
+	if err := a.Healthy(ctx); err != nil {
+		return err
+	}
+
+	// Forget returns from publishes that gave up waiting for their confirm
+	for len(a.returns) > 0 {
+		<-a.returns
+	}
+
+	confirm, err := a.channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Expiration:   expiration,
+		MessageId:    id,
+		AppId:        "sonic",
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-confirm.Done():
+	case <-a.closed:
+		return a.Healthy(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !confirm.Acked() {
+		return fmt.Errorf("RabbitMQ couldn't store the task")
+	}
+	select {
+	case returned := <-a.returns:
+		return fmt.Errorf("RabbitMQ couldn't route the task to a queue with %s: %d %s", returned.RoutingKey, returned.ReplyCode, returned.ReplyText)
+	default:
+		return nil
+	}
+}
+
+func amqpDelayed(queueName string) string {
+	return queueName + ".delayed"
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// backfillReport summarises a backfill run. It's printed to stdout as JSON
+// when the run finishes.
+type backfillReport struct {
+	Queue     string        `json:"queue"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Requeued  int           `json:"requeued"`
+	Duration  time.Duration `json:"duration"`
+	Drained   bool          `json:"drained"`
+}
+
+func (r *backfillReport) record(requeue bool, err error) {
+	switch {
+	case err == nil:
+		r.Succeeded++
+	case requeue:
+		r.Requeued++
+	default:
+		r.Failed++
+	}
+}
+
+/*
+ * Entry point for `sonic backfill`. Returns the process exit code, which is
+ * non-zero if any task failed permanently.
+ */
+func runBackfill(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	untilEmpty := flags.Bool("until-empty", false, "exit once the queue has been drained")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "number of tasks to run at once")
+	idle := flags.Duration("idle", 5*time.Second, "how long the queue must be empty before it is considered drained")
+	flags.Parse(args)
+
+	if *concurrency < 1 {
+		log.Println("ERROR backfill concurrency must be at least 1")
+		return 2
+	}
+
+	if !*untilEmpty {
+		*idle = 0
+	}
+
+	report := backfill(ctx, *concurrency, *idle)
+
+	log.Printf("INFO backfill of %s finished in %s: %d succeeded, %d failed, %d requeued \n", report.Queue, report.Duration, report.Succeeded, report.Failed, report.Requeued)
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		log.Println("ERROR writing backfill report", err)
+	}
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Run tasks from the queue on concurrency workers until every worker has
+ * waited idle for a task, or until the context is cancelled. An idle of zero
+ * never considers the queue drained.
+ */
+func backfill(ctx context.Context, concurrency int, idle time.Duration) backfillReport {
+	report := backfillReport{Queue: config.QUEUE}
+	started := time.Now()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				handled, requeue, err := popWithIdleTimeout(ctx, idle)
+				if !handled {
+					return
+				}
+				mu.Lock()
+				report.record(requeue, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	report.Duration = time.Since(started)
+	report.Drained = ctx.Err() == nil
+	return report
+}
+
+/*
+ * Pop a single task, giving up if none arrives within idle. The pop is only
+ * abandoned if the handler hasn't started, so a task is never cut off
+ * mid-run. Returns whether a task was handled and its outcome.
+ */
+func popWithIdleTimeout(ctx context.Context, idle time.Duration) (bool, bool, error) {
+	popCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	handled := false
+	abandoned := false
+	var requeue bool
+	var taskErr error
+
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !handled {
+				abandoned = true
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	handler := cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			mu.Lock()
+			if abandoned {
+				mu.Unlock()
+				return true, context.Canceled
+			}
+			handled = true
+			mu.Unlock()
+
+			requeue, taskErr = handleTask(ctx, task)
+			return requeue, taskErr
+		},
+	}
+
+	if err := queue.Pop(popCtx, config.QUEUE, handler); err != nil && !handled {
+		if popCtx.Err() == nil {
+			log.Printf("ERROR popping from queue %s: %s \n", config.QUEUE, err.Error())
+		}
+		return false, false, err
+	}
+
+	return handled, requeue, taskErr
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillUntilEmpty(t *testing.T) {
+	paths := []string{}
+	for i := 0; i < 3; i++ {
+		_, path := getPathForTest()
+		paths = append(paths, path)
+		assert.Nil(t, queue.Publish(context.Background(), config.QUEUE, &kewpie.Task{
+			Body: "touch " + path,
+		}))
+	}
+	assert.Nil(t, queue.Publish(context.Background(), config.QUEUE, &kewpie.Task{
+		Body: "exit 1",
+	}))
+
+	report := backfill(context.Background(), 2, 100*time.Millisecond)
+
+	assert.True(t, report.Drained)
+	assert.Equal(t, 3, report.Succeeded)
+	assert.Equal(t, 1, report.Failed)
+
+	for _, path := range paths {
+		assert.Nil(t, os.Remove(path))
+	}
+}
+
+func TestBackfillCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report := backfill(ctx, 1, 0)
+
+	assert.False(t, report.Drained)
+	assert.Equal(t, 0, report.Succeeded)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// What to do with a task whose producer has used up its budget.
+const (
+	budgetActionDelay  = "delay"
+	budgetActionReject = "reject"
+)
+
+// producerTag names the team or service that published a task, for budget
+// accounting.
+const producerTag = "producer"
+
+// budgets tracks execution time used by each producer in the current
+// BUDGET_PERIOD. Accounting is per worker and isn't persisted.
+var budgets = struct {
+	sync.Mutex
+	period  time.Time
+	used    map[string]time.Duration
+	alerted map[string]bool
+}{
+	used:    map[string]time.Duration{},
+	alerted: map[string]bool{},
+}
+
+/*
+ * The budget for a producer, falling back to the * entry for producers
+ * without their own. Tasks without a producer tag are never limited.
+ */
+func producerBudget(producer string) (time.Duration, bool) {
+	if producer == "" {
+		return 0, false
+	}
+	if budget, ok := config.PRODUCER_BUDGETS[producer]; ok {
+		return budget, true
+	}
+	budget, ok := config.PRODUCER_BUDGETS["*"]
+	return budget, ok
+}
+
+// Must be called with budgets locked.
+func rollBudgetPeriod(now time.Time) {
+	period := now.Truncate(config.BUDGET_PERIOD)
+	if !period.Equal(budgets.period) {
+		budgets.period = period
+		budgets.used = map[string]time.Duration{}
+		budgets.alerted = map[string]bool{}
+	}
+}
+
+/*
+ * Add the time a task ran for to its producer's usage.
+ */
+func recordBudgetUsage(task kewpie.Task, elapsed time.Duration) {
+	producer := task.Tags[producerTag]
+	if producer == "" {
+		return
+	}
+
+	addCounter("sonic_producer_seconds_total", map[string]string{"producer": producer}, elapsed.Seconds())
+
+	if _, ok := producerBudget(producer); !ok {
+		return
+	}
+
+	budgets.Lock()
+	defer budgets.Unlock()
+
+	rollBudgetPeriod(time.Now())
+	budgets.used[producer] += elapsed
+}
+
+/*
+ * Check a task against its producer's budget. If the budget is used up the
+ * task is either delayed until the next period or rejected, depending on
+ * BUDGET_ACTION, and handled is true.
+ */
+func enforceBudget(ctx context.Context, task kewpie.Task) (handled bool, requeue bool, err error) {
+	producer := task.Tags[producerTag]
+	budget, ok := producerBudget(producer)
+	if !ok {
+		return false, false, nil
+	}
+
+	budgets.Lock()
+	now := time.Now()
+	rollBudgetPeriod(now)
+	used := budgets.used[producer]
+	periodEnd := budgets.period.Add(config.BUDGET_PERIOD)
+	exhausted := used >= budget
+	alert := exhausted && !budgets.alerted[producer]
+	if alert {
+		budgets.alerted[producer] = true
+	}
+	budgets.Unlock()
+
+	if !exhausted {
+		return false, false, nil
+	}
+
+	if alert {
+		sendBudgetAlert(producer, budget, used, periodEnd)
+	}
+
+	if config.BUDGET_ACTION == budgetActionReject {
+		err := TaskError{
+			Code:    errCodeBudgetExhausted,
+			Message: fmt.Sprintf("Producer %s has used its budget of %s until %s", producer, budget, periodEnd.Format(time.RFC3339)),
+			Details: map[string]string{
+				"producer":   producer,
+				"period_end": periodEnd.Format(time.RFC3339),
+			},
+		}
+		log.Printf("ERROR rejecting task %s: %s \n", task.ID, err.Message)
+		failTask(task, err)
+		return true, false, err
+	}
+
+	log.Printf("INFO delaying task %s until %s, producer %s has used its budget \n", task.ID, periodEnd.Format(time.RFC3339), producer)
+	task.RunAt = periodEnd
+	if err := publishOrSpill(ctx, sourceQueue(ctx), &task); err != nil {
+		log.Printf("ERROR republishing task %s: %s \n", task.ID, err.Error())
+		return true, true, err
+	}
+
+	return true, false, nil
+}
+
+// budgetAlert is the body POSTed to BUDGET_ALERT_WEBHOOK.
+type budgetAlert struct {
+	Producer      string    `json:"producer"`
+	BudgetSeconds float64   `json:"budget_seconds"`
+	UsedSeconds   float64   `json:"used_seconds"`
+	PeriodEnd     time.Time `json:"period_end"`
+}
+
+/*
+ * Report that a producer has used up its budget, once per period.
+ */
+func sendBudgetAlert(producer string, budget, used time.Duration, periodEnd time.Time) {
+	log.Printf("ERROR producer %s has used %s of its %s budget \n", producer, used, budget)
+	incCounter("sonic_budget_exhausted_total", map[string]string{"producer": producer})
+
+	if config.BUDGET_ALERT_WEBHOOK == "" {
+		return
+	}
+
+	payload, err := json.Marshal(budgetAlert{
+		Producer:      producer,
+		BudgetSeconds: budget.Seconds(),
+		UsedSeconds:   used.Seconds(),
+		PeriodEnd:     periodEnd,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON %+v\n", err)
+		return
+	}
+
+	if err := deliverWebhook(http.MethodPost, "budget_alert", config.BUDGET_ALERT_WEBHOOK, http.Header{}, payload); err != nil {
+		log.Printf("ERROR sending budget alert for producer %s: %s \n", producer, err.Error())
+	}
+}
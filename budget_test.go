@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withBudgets(action string) func() {
+	config.PRODUCER_BUDGETS = map[string]time.Duration{
+		"billing": time.Minute,
+		"*":       time.Hour,
+	}
+	config.BUDGET_ACTION = action
+	return func() {
+		config.PRODUCER_BUDGETS = map[string]time.Duration{}
+		config.BUDGET_ACTION = budgetActionDelay
+		budgets.Lock()
+		budgets.period = time.Time{}
+		budgets.used = map[string]time.Duration{}
+		budgets.alerted = map[string]bool{}
+		budgets.Unlock()
+	}
+}
+
+func TestProducerBudget(t *testing.T) {
+	defer withBudgets(budgetActionDelay)()
+
+	budget, ok := producerBudget("billing")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, budget)
+
+	budget, ok = producerBudget("reports")
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, budget)
+
+	_, ok = producerBudget("")
+	assert.False(t, ok)
+}
+
+func TestEnforceBudgetReject(t *testing.T) {
+	defer withBudgets(budgetActionReject)()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"producer": "billing",
+		},
+	}
+
+	handled, _, err := enforceBudget(context.Background(), task)
+	assert.False(t, handled)
+	assert.Nil(t, err)
+
+	recordBudgetUsage(task, 2*time.Minute)
+
+	handled, requeue, err := enforceBudget(context.Background(), task)
+	assert.True(t, handled)
+	assert.False(t, requeue)
+	assert.Equal(t, errCodeBudgetExhausted, newTaskError(err).Code)
+	assert.Equal(t, 1.0, counterValue("sonic_budget_exhausted_total", map[string]string{"producer": "billing"}))
+
+	// Other producers are unaffected
+	handled, _, _ = enforceBudget(context.Background(), kewpie.Task{
+		Tags: kewpie.Tags{
+			"producer": "reports",
+		},
+	})
+	assert.False(t, handled)
+}
+
+func TestEnforceBudgetDelay(t *testing.T) {
+	defer withBudgets(budgetActionDelay)()
+
+	task := kewpie.Task{
+		Body: "delayed",
+		Tags: kewpie.Tags{
+			"producer": "billing",
+		},
+	}
+	recordBudgetUsage(task, 2*time.Minute)
+
+	handled, requeue, err := enforceBudget(context.Background(), task)
+	assert.True(t, handled)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+}
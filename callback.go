@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// callbackQueueTag names a queue that a task's lifecycle events are
+// published to, in place of its HTTP webhooks.
+const callbackQueueTag = "callback_queue"
+
+/*
+ * Publish an event to the task's callback queue, as a task whose body is the
+ * payload the webhook would have carried. The queue must be one of
+ * CALLBACK_QUEUES, which Sonic connects to at startup. Events that can't be
+ * published are spilled to STATE_DIR if it's set. Otherwise a failure to
+ * publish is treated like a receiver failing, so a start event that can't be
+ * published requeues the task.
+ */
+func publishCallback(evt string, body webhookPayload) error {
+	task := body.Task
+	name := task.Tags[callbackQueueTag]
+	if !config.CALLBACK_QUEUES[name] {
+		log.Printf("ERROR refusing to publish %s event to %s, which isn't in CALLBACK_QUEUES \n", evt, name)
+		incCounter("sonic_webhook_policy_violations_total", map[string]string{"event": evt})
+		return ErrWebhookNotAllowed
+	}
+
+	payload, headers, err := buildWebhook(evt, body)
+	if err != nil {
+		return err
+	}
+
+	callback := kewpie.Task{
+		Body: string(payload),
+		Tags: kewpie.Tags{
+			"event":        evt,
+			"task_id":      task.ID,
+			"content_type": headers.Get("Content-Type"),
+		},
+	}
+	if err := publishOrSpill(context.Background(), name, &callback); err != nil {
+		log.Printf("ERROR publishing %s event for task %s to %s: %s \n", evt, task.ID, name, err.Error())
+		return ErrWebhookServerFailed
+	}
+	return nil
+}
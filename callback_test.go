@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackQueue(t *testing.T) {
+	config.CALLBACK_QUEUES = map[string]bool{"callbacks_test": true}
+	defer func() {
+		config.CALLBACK_QUEUES = map[string]bool{}
+	}()
+
+	_, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "callback-task",
+		Body: "true",
+		Tags: kewpie.Tags{
+			callbackQueueTag:  "callbacks_test",
+			"webhook_success": "http://receiver.invalid/success",
+		},
+	})
+	assert.Nil(t, err)
+
+	events := []string{}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := queue.Pop(ctx, "callbacks_test", cliHandler{
+			handleFunc: func(callback kewpie.Task) (bool, error) {
+				events = append(events, callback.Tags["event"])
+				assert.Equal(t, "callback-task", callback.Tags["task_id"])
+
+				payload := webhookPayload{}
+				assert.Nil(t, json.Unmarshal([]byte(callback.Body), &payload))
+				assert.Equal(t, "callback-task", payload.ID)
+				return false, nil
+			},
+		})
+		cancel()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"start", "success"}, events)
+}
+
+func TestCallbackQueueNotAllowed(t *testing.T) {
+	err := sendWebhook(startWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			callbackQueueTag: "anywhere",
+		},
+	})
+	assert.Equal(t, ErrWebhookNotAllowed, err)
+}
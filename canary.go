@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"regexp"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+const (
+	variantPrimary = "primary"
+	variantCanary  = "canary"
+)
+
+// canaryState tracks the outcomes of recent canary runs so the canary can be
+// switched off automatically if it starts failing.
+var canaryState = struct {
+	sync.Mutex
+	outcomes []bool
+	disabled bool
+}{}
+
+/*
+ * Decide whether a task runs its own command or the canary. Returns the task
+ * to run, with the body rendered from CANARY_TEMPLATE for canary runs, and
+ * which variant was chosen.
+ */
+func routeCanary(task kewpie.Task) (kewpie.Task, string) {
+	if config.CANARY_TEMPLATE == "" || !canaryEligible(task) {
+		return task, variantPrimary
+	}
+
+	canaryState.Lock()
+	disabled := canaryState.disabled
+	canaryState.Unlock()
+
+	if disabled || rand.Float64()*100 >= config.CANARY_PERCENT {
+		return task, variantPrimary
+	}
+
+	body, err := renderCommandTemplate(config.CANARY_TEMPLATE, task)
+	if err != nil {
+		log.Printf("ERROR rendering canary command for task %s, running primary: %s \n", task.ID, err.Error())
+		return task, variantPrimary
+	}
+
+	canaryTask := task
+	canaryTask.Body = body
+	return canaryTask, variantCanary
+}
+
+func canaryEligible(task kewpie.Task) bool {
+	if config.CANARY_MATCH == "" {
+		return true
+	}
+	return regexp.MustCompile(config.CANARY_MATCH).MatchString(task.Body)
+}
+
+/*
+ * Record the outcome of a run for telemetry. Once the canary's failure rate
+ * over the last CANARY_WINDOW runs exceeds CANARY_MAX_FAILURE_RATE, the
+ * canary is disabled and every task falls back to the primary command until
+ * Sonic is restarted.
+ */
+func recordCanaryResult(variant string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	if config.CANARY_TEMPLATE == "" {
+		return
+	}
+
+	incCounter("sonic_canary_runs_total", map[string]string{"variant": variant, "result": result})
+
+	if variant != variantCanary {
+		return
+	}
+
+	canaryState.Lock()
+	defer canaryState.Unlock()
+
+	canaryState.outcomes = append(canaryState.outcomes, err != nil)
+	if len(canaryState.outcomes) > config.CANARY_WINDOW {
+		canaryState.outcomes = canaryState.outcomes[len(canaryState.outcomes)-config.CANARY_WINDOW:]
+	}
+
+	if canaryState.disabled || len(canaryState.outcomes) < config.CANARY_WINDOW {
+		return
+	}
+
+	failures := 0
+	for _, failed := range canaryState.outcomes {
+		if failed {
+			failures++
+		}
+	}
+
+	rate := float64(failures) / float64(len(canaryState.outcomes))
+	if rate > config.CANARY_MAX_FAILURE_RATE {
+		canaryState.disabled = true
+		incCounter("sonic_canary_disabled_total", nil)
+		log.Printf("ERROR canary failure rate %.2f exceeds %.2f, falling back to the primary command \n", rate, config.CANARY_MAX_FAILURE_RATE)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withCanary(percent float64) func() {
+	config.CANARY_TEMPLATE = "/opt/v2/{{.Body}}"
+	config.CANARY_PERCENT = percent
+	config.CANARY_WINDOW = 4
+	config.CANARY_MAX_FAILURE_RATE = 0.5
+	return func() {
+		config.CANARY_TEMPLATE = ""
+		config.CANARY_PERCENT = 0
+		config.CANARY_MATCH = ""
+		canaryState.Lock()
+		canaryState.outcomes = nil
+		canaryState.disabled = false
+		canaryState.Unlock()
+	}
+}
+
+func TestRouteCanary(t *testing.T) {
+	defer withCanary(100)()
+
+	routed, variant := routeCanary(kewpie.Task{Body: "report"})
+	assert.Equal(t, variantCanary, variant)
+	assert.Equal(t, "/opt/v2/report", routed.Body)
+
+	config.CANARY_MATCH = "^export"
+	routed, variant = routeCanary(kewpie.Task{Body: "report"})
+	assert.Equal(t, variantPrimary, variant)
+	assert.Equal(t, "report", routed.Body)
+}
+
+func TestRouteCanaryNone(t *testing.T) {
+	defer withCanary(0)()
+
+	_, variant := routeCanary(kewpie.Task{Body: "report"})
+	assert.Equal(t, variantPrimary, variant)
+}
+
+func TestCanaryFallback(t *testing.T) {
+	defer withCanary(100)()
+
+	recordCanaryResult(variantCanary, nil)
+	recordCanaryResult(variantCanary, errors.New("boom"))
+	recordCanaryResult(variantCanary, nil)
+	recordCanaryResult(variantCanary, errors.New("boom"))
+
+	_, variant := routeCanary(kewpie.Task{Body: "report"})
+	assert.Equal(t, variantCanary, variant)
+
+	recordCanaryResult(variantCanary, errors.New("boom"))
+
+	_, variant = routeCanary(kewpie.Task{Body: "report"})
+	assert.Equal(t, variantPrimary, variant)
+}
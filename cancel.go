@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// cancelRequeueDelay is how long a cancellation for a task that isn't
+// running here waits before it's popped again, by this worker or another.
+var cancelRequeueDelay = time.Second
+
+// cancellableTask is a running task that a message on CANCEL_QUEUE can
+// abort.
+type cancellableTask struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// cancelRegistry holds the tasks running in this process by ID, and the IDs
+// of tasks cancelled before they started here, until their cancellations
+// expire.
+type cancelRegistry struct {
+	sync.Mutex
+	tasks   map[string]*cancellableTask
+	pending map[string]time.Time
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{
+		tasks:   map[string]*cancellableTask{},
+		pending: map[string]time.Time{},
+	}
+}
+
+var cancellable = newCancelRegistry()
+
+/*
+ * Record a running task so that it can be cancelled by its ID. Returns a
+ * function that reports whether it was cancelled and forgets it.
+ */
+func trackCancellable(task kewpie.Task, cancel context.CancelFunc) func() bool {
+	return cancellable.track(task, cancel)
+}
+
+/*
+ * Kill the command of the running task with the given ID. Returns whether
+ * the task was running here.
+ */
+func cancelRunning(id string) bool {
+	return cancellable.cancel(id, time.Time{})
+}
+
+func (r *cancelRegistry) track(task kewpie.Task, cancel context.CancelFunc) func() bool {
+	if config.CANCEL_QUEUE == "" || task.ID == "" {
+		return func() bool { return false }
+	}
+
+	entry := &cancellableTask{cancel: cancel}
+	r.Lock()
+	r.tasks[task.ID] = entry
+	if until, ok := r.pending[task.ID]; ok {
+		delete(r.pending, task.ID)
+		if time.Now().Before(until) {
+			log.Printf("INFO task %s was cancelled before it started, cancelling it \n", task.ID)
+			incCounter("sonic_tasks_cancelled_total", nil)
+			entry.cancelled = true
+			cancel()
+		}
+	}
+	r.Unlock()
+
+	return func() bool {
+		r.Lock()
+		defer r.Unlock()
+
+		if r.tasks[task.ID] == entry {
+			delete(r.tasks, task.ID)
+		}
+		return entry.cancelled
+	}
+}
+
+/*
+ * Kill the command of the running task with the given ID, returning whether
+ * it was running here. If it wasn't, the task is refused should it start
+ * here before until.
+ */
+func (r *cancelRegistry) cancel(id string, until time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	entry, ok := r.tasks[id]
+	if !ok {
+		now := time.Now()
+		for pendingID, expiry := range r.pending {
+			if now.After(expiry) {
+				delete(r.pending, pendingID)
+			}
+		}
+		if now.Before(until) {
+			r.pending[id] = until
+		}
+		return false
+	}
+	if !entry.cancelled {
+		entry.cancelled = true
+		entry.cancel()
+	}
+	return true
+}
+
+/*
+ * Consume CANCEL_QUEUE alongside the main queue. The body of each message is
+ * the ID of a task to cancel, and if it's running here its command is killed
+ * and it fails as aborted.
+ *
+ * CANCEL_QUEUE is shared by the whole fleet and each message reaches only one
+ * worker, so a cancellation for a task that isn't running here is published
+ * back to the queue for another worker to try, until CANCEL_TTL after it was
+ * first seen. It's also remembered until then, so that if the task hasn't
+ * started yet and then starts here, it's cancelled straight away.
+ */
+func subscribeCancellations(ctx context.Context) {
+	handler := cancellationHandler(ctx, cancellable)
+
+	go func() {
+		if err := queue.Subscribe(ctx, config.CANCEL_QUEUE, handler); err != nil {
+			log.Printf("ERROR subscribing to %s: %s \n", config.CANCEL_QUEUE, err.Error())
+		}
+	}()
+}
+
+func cancellationHandler(ctx context.Context, registry *cancelRegistry) cliHandler {
+	return cliHandler{
+		handleFunc: func(message kewpie.Task) (bool, error) {
+			id := strings.TrimSpace(message.Body)
+			if id == "" {
+				log.Printf("ERROR ignoring cancellation %s without a task ID \n", message.ID)
+				return false, nil
+			}
+
+			// The expiry is stamped the first time a cancellation is seen, and
+			// travels with it as it's passed between workers
+			until, err := time.Parse(time.RFC3339, message.Tags[expiresAtTag])
+			if err != nil {
+				until = time.Now().Add(config.CANCEL_TTL)
+
+				tags := kewpie.Tags{}
+				for key, value := range message.Tags {
+					tags[key] = value
+				}
+				tags[expiresAtTag] = until.UTC().Format(time.RFC3339)
+				message.Tags = tags
+			}
+
+			if time.Now().After(until) {
+				log.Printf("INFO dropping cancellation of task %s, which didn't start before %s \n", id, message.Tags[expiresAtTag])
+				return false, nil
+			}
+
+			if registry.cancel(id, until) {
+				log.Printf("INFO cancelling task %s \n", id)
+				incCounter("sonic_tasks_cancelled_total", nil)
+				return false, nil
+			}
+
+			log.Printf("INFO task %s isn't running here, passing its cancellation on \n", id)
+			message.RunAt = time.Time{}
+			message.Delay = cancelRequeueDelay
+			if err := publishOrSpill(ctx, config.CANCEL_QUEUE, &message); err != nil {
+				log.Printf("ERROR republishing cancellation of task %s: %s \n", id, err.Error())
+				return true, err
+			}
+			return false, nil
+		},
+	}
+}
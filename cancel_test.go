@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelRunning(t *testing.T) {
+	config.CANCEL_QUEUE = "cancel_test"
+	defer func() {
+		config.CANCEL_QUEUE = ""
+	}()
+
+	assert.False(t, cancelRunning("not-running"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled := trackCancellable(kewpie.Task{ID: "running"}, cancel)
+	assert.True(t, cancelRunning("running"))
+	assert.NotNil(t, ctx.Err())
+	assert.True(t, cancelled())
+
+	// Forgotten once it's finished
+	assert.False(t, cancelRunning("running"))
+}
+
+func TestCancelQueue(t *testing.T) {
+	config.CANCEL_QUEUE = "cancel_test"
+	defer func() {
+		config.CANCEL_QUEUE = ""
+	}()
+
+	received := make(chan webhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := webhookPayload{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribeCancellations(ctx)
+
+	before := counterValue("sonic_tasks_cancelled_total", nil)
+
+	type result struct {
+		requeue bool
+		err     error
+	}
+	done := make(chan result, 1)
+	started := time.Now()
+	go func() {
+		requeue, err := handleTask(context.Background(), kewpie.Task{
+			ID:   "5e0f3b8a-9c1d-4f2e-a6b7-c8d9e0f1a2b3",
+			Body: "sleep 5",
+			Tags: kewpie.Tags{"webhook_cancel": server.URL},
+		})
+		done <- result{requeue, err}
+	}()
+
+	for {
+		cancellable.Lock()
+		_, running := cancellable.tasks["5e0f3b8a-9c1d-4f2e-a6b7-c8d9e0f1a2b3"]
+		cancellable.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Nil(t, queue.Publish(ctx, config.CANCEL_QUEUE, &kewpie.Task{Body: "5e0f3b8a-9c1d-4f2e-a6b7-c8d9e0f1a2b3"}))
+
+	outcome := <-done
+	assert.False(t, outcome.requeue)
+	assert.Equal(t, errCodeAborted, newTaskError(outcome.err).Code)
+	assert.True(t, time.Since(started) < 2*time.Second)
+	assert.Equal(t, before+1, counterValue("sonic_tasks_cancelled_total", nil))
+
+	payload := <-received
+	if assert.NotNil(t, payload.Error) {
+		assert.Equal(t, errCodeAborted, payload.Error.Code)
+	}
+}
+
+func TestCancelQueueReachesTheWorkerRunningTheTask(t *testing.T) {
+	config.CANCEL_QUEUE = "cancel_two_workers_test"
+	cancelRequeueDelay = 10 * time.Millisecond
+	defer func() {
+		config.CANCEL_QUEUE = ""
+		cancelRequeueDelay = time.Second
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	idle := newCancelRegistry()
+	busy := newCancelRegistry()
+
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	cancelled := busy.track(kewpie.Task{ID: "3c9d2a7e-1f4b-4e8a-9b6c-5d0e7f1a2b4c"}, stop)
+
+	// The idle worker sees the cancellation first, and has to pass it on
+	go queue.Subscribe(ctx, config.CANCEL_QUEUE, cancellationHandler(ctx, idle))
+	assert.Nil(t, queue.Publish(ctx, config.CANCEL_QUEUE, &kewpie.Task{Body: "3c9d2a7e-1f4b-4e8a-9b6c-5d0e7f1a2b4c"}))
+
+	for {
+		idle.Lock()
+		_, seen := idle.pending["3c9d2a7e-1f4b-4e8a-9b6c-5d0e7f1a2b4c"]
+		idle.Unlock()
+		if seen {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go queue.Subscribe(ctx, config.CANCEL_QUEUE, cancellationHandler(ctx, busy))
+
+	select {
+	case <-runCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task was never cancelled")
+	}
+	assert.True(t, cancelled())
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+	config.CANCEL_QUEUE = "cancel_before_start_test"
+	cancelRequeueDelay = 10 * time.Millisecond
+	defer func() {
+		config.CANCEL_QUEUE = ""
+		cancelRequeueDelay = time.Second
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := newCancelRegistry()
+	go queue.Subscribe(ctx, config.CANCEL_QUEUE, cancellationHandler(ctx, registry))
+	assert.Nil(t, queue.Publish(ctx, config.CANCEL_QUEUE, &kewpie.Task{Body: "8f1e6b2d-7a3c-4d9e-b5f0-2c4a6e8d0b1f"}))
+
+	for {
+		registry.Lock()
+		_, seen := registry.pending["8f1e6b2d-7a3c-4d9e-b5f0-2c4a6e8d0b1f"]
+		registry.Unlock()
+		if seen {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	cancelled := registry.track(kewpie.Task{ID: "8f1e6b2d-7a3c-4d9e-b5f0-2c4a6e8d0b1f"}, stop)
+	assert.NotNil(t, runCtx.Err())
+	assert.True(t, cancelled())
+
+	// An expired cancellation is forgotten
+	assert.False(t, registry.cancel("3b7a9c1e-5d2f-4a6b-8e0c-9f1d3b5a7c2e", time.Now().Add(-time.Second)))
+	registry.Lock()
+	_, remembered := registry.pending["3b7a9c1e-5d2f-4a6b-8e0c-9f1d3b5a7c2e"]
+	registry.Unlock()
+	assert.False(t, remembered)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paidright/sonic/config"
+)
+
+const cpuPeriodMicros = 100000
+
+// taskCgroup is a cgroup v2 group created to hold a single task's processes.
+type taskCgroup struct {
+	path   string
+	limits resourceLimits
+}
+
+var accountingUnavailable sync.Once
+
+/*
+ * Create a cgroup under CGROUP_ROOT with the given limits. Without limits a
+ * cgroup is only created to account for the task's resource usage, as long
+ * as CGROUP_ACCOUNTING allows it. In auto mode Sonic falls back to rusage if
+ * that isn't possible, and nil is returned.
+ */
+func createCgroup(limits resourceLimits) (*taskCgroup, error) {
+	if limits.any() {
+		return makeCgroup(limits)
+	}
+
+	if config.CGROUP_ACCOUNTING == "false" {
+		return nil, nil
+	}
+
+	cgroup, err := accountingCgroup()
+	if err != nil && config.CGROUP_ACCOUNTING == "auto" {
+		accountingUnavailable.Do(func() {
+			log.Printf("INFO cgroup accounting unavailable, falling back to rusage: %s \n", err)
+		})
+		return nil, nil
+	}
+	return cgroup, err
+}
+
+/*
+ * Create a cgroup without limits, refusing to touch CGROUP_ROOT unless it
+ * sits in a cgroup v2 hierarchy.
+ */
+func accountingCgroup() (*taskCgroup, error) {
+	parent := filepath.Dir(config.CGROUP_ROOT)
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not on a cgroup v2 hierarchy", parent)
+	}
+	return makeCgroup(resourceLimits{})
+}
+
+func makeCgroup(limits resourceLimits) (*taskCgroup, error) {
+	if err := os.MkdirAll(config.CGROUP_ROOT, 0755); err != nil {
+		return nil, err
+	}
+
+	// Delegate the controllers to the per task groups. This fails harmlessly
+	// if they are already enabled.
+	ioutil.WriteFile(filepath.Join(config.CGROUP_ROOT, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+
+	path, err := ioutil.TempDir(config.CGROUP_ROOT, "task-")
+	if err != nil {
+		return nil, err
+	}
+	cgroup := &taskCgroup{path: path, limits: limits}
+
+	if limits.cpus > 0 {
+		quota := int64(limits.cpus * cpuPeriodMicros)
+		if err := cgroup.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriodMicros)); err != nil {
+			cgroup.remove()
+			return nil, err
+		}
+	}
+
+	if limits.memoryBytes > 0 {
+		if err := cgroup.write("memory.max", strconv.FormatInt(limits.memoryBytes, 10)); err != nil {
+			cgroup.remove()
+			return nil, err
+		}
+		// Without swap limited too a task can blow through memory.max
+		cgroup.write("memory.swap.max", "0")
+	}
+
+	if limits.pids > 0 {
+		if err := cgroup.write("pids.max", strconv.FormatInt(limits.pids, 10)); err != nil {
+			cgroup.remove()
+			return nil, err
+		}
+	}
+
+	return cgroup, nil
+}
+
+/*
+ * Move a process into the cgroup. Its children will inherit membership.
+ */
+func (c *taskCgroup) add(pid int) error {
+	return c.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+/*
+ * Kill the task if it tries to start more processes than its pids limit
+ * allows. The kernel only refuses the fork, which a fork bomb would simply
+ * retry. Returns a function to stop watching.
+ */
+func (c *taskCgroup) watch(kill func()) func() {
+	if c.limits.pids <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if c.event("pids.events", "max") > 0 {
+					log.Printf("INFO task in %s reached its pids limit, killing it \n", c.path)
+					kill()
+					c.write("cgroup.kill", "1")
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+/*
+ * If the task breached its memory or pids limit, describe that in place of
+ * the error from waiting on it.
+ */
+func (c *taskCgroup) classify(waitErr error) error {
+	if waitErr == nil {
+		return nil
+	}
+
+	if c.limits.pids > 0 && c.event("pids.events", "max") > 0 {
+		return TaskError{
+			Code:    errCodePidsLimit,
+			Message: "The task tried to start more processes than its limit allows and was killed",
+			Details: map[string]string{
+				"pids_limit": strconv.FormatInt(c.limits.pids, 10),
+			},
+			Retryable: true,
+		}
+	}
+
+	if c.limits.memoryBytes > 0 && c.event("memory.events", "oom_kill") > 0 {
+		taskErr := newTaskError(waitErr)
+		details := map[string]string{
+			"memory_limit": strconv.FormatInt(c.limits.memoryBytes, 10),
+		}
+		if exitCode, ok := taskErr.Details["exit_code"]; ok {
+			details["exit_code"] = exitCode
+		}
+		return TaskError{
+			Code:      errCodeMemoryLimit,
+			Message:   "The task exceeded its memory limit and was killed",
+			Details:   details,
+			Retryable: true,
+		}
+	}
+
+	return waitErr
+}
+
+/*
+ * Describe what the task's processes consumed, including descendants that
+ * were never waited for. Counters the kernel doesn't provide, such as
+ * memory.peak before Linux 5.19, are left out.
+ */
+func (c *taskCgroup) account(usage *resourceUsage) {
+	userMicros, userErr := c.stat("cpu.stat", "user_usec")
+	systemMicros, systemErr := c.stat("cpu.stat", "system_usec")
+	if userErr != nil || systemErr != nil {
+		return
+	}
+	usage.Source = "cgroup"
+	usage.UserCPUSeconds = float64(userMicros) / 1e6
+	usage.SystemCPUSeconds = float64(systemMicros) / 1e6
+
+	if throttled, err := c.stat("cpu.stat", "throttled_usec"); err == nil {
+		seconds := float64(throttled) / 1e6
+		usage.CPUThrottledSeconds = &seconds
+	}
+
+	if contents, err := ioutil.ReadFile(filepath.Join(c.path, "memory.peak")); err == nil {
+		if peak, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64); err == nil {
+			usage.MemoryPeakBytes = &peak
+		}
+	}
+}
+
+/*
+ * Tear down the cgroup once the task has exited, killing anything the task
+ * left behind. Groups created only for accounting leave stragglers be, as
+ * they would have survived without one.
+ */
+func (c *taskCgroup) remove() {
+	if !c.limits.any() {
+		if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("INFO leaving cgroup %s in place, the task left processes running \n", c.path)
+		}
+		return
+	}
+
+	// cgroup.kill only exists from Linux 5.14, so stragglers may survive on
+	// older kernels and the rmdir will fail
+	c.write("cgroup.kill", "1")
+
+	for attempt := 0; attempt < 10; attempt++ {
+		if err := os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	log.Printf("ERROR unable to remove cgroup %s \n", c.path)
+}
+
+func (c *taskCgroup) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(c.path, file), []byte(value), 0644)
+}
+
+/*
+ * Read a counter from a flat keyed cgroup file such as memory.events.
+ */
+func (c *taskCgroup) event(file, key string) int64 {
+	value, _ := c.stat(file, key)
+	return value
+}
+
+/*
+ * Read a counter from a flat keyed cgroup file, with an error if the file or
+ * key doesn't exist.
+ */
+func (c *taskCgroup) stat(file, key string) (int64, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(c.path, file))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("%s has no %s", file, key)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// ErrLimitsUnsupported is returned when CPU or memory limits are requested on
+// a platform without cgroups.
+var ErrLimitsUnsupported = fmt.Errorf("CPU, memory and pids limits are only supported on linux")
+
+type taskCgroup struct{}
+
+func createCgroup(limits resourceLimits) (*taskCgroup, error) {
+	if limits.any() {
+		return nil, ErrLimitsUnsupported
+	}
+	return nil, nil
+}
+
+func (c *taskCgroup) add(pid int) error {
+	return nil
+}
+
+func (c *taskCgroup) watch(kill func()) func() {
+	return func() {}
+}
+
+func (c *taskCgroup) classify(waitErr error) error {
+	return waitErr
+}
+
+func (c *taskCgroup) account(usage *resourceUsage) {}
+
+func (c *taskCgroup) remove() {}
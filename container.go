@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// containerImageTag runs a task inside a container of the given image,
+// overriding CONTAINER_IMAGE.
+const containerImageTag = "container_image"
+
+// ErrContainerPriority is returned for container tasks with a scheduling
+// priority, which the container runtime can't apply to the command.
+var ErrContainerPriority = fmt.Errorf("nice_level, ionice_class, NICE_LEVEL and IONICE_CLASS can't be applied to container tasks")
+
+// containerUlimits are the names container runtimes give the rlimits Sonic
+// applies.
+var containerUlimits = map[string]string{
+	"RLIMIT_FSIZE":  "fsize",
+	"RLIMIT_NPROC":  "nproc",
+	"RLIMIT_NOFILE": "nofile",
+}
+
+// containerPool keeps idle containers running for each image, so a task can
+// exec into one immediately rather than waiting for a container to start.
+// Containers are never reused: each is removed once its task finishes and a
+// fresh one is started in the background to replace it.
+type containerPool struct {
+	sync.Mutex
+	idle     map[string][]string
+	starting map[string]int
+}
+
+var containers = &containerPool{
+	idle:     map[string][]string{},
+	starting: map[string]int{},
+}
+
+/*
+ * The image a task should run in, or an empty string to run it on the host.
+ */
+func taskImage(task kewpie.Task) string {
+	if task.Tags[containerImageTag] != "" {
+		return task.Tags[containerImageTag]
+	}
+	return config.CONTAINER_IMAGE
+}
+
+/*
+ * Take an idle container for the image, starting one if none are waiting,
+ * and top the pool back up in the background.
+ */
+func (p *containerPool) acquire(ctx context.Context, image string) (string, error) {
+	p.Lock()
+	idle := p.idle[image]
+	if len(idle) > 0 {
+		id := idle[0]
+		p.idle[image] = idle[1:]
+		p.Unlock()
+		go p.fill(image)
+		return id, nil
+	}
+	p.Unlock()
+
+	go p.fill(image)
+
+	log.Printf("INFO no warm container for %s, starting one \n", image)
+	incCounter("sonic_container_cold_starts_total", map[string]string{"image": image})
+	return startContainer(ctx, image)
+}
+
+/*
+ * Start containers until WARM_CONTAINERS are idle or starting for the image.
+ */
+func (p *containerPool) fill(image string) {
+	for {
+		p.Lock()
+		if len(p.idle[image])+p.starting[image] >= config.WARM_CONTAINERS {
+			p.Unlock()
+			return
+		}
+		p.starting[image]++
+		p.Unlock()
+
+		id, err := startContainer(context.Background(), image)
+
+		p.Lock()
+		p.starting[image]--
+		if err == nil {
+			p.idle[image] = append(p.idle[image], id)
+		}
+		p.Unlock()
+
+		if err != nil {
+			log.Printf("ERROR starting warm container for %s: %s \n", image, err.Error())
+			return
+		}
+	}
+}
+
+/*
+ * Remove every idle container, when Sonic is shutting down.
+ */
+func (p *containerPool) drain() {
+	p.Lock()
+	defer p.Unlock()
+
+	for image, ids := range p.idle {
+		for _, id := range ids {
+			removeContainer(id)
+		}
+		delete(p.idle, image)
+	}
+}
+
+/*
+ * Check an image against the pinning policy. With CONTAINER_REQUIRE_DIGEST
+ * set, images must be referenced by digest rather than a floating tag, and
+ * with CONTAINER_ALLOWED_IMAGES set, only those images may be used.
+ */
+func checkImage(image string) error {
+	if config.CONTAINER_REQUIRE_DIGEST && !strings.Contains(image, "@sha256:") {
+		return TaskError{
+			Code:    errCodeImageRejected,
+			Message: fmt.Sprintf("Image %s must be pinned by digest", image),
+			Details: map[string]string{
+				"image": image,
+			},
+		}
+	}
+
+	if len(config.CONTAINER_ALLOWED_IMAGES) == 0 {
+		return nil
+	}
+	for _, allowed := range config.CONTAINER_ALLOWED_IMAGES {
+		if image == allowed {
+			return nil
+		}
+	}
+
+	return TaskError{
+		Code:    errCodeImageRejected,
+		Message: fmt.Sprintf("Image %s is not in CONTAINER_ALLOWED_IMAGES", image),
+		Details: map[string]string{
+			"image": image,
+		},
+	}
+}
+
+/*
+ * Make sure an image is available locally, pulling it if it isn't. Cache hits
+ * and misses, and time spent pulling, are recorded in metrics.
+ */
+func ensureImage(ctx context.Context, image string) error {
+	labels := map[string]string{"image": image}
+
+	if runTrackedChild(exec.CommandContext(ctx, config.CONTAINER_RUNTIME, "image", "inspect", image)) == nil {
+		incCounter("sonic_image_cache_hits_total", labels)
+		return nil
+	}
+	incCounter("sonic_image_cache_misses_total", labels)
+
+	log.Printf("INFO pulling image %s \n", image)
+	started := time.Now()
+	output, err := combinedOutputTrackedChild(exec.CommandContext(ctx, config.CONTAINER_RUNTIME, "pull", image))
+	addCounter("sonic_image_pull_seconds_total", labels, time.Since(started).Seconds())
+	if err != nil {
+		incCounter("sonic_image_pull_failures_total", labels)
+		return fmt.Errorf("Unable to pull %s: %s %s", image, err.Error(), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+/*
+ * Pull the allowed images and fill the warm pools when Sonic starts, so the
+ * first tasks don't wait on them.
+ */
+func prepareImages() {
+	images := append([]string{}, config.CONTAINER_ALLOWED_IMAGES...)
+	for _, image := range config.WARM_IMAGES {
+		if !contains(images, image) {
+			images = append(images, image)
+		}
+	}
+
+	for _, image := range images {
+		go func(image string) {
+			if err := checkImage(image); err != nil {
+				log.Printf("ERROR not preparing image: %s \n", err.Error())
+				return
+			}
+			if err := ensureImage(context.Background(), image); err != nil {
+				log.Printf("ERROR %s \n", err.Error())
+				return
+			}
+			if contains(config.WARM_IMAGES, image) {
+				containers.fill(image)
+			}
+		}(image)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Start an idle container that stays up until removed, returning its id.
+ * RLIMIT_NOFILE, RLIMIT_NPROC and RLIMIT_FSIZE apply to everything in it.
+ */
+func startContainer(ctx context.Context, image string) (string, error) {
+	if err := ensureImage(ctx, image); err != nil {
+		return "", err
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	args := []string{"run", "--detach", "--init"}
+	for _, setting := range rlimits {
+		args = append(args, "--ulimit", fmt.Sprintf("%s=%d:%d", containerUlimits[setting.name], setting.value, setting.value))
+	}
+	args = append(args, "--entrypoint", "sleep", image, "infinity")
+	cmd := exec.CommandContext(ctx, config.CONTAINER_RUNTIME, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := runTrackedChild(cmd); err != nil {
+		return "", fmt.Errorf("Unable to start a container from %s: %s %s", image, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func removeContainer(id string) {
+	if err := runTrackedChild(exec.Command(config.CONTAINER_RUNTIME, "rm", "--force", id)); err != nil {
+		log.Printf("ERROR removing container %s: %s \n", id, err.Error())
+	}
+}
+
+/*
+ * Apply a task's CPU, memory and pids limits, and its CPU affinity, to the
+ * container it runs in, rather than to the exec client on the host.
+ */
+func limitContainer(ctx context.Context, id string, limits resourceLimits, affinity []int) error {
+	if !limits.any() && len(affinity) == 0 {
+		return nil
+	}
+
+	args := []string{"update"}
+	if limits.cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.cpus, 'f', -1, 64))
+	}
+	if limits.memoryBytes > 0 {
+		// Without swap, as on the host
+		memory := strconv.FormatInt(limits.memoryBytes, 10)
+		args = append(args, "--memory", memory, "--memory-swap", memory)
+	}
+	if limits.pids > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(limits.pids, 10))
+	}
+	if len(affinity) > 0 {
+		cpus := []string{}
+		for _, cpu := range affinity {
+			cpus = append(cpus, strconv.Itoa(cpu))
+		}
+		args = append(args, "--cpuset-cpus", strings.Join(cpus, ","))
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, config.CONTAINER_RUNTIME, append(args, id)...)
+	cmd.Stderr = stderr
+	if err := runTrackedChild(cmd); err != nil {
+		return fmt.Errorf("Unable to apply limits to container %s: %s %s", id, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+/*
+ * The user a task's command runs as in its container, from its run_as_uid
+ * and run_as_gid tags or RUN_AS_UID and RUN_AS_GID, or an empty string for
+ * the image's own user.
+ */
+func containerUser(task kewpie.Task) (string, error) {
+	uid, gid, err := taskCredentials(task)
+	if err != nil {
+		return "", err
+	}
+
+	if uid < 0 && gid < 0 {
+		return "", nil
+	}
+	if uid < 0 {
+		uid = os.Getuid()
+	}
+	if gid < 0 {
+		gid = os.Getgid()
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+/*
+ * Build the command that runs a task's command inside a container, as user
+ * if it's set. The task's env_ tags are passed through to the container.
+ */
+func containerCommand(id, command string, args []string, task kewpie.Task, user string) (string, []string) {
+	execArgs := []string{"exec", "--interactive"}
+
+	if user != "" {
+		execArgs = append(execArgs, "--user", user)
+	}
+	for _, env := range envTags(task) {
+		execArgs = append(execArgs, "--env", env)
+	}
+
+	execArgs = append(execArgs, id, command)
+	return config.CONTAINER_RUNTIME, append(execArgs, args...)
+}
+
+/*
+ * Describe a container task's failure in the same terms as a task run on the
+ * host, so webhook receivers don't need to know which runner was used. The
+ * exec client reports problems with the runtime or the command itself
+ * through reserved exit codes, and an OOM kill is only visible by inspecting
+ * the container.
+ */
+func classifyContainerError(id, image string, command string, waitErr error) error {
+	exitErr, ok := waitErr.(*exec.ExitError)
+	if !ok {
+		return waitErr
+	}
+
+	details := map[string]string{
+		"image":     image,
+		"exit_code": strconv.Itoa(exitErr.ExitCode()),
+	}
+
+	switch exitErr.ExitCode() {
+	case 125:
+		return TaskError{
+			Code:      errCodeProcStartFailed,
+			Message:   "The container runtime failed to run the command",
+			Details:   details,
+			Retryable: true,
+		}
+	case 126, 127:
+		details["command"] = command
+		return TaskError{
+			Code:      errCodeProcStartFailed,
+			Message:   fmt.Sprintf("Unable to run %s in the container", command),
+			Details:   details,
+			Retryable: true,
+		}
+	}
+
+	output, err := outputTrackedChild(exec.Command(config.CONTAINER_RUNTIME, "inspect", "--format", "{{.State.OOMKilled}}", id))
+	if err == nil && strings.TrimSpace(string(output)) == "true" {
+		return TaskError{
+			Code:      errCodeMemoryLimit,
+			Message:   "The task exceeded its memory limit and was killed",
+			Details:   details,
+			Retryable: true,
+		}
+	}
+
+	return waitErr
+}
+
+/*
+ * Describe a failure to get a container for a task.
+ */
+func containerStartError(image string, err error) error {
+	return TaskError{
+		Code:    errCodeProcStartFailed,
+		Message: err.Error(),
+		Details: map[string]string{
+			"image": image,
+		},
+		Retryable: true,
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRuntime stands in for docker. run prints a container id, exec runs the
+// command on the host, and every invocation is logged.
+const fakeRuntime = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls"
+case "$1" in
+run) echo "container-$$" ;;
+exec) shift; while [ "$1" != "${1#-}" ]; do case "$1" in --env) export "$2"; shift ;; --user) shift ;; esac; shift; done; shift; exec "$@" ;;
+esac
+`
+
+func withFakeRuntime(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sonic-runtime")
+	assert.Nil(t, err)
+
+	runtime := filepath.Join(dir, "docker")
+	assert.Nil(t, ioutil.WriteFile(runtime, []byte(fakeRuntime), 0755))
+
+	config.CONTAINER_RUNTIME = runtime
+	return dir, func() {
+		containers.drain()
+		config.CONTAINER_RUNTIME = "docker"
+		config.WARM_CONTAINERS = 0
+		os.RemoveAll(dir)
+	}
+}
+
+func runtimeCalls(t *testing.T, dir string) []string {
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.Nil(t, err)
+	return strings.Split(strings.TrimSpace(string(calls)), "\n")
+}
+
+func TestContainerCommand(t *testing.T) {
+	command, args := containerCommand("abc", "echo", []string{"hai"}, kewpie.Task{
+		Tags: kewpie.Tags{
+			"env_GREETING": "hello",
+		},
+	}, "")
+	assert.Equal(t, "docker", command)
+	assert.Equal(t, []string{"exec", "--interactive", "--env", "GREETING=hello", "abc", "echo", "hai"}, args)
+
+	_, args = containerCommand("abc", "echo", []string{"hai"}, kewpie.Task{}, "1234:5678")
+	assert.Equal(t, []string{"exec", "--interactive", "--user", "1234:5678", "abc", "echo", "hai"}, args)
+}
+
+func TestContainerPool(t *testing.T) {
+	dir, cleanup := withFakeRuntime(t)
+	defer cleanup()
+
+	config.WARM_CONTAINERS = 2
+	containers.fill("alpine")
+
+	containers.Lock()
+	assert.Equal(t, 2, len(containers.idle["alpine"]))
+	warm := containers.idle["alpine"][0]
+	containers.Unlock()
+
+	id, err := containers.acquire(context.Background(), "alpine")
+	assert.Nil(t, err)
+	assert.Equal(t, warm, id)
+
+	// The pool is topped back up in the background
+	for i := 0; i < 100; i++ {
+		containers.Lock()
+		idle := len(containers.idle["alpine"])
+		containers.Unlock()
+		if idle == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	runs := 0
+	for _, call := range runtimeCalls(t, dir) {
+		if strings.HasPrefix(call, "run ") {
+			runs++
+		}
+	}
+	assert.Equal(t, 3, runs)
+}
+
+func TestRunTaskInContainer(t *testing.T) {
+	dir, cleanup := withFakeRuntime(t)
+	defer cleanup()
+
+	assert.Nil(t, runTaskProc(context.Background(), kewpie.Task{
+		Body: "printenv GREETING",
+		Tags: kewpie.Tags{
+			"container_image": "alpine",
+			"env_GREETING":    "hello",
+		},
+	}))
+
+	calls := runtimeCalls(t, dir)
+	assert.Equal(t, "image inspect alpine", calls[0])
+	assert.Contains(t, calls[1], "run --detach --init --entrypoint sleep alpine infinity")
+	assert.Contains(t, calls[2], "exec --interactive --env GREETING=hello container-")
+	assert.Contains(t, calls[3], "rm --force container-")
+}
+
+func TestContainerLimitsAndCredentials(t *testing.T) {
+	dir, cleanup := withFakeRuntime(t)
+	defer cleanup()
+	config.RUN_AS_UID = 1234
+	config.RUN_AS_GID = 5678
+	rlimits = []rlimitSetting{{name: "RLIMIT_NOFILE", value: 64}}
+	defer func() {
+		config.RUN_AS_UID = -1
+		config.RUN_AS_GID = -1
+		rlimits = nil
+	}()
+
+	assert.Nil(t, runTaskProc(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"container_image": "alpine",
+			"cpu_limit":       "0.5",
+			"memory_limit":    "64M",
+			"pids_limit":      "10",
+			"cpu_affinity":    "0-1",
+		},
+	}))
+
+	calls := runtimeCalls(t, dir)
+	assert.Contains(t, calls[1], "run --detach --init --ulimit nofile=64:64 --entrypoint sleep alpine infinity")
+	assert.Contains(t, calls[2], "update --cpus 0.5 --memory 67108864 --memory-swap 67108864 --pids-limit 10 --cpuset-cpus 0,1 container-")
+	assert.Contains(t, calls[3], "exec --interactive --user 1234:5678 container-")
+}
+
+func TestContainerRefusesPriority(t *testing.T) {
+	_, cleanup := withFakeRuntime(t)
+	defer cleanup()
+
+	err := runTaskProc(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"container_image": "alpine",
+			"nice_level":      "10",
+		},
+	})
+	assert.Equal(t, ErrContainerPriority, err)
+}
+
+func TestCheckImage(t *testing.T) {
+	defer func() {
+		config.CONTAINER_ALLOWED_IMAGES = []string{}
+		config.CONTAINER_REQUIRE_DIGEST = false
+	}()
+
+	assert.Nil(t, checkImage("alpine:latest"))
+
+	config.CONTAINER_REQUIRE_DIGEST = true
+	assert.Equal(t, errCodeImageRejected, newTaskError(checkImage("alpine:latest")).Code)
+	assert.Nil(t, checkImage("alpine@sha256:abc"))
+
+	config.CONTAINER_ALLOWED_IMAGES = []string{"alpine@sha256:abc"}
+	assert.Nil(t, checkImage("alpine@sha256:abc"))
+	assert.Equal(t, errCodeImageRejected, newTaskError(checkImage("alpine@sha256:def")).Code)
+}
+
+func TestEnsureImage(t *testing.T) {
+	dir, cleanup := withFakeRuntime(t)
+	defer cleanup()
+
+	labels := map[string]string{"image": "alpine"}
+	hits := counterValue("sonic_image_cache_hits_total", labels)
+	assert.Nil(t, ensureImage(context.Background(), "alpine"))
+	assert.Equal(t, hits+1, counterValue("sonic_image_cache_hits_total", labels))
+
+	// A runtime that has no images pulls them
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(`#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls"
+[ "$1" != "image" ]
+`), 0755))
+	misses := counterValue("sonic_image_cache_misses_total", labels)
+	assert.Nil(t, ensureImage(context.Background(), "alpine"))
+	assert.Equal(t, misses+1, counterValue("sonic_image_cache_misses_total", labels))
+	assert.Equal(t, "pull alpine", runtimeCalls(t, dir)[2])
+}
+
+func TestContainerErrors(t *testing.T) {
+	dir, cleanup := withFakeRuntime(t)
+	defer cleanup()
+
+	task := kewpie.Task{
+		Body: "definitely-not-a-command",
+		Tags: kewpie.Tags{
+			"container_image": "alpine",
+		},
+	}
+
+	taskErr := newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeProcStartFailed, taskErr.Code)
+	assert.Equal(t, "definitely-not-a-command", taskErr.Details["command"])
+	assert.Equal(t, "alpine", taskErr.Details["image"])
+
+	// A container that was OOM killed
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(`#!/bin/sh
+case "$1" in
+run) echo "container-$$" ;;
+exec) exit 137 ;;
+inspect) echo true ;;
+esac
+`), 0755))
+	task.Body = "true"
+	taskErr = newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeMemoryLimit, taskErr.Code)
+	assert.Equal(t, "137", taskErr.Details["exit_code"])
+
+	// A runtime that can't start containers
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(`#!/bin/sh
+echo "Cannot connect to the Docker daemon" >&2
+exit 1
+`), 0755))
+	taskErr = newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeProcStartFailed, taskErr.Code)
+	assert.Contains(t, taskErr.Message, "Cannot connect to the Docker daemon")
+}
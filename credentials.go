@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// ErrRootCredentials is returned when a task tag asks to run as root. Tags
+// come from producers, so they may lower privileges but never raise them.
+var ErrRootCredentials = fmt.Errorf("Tasks may not request to run as root")
+
+// ErrCredentialsNotAllowed is returned when a task tag asks for an id the
+// operator hasn't allowed.
+var ErrCredentialsNotAllowed = fmt.Errorf("Tasks may only request to run as the configured ids or those in RUN_AS_ALLOWED_UIDS and RUN_AS_ALLOWED_GIDS")
+
+/*
+ * Work out the uid and gid a task should run as. The run_as_uid and
+ * run_as_gid tags override RUN_AS_UID and RUN_AS_GID, but only with the
+ * configured id or one listed in RUN_AS_ALLOWED_UIDS or RUN_AS_ALLOWED_GIDS,
+ * so a producer can't pick an arbitrary user on the host. A configured value
+ * of -1 means the child keeps Sonic's own id, which tags can't ask for.
+ */
+func taskCredentials(task kewpie.Task) (int, int, error) {
+	uid, err := credentialTag(task, "run_as_uid", config.RUN_AS_UID, config.RUN_AS_ALLOWED_UIDS)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	gid, err := credentialTag(task, "run_as_gid", config.RUN_AS_GID, config.RUN_AS_ALLOWED_GIDS)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return uid, gid, nil
+}
+
+func credentialTag(task kewpie.Task, tag string, fallback int, allowed map[int]bool) (int, error) {
+	if task.Tags[tag] == "" {
+		return fallback, nil
+	}
+
+	id, err := strconv.Atoi(task.Tags[tag])
+	if err != nil {
+		return -1, fmt.Errorf("Invalid %s tag: %s", tag, err.Error())
+	}
+	if id < 0 {
+		return -1, fmt.Errorf("Invalid %s tag: ids can't be negative", tag)
+	}
+	if id == 0 {
+		return -1, ErrRootCredentials
+	}
+	if id != fallback && !allowed[id] {
+		return -1, ErrCredentialsNotAllowed
+	}
+
+	return id, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskCredentialsDefaults(t *testing.T) {
+	uid, gid, err := taskCredentials(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, -1, gid)
+}
+
+func TestTaskCredentialsOverride(t *testing.T) {
+	config.RUN_AS_UID = 1000
+	config.RUN_AS_GID = 1000
+	config.RUN_AS_ALLOWED_UIDS = map[int]bool{1001: true}
+	defer func() {
+		config.RUN_AS_UID = -1
+		config.RUN_AS_GID = -1
+		config.RUN_AS_ALLOWED_UIDS = map[int]bool{}
+	}()
+
+	uid, gid, err := taskCredentials(kewpie.Task{
+		Tags: kewpie.Tags{
+			"run_as_uid": "1001",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, uid)
+	assert.Equal(t, 1000, gid)
+}
+
+func TestTaskCredentialsRefusesRoot(t *testing.T) {
+	_, _, err := taskCredentials(kewpie.Task{
+		Tags: kewpie.Tags{
+			"run_as_gid": "0",
+		},
+	})
+	assert.Equal(t, ErrRootCredentials, err)
+}
+
+func TestTaskCredentialsRefusesNegative(t *testing.T) {
+	config.RUN_AS_UID = 1000
+	config.RUN_AS_GID = 1000
+	defer func() {
+		config.RUN_AS_UID = -1
+		config.RUN_AS_GID = -1
+	}()
+
+	for _, tag := range []string{"run_as_uid", "run_as_gid"} {
+		_, _, err := taskCredentials(kewpie.Task{
+			Tags: kewpie.Tags{
+				tag: "-1",
+			},
+		})
+		assert.NotNil(t, err, tag)
+	}
+}
+
+func TestTaskCredentialsAllowlist(t *testing.T) {
+	config.RUN_AS_UID = 1000
+	config.RUN_AS_GID = 1000
+	config.RUN_AS_ALLOWED_GIDS = map[int]bool{1002: true}
+	defer func() {
+		config.RUN_AS_UID = -1
+		config.RUN_AS_GID = -1
+		config.RUN_AS_ALLOWED_GIDS = map[int]bool{}
+	}()
+
+	// The configured ids may be asked for explicitly
+	uid, gid, err := taskCredentials(kewpie.Task{
+		Tags: kewpie.Tags{
+			"run_as_uid": "1000",
+			"run_as_gid": "1002",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1002, gid)
+
+	_, _, err = taskCredentials(kewpie.Task{
+		Tags: kewpie.Tags{
+			"run_as_uid": "1003",
+		},
+	})
+	assert.Equal(t, ErrCredentialsNotAllowed, err)
+
+	_, _, err = taskCredentials(kewpie.Task{
+		Tags: kewpie.Tags{
+			"run_as_gid": "1003",
+		},
+	})
+	assert.Equal(t, ErrCredentialsNotAllowed, err)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+/*
+ * Drop the child's privileges to the uid and gid configured for the task.
+ * Supplementary groups are cleared so the child doesn't inherit Sonic's.
+ */
+func applyCredentials(cmd *exec.Cmd, task kewpie.Task) error {
+	uid, gid, err := taskCredentials(task)
+	if err != nil {
+		return err
+	}
+
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+
+	if uid < 0 {
+		uid = os.Getuid()
+	}
+	if gid < 0 {
+		gid = os.Getgid()
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uint32(uid),
+		Gid: uint32(gid),
+	}
+
+	return nil
+}
+
+/*
+ * Hand ownership of a path Sonic created for the child over to the
+ * credentials the child will run as.
+ */
+func chownForChild(cmd *exec.Cmd, path string) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return nil
+	}
+	return os.Chown(path, int(cmd.SysProcAttr.Credential.Uid), int(cmd.SysProcAttr.Credential.Gid))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// ErrCredentialsUnsupported is returned when a uid or gid is configured on
+// Windows, which has no equivalent.
+var ErrCredentialsUnsupported = fmt.Errorf("Running tasks as another uid or gid is not supported on windows")
+
+func applyCredentials(cmd *exec.Cmd, task kewpie.Task) error {
+	uid, gid, err := taskCredentials(task)
+	if err != nil {
+		return err
+	}
+
+	if uid >= 0 || gid >= 0 {
+		return ErrCredentialsUnsupported
+	}
+
+	return nil
+}
+
+func chownForChild(cmd *exec.Cmd, path string) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// Tags added to the copy of a task sent to the dead letter queue, recording
+// how it failed.
+const (
+	deadLetterCodeTag     = "sonic_dead_letter_code"
+	deadLetterErrorTag    = "sonic_dead_letter_error"
+	deadLetterExitCodeTag = "sonic_dead_letter_exit_code"
+	deadLetterAttemptsTag = "sonic_dead_letter_attempts"
+	deadLetterAtTag       = "sonic_dead_letter_at"
+	deadLetterHostTag     = "sonic_dead_letter_host"
+)
+
+/*
+ * Publish a task that failed for good to DEAD_LETTER_QUEUE, if set, so it can
+ * be audited and replayed. The copy is the task as it was delivered, with its
+ * attempts reset and the failure recorded in tags, so publishing it back to
+ * its queue runs it again as if it were new.
+ */
+func deadLetter(task kewpie.Task, err error) {
+	if config.DEAD_LETTER_QUEUE == "" {
+		return
+	}
+
+	taskErr := newTaskError(err)
+	tags := kewpie.Tags{}
+	for tag, value := range task.Tags {
+		tags[tag] = value
+	}
+	tags[deadLetterCodeTag] = taskErr.Code
+	tags[deadLetterErrorTag] = taskErr.Message
+	tags[deadLetterAttemptsTag] = strconv.Itoa(task.Attempts + 1)
+	tags[deadLetterAtTag] = time.Now().UTC().Format(time.RFC3339)
+	delete(tags, deadLetterExitCodeTag)
+	if code, ok := routingExitCode(err); ok {
+		tags[deadLetterExitCodeTag] = strconv.Itoa(code)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		tags[deadLetterHostTag] = hostname
+	}
+
+	dead := kewpie.Task{
+		ID:           task.ID,
+		Body:         task.Body,
+		Tags:         tags,
+		NoExpBackoff: task.NoExpBackoff,
+	}
+
+	// Shutting down mustn't stop a task being dead lettered
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := publishOrSpill(ctx, config.DEAD_LETTER_QUEUE, &dead); err != nil {
+		log.Printf("ERROR dead lettering task %s to %s, it's been dropped: %s \n", task.ID, config.DEAD_LETTER_QUEUE, err.Error())
+		incCounter("sonic_dead_letter_failures_total", nil)
+		return
+	}
+	log.Printf("INFO dead lettered task %s to %s: %s \n", task.ID, config.DEAD_LETTER_QUEUE, taskErr.Code)
+	incCounter("sonic_dead_lettered_total", map[string]string{"code": taskErr.Code})
+}
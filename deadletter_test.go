@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterFailedTask(t *testing.T) {
+	config.DEAD_LETTER_QUEUE = "dead_letter_test"
+	defer func() {
+		config.DEAD_LETTER_QUEUE = ""
+	}()
+
+	task := kewpie.Task{
+		ID:       "5b0b3c39-3d4e-4b0e-9b8e-6f1c1c7e2a11",
+		Body:     "ls /nonexistent/sonic",
+		Tags:     kewpie.Tags{"label_team": "billing"},
+		Attempts: 2,
+	}
+	requeue, err := handleTask(context.Background(), task)
+	assert.False(t, requeue)
+	assert.NotNil(t, err)
+
+	dead := drainQueue(t, "dead_letter_test")
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, task.ID, dead[0].ID)
+	assert.Equal(t, task.Body, dead[0].Body)
+	assert.Equal(t, 0, dead[0].Attempts)
+	assert.Equal(t, "billing", dead[0].Tags["label_team"])
+	assert.Equal(t, errCodeProcExited, dead[0].Tags[deadLetterCodeTag])
+	assert.Equal(t, "2", dead[0].Tags[deadLetterExitCodeTag])
+	assert.Equal(t, "3", dead[0].Tags[deadLetterAttemptsTag])
+	assert.NotEqual(t, "", dead[0].Tags[deadLetterAtTag])
+	assert.Nil(t, checkTags(dead[0]))
+}
+
+func TestDeadLetterRejectedByStartWebhook(t *testing.T) {
+	config.DEAD_LETTER_QUEUE = "dead_letter_rejected_test"
+	defer func() {
+		config.DEAD_LETTER_QUEUE = ""
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{"webhook_start": server.URL},
+	})
+	assert.False(t, requeue)
+	assert.Equal(t, ErrWebhookBadRequest, err)
+
+	dead := drainQueue(t, "dead_letter_rejected_test")
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, errCodeWebhookRejected, dead[0].Tags[deadLetterCodeTag])
+	assert.Equal(t, server.URL, dead[0].Tags["webhook_start"])
+	_, ok := dead[0].Tags[deadLetterExitCodeTag]
+	assert.False(t, ok)
+}
+
+func TestDeadLetterSkipsRequeuedTasks(t *testing.T) {
+	config.DEAD_LETTER_QUEUE = "dead_letter_requeued_test"
+	config.RETRY = true
+	defer func() {
+		config.DEAD_LETTER_QUEUE = ""
+		config.RETRY = false
+	}()
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{Body: "false"})
+	assert.True(t, requeue)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(drainQueue(t, "dead_letter_requeued_test")))
+
+	requeue, err = handleTask(context.Background(), kewpie.Task{Body: "true"})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(drainQueue(t, "dead_letter_requeued_test")))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// taskWaitDelay is how long to keep waiting for a task's output to close
+// after it has exited or been killed, in case something it started outlives
+// it.
+var taskWaitDelay = 5 * time.Second
+
+// deadlineSignal is sent to a task DEADLINE_WARNING before it is killed for
+// running too long, if DEADLINE_WARNING_SIGNAL is set.
+var deadlineSignal os.Signal
+
+/*
+ * Arrange for the task's process to be sent deadlineSignal shortly before its
+ * deadline, so it can flush or checkpoint before it is killed. Returns a
+ * function to cancel the warning.
+ */
+func warnBeforeDeadline(process *os.Process, deadline time.Time) func() {
+	if deadlineSignal == nil || deadline.IsZero() {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(time.Until(deadline.Add(-config.DEADLINE_WARNING)), func() {
+		log.Printf("INFO pid %d is near its deadline, sending %s \n", process.Pid, deadlineSignal)
+		if err := process.Signal(deadlineSignal); err != nil {
+			log.Printf("ERROR signalling pid %d: %s \n", process.Pid, err.Error())
+		}
+	})
+
+	return func() {
+		timer.Stop()
+	}
+}
+
+/*
+ * Work out how long a task may run for. The timeout tag, a Go style Duration
+ * string, can shorten MAX_TASK_RUNTIME for a task but never extend it. Zero
+ * means no limit.
+ */
+func taskRuntime(task kewpie.Task) (time.Duration, error) {
+	if task.Tags["timeout"] == "" {
+		return config.MAX_TASK_RUNTIME, nil
+	}
+
+	timeout, err := time.ParseDuration(task.Tags["timeout"])
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid timeout %q, expected a duration like 10m", task.Tags["timeout"])
+	}
+	if config.MAX_TASK_RUNTIME > 0 && timeout > config.MAX_TASK_RUNTIME {
+		return config.MAX_TASK_RUNTIME, nil
+	}
+	return timeout, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskRuntime(t *testing.T) {
+	config.MAX_TASK_RUNTIME = time.Hour
+	defer func() {
+		config.MAX_TASK_RUNTIME = 0
+	}()
+
+	runtime, err := taskRuntime(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, runtime)
+
+	runtime, err = taskRuntime(kewpie.Task{Tags: kewpie.Tags{"timeout": "5m"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, runtime)
+
+	runtime, err = taskRuntime(kewpie.Task{Tags: kewpie.Tags{"timeout": "2h"}})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, runtime)
+
+	_, err = taskRuntime(kewpie.Task{Tags: kewpie.Tags{"timeout": "soon"}})
+	assert.NotNil(t, err)
+	_, err = taskRuntime(kewpie.Task{Tags: kewpie.Tags{"timeout": "-1s"}})
+	assert.NotNil(t, err)
+}
+
+func TestTimeoutTag(t *testing.T) {
+	err := runTaskProc(context.Background(), kewpie.Task{
+		Body: "sleep 5",
+		Tags: kewpie.Tags{"timeout": "100ms"},
+	})
+	taskErr, ok := err.(TaskError)
+	assert.True(t, ok)
+	assert.Equal(t, errCodeTimedOut, taskErr.Code)
+}
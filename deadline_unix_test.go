@@ -0,0 +1,127 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	signal, err := parseSignal("SIGUSR1")
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGUSR1, signal)
+
+	signal, err = parseSignal("term")
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGTERM, signal)
+
+	_, err = parseSignal("SIGWAT")
+	assert.Error(t, err)
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-deadline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Record the deadline, then wait to be warned about it
+	script := filepath.Join(dir, "task.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$SONIC_DEADLINE" > "$(dirname "$0")/deadline"
+trap 'echo warned > "$(dirname "$0")/warned"; exit 0' USR1
+while true; do sleep 0.01; done
+`), 0755))
+
+	config.MAX_TASK_RUNTIME = 2 * time.Second
+	config.DEADLINE_WARNING = 1900 * time.Millisecond
+	deadlineSignal = syscall.SIGUSR1
+	defer func() {
+		config.MAX_TASK_RUNTIME = 0
+		config.DEADLINE_WARNING = 10 * time.Second
+		deadlineSignal = nil
+	}()
+
+	started := time.Now()
+	assert.Nil(t, runTaskProc(context.Background(), kewpie.Task{Body: script}))
+	assert.True(t, time.Since(started) < time.Second)
+
+	recorded, err := ioutil.ReadFile(filepath.Join(dir, "deadline"))
+	assert.Nil(t, err)
+	deadline, err := time.Parse(time.RFC3339, strings.TrimSpace(string(recorded)))
+	assert.Nil(t, err)
+	assert.True(t, deadline.After(started.Add(time.Second)) && deadline.Before(started.Add(3*time.Second)))
+
+	warned, err := ioutil.ReadFile(filepath.Join(dir, "warned"))
+	assert.Nil(t, err)
+	assert.Equal(t, "warned\n", string(warned))
+}
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-deadline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A grandchild holds the output open, and another would outlive the task
+	script := filepath.Join(dir, "task.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+(sleep 1; echo survived > "$(dirname "$0")/survived") &
+sleep 30 &
+wait
+`), 0755))
+
+	config.MAX_TASK_RUNTIME = 200 * time.Millisecond
+	defer func() {
+		config.MAX_TASK_RUNTIME = 0
+	}()
+
+	// Capturing the output puts a pipe between the task and Sonic
+	output := &bytes.Buffer{}
+	started := time.Now()
+	err = runTaskProcWithOutput(context.Background(), kewpie.Task{Body: script}, procOutput{combined: output})
+	assert.Equal(t, errCodeTimedOut, newTaskError(err).Code)
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "survived"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTaskLeavingProcessesBehind(t *testing.T) {
+	taskWaitDelay = 200 * time.Millisecond
+	defer func() {
+		taskWaitDelay = 5 * time.Second
+	}()
+
+	dir, err := ioutil.TempDir("", "sonic-deadline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "task.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+sleep 30 &
+echo $!
+`), 0755))
+
+	output := &bytes.Buffer{}
+	started := time.Now()
+	assert.Nil(t, runTaskProcWithOutput(context.Background(), kewpie.Task{Body: script}, procOutput{combined: output}))
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(output.String()))
+	assert.Nil(t, err)
+	syscall.Kill(pid, syscall.SIGKILL)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ErrSignalsUnsupported is returned when DEADLINE_WARNING_SIGNAL is set on
+// Windows, which can't deliver signals to other processes.
+var ErrSignalsUnsupported = fmt.Errorf("Deadline warning signals are not supported on windows")
+
+func parseSignal(name string) (os.Signal, error) {
+	return nil, ErrSignalsUnsupported
+}
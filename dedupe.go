@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// dedupeIDTag names the logical job a task does. Of the tasks with the same
+// dedupe_id, only the first is run within DEDUPE_WINDOW.
+const dedupeIDTag = "dedupe_id"
+
+// redisDedupeClaim records a task as the holder of a dedupe ID unless
+// another task already holds it. Reruns of the holder are let through.
+var redisDedupeClaim = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if not holder then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if holder == ARGV[1] then
+	return 1
+end
+return 0
+`)
+
+// dedupeStore remembers which task holds each dedupe ID.
+type dedupeStore interface {
+	claim(key, taskID string, window time.Duration) (bool, error)
+	ping() error
+}
+
+// dedupe is the store for DEDUPE_STORE, or nil if DEDUPE_WINDOW isn't set.
+var dedupe dedupeStore
+
+/*
+ * The store set by DEDUPE_STORE.
+ */
+func newDedupeStore() (dedupeStore, error) {
+	if config.DEDUPE_STORE == "redis" {
+		client, err := newRedisClient(config.REDIS_URL)
+		if err != nil {
+			return nil, err
+		}
+		return &redisDedupe{client: client}, nil
+	}
+	return newMemoryDedupe(config.DEDUPE_SIZE), nil
+}
+
+/*
+ * Check that no other task has run with the same dedupe_id within
+ * DEDUPE_WINDOW, claiming it for this one. The first result is whether the
+ * task should run. If it shouldn't, the rest are the requeue decision for
+ * Kewpie: duplicates are acked without running, and if the store is
+ * unavailable and fails closed the task is requeued.
+ */
+func claimDedupeID(task kewpie.Task) (bool, bool, error) {
+	key := task.Tags[dedupeIDTag]
+	if key == "" || dedupe == nil || config.DEDUPE_WINDOW == 0 {
+		return true, false, nil
+	}
+
+	claimed, err := dedupe.claim(key, task.ID, config.DEDUPE_WINDOW)
+	if err != nil {
+		reportSubsystemFailure("dedupe", err)
+		if config.FAIL_CLOSED["dedupe"] {
+			log.Printf("ERROR not running task %s while dedupe is unavailable, requeueing it \n", task.ID)
+			incCounter("sonic_tasks_deferred_total", map[string]string{"subsystem": "dedupe"})
+			return false, true, subsystemUnavailableError("dedupe", err)
+		}
+		log.Printf("ERROR checking %s %s of task %s, running it anyway: %s \n", dedupeIDTag, key, task.ID, err.Error())
+		return true, false, nil
+	}
+
+	if !claimed {
+		log.Printf("INFO skipping task %s, a duplicate of %s %s \n", task.ID, dedupeIDTag, key)
+		incCounter("sonic_tasks_deduplicated_total", nil)
+		return false, false, nil
+	}
+	return true, false, nil
+}
+
+func probeDedupe() error {
+	if dedupe == nil {
+		return nil
+	}
+	return dedupe.ping()
+}
+
+// memoryDedupeEntry is a dedupe ID held by a task until it expires.
+type memoryDedupeEntry struct {
+	key     string
+	taskID  string
+	expires time.Time
+}
+
+// memoryDedupe remembers up to size dedupe IDs on this worker, forgetting
+// the least recently seen first.
+type memoryDedupe struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newMemoryDedupe(size int) *memoryDedupe {
+	return &memoryDedupe{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (m *memoryDedupe) claim(key, taskID string, window time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.entries[key]; ok {
+		entry := element.Value.(*memoryDedupeEntry)
+		if time.Now().Before(entry.expires) {
+			m.order.MoveToFront(element)
+			return entry.taskID == taskID, nil
+		}
+		m.order.Remove(element)
+		delete(m.entries, key)
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryDedupeEntry{
+		key:     key,
+		taskID:  taskID,
+		expires: time.Now().Add(window),
+	})
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryDedupeEntry).key)
+	}
+	return true, nil
+}
+
+func (m *memoryDedupe) ping() error {
+	return nil
+}
+
+// redisDedupe shares dedupe IDs between workers through Redis, each held in
+// a key that expires at the end of its window.
+type redisDedupe struct {
+	client *redis.Client
+}
+
+func (r *redisDedupe) claim(key, taskID string, window time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	claimed, err := redisDedupeClaim.Run(ctx, r.client, []string{"sonic.dedupe." + key}, taskID, int64(window/time.Millisecond)).Int()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+func (r *redisDedupe) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingDedupe is a dedupe store that can't be reached.
+type failingDedupe struct{}
+
+func (failingDedupe) claim(key, taskID string, window time.Duration) (bool, error) {
+	return false, fmt.Errorf("connection refused")
+}
+
+func (failingDedupe) ping() error {
+	return fmt.Errorf("connection refused")
+}
+
+func withDedupe(store dedupeStore) func() {
+	dedupe = store
+	config.DEDUPE_WINDOW = time.Minute
+	return func() {
+		dedupe = nil
+		config.DEDUPE_WINDOW = 0
+	}
+}
+
+func TestMemoryDedupe(t *testing.T) {
+	store := newMemoryDedupe(2)
+
+	claimed, _ := store.claim("report-42", "one", time.Minute)
+	assert.True(t, claimed)
+	claimed, _ = store.claim("report-42", "two", time.Minute)
+	assert.False(t, claimed)
+
+	// Reruns of the same task aren't duplicates
+	claimed, _ = store.claim("report-42", "one", time.Minute)
+	assert.True(t, claimed)
+
+	// The least recently seen ID is forgotten first
+	store.claim("report-43", "three", time.Minute)
+	store.claim("report-42", "one", time.Minute)
+	store.claim("report-44", "four", time.Minute)
+	claimed, _ = store.claim("report-43", "five", time.Minute)
+	assert.True(t, claimed)
+	claimed, _ = store.claim("report-42", "six", time.Minute)
+	assert.True(t, claimed)
+
+	// And once its window has passed
+	store.claim("report-45", "seven", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	claimed, _ = store.claim("report-45", "eight", time.Minute)
+	assert.True(t, claimed)
+}
+
+func TestRedisDedupe(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client, err := newRedisClient("redis://" + server.Addr() + "/2")
+	assert.Nil(t, err)
+	store := &redisDedupe{client: client}
+	defer client.Close()
+
+	assert.Nil(t, store.ping())
+
+	claimed, err := store.claim("report-42", "one", time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	claimed, _ = store.claim("report-42", "two", time.Minute)
+	assert.False(t, claimed)
+	claimed, _ = store.claim("report-42", "one", time.Minute)
+	assert.True(t, claimed)
+
+	holder, _ := server.DB(2).Get("sonic.dedupe.report-42")
+	assert.Equal(t, "one", holder)
+	assert.Equal(t, time.Minute, server.DB(2).TTL("sonic.dedupe.report-42"))
+
+	// Anyone can have it once it expires
+	server.FastForward(time.Minute)
+	claimed, _ = store.claim("report-42", "two", time.Minute)
+	assert.True(t, claimed)
+}
+
+func TestDuplicateTask(t *testing.T) {
+	defer withDedupe(newMemoryDedupe(10))()
+
+	deduplicated := counterValue("sonic_tasks_deduplicated_total", nil)
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "first",
+		Body: "true",
+		Tags: kewpie.Tags{dedupeIDTag: "report-42"},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+
+	// Would fail if it ran
+	requeue, err = handleTask(context.Background(), kewpie.Task{
+		ID:   "second",
+		Body: "false",
+		Tags: kewpie.Tags{dedupeIDTag: "report-42"},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, deduplicated+1, counterValue("sonic_tasks_deduplicated_total", nil))
+
+	// Tasks without a dedupe_id are never duplicates
+	requeue, err = handleTask(context.Background(), kewpie.Task{ID: "third", Body: "false"})
+	assert.False(t, requeue)
+	assert.NotNil(t, err)
+}
+
+func TestDedupeUnavailable(t *testing.T) {
+	defer withDedupe(failingDedupe{})()
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{dedupeIDTag: "report-42"},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+
+	config.FAIL_CLOSED = map[string]bool{"dedupe": true}
+	defer func() {
+		config.FAIL_CLOSED = map[string]bool{}
+	}()
+
+	requeue, err = handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{dedupeIDTag: "report-42"},
+	})
+	assert.True(t, requeue)
+	assert.Equal(t, errCodeSubsystemUnavailable, newTaskError(err).Code)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/paidright/sonic/config"
+)
+
+// subsystemProbeInterval is how long a subsystem's health is trusted before
+// it's probed again.
+const subsystemProbeInterval = 10 * time.Second
+
+// subsystem is an optional part of Sonic that tasks can run without. By
+// default it fails open: when it's unavailable tasks run regardless and lose
+// only what it provides. Listed in FAIL_CLOSED, tasks aren't run until it's
+// healthy again.
+type subsystem struct {
+	name    string
+	enabled func() bool
+	probe   func() error
+
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// subsystemStatus describes a subsystem's health in the readiness report.
+type subsystemStatus struct {
+	Mode    string `json:"mode"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// subsystems are the optional subsystems whose failure mode can be chosen
+// with FAIL_CLOSED.
+var subsystems = []*subsystem{
+	{
+		name:    "metrics",
+		enabled: func() bool { return config.METRICS_ADDR != "" || config.METRICS_BACKEND != metricsPrometheus },
+		probe:   probeMetrics,
+	},
+	{
+		name:    "state",
+		enabled: func() bool { return config.STATE_DIR != "" },
+		probe:   probeStateDir,
+	},
+	{
+		name:    "dedupe",
+		enabled: func() bool { return config.DEDUPE_WINDOW > 0 && config.DEDUPE_STORE == "redis" },
+		probe:   probeDedupe,
+	},
+}
+
+func findSubsystem(name string) *subsystem {
+	for _, s := range subsystems {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *subsystem) mode() string {
+	if config.FAIL_CLOSED[s.name] {
+		return "fail_closed"
+	}
+	return "fail_open"
+}
+
+/*
+ * The subsystem's health, probing it if it hasn't been checked recently.
+ */
+func (s *subsystem) health() error {
+	s.mu.Lock()
+	stale := time.Since(s.checked) >= subsystemProbeInterval
+	s.mu.Unlock()
+	if stale {
+		s.report(s.probe())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+/*
+ * Record the subsystem's health, logging when it changes.
+ */
+func (s *subsystem) report(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil && s.err == nil {
+		log.Printf("ERROR %s is unavailable, failing %s: %s \n", s.name, s.mode(), err.Error())
+		incCounter("sonic_subsystem_failures_total", map[string]string{"subsystem": s.name})
+	} else if err == nil && s.err != nil {
+		log.Printf("INFO %s is available again \n", s.name)
+	}
+	s.err = err
+	s.checked = time.Now()
+}
+
+/*
+ * Record that a subsystem failed while in use, so tasks stop being run
+ * straight away if it fails closed, rather than after its next probe.
+ */
+func reportSubsystemFailure(name string, err error) {
+	if s := findSubsystem(name); s != nil && s.enabled() {
+		s.report(err)
+	}
+}
+
+/*
+ * Find an enabled subsystem that fails closed and is unavailable, in which
+ * case tasks mustn't be run.
+ */
+func unavailableSubsystem() (string, error) {
+	for _, s := range subsystems {
+		if !s.enabled() || !config.FAIL_CLOSED[s.name] {
+			continue
+		}
+		if err := s.health(); err != nil {
+			return s.name, err
+		}
+	}
+	return "", nil
+}
+
+/*
+ * Describe a task that wasn't run because a subsystem that fails closed is
+ * unavailable. It's always requeued, as it hasn't failed.
+ */
+func subsystemUnavailableError(name string, err error) error {
+	return TaskError{
+		Code:    errCodeSubsystemUnavailable,
+		Message: fmt.Sprintf("%s is unavailable: %s", name, err.Error()),
+		Details: map[string]string{
+			"subsystem": name,
+		},
+		Retryable: true,
+	}
+}
+
+/*
+ * Serve /ready, reporting the health of the queue and each enabled
+ * subsystem. Sonic is ready when the queue and every subsystem that fails
+ * closed are healthy, and answers 503 otherwise.
+ */
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := map[string]subsystemStatus{}
+	ready := true
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	statuses["queue"] = newSubsystemStatus("fail_closed", queue.Healthy(ctx))
+	ready = statuses["queue"].Healthy
+
+	for _, s := range subsystems {
+		if !s.enabled() {
+			continue
+		}
+		status := newSubsystemStatus(s.mode(), s.health())
+		statuses[s.name] = status
+		if !status.Healthy && config.FAIL_CLOSED[s.name] {
+			ready = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":      ready,
+		"subsystems": statuses,
+	})
+}
+
+func newSubsystemStatus(mode string, err error) subsystemStatus {
+	status := subsystemStatus{Mode: mode, Healthy: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+/*
+ * Check STATE_DIR can be written to.
+ */
+func probeStateDir() error {
+	file, err := ioutil.TempFile(config.STATE_DIR, ".probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write([]byte("ok")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
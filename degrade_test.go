@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withStateDir(t *testing.T, failClosed bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "sonic-degrade")
+	assert.Nil(t, err)
+
+	config.STATE_DIR = dir
+	if failClosed {
+		config.FAIL_CLOSED = map[string]bool{"state": true}
+	}
+	state := findSubsystem("state")
+	state.report(nil)
+	state.checked = time.Time{}
+
+	return dir, func() {
+		config.STATE_DIR = ""
+		config.FAIL_CLOSED = map[string]bool{}
+		state.report(nil)
+		os.RemoveAll(dir)
+	}
+}
+
+func readiness(t *testing.T) (int, map[string]subsystemStatus) {
+	recorder := httptest.NewRecorder()
+	readinessHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+	report := struct {
+		Ready      bool                       `json:"ready"`
+		Subsystems map[string]subsystemStatus `json:"subsystems"`
+	}{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, recorder.Code == http.StatusOK, report.Ready)
+	return recorder.Code, report.Subsystems
+}
+
+func TestFailClosedDefersTasks(t *testing.T) {
+	dir, cleanup := withStateDir(t, true)
+	defer cleanup()
+
+	name, err := unavailableSubsystem()
+	assert.Equal(t, "", name)
+	assert.Nil(t, err)
+
+	// The state dir disappearing is noticed by the next probe
+	assert.Nil(t, os.RemoveAll(dir))
+	findSubsystem("state").checked = time.Time{}
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{Body: "true"})
+	assert.True(t, requeue)
+	taskErr := newTaskError(err)
+	assert.Equal(t, errCodeSubsystemUnavailable, taskErr.Code)
+	assert.Equal(t, "state", taskErr.Details["subsystem"])
+	assert.True(t, taskErr.Retryable)
+
+	status, subsystems := readiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "fail_closed", subsystems["state"].Mode)
+	assert.False(t, subsystems["state"].Healthy)
+	assert.NotEqual(t, "", subsystems["state"].Error)
+	assert.True(t, subsystems["queue"].Healthy)
+
+	// And recovers once it's back
+	assert.Nil(t, os.MkdirAll(dir, 0700))
+	findSubsystem("state").checked = time.Time{}
+	status, subsystems = readiness(t)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, subsystems["state"].Healthy)
+}
+
+func TestFailOpenRunsTasks(t *testing.T) {
+	dir, cleanup := withStateDir(t, false)
+	defer cleanup()
+
+	assert.Nil(t, os.RemoveAll(dir))
+	findSubsystem("state").checked = time.Time{}
+
+	name, err := unavailableSubsystem()
+	assert.Equal(t, "", name)
+	assert.Nil(t, err)
+
+	status, subsystems := readiness(t)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "fail_open", subsystems["state"].Mode)
+	assert.False(t, subsystems["state"].Healthy)
+}
+
+func TestSubsystemFailureReported(t *testing.T) {
+	dir, cleanup := withStateDir(t, true)
+	defer cleanup()
+
+	// A failed write takes effect without waiting for the next probe
+	assert.Nil(t, os.RemoveAll(dir))
+	assert.Equal(t, "", saveInFlight(kewpie.Task{ID: "abc"}, os.Getpid(), time.Now()))
+	name, err := unavailableSubsystem()
+	assert.Equal(t, "state", name)
+	assert.NotNil(t, err)
+}
+
+func TestReadinessOmitsDisabledSubsystems(t *testing.T) {
+	status, subsystems := readiness(t)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(subsystems))
+	assert.Equal(t, "fail_closed", subsystems["queue"].Mode)
+}
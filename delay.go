@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// Tags a producer sets to hold a task until later, for backends that can't
+// delay tasks themselves.
+const (
+	runAtTag = "run_at"
+	delayTag = "delay"
+)
+
+// delayTolerance is how early a task may be popped and still run, so clock
+// skew between hosts doesn't send it round the queue again.
+const delayTolerance = time.Second
+
+/*
+ * When a task is due, from its run_at tag or else its delay tag. The delay
+ * counts from when the task is popped. Tasks with neither tag, or invalid
+ * ones, are due straight away.
+ */
+func taskDueAt(task kewpie.Task) time.Time {
+	if value := task.Tags[runAtTag]; value != "" {
+		runAt, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return runAt
+		}
+		log.Printf("ERROR task %s has an invalid %s %q, running it now \n", task.ID, runAtTag, value)
+	}
+
+	if value := task.Tags[delayTag]; value != "" {
+		delay, err := time.ParseDuration(value)
+		if err == nil {
+			return time.Now().Add(delay)
+		}
+		log.Printf("ERROR task %s has an invalid %s %q, running it now \n", task.ID, delayTag, value)
+	}
+
+	return time.Time{}
+}
+
+/*
+ * Republish a task that isn't due yet with the rest of its delay. Its delay
+ * tag is replaced with a run_at tag so it isn't delayed again each time it's
+ * popped. Returns the requeue decision for Kewpie, which requeues the task
+ * if it couldn't be republished.
+ */
+func deferTask(ctx context.Context, task kewpie.Task, runAt time.Time) (bool, error) {
+	log.Printf("INFO task %s isn't due until %s, requeueing it \n", task.ID, runAt.Format(time.RFC3339))
+
+	tags := kewpie.Tags{}
+	for key, value := range task.Tags {
+		tags[key] = value
+	}
+	delete(tags, delayTag)
+	tags[runAtTag] = runAt.UTC().Format(time.RFC3339)
+	task.Tags = tags
+	task.RunAt = runAt
+	task.Delay = time.Until(runAt)
+
+	if err := publishOrSpill(ctx, sourceQueue(ctx), &task); err != nil {
+		log.Printf("ERROR republishing task %s: %s \n", task.ID, err.Error())
+		return true, err
+	}
+
+	incCounter("sonic_tasks_delayed_total", nil)
+	return false, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskDueAt(t *testing.T) {
+	assert.True(t, taskDueAt(kewpie.Task{}).IsZero())
+
+	due := taskDueAt(kewpie.Task{Tags: kewpie.Tags{runAtTag: "2030-01-02T03:04:05Z"}})
+	assert.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), due.UTC())
+
+	due = taskDueAt(kewpie.Task{Tags: kewpie.Tags{delayTag: "1h"}})
+	assert.InDelta(t, float64(time.Hour), float64(time.Until(due)), float64(time.Minute))
+
+	// run_at wins over delay
+	due = taskDueAt(kewpie.Task{Tags: kewpie.Tags{runAtTag: "2030-01-02T03:04:05Z", delayTag: "1h"}})
+	assert.Equal(t, 2030, due.Year())
+
+	assert.True(t, taskDueAt(kewpie.Task{Tags: kewpie.Tags{runAtTag: "tomorrow"}}).IsZero())
+	assert.True(t, taskDueAt(kewpie.Task{Tags: kewpie.Tags{delayTag: "a while"}}).IsZero())
+}
+
+func TestDelayedTask(t *testing.T) {
+	memory := queue.backend().(*memoryQueue)
+	memory.Reset(config.QUEUE)
+	defer memory.Reset(config.QUEUE)
+
+	delayed := counterValue("sonic_tasks_delayed_total", nil)
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "0d6c1f9e-2f0a-4c55-8d8e-3a4f1d2b7c90",
+		Body: "definitely_not_a_real_command",
+		Tags: kewpie.Tags{delayTag: "1h", "label_team": "billing"},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, delayed+1, counterValue("sonic_tasks_delayed_total", nil))
+
+	waiting := memory.Waiting(config.QUEUE)
+	assert.Equal(t, 1, len(waiting))
+	assert.Equal(t, "0d6c1f9e-2f0a-4c55-8d8e-3a4f1d2b7c90", waiting[0].ID)
+	assert.Equal(t, "billing", waiting[0].Tags["label_team"])
+	_, ok := waiting[0].Tags[delayTag]
+	assert.False(t, ok)
+	runAt, err := time.Parse(time.RFC3339, waiting[0].Tags[runAtTag])
+	assert.Nil(t, err)
+	assert.InDelta(t, float64(time.Hour), float64(time.Until(runAt)), float64(time.Minute))
+	assert.InDelta(t, float64(time.Hour), float64(time.Until(waiting[0].RunAt)), float64(time.Minute))
+}
+
+func TestDueTask(t *testing.T) {
+	memory := queue.backend().(*memoryQueue)
+	memory.Reset(config.QUEUE)
+	defer memory.Reset(config.QUEUE)
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{runAtTag: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(memory.Waiting(config.QUEUE)))
+}
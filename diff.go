@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/paidright/sonic/config"
+)
+
+// maxDiffLines caps the size of a mismatch report's diff.
+const maxDiffLines = 200
+
+var timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+
+// outputCapture records a command's output for comparison between primary
+// and shadow runs. The whole stream is hashed, and the first limit bytes are
+// kept so they can be normalised and diffed.
+type outputCapture struct {
+	limit     int64
+	raw       hash.Hash
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func newOutputCapture() *outputCapture {
+	limit, err := parseByteSize(config.SHADOW_CAPTURE_LIMIT)
+	if err != nil {
+		log.Printf("ERROR parsing SHADOW_CAPTURE_LIMIT, output will not be diffed: %s \n", err.Error())
+		limit = 0
+	}
+	return &outputCapture{
+		limit: limit,
+		raw:   sha256.New(),
+	}
+}
+
+func (c *outputCapture) Write(p []byte) (int, error) {
+	c.raw.Write(p)
+	if c.truncated {
+		return len(p), nil
+	}
+	if int64(c.buf.Len()+len(p)) > c.limit {
+		c.truncated = true
+		c.buf.Reset()
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+/*
+ * The normalised output, or nil if there was too much output to capture.
+ */
+func (c *outputCapture) normalised() []byte {
+	if c.truncated {
+		return nil
+	}
+	return normaliseOutput(c.buf.Bytes())
+}
+
+/*
+ * A hash of the output for comparison. Output that fit within the capture
+ * limit is normalised first, so runs that differ only in ignored fields or
+ * timestamps match. Anything larger is compared byte for byte.
+ */
+func (c *outputCapture) digest() string {
+	if c.truncated {
+		return "raw:" + hex.EncodeToString(c.raw.Sum(nil))
+	}
+	sum := sha256.Sum256(c.normalised())
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Normalise output so that differences which don't matter don't show up as
+ * mismatches. Output that is a JSON document, or JSON lines, is rewritten
+ * with sorted keys and without SHADOW_IGNORE_FIELDS. If
+ * SHADOW_IGNORE_TIMESTAMPS is set, anything that looks like an ISO 8601
+ * timestamp is masked.
+ */
+func normaliseOutput(out []byte) []byte {
+	if doc, ok := canonicalJSON(out, true); ok {
+		out = doc
+	} else {
+		lines := strings.Split(string(out), "\n")
+		for i, line := range lines {
+			if doc, ok := canonicalJSON([]byte(line), false); ok {
+				lines[i] = string(doc)
+			}
+		}
+		out = []byte(strings.Join(lines, "\n"))
+	}
+
+	if config.SHADOW_IGNORE_TIMESTAMPS {
+		out = timestampPattern.ReplaceAll(out, []byte("<timestamp>"))
+	}
+
+	return out
+}
+
+/*
+ * Rewrite a JSON object or array canonically. Documents are indented so they
+ * diff line by line, single lines are kept compact.
+ */
+func canonicalJSON(in []byte, indent bool) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(in)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	doc = stripIgnoredFields(doc)
+
+	var out []byte
+	var err error
+	if indent {
+		out, err = json.MarshalIndent(doc, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, err = json.Marshal(doc)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+func stripIgnoredFields(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if config.SHADOW_IGNORE_FIELDS[key] {
+				delete(v, key)
+				continue
+			}
+			v[key] = stripIgnoredFields(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stripIgnoredFields(value)
+		}
+	}
+	return doc
+}
+
+/*
+ * A line diff of two outputs, with removed lines prefixed "- " and added
+ * lines "+ ". Unchanged lines are left out.
+ */
+func diffOutputs(primary, shadow []byte) []string {
+	a := strings.Split(string(primary), "\n")
+	b := strings.Split(string(shadow), "\n")
+
+	// Longest common subsequence, built from the end so the diff can be
+	// walked forwards.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			diff = append(diff, "+ "+b[j])
+			j++
+		default:
+			diff = append(diff, "- "+a[i])
+			i++
+		}
+		if len(diff) >= maxDiffLines {
+			diff = append(diff, "...")
+			break
+		}
+	}
+
+	return diff
+}
+
+// shadowReport describes a shadow run that didn't match the primary.
+type shadowReport struct {
+	TaskID          string   `json:"task_id"`
+	Result          string   `json:"result"`
+	PrimaryExitCode string   `json:"primary_exit_code"`
+	ShadowExitCode  int      `json:"shadow_exit_code"`
+	Diff            []string `json:"diff,omitempty"`
+}
+
+/*
+ * Log a mismatch report and, if SHADOW_REPORT_DIR is set, write it there as
+ * <task id>.json for later inspection.
+ */
+func reportShadowMismatch(report shadowReport) {
+	log.Printf("INFO shadow mismatch for task %s: %s, primary exit %s, shadow exit %d \n", report.TaskID, report.Result, report.PrimaryExitCode, report.ShadowExitCode)
+	for _, line := range report.Diff {
+		log.Printf("INFO shadow diff %s: %s \n", report.TaskID, line)
+	}
+
+	if config.SHADOW_REPORT_DIR == "" {
+		return
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("ERROR marshalling shadow report for task %s: %s \n", report.TaskID, err.Error())
+		return
+	}
+
+	if err := os.MkdirAll(config.SHADOW_REPORT_DIR, 0755); err != nil {
+		log.Printf("ERROR creating shadow report directory: %s \n", err.Error())
+		return
+	}
+
+	name := filepath.Join(config.SHADOW_REPORT_DIR, fmt.Sprintf("%s.json", filepath.Base(report.TaskID)))
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		log.Printf("ERROR writing shadow report for task %s: %s \n", report.TaskID, err.Error())
+	}
+}
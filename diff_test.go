@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseOutput(t *testing.T) {
+	config.SHADOW_IGNORE_FIELDS = map[string]bool{"request_id": true}
+	config.SHADOW_IGNORE_TIMESTAMPS = true
+	defer func() {
+		config.SHADOW_IGNORE_FIELDS = map[string]bool{}
+		config.SHADOW_IGNORE_TIMESTAMPS = false
+	}()
+
+	assert.Equal(t,
+		normaliseOutput([]byte(`{"total": 10, "request_id": "abc", "at": "2019-06-01T10:00:00Z"}`)),
+		normaliseOutput([]byte(`{"at": "2020-01-01T00:00:00.123+10:00", "request_id": "def", "total": 10}`)),
+	)
+
+	assert.Equal(t,
+		"starting at <timestamp>\n{\"b\":2,\"c\":[1]}\n",
+		string(normaliseOutput([]byte("starting at 2019-06-01 10:00:00\n{\"c\": [1], \"b\": 2, \"request_id\": 1}\n"))),
+	)
+
+	assert.NotEqual(t,
+		normaliseOutput([]byte(`{"total": 10}`)),
+		normaliseOutput([]byte(`{"total": 11}`)),
+	)
+}
+
+func TestOutputCapture(t *testing.T) {
+	small := newOutputCapture()
+	small.Write([]byte(`{"b": 1, "a": 2}`))
+
+	reordered := newOutputCapture()
+	reordered.Write([]byte(`{"a": 2, "b": 1}`))
+
+	assert.Equal(t, small.digest(), reordered.digest())
+
+	big := &outputCapture{limit: 4, raw: small.raw}
+	big.Write([]byte("too much output"))
+	assert.Nil(t, big.normalised())
+	assert.Contains(t, big.digest(), "raw:")
+}
+
+func TestDiffOutputs(t *testing.T) {
+	diff := diffOutputs([]byte("a\nb\nc\n"), []byte("a\nB\nc\nd\n"))
+	assert.Equal(t, []string{"- b", "+ B", "+ d"}, diff)
+
+	assert.Empty(t, diffOutputs([]byte("same\n"), []byte("same\n")))
+}
+
+func TestReportShadowMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-shadow")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config.SHADOW_REPORT_DIR = dir
+	defer func() {
+		config.SHADOW_REPORT_DIR = ""
+	}()
+
+	reportShadowMismatch(shadowReport{
+		TaskID: "task-1",
+		Result: "output_mismatch",
+		Diff:   []string{"- a", "+ b"},
+	})
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "task-1.json"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"output_mismatch"`)
+	assert.Contains(t, string(body), `"+ b"`)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+// ErrDiskSpaceUnsupported is returned when checking free disk space on
+// Windows.
+var ErrDiskSpaceUnsupported = fmt.Errorf("Checking free disk space is not supported on windows")
+
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, ErrDiskSpaceUnsupported
+}
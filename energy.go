@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/paidright/sonic/config"
+)
+
+// joulesPerKWh converts energy readings into the units carbon intensity is
+// quoted in.
+const joulesPerKWh = 3.6e6
+
+// energySample is a reading of the host's RAPL energy counters, in
+// microjoules per domain, along with the CPU time spent across all cores.
+type energySample struct {
+	microjoules map[string]uint64
+	ranges      map[string]uint64
+	busySeconds float64
+}
+
+// energyMeter estimates the energy a task used between starting and
+// finishing. start is nil if RAPL counters couldn't be read.
+type energyMeter struct {
+	start *energySample
+}
+
+var raplUnavailable sync.Once
+
+/*
+ * Begin measuring the energy a task uses. Returns nil unless
+ * ENERGY_TELEMETRY is set.
+ */
+func startEnergyMeter() *energyMeter {
+	if !config.ENERGY_TELEMETRY {
+		return nil
+	}
+
+	sample, err := readEnergy()
+	if err != nil {
+		raplUnavailable.Do(func() {
+			log.Printf("INFO RAPL energy counters unavailable, estimating energy from CPU time: %s \n", err)
+		})
+		return &energyMeter{}
+	}
+	return &energyMeter{start: &sample}
+}
+
+/*
+ * Add the energy the task used, and the CO2 that represents, to its usage.
+ * With RAPL counters the host's energy use over the run is split by the
+ * task's share of the CPU time spent across the host. Otherwise it's
+ * estimated from the task's CPU time and ENERGY_WATTS_PER_CPU, if set.
+ */
+func (m *energyMeter) account(usage *resourceUsage) {
+	if m == nil || usage.Source == "" {
+		return
+	}
+	cpuSeconds := usage.UserCPUSeconds + usage.SystemCPUSeconds
+
+	var joules float64
+	source := ""
+	if m.start != nil {
+		if end, err := readEnergy(); err == nil && end.busySeconds > m.start.busySeconds {
+			share := cpuSeconds / (end.busySeconds - m.start.busySeconds)
+			if share > 1 {
+				share = 1
+			}
+			joules = end.joulesSince(*m.start) * share
+			source = "rapl"
+		}
+	}
+	if source == "" && config.ENERGY_WATTS_PER_CPU > 0 {
+		joules = cpuSeconds * config.ENERGY_WATTS_PER_CPU
+		source = "estimate"
+	}
+	if source == "" {
+		return
+	}
+
+	usage.EnergyJoules = &joules
+	usage.EnergySource = source
+	if config.CARBON_INTENSITY > 0 {
+		grams := joules / joulesPerKWh * config.CARBON_INTENSITY
+		usage.CO2Grams = &grams
+	}
+}
+
+/*
+ * The energy used across every domain since an earlier sample, allowing for
+ * counters that wrapped around in between.
+ */
+func (s energySample) joulesSince(earlier energySample) float64 {
+	total := uint64(0)
+	for domain, now := range s.microjoules {
+		then, ok := earlier.microjoules[domain]
+		if !ok {
+			continue
+		}
+		if now >= then {
+			total += now - then
+		} else {
+			total += s.ranges[domain] - then + now
+		}
+	}
+	return float64(total) / 1e6
+}
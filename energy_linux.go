@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/paidright/sonic/config"
+)
+
+// userHZ is the unit /proc/stat reports CPU time in. It's 100 on every
+// architecture Linux supports.
+const userHZ = 100
+
+/*
+ * Read the package level RAPL counters under RAPL_ROOT, and the CPU time
+ * spent across the host from /proc/stat.
+ */
+func readEnergy() (energySample, error) {
+	sample := energySample{
+		microjoules: map[string]uint64{},
+		ranges:      map[string]uint64{},
+	}
+
+	domains, _ := filepath.Glob(filepath.Join(config.RAPL_ROOT, "intel-rapl:*"))
+	for _, domain := range domains {
+		// Subdomains such as intel-rapl:0:1 are already counted in their
+		// package
+		if strings.Count(filepath.Base(domain), ":") != 1 {
+			continue
+		}
+		energy, err := readUint(filepath.Join(domain, "energy_uj"))
+		if err != nil {
+			return sample, err
+		}
+		limit, err := readUint(filepath.Join(domain, "max_energy_range_uj"))
+		if err != nil {
+			return sample, err
+		}
+		sample.microjoules[domain] = energy
+		sample.ranges[domain] = limit
+	}
+	if len(sample.microjoules) == 0 {
+		return sample, fmt.Errorf("No RAPL domains found under %s", config.RAPL_ROOT)
+	}
+
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return sample, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[0] != "cpu" {
+			continue
+		}
+		// user, nice, system, idle, iowait, irq and softirq, of which idle
+		// and iowait aren't busy
+		for i, field := range fields[1:8] {
+			if i == 3 || i == 4 {
+				continue
+			}
+			ticks, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return sample, err
+			}
+			sample.busySeconds += float64(ticks) / userHZ
+		}
+		return sample, nil
+	}
+	return sample, fmt.Errorf("No cpu line in /proc/stat")
+}
+
+func readUint(path string) (uint64, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+}
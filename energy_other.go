@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// ErrRAPLUnsupported is returned when reading energy counters on a platform
+// without RAPL support.
+var ErrRAPLUnsupported = fmt.Errorf("RAPL energy counters are only supported on linux")
+
+func readEnergy() (energySample, error) {
+	return energySample{}, ErrRAPLUnsupported
+}
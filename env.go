@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+/*
+ * Build the environment for a task's command. Sonic's own environment is
+ * inherited, each label_<name> tag sets SONIC_LABEL_<NAME>, and each
+ * env_<NAME> tag sets NAME.
+ */
+func taskEnv(task kewpie.Task) []string {
+	env := append(os.Environ(), labelEnv(task)...)
+	return append(env, envTags(task)...)
+}
+
+/*
+ * The variables set by a task's env_<NAME> tags, as NAME=value pairs sorted
+ * by name. A tag named just env_ is ignored.
+ */
+func envTags(task kewpie.Task) []string {
+	names := []string{}
+	for tag := range task.Tags {
+		if strings.HasPrefix(tag, "env_") && len(tag) > len("env_") {
+			names = append(names, tag)
+		}
+	}
+	sort.Strings(names)
+
+	env := []string{}
+	for _, tag := range names {
+		env = append(env, strings.TrimPrefix(tag, "env_")+"="+task.Tags[tag])
+	}
+	return env
+}
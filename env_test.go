@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskEnv(t *testing.T) {
+	env := taskEnv(kewpie.Task{
+		Tags: kewpie.Tags{
+			"env_GREETING": "hai",
+			"env_":         "ignored",
+			"greeting":     "ignored",
+		},
+	})
+
+	assert.Equal(t, "GREETING=hai", env[len(env)-1])
+	assert.Equal(t, len(os.Environ())+1, len(env))
+}
+
+func TestEnvTags(t *testing.T) {
+	assert.Equal(t, []string{"A=1", "B=2"}, envTags(kewpie.Task{
+		Tags: kewpie.Tags{
+			"env_B":    "2",
+			"env_A":    "1",
+			"label_id": "ignored",
+		},
+	}))
+	assert.Equal(t, []string{}, envTags(kewpie.Task{}))
+}
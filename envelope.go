@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// envelopeVersionTag names the version of the task format a producer wrote a
+// task in, as MAJOR.MINOR.
+const envelopeVersionTag = "sonic_version"
+
+// envelopeMajor and envelopeMinor are the newest task format this version of
+// Sonic understands. Minor versions only add tags and fields that older
+// workers can safely ignore, so the minor is bumped for those. Anything that
+// changes the meaning of an existing body, tag or field bumps the major.
+const (
+	envelopeMajor = 1
+	envelopeMinor = 0
+)
+
+// envelopeVersion is the version tasks are written in by Sonic's own
+// producers, the gateway and sonicclient.
+var envelopeVersion = fmt.Sprintf("%d.%d", envelopeMajor, envelopeMinor)
+
+/*
+ * Check a task's envelope version can be handled. Tasks without one predate
+ * versioning, and are 1.0. Older versions and newer minor versions are
+ * accepted, the latter with a warning as they may use features this worker
+ * doesn't know about. A newer major version, or one that can't be parsed,
+ * can't be safely interpreted and is described in a TaskError.
+ */
+func checkEnvelope(task kewpie.Task) error {
+	version, ok := task.Tags[envelopeVersionTag]
+	if !ok {
+		incCounter("sonic_task_envelopes_total", map[string]string{"result": "unversioned"})
+		return nil
+	}
+
+	major, minor, err := parseEnvelopeVersion(version)
+	if err != nil || major > envelopeMajor {
+		incCounter("sonic_task_envelopes_total", map[string]string{"result": "rejected"})
+		message := fmt.Sprintf("Task format %s isn't supported by this worker, which understands up to %s", version, envelopeVersion)
+		if err != nil {
+			message = err.Error()
+		}
+		return TaskError{
+			Code:    errCodeUnsupportedEnvelope,
+			Message: message,
+			Details: map[string]string{
+				"version":   version,
+				"supported": envelopeVersion,
+			},
+		}
+	}
+
+	if major == envelopeMajor && minor > envelopeMinor {
+		log.Printf("INFO task %s uses task format %s, newer than %s, so it may use features this worker ignores \n", task.ID, version, envelopeVersion)
+		incCounter("sonic_task_envelopes_total", map[string]string{"result": "newer_minor"})
+		return nil
+	}
+
+	incCounter("sonic_task_envelopes_total", map[string]string{"result": "accepted"})
+	return nil
+}
+
+/*
+ * Parse a MAJOR.MINOR envelope version. A bare MAJOR is MAJOR.0.
+ */
+func parseEnvelopeVersion(version string) (int, int, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("%s must be MAJOR.MINOR, not %q", envelopeVersionTag, version)
+	}
+
+	numbers := []int{0, 0}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return 0, 0, fmt.Errorf("%s must be MAJOR.MINOR, not %q", envelopeVersionTag, version)
+		}
+		numbers[i] = number
+	}
+	return numbers[0], numbers[1], nil
+}
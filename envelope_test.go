@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/sonicclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckEnvelope(t *testing.T) {
+	accepted := []kewpie.Tags{
+		nil,
+		{envelopeVersionTag: "1.0"},
+		{envelopeVersionTag: "1"},
+		{envelopeVersionTag: "0.9"},
+		// Newer minor versions are accepted with a warning
+		{envelopeVersionTag: "1.7"},
+	}
+	for _, tags := range accepted {
+		assert.Nil(t, checkEnvelope(kewpie.Task{Body: "true", Tags: tags}), "%v", tags)
+	}
+
+	for _, version := range []string{"2.0", "2", "1.0.1", "one", "-1.0", ""} {
+		err := checkEnvelope(kewpie.Task{Body: "true", Tags: kewpie.Tags{envelopeVersionTag: version}})
+		assert.NotNil(t, err, version)
+		taskErr := newTaskError(err)
+		assert.Equal(t, errCodeUnsupportedEnvelope, taskErr.Code)
+		assert.Equal(t, version, taskErr.Details["version"])
+		assert.False(t, taskErr.Retryable)
+	}
+}
+
+func TestUnsupportedEnvelopeNotRun(t *testing.T) {
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "false",
+		Tags: kewpie.Tags{envelopeVersionTag: "2.0"},
+	})
+	assert.False(t, requeue)
+	assert.Equal(t, errCodeUnsupportedEnvelope, newTaskError(err).Code)
+}
+
+func TestEnvelopeVersionMatchesClient(t *testing.T) {
+	assert.Equal(t, sonicclient.EnvelopeVersion, envelopeVersion)
+	assert.True(t, knownTags[envelopeVersionTag])
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/paidright/sonic/config"
+)
+
+// Error codes reported to webhook receivers. These are part of the public
+// contract with producers, so existing values must never change meaning.
+const (
+	errCodeProcExited           = "proc_exited"
+	errCodeProcStartFailed      = "proc_start_failed"
+	errCodeProcCancelled        = "proc_cancelled"
+	errCodeWebhookRejected      = "webhook_rejected"
+	errCodeWebhookFailed        = "webhook_failed"
+	errCodeInterrupted          = "interrupted"
+	errCodeUnknownTag           = "unknown_tag"
+	errCodeMemoryLimit          = "memory_limit_exceeded"
+	errCodeTransformFailed      = "transform_failed"
+	errCodeVetoed               = "vetoed"
+	errCodeStalled              = "stalled"
+	errCodeTimedOut             = "timed_out"
+	errCodeBudgetExhausted      = "budget_exhausted"
+	errCodePreempted            = "preempted"
+	errCodeImageRejected        = "image_rejected"
+	errCodePidsLimit            = "pids_limit_exceeded"
+	errCodeAborted              = "aborted"
+	errCodeCommandNotFound      = "command_not_found"
+	errCodeScriptFetch          = "script_fetch_failed"
+	errCodeScriptRejected       = "script_rejected"
+	errCodePolicyViolation      = "policy_violation"
+	errCodeJailRejected         = "jail_rejected"
+	errCodeUnsupportedEnvelope  = "unsupported_version"
+	errCodeSubsystemUnavailable = "subsystem_unavailable"
+	errCodeUnknown              = "unknown"
+)
+
+// TaskError is the structured description of why a task failed. It is sent
+// in the fail webhook so receivers can branch on Code, and localise the
+// message themselves, instead of matching against free text.
+type TaskError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	Retryable bool              `json:"retryable"`
+}
+
+func (e TaskError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+/*
+ * Classify an error returned while handling a task into a TaskError. The
+ * retryable flag says whether the error can be retried at all. Whether the
+ * task is actually requeued also depends on its retry policy, and the flag
+ * sent in its fail webhook reflects both.
+ */
+func newTaskError(err error) TaskError {
+	if taskErr, ok := err.(TaskError); ok {
+		return taskErr
+	}
+
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return TaskError{
+			Code:      errCodeProcCancelled,
+			Message:   err.Error(),
+			Retryable: true,
+		}
+	case ErrWebhookBadRequest:
+		return TaskError{
+			Code:    errCodeWebhookRejected,
+			Message: err.Error(),
+		}
+	case ErrWebhookNotAllowed:
+		return TaskError{
+			Code:    errCodePolicyViolation,
+			Message: err.Error(),
+		}
+	case ErrWebhookServerFailed:
+		return TaskError{
+			Code:      errCodeWebhookFailed,
+			Message:   err.Error(),
+			Retryable: true,
+		}
+	}
+
+	switch e := err.(type) {
+	case *exec.ExitError:
+		return TaskError{
+			Code:    errCodeProcExited,
+			Message: e.Error(),
+			Details: map[string]string{
+				"exit_code": strconv.Itoa(e.ExitCode()),
+			},
+			Retryable: true,
+		}
+	case *exec.Error:
+		return TaskError{
+			Code:    errCodeProcStartFailed,
+			Message: e.Error(),
+			Details: map[string]string{
+				"command": e.Name,
+			},
+			Retryable: true,
+		}
+	}
+
+	return TaskError{
+		Code:      errCodeUnknown,
+		Message:   err.Error(),
+		Retryable: true,
+	}
+}
+
+/*
+ * Describe a command that failed to start because it, or the interpreter
+ * named in its #! line, doesn't exist. This is almost always a worker
+ * misconfiguration, so it isn't requeued unless RETRY_COMMAND_NOT_FOUND is
+ * set. Other start errors are returned unchanged.
+ */
+func classifyStartError(command string, err error) error {
+	details := map[string]string{
+		"command": command,
+		"path":    taskPath(),
+	}
+
+	var message string
+	switch e := err.(type) {
+	case *exec.Error:
+		if e.Err != exec.ErrNotFound {
+			return err
+		}
+		message = fmt.Sprintf("%s was not found in PATH. Check it is installed on the worker, or use its full path", command)
+	case *os.PathError:
+		if !os.IsNotExist(e.Err) {
+			return err
+		}
+		details["resolved"] = e.Path
+		message = fmt.Sprintf("%s does not exist. Check it is installed on the worker, and that the interpreter in its #! line exists", e.Path)
+	default:
+		return err
+	}
+
+	incCounter("sonic_command_not_found_total", nil)
+
+	return TaskError{
+		Code:      errCodeCommandNotFound,
+		Message:   message,
+		Details:   details,
+		Retryable: config.RETRY_COMMAND_NOT_FOUND,
+	}
+}
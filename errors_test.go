@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTaskErrorExitCode(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+
+	taskErr := newTaskError(err)
+	assert.Equal(t, errCodeProcExited, taskErr.Code)
+	assert.Equal(t, "3", taskErr.Details["exit_code"])
+}
+
+func TestNewTaskErrorMissingCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	missing := counterValue("sonic_command_not_found_total", nil)
+
+	taskErr := newTaskError(runProc(ctx, "definitely_not_a_real_command"))
+	assert.Equal(t, errCodeCommandNotFound, taskErr.Code)
+	assert.Equal(t, "definitely_not_a_real_command", taskErr.Details["command"])
+	assert.Equal(t, taskPath(), taskErr.Details["path"])
+	assert.False(t, taskErr.Retryable)
+
+	taskErr = newTaskError(runProc(ctx, "/definitely/not/a/real/command"))
+	assert.Equal(t, errCodeCommandNotFound, taskErr.Code)
+	assert.Equal(t, "/definitely/not/a/real/command", taskErr.Details["resolved"])
+
+	assert.Equal(t, missing+2, counterValue("sonic_command_not_found_total", nil))
+}
+
+func TestNewTaskErrorCommandNotRunnable(t *testing.T) {
+	taskErr := newTaskError(runProc(context.Background(), os.TempDir()))
+	assert.NotEqual(t, errCodeCommandNotFound, taskErr.Code)
+}
+
+func TestNewTaskErrorWebhookRejected(t *testing.T) {
+	taskErr := newTaskError(ErrWebhookBadRequest)
+	assert.Equal(t, errCodeWebhookRejected, taskErr.Code)
+	assert.False(t, taskErr.Retryable)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// expiresAtTag is the time after which a task is no longer worth running.
+const expiresAtTag = "expires_at"
+
+/*
+ * Whether a task has passed the time in its expires_at tag. Tasks with an
+ * invalid expiry never expire.
+ */
+func taskExpired(task kewpie.Task) bool {
+	value := task.Tags[expiresAtTag]
+	if value == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Printf("ERROR task %s has an invalid %s %q, ignoring it \n", task.ID, expiresAtTag, value)
+		return false
+	}
+	return time.Now().After(expiresAt)
+}
+
+/*
+ * Drop a task that expired before it could run, telling its expired webhook.
+ * The task is acked, as running it later would be just as pointless.
+ */
+func expireTask(task kewpie.Task) (bool, error) {
+	log.Printf("INFO skipping task %s, which expired at %s \n", task.ID, task.Tags[expiresAtTag])
+	incCounter("sonic_tasks_expired_total", nil)
+
+	if err := sendWebhook(expiredWebhook, task); err != nil {
+		log.Printf("ERROR sending expired webhook for task %+v\n", task)
+	}
+	return false, nil
+}
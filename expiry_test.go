@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskExpired(t *testing.T) {
+	assert.False(t, taskExpired(kewpie.Task{}))
+	assert.True(t, taskExpired(kewpie.Task{Tags: kewpie.Tags{expiresAtTag: "2019-01-02T03:04:05Z"}}))
+	assert.False(t, taskExpired(kewpie.Task{Tags: kewpie.Tags{expiresAtTag: time.Now().Add(time.Hour).Format(time.RFC3339)}}))
+	assert.False(t, taskExpired(kewpie.Task{Tags: kewpie.Tags{expiresAtTag: "yesterday"}}))
+}
+
+func TestExpiredTask(t *testing.T) {
+	events := make(chan string, 3)
+	payloads := make(chan webhookPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Path
+		if r.URL.Path == "/expired" {
+			received := webhookPayload{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+			payloads <- received
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	expired := counterValue("sonic_tasks_expired_total", nil)
+
+	task := kewpie.Task{
+		ID:   "9f1d7c2e-4b3a-4e6f-8a1b-5c2d3e4f5a6b",
+		Body: "definitely_not_a_real_command",
+		Tags: kewpie.Tags{
+			expiresAtTag:      "2019-01-02T03:04:05Z",
+			"webhook_start":   server.URL + "/start",
+			"webhook_fail":    server.URL + "/fail",
+			"webhook_expired": server.URL + "/expired",
+		},
+	}
+	requeue, err := handleTask(context.Background(), task)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, expired+1, counterValue("sonic_tasks_expired_total", nil))
+	assert.Nil(t, checkTags(task))
+
+	select {
+	case received := <-payloads:
+		assert.Equal(t, task.ID, received.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no expired webhook")
+	}
+	assert.Equal(t, "/expired", <-events)
+	assert.Equal(t, 0, len(events))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/paidright/sonic/config"
+)
+
+// sourceQueueKey marks the context of a task with the queue it was popped
+// from.
+type sourceQueueKey struct{}
+
+/*
+ * Mark ctx as handling a task popped from queueName.
+ */
+func withSourceQueue(ctx context.Context, queueName string) context.Context {
+	return context.WithValue(ctx, sourceQueueKey{}, queueName)
+}
+
+/*
+ * The queue the task being handled in ctx was popped from, where it's
+ * republished to if it's delayed, passed on or preempted. That's QUEUE unless
+ * it came from a weighted or urgent queue.
+ */
+func sourceQueue(ctx context.Context) string {
+	if queueName, ok := ctx.Value(sourceQueueKey{}).(string); ok {
+		return queueName
+	}
+	return config.QUEUE
+}
+
+// fairQueue is a queue consumed in proportion to its weight.
+type fairQueue struct {
+	name    string
+	weight  int
+	current int
+}
+
+// fairScheduler picks which queue to take the next task from, using smooth
+// weighted round robin so that a queue with weight 5 is visited five times as
+// often as one with weight 1, interleaved rather than in bursts.
+type fairScheduler struct {
+	queues []*fairQueue
+}
+
+func newFairScheduler(weights map[string]int) *fairScheduler {
+	names := []string{}
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scheduler := &fairScheduler{}
+	for _, name := range names {
+		scheduler.queues = append(scheduler.queues, &fairQueue{name: name, weight: weights[name]})
+	}
+	return scheduler
+}
+
+/*
+ * Pick the next queue to try, leaving out any in skip. Skipped queues don't
+ * build up credit, so a queue that was empty doesn't get a burst of turns
+ * once it has work again.
+ */
+func (s *fairScheduler) next(skip map[string]bool) *fairQueue {
+	var best *fairQueue
+	total := 0
+	for _, q := range s.queues {
+		if skip[q.name] {
+			continue
+		}
+		q.current += q.weight
+		total += q.weight
+		if best == nil || q.current > best.current {
+			best = q
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+/*
+ * Consume tasks from every queue in QUEUE_WEIGHTS, sharing the worker between
+ * them by weight. Queues without work are passed over, so their share goes to
+ * the others until they have some. Each task consumed is counted against its
+ * queue in the sonic_queue_tasks_total and sonic_queue_task_seconds_total
+ * metrics. Tasks are handled by the handler handlerFor returns for a context
+ * marked with their queue.
+ */
+func subscribeWeighted(ctx context.Context, handlerFor func(context.Context) types.Handler) error {
+	scheduler := newFairScheduler(config.QUEUE_WEIGHTS)
+	log.Printf("INFO sharing the worker between queues by weight: %v \n", config.QUEUE_WEIGHTS)
+
+	for ctx.Err() == nil {
+		started := time.Now()
+		idle := map[string]bool{}
+		for len(idle) < len(scheduler.queues) && ctx.Err() == nil {
+			q := scheduler.next(idle)
+			popped := time.Now()
+			if !popWithin(ctx, queue, q.name, handlerFor(withSourceQueue(ctx, q.name)), config.QUEUE_POLL_TIMEOUT) {
+				idle[q.name] = true
+				continue
+			}
+			incCounter("sonic_queue_tasks_total", map[string]string{"queue": q.name})
+			addCounter("sonic_queue_task_seconds_total", map[string]string{"queue": q.name}, time.Since(popped).Seconds())
+			break
+		}
+
+		// Backends that return at once from an empty queue would otherwise
+		// be polled in a tight loop
+		if len(idle) == len(scheduler.queues) && time.Since(started) < config.QUEUE_POLL_TIMEOUT {
+			select {
+			case <-ctx.Done():
+			case <-time.After(config.QUEUE_POLL_TIMEOUT - time.Since(started)):
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Pop a single task from a queue, giving up if none arrives within timeout.
+ * The pop is only abandoned if the handler hasn't started, so a task is
+ * never cut off mid-run. Returns whether a task was handled.
+ */
+func popWithin(ctx context.Context, client QueueBackend, queueName string, handler types.Handler, timeout time.Duration) bool {
+	popCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	handled := false
+	abandoned := false
+
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !handled {
+			abandoned = true
+			cancel()
+		}
+	})
+	defer timer.Stop()
+
+	err := client.Pop(popCtx, queueName, cliHandler{
+		handleFunc: func(task types.Task) (bool, error) {
+			mu.Lock()
+			if abandoned {
+				mu.Unlock()
+				return true, context.Canceled
+			}
+			handled = true
+			mu.Unlock()
+
+			return handler.Handle(task)
+		},
+	})
+	if err != nil && !handled && popCtx.Err() == nil {
+		log.Printf("ERROR popping from queue %s: %s \n", queueName, err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return handled
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairScheduler(t *testing.T) {
+	scheduler := newFairScheduler(map[string]int{"reports": 5, "cleanup": 1})
+
+	picked := []string{}
+	for i := 0; i < 12; i++ {
+		picked = append(picked, scheduler.next(nil).name)
+	}
+	assert.Equal(t, 10, strings.Count(strings.Join(picked, ","), "reports"))
+	assert.Equal(t, 2, strings.Count(strings.Join(picked, ","), "cleanup"))
+	// Visits are interleaved rather than all at once
+	assert.NotEqual(t, "cleanup", picked[5])
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "cleanup", scheduler.next(map[string]bool{"reports": true}).name)
+	}
+	assert.Nil(t, newFairScheduler(map[string]int{"reports": 1}).next(map[string]bool{"reports": true}))
+}
+
+func TestSubscribeWeighted(t *testing.T) {
+	config.QUEUE_WEIGHTS = map[string]int{"fair_heavy": 3, "fair_light": 1}
+	defer func() {
+		config.QUEUE_WEIGHTS = map[string]int{}
+	}()
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, queue.Publish(context.Background(), "fair_heavy", &kewpie.Task{Body: "heavy"}))
+	}
+	for i := 0; i < 8; i++ {
+		assert.Nil(t, queue.Publish(context.Background(), "fair_light", &kewpie.Task{Body: "light"}))
+	}
+
+	var mu sync.Mutex
+	consumed := []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			consumed = append(consumed, task.Body)
+			if len(consumed) == 8 {
+				cancel()
+			}
+			return false, nil
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- subscribeWeighted(ctx, func(context.Context) types.Handler { return handler })
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		cancel()
+		t.Fatal("subscribeWeighted didn't consume the tasks")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The light queue gets one turn in four while the heavy queue has work,
+	// then the whole worker once it's drained
+	assert.Equal(t, []string{"heavy", "heavy", "light", "heavy", "heavy", "light", "light", "light"}, consumed)
+}
+
+func TestSubscribeWeightedRepublishesToSourceQueue(t *testing.T) {
+	config.QUEUE_WEIGHTS = map[string]int{config.QUEUE: 3, "fair_delayed": 1}
+	memory := queue.backend().(*memoryQueue)
+	memory.Reset(config.QUEUE)
+	memory.Reset("fair_delayed")
+	defer func() {
+		config.QUEUE_WEIGHTS = map[string]int{}
+		memory.Reset(config.QUEUE)
+		memory.Reset("fair_delayed")
+	}()
+
+	assert.Nil(t, queue.Publish(context.Background(), "fair_delayed", &kewpie.Task{
+		ID:   "5b7f6c3e-8d1a-4f2b-9e0c-2a6d4c8b1f37",
+		Body: "definitely_not_a_real_command",
+		Tags: kewpie.Tags{delayTag: "1h"},
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- subscribeWeighted(ctx, func(ctx context.Context) types.Handler {
+			return cliHandler{
+				handleFunc: func(task kewpie.Task) (bool, error) {
+					defer cancel()
+					return handleTask(ctx, task)
+				},
+			}
+		})
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		cancel()
+		t.Fatal("subscribeWeighted didn't consume the task")
+	}
+
+	assert.Equal(t, 0, len(memory.Waiting(config.QUEUE)))
+	waiting := memory.Waiting("fair_delayed")
+	assert.Equal(t, 1, len(waiting))
+	assert.Equal(t, "5b7f6c3e-8d1a-4f2b-9e0c-2a6d4c8b1f37", waiting[0].ID)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// Tags naming a script to download and run in place of the task's body, and
+// the SHA-256 it must match.
+const (
+	scriptURLTag    = "script_url"
+	scriptSHA256Tag = "script_sha256"
+)
+
+// maxScriptSize is the largest script Sonic will download.
+const maxScriptSize = 1 << 20
+
+// scriptClient downloads scripts named by script_url tags.
+var scriptClient = newScriptClient()
+
+// errBlockedScriptAddress is returned when a script_url resolves to a private
+// address outside SCRIPT_ALLOWED_NETWORKS.
+var errBlockedScriptAddress = fmt.Errorf("Downloading scripts from private addresses is blocked")
+
+// errScriptRedirectNotAllowed is returned when a script_url redirects outside
+// SCRIPT_URL_ALLOWLIST.
+var errScriptRedirectNotAllowed = fmt.Errorf("Script redirects outside SCRIPT_URL_ALLOWLIST are refused")
+
+/*
+ * Build the HTTP client for downloading scripts. Script URLs come from
+ * producers, so downloads are limited to SCRIPT_FETCH_TIMEOUT, never connect
+ * to private addresses, such as cloud metadata endpoints or admin ports on
+ * localhost, outside SCRIPT_ALLOWED_NETWORKS, and only follow redirects within
+ * SCRIPT_URL_ALLOWLIST.
+ */
+func newScriptClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   config.WEBHOOK_DIAL_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+		Control:   checkScriptAddress,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: config.WEBHOOK_TLS_HANDSHAKE_TIMEOUT,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: config.SCRIPT_FETCH_TIMEOUT,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("Stopped after 10 redirects")
+			}
+			if !scriptURLAllowed(req.URL.String()) {
+				return errScriptRedirectNotAllowed
+			}
+			return nil
+		},
+	}
+}
+
+/*
+ * Check the address a script download is about to connect to, after the host
+ * is resolved, as checkWebhookAddress does for webhooks.
+ */
+func checkScriptAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !addressAllowed(ip, config.SCRIPT_ALLOWED_NETWORKS) {
+		return errBlockedScriptAddress
+	}
+	return nil
+}
+
+/*
+ * If the task names a script_url, download it and return a copy of the task
+ * that runs it as a script. The script must match the script_sha256 tag, so a
+ * compromised or changed script is never run.
+ */
+func fetchTaskScript(ctx context.Context, task kewpie.Task) (kewpie.Task, error) {
+	url := task.Tags[scriptURLTag]
+	if url == "" {
+		return task, nil
+	}
+
+	want := strings.ToLower(strings.TrimSpace(task.Tags[scriptSHA256Tag]))
+	if want == "" {
+		return task, scriptRejectedError(url, "The script_url tag requires a script_sha256 tag")
+	}
+
+	if !scriptURLAllowed(url) {
+		return task, scriptRejectedError(url, "The script_url isn't in SCRIPT_URL_ALLOWLIST")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return task, scriptRejectedError(url, err.Error())
+	}
+
+	res, err := scriptClient.Do(req.WithContext(ctx))
+	if errors.Is(err, errBlockedScriptAddress) || errors.Is(err, errScriptRedirectNotAllowed) {
+		return task, scriptRejectedError(url, err.Error())
+	}
+	if err != nil {
+		return task, scriptFetchError(url, err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return task, scriptFetchError(url, fmt.Sprintf("Downloading the script returned a %d", res.StatusCode))
+	}
+
+	script, err := ioutil.ReadAll(io.LimitReader(res.Body, maxScriptSize+1))
+	if err != nil {
+		return task, scriptFetchError(url, err.Error())
+	}
+	if len(script) > maxScriptSize {
+		return task, scriptRejectedError(url, fmt.Sprintf("The script is larger than %d bytes", maxScriptSize))
+	}
+
+	sum := sha256.Sum256(script)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return task, scriptRejectedError(url, fmt.Sprintf("The script's SHA-256 is %s, not %s", got, want))
+	}
+
+	tags := kewpie.Tags{}
+	for name, value := range task.Tags {
+		tags[name] = value
+	}
+	tags[scriptTag] = "true"
+	task.Tags = tags
+	task.Body = string(script)
+
+	return task, nil
+}
+
+func scriptFetchError(url, message string) error {
+	return TaskError{
+		Code:    errCodeScriptFetch,
+		Message: message,
+		Details: map[string]string{
+			"script_url": url,
+		},
+		Retryable: true,
+	}
+}
+
+func scriptRejectedError(url, message string) error {
+	return TaskError{
+		Code:    errCodeScriptRejected,
+		Message: message,
+		Details: map[string]string{
+			"script_url": url,
+		},
+	}
+}
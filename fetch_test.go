@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchTaskScript(t *testing.T) {
+	script := "#!/bin/sh\necho fetched $GREETING\n"
+	sum := sha256.Sum256([]byte(script))
+	digest := hex.EncodeToString(sum[:])
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	config.SCRIPT_ALLOWED_NETWORKS = []*net.IPNet{loopback}
+	defer func() {
+		config.SCRIPT_ALLOWED_NETWORKS = []*net.IPNet{}
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/script.sh" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(script))
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			scriptURLTag:    server.URL + "/script.sh",
+			scriptSHA256Tag: digest,
+			"env_GREETING":  "hello",
+		},
+	}
+
+	output := newTailBuffer(64)
+	assert.Nil(t, runTaskProcWithOutput(context.Background(), task, procOutput{combined: output}))
+	out, _ := output.String()
+	assert.Equal(t, "fetched hello\n", out)
+	assert.Equal(t, "", task.Tags[scriptTag])
+
+	task.Tags[scriptSHA256Tag] = hex.EncodeToString(make([]byte, sha256.Size))
+	taskErr := newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeScriptRejected, taskErr.Code)
+	assert.Contains(t, taskErr.Message, digest)
+	assert.False(t, taskErr.Retryable)
+
+	delete(task.Tags, scriptSHA256Tag)
+	taskErr = newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeScriptRejected, taskErr.Code)
+
+	task.Tags[scriptSHA256Tag] = digest
+	task.Tags[scriptURLTag] = server.URL + "/missing.sh"
+	taskErr = newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeScriptFetch, taskErr.Code)
+	assert.Equal(t, server.URL+"/missing.sh", taskErr.Details["script_url"])
+}
+
+func TestFetchTaskScriptRefusesPrivateAddresses(t *testing.T) {
+	fetched := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Write([]byte("#!/bin/sh\necho fetched\n"))
+	}))
+	defer server.Close()
+
+	for _, url := range []string{server.URL + "/script.sh", "http://169.254.169.254/latest/meta-data"} {
+		_, err := fetchTaskScript(context.Background(), kewpie.Task{
+			Tags: kewpie.Tags{
+				scriptURLTag:    url,
+				scriptSHA256Tag: hex.EncodeToString(make([]byte, sha256.Size)),
+			},
+		})
+		taskErr := newTaskError(err)
+		assert.Equal(t, errCodeScriptRejected, taskErr.Code, url)
+		assert.False(t, taskErr.Retryable, url)
+	}
+	assert.False(t, fetched)
+}
+
+func TestFetchTaskScriptAllowlist(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	config.SCRIPT_ALLOWED_NETWORKS = []*net.IPNet{loopback}
+	config.SCRIPT_URL_ALLOWLIST = []string{"scripts.example.com"}
+	defer func() {
+		config.SCRIPT_ALLOWED_NETWORKS = []*net.IPNet{}
+		config.SCRIPT_URL_ALLOWLIST = []string{}
+	}()
+
+	fetched := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer server.Close()
+
+	_, err := fetchTaskScript(context.Background(), kewpie.Task{
+		Tags: kewpie.Tags{
+			scriptURLTag:    server.URL + "/script.sh",
+			scriptSHA256Tag: hex.EncodeToString(make([]byte, sha256.Size)),
+		},
+	})
+	assert.Equal(t, errCodeScriptRejected, newTaskError(err).Code)
+	assert.False(t, fetched)
+}
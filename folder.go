@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The folders a task file moves through after it's dropped in a queue's
+// folder.
+const (
+	folderProcessing = "processing"
+	folderDone       = "done"
+	folderFailed     = "failed"
+)
+
+// folderQueue is a queue backend on a directory, for air-gapped hosts and
+// simple hand-offs. Each queue is a folder under DROP_FOLDER, and each .json
+// file dropped in it is a task. A worker claims a task by moving it into
+// processing/, and moves it to done/ or failed/ once it's handled. Workers
+// on other hosts can share the folder over a network filesystem, as long as
+// renames on it are atomic.
+type folderQueue struct {
+	root string
+}
+
+/*
+ * Create each queue's folder and the folders tasks move through.
+ */
+func (f *folderQueue) Connect(backend string, queues []string, connection interface{}) error {
+	if config.DROP_FOLDER == "" {
+		return fmt.Errorf("DROP_FOLDER must be set to use the folder backend")
+	}
+	f.root = config.DROP_FOLDER
+	for _, name := range queues {
+		if err := f.ensure(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *folderQueue) Disconnect() error {
+	return nil
+}
+
+/*
+ * Check DROP_FOLDER is still there.
+ */
+func (f *folderQueue) Healthy(ctx context.Context) error {
+	info, err := os.Stat(f.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("DROP_FOLDER %s isn't a directory", f.root)
+	}
+	return nil
+}
+
+/*
+ * Write a task to a file named after its ID in a queue's folder. Delayed
+ * tasks are written straight away, and left alone until they're due.
+ */
+func (f *folderQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	if err := f.ensure(queueName); err != nil {
+		return err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.dir(queueName), folderFileName(payload.ID)), body)
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done.
+ */
+func (f *folderQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := f.Pop(ctx, queueName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the first due task in a queue's folder, by file name, and handle
+ * it, checking for new files every DROP_FOLDER_POLL. Tasks left in
+ * processing/ by a worker that died are put back once they've been idle
+ * for DROP_FOLDER_CLAIM_IDLE, and that counts as an attempt.
+ */
+func (f *folderQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		if err := f.reclaim(queueName); err != nil {
+			return err
+		}
+
+		name, task, ok, err := f.claim(queueName)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return f.handle(queueName, name, task, handler)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(config.DROP_FOLDER_POLL):
+		}
+	}
+}
+
+func (f *folderQueue) handle(queueName, name string, task kewpie.Task, handler types.Handler) error {
+	claimed := filepath.Join(f.dir(queueName), folderProcessing, name)
+
+	done := make(chan struct{})
+	interval := config.DROP_FOLDER_CLAIM_IDLE / 2
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Touching it keeps it from being put back
+				now := time.Now()
+				os.Chtimes(claimed, now, now)
+			}
+		}
+	}()
+
+	requeue, err := handler.Handle(task)
+	close(done)
+
+	if err == nil {
+		return os.Rename(claimed, filepath.Join(f.dir(queueName), folderDone, name))
+	}
+
+	log.Println("ERROR kewpie task handler", err)
+	if !requeue {
+		failed := filepath.Join(f.dir(queueName), folderFailed, name)
+		ioutil.WriteFile(strings.TrimSuffix(failed, ".json")+".error", []byte(err.Error()+"\n"), 0644)
+		return os.Rename(claimed, failed)
+	}
+
+	task.Attempts++
+	task.RunAt = time.Time{}
+	task.Delay = 0
+	if !task.NoExpBackoff {
+		task.Delay = util.CalcBackoff(task.Attempts + 1)
+	}
+	if err := f.Publish(context.Background(), queueName, &task); err != nil {
+		// Leave it claimed to be put back once it's idle instead
+		log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+		return nil
+	}
+	return os.Remove(claimed)
+}
+
+/*
+ * Claim the first due task in a queue's folder by moving it into
+ * processing/. Files another worker claims first are skipped. Files that
+ * aren't tasks are moved to failed/.
+ */
+func (f *folderQueue) claim(queueName string) (string, kewpie.Task, bool, error) {
+	dir := f.dir(queueName)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", kewpie.Task{}, false, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", kewpie.Task{}, false, err
+		}
+
+		task := kewpie.Task{}
+		if err := json.Unmarshal(contents, &task); err != nil {
+			log.Printf("ERROR moving %s to %s as it isn't a task: %s \n", path, folderFailed, err.Error())
+			failed := filepath.Join(dir, folderFailed, name)
+			ioutil.WriteFile(strings.TrimSuffix(failed, ".json")+".error", []byte(err.Error()+"\n"), 0644)
+			os.Rename(path, failed)
+			continue
+		}
+		if time.Now().Before(task.RunAt) {
+			continue
+		}
+		if task.ID == "" {
+			task.ID = strings.TrimSuffix(name, ".json")
+		}
+
+		claimed := filepath.Join(dir, folderProcessing, name)
+		if err := os.Rename(path, claimed); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", kewpie.Task{}, false, err
+		}
+		// Claimed now, not whenever the file was last written
+		now := time.Now()
+		os.Chtimes(claimed, now, now)
+
+		return name, task, true, nil
+	}
+	return "", kewpie.Task{}, false, nil
+}
+
+/*
+ * Put back tasks that have sat in processing/ for DROP_FOLDER_CLAIM_IDLE
+ * without being touched, counting the attempt their worker didn't finish.
+ */
+func (f *folderQueue) reclaim(queueName string) error {
+	processing := filepath.Join(f.dir(queueName), folderProcessing)
+	entries, err := ioutil.ReadDir(processing)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || time.Since(entry.ModTime()) < config.DROP_FOLDER_CLAIM_IDLE {
+			continue
+		}
+		path := filepath.Join(processing, name)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		task := kewpie.Task{}
+		if err := json.Unmarshal(contents, &task); err == nil {
+			task.Attempts++
+			if contents, err = json.Marshal(task); err != nil {
+				return err
+			}
+			if err := writeFileAtomic(path, contents); err != nil {
+				return err
+			}
+		}
+
+		// Only the worker that wins the rename puts it back
+		if err := os.Rename(path, filepath.Join(f.dir(queueName), name)); err != nil {
+			continue
+		}
+		log.Printf("INFO put back %s on %s, idle in %s since %s \n", name, queueName, folderProcessing, entry.ModTime().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (f *folderQueue) ensure(queueName string) error {
+	for _, sub := range []string{folderProcessing, folderDone, folderFailed} {
+		if err := os.MkdirAll(filepath.Join(f.dir(queueName), sub), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *folderQueue) dir(queueName string) string {
+	return filepath.Join(f.root, queueName)
+}
+
+/*
+ * The file a task is written to, named after its ID with anything that
+ * can't be in a file name replaced.
+ */
+func folderFileName(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, strings.TrimLeft(id, ".")) + ".json"
+}
+
+/*
+ * Write a file by writing a hidden temporary file alongside it and renaming
+ * it into place, so it's never seen half written.
+ */
+func writeFileAtomic(path string, contents []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
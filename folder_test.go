@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withFolderQueue(t *testing.T) (*folderQueue, func()) {
+	dir, err := ioutil.TempDir("", "sonic-folder")
+	assert.Nil(t, err)
+	config.DROP_FOLDER = dir
+	config.DROP_FOLDER_POLL = 20 * time.Millisecond
+
+	client := &folderQueue{}
+	assert.Nil(t, client.Connect("folder", []string{"folder_test"}, nil))
+	return client, func() {
+		config.DROP_FOLDER = ""
+		config.DROP_FOLDER_POLL = time.Second
+		os.RemoveAll(dir)
+	}
+}
+
+func folderFiles(t *testing.T, client *folderQueue, sub string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(client.dir("folder_test"), sub))
+	assert.Nil(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestFolderQueue(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	assert.Nil(t, client.Publish(context.Background(), "folder_test", &kewpie.Task{ID: "first", Body: "echo one"}))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(client.dir("folder_test"), "second.json"), []byte(`{"body": "echo two"}`), 0644))
+	assert.Equal(t, []string{"first.json", "second.json"}, folderFiles(t, client, ""))
+
+	handled := []kewpie.Task{}
+	for range []int{1, 2} {
+		assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+			handleFunc: func(task kewpie.Task) (bool, error) {
+				handled = append(handled, task)
+				return false, nil
+			},
+		}))
+	}
+	assert.Equal(t, "first", handled[0].ID)
+	assert.Equal(t, "echo one", handled[0].Body)
+	// Files dropped in without an ID are named for their file
+	assert.Equal(t, "second", handled[1].ID)
+
+	assert.Equal(t, []string{}, folderFiles(t, client, ""))
+	assert.Equal(t, []string{}, folderFiles(t, client, folderProcessing))
+	assert.Equal(t, []string{"first.json", "second.json"}, folderFiles(t, client, folderDone))
+}
+
+func TestFolderQueueReject(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	assert.Nil(t, client.Publish(context.Background(), "folder_test", &kewpie.Task{ID: "broken", Body: "exit 1"}))
+	assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			return false, fmt.Errorf("exit status 1")
+		},
+	}))
+
+	assert.Equal(t, []string{"broken.error", "broken.json"}, folderFiles(t, client, folderFailed))
+	reason, err := ioutil.ReadFile(filepath.Join(client.dir("folder_test"), folderFailed, "broken.error"))
+	assert.Nil(t, err)
+	assert.Equal(t, "exit status 1\n", string(reason))
+}
+
+func TestFolderQueueRequeue(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	assert.Nil(t, client.Publish(context.Background(), "folder_test", &kewpie.Task{ID: "again", Body: "exit 1"}))
+	assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			return true, fmt.Errorf("exit status 1")
+		},
+	}))
+
+	assert.Equal(t, []string{}, folderFiles(t, client, folderProcessing))
+	assert.Equal(t, []string{"again.json"}, folderFiles(t, client, ""))
+
+	_, task, ok, err := client.claim("folder_test")
+	assert.Nil(t, err)
+	assert.False(t, ok, "it isn't due until its backoff is over")
+	assert.Equal(t, "", task.ID)
+}
+
+func TestFolderQueueNotATask(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	dir := client.dir("folder_test")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte("nope"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"body": "echo hi"}`), 0644))
+	// Neither hidden nor other files are tasks
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".c.json"), []byte(`{"body": "echo half written"}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0644))
+
+	assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "b", task.ID)
+			return false, nil
+		},
+	}))
+	assert.Equal(t, []string{"a.error", "a.json"}, folderFiles(t, client, folderFailed))
+	assert.Equal(t, []string{".c.json", "notes.txt"}, folderFiles(t, client, ""))
+}
+
+func TestFolderQueueDelayed(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	assert.Nil(t, client.Publish(context.Background(), "folder_test", &kewpie.Task{ID: "a", Body: "echo later", Delay: time.Hour}))
+	assert.Nil(t, client.Publish(context.Background(), "folder_test", &kewpie.Task{ID: "b", Body: "echo soon", Delay: 100 * time.Millisecond}))
+
+	// Tasks that aren't due don't hold up those behind them
+	start := time.Now()
+	assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "echo soon", task.Body)
+			return false, nil
+		},
+	}))
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.Pop(ctx, "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			t.Fatal("nothing is due")
+			return false, nil
+		},
+	}))
+}
+
+func TestFolderQueueReclaim(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+	config.DROP_FOLDER_CLAIM_IDLE = time.Second
+	defer func() {
+		config.DROP_FOLDER_CLAIM_IDLE = 5 * time.Minute
+	}()
+
+	// A worker claimed these, then died
+	processing := filepath.Join(client.dir("folder_test"), folderProcessing)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(processing, "stale.json"), []byte(`{"id": "stale", "body": "echo hi"}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(processing, "busy.json"), []byte(`{"id": "busy", "body": "echo hi"}`), 0644))
+	old := time.Now().Add(-time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(processing, "stale.json"), old, old))
+
+	assert.Nil(t, client.Pop(context.Background(), "folder_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "stale", task.ID)
+			assert.Equal(t, 1, task.Attempts)
+			return false, nil
+		},
+	}))
+	assert.Equal(t, []string{"busy.json"}, folderFiles(t, client, folderProcessing))
+	assert.Equal(t, []string{"stale.json"}, folderFiles(t, client, folderDone))
+}
+
+func TestFolderQueueCancelled(t *testing.T) {
+	client, cleanup := withFolderQueue(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- client.Subscribe(ctx, "folder_test", cliHandler{
+			handleFunc: func(task kewpie.Task) (bool, error) {
+				return false, nil
+			},
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestFolderQueueUnset(t *testing.T) {
+	assert.NotNil(t, (&folderQueue{}).Connect("folder", []string{"folder_test"}, nil))
+}
+
+func TestFolderFileName(t *testing.T) {
+	assert.Equal(t, "abc.json", folderFileName("abc"))
+	assert.Equal(t, "_etc_passwd.json", folderFileName("../etc/passwd"))
+	assert.Equal(t, "hidden.json", folderFileName(".hidden"))
+	assert.Equal(t, "a_b.json", folderFileName(`a\b`))
+}
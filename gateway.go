@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// gatewayMaxBody caps the size of a task submission.
+const gatewayMaxBody = 1 << 20
+
+// gatewayClockSkew is how far a submission's timestamp may be from the
+// gateway's clock, which limits how long a captured request can be replayed.
+const gatewayClockSkew = 5 * time.Minute
+
+// gatewaySignatures remembers the signatures of accepted submissions until
+// their timestamps are outside gatewayClockSkew, so each can only be used once.
+type gatewaySignatures struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+// gatewayTemplate describes a kind of task HTTP producers can submit. The
+// command comes from the template, so producers can only fill in its params
+// and the tags it allows.
+type gatewayTemplate struct {
+	Queue     string                  `json:"queue"`
+	Body      string                  `json:"body"`
+	Tags      kewpie.Tags             `json:"tags"`
+	Params    map[string]gatewayParam `json:"params"`
+	AllowTags []string                `json:"allow_tags"`
+
+	patterns map[string]*regexp.Regexp
+}
+
+// gatewayParam is a value producers supply for a template, which is set as an
+// environment variable of the same name for the command.
+type gatewayParam struct {
+	Required bool   `json:"required"`
+	Pattern  string `json:"pattern"`
+	Default  string `json:"default"`
+}
+
+// gatewaySubmission is the body of a request to submit a task.
+type gatewaySubmission struct {
+	Params       map[string]string `json:"params"`
+	Tags         kewpie.Tags       `json:"tags"`
+	DelaySeconds int               `json:"delay_seconds"`
+}
+
+/*
+ * Entry point for `sonic gateway`. Serves the task submission API until
+ * interrupted, returning the process exit code.
+ */
+func runGateway(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("gateway", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to accept task submissions on")
+	path := flags.String("templates", "", "JSON file of the task templates producers can submit")
+	flags.Parse(args)
+
+	if config.GATEWAY_SECRET == "" {
+		log.Println("ERROR GATEWAY_SECRET must be set to run the gateway")
+		return 2
+	}
+
+	templates, err := loadGatewayTemplates(*path)
+	if err != nil {
+		log.Printf("ERROR loading gateway templates: %s \n", err.Error())
+		return 2
+	}
+
+	// Kewpie backends only publish to queues they were connected to
+	queues := queueNames()
+	connected := map[string]bool{}
+	for _, name := range queues {
+		connected[name] = true
+	}
+	for _, template := range templateList(templates) {
+		if !connected[template.Queue] {
+			connected[template.Queue] = true
+			queues = append(queues, template.Queue)
+		}
+	}
+	if len(queues) > len(queueNames()) {
+		queue.Disconnect()
+		if err := queue.Connect(config.KEWPIE_BACKEND, queues, nil); err != nil {
+			log.Printf("ERROR connecting to queues %v: %s \n", queues, err.Error())
+			return 1
+		}
+	}
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           gatewayHandler(templates),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("INFO gateway accepting tasks on %s for templates %s \n", *addr, strings.Join(templateNames(templates), ", "))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("ERROR gateway failed: %s \n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Read the gateway's templates, keyed by name, from a JSON file. Templates
+ * without a queue publish to QUEUE.
+ */
+func loadGatewayTemplates(path string) (map[string]*gatewayTemplate, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--templates must be set")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*gatewayTemplate{}
+	if err := json.Unmarshal(contents, &templates); err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("No templates found in %s", path)
+	}
+
+	for name, template := range templates {
+		if strings.TrimSpace(template.Body) == "" {
+			return nil, fmt.Errorf("Template %s has no body", name)
+		}
+		if template.Queue == "" {
+			template.Queue = config.QUEUE
+		}
+		template.patterns = map[string]*regexp.Regexp{}
+		for param, spec := range template.Params {
+			if !labelNamePattern.MatchString(param) {
+				return nil, fmt.Errorf("Template %s param %q isn't a valid environment variable name", name, param)
+			}
+			if spec.Pattern == "" {
+				continue
+			}
+			pattern, err := regexp.Compile("^(?:" + spec.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Template %s param %s has an invalid pattern: %s", name, param, err)
+			}
+			template.patterns[param] = pattern
+		}
+	}
+
+	return templates, nil
+}
+
+func templateList(templates map[string]*gatewayTemplate) []*gatewayTemplate {
+	list := []*gatewayTemplate{}
+	for _, name := range templateNames(templates) {
+		list = append(list, templates[name])
+	}
+	return list
+}
+
+func templateNames(templates map[string]*gatewayTemplate) []string {
+	names := []string{}
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * Serve POST /tasks/<template>. Submissions must be signed with
+ * GATEWAY_SECRET, and are checked against the template before the task is
+ * published.
+ */
+func gatewayHandler(templates map[string]*gatewayTemplate) http.Handler {
+	seen := &gatewaySignatures{expires: map[string]time.Time{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/tasks/")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeGatewayError(w, http.StatusMethodNotAllowed, "Tasks must be submitted with a POST")
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxBody))
+		if err != nil {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, "The submission is too large")
+			return
+		}
+
+		if err := verifyGatewaySignature(r.Method, r.URL.Path, r.Header, body, seen, time.Now()); err != nil {
+			log.Printf("ERROR rejecting gateway submission from %s: %s \n", r.RemoteAddr, err.Error())
+			incCounter("sonic_gateway_submissions_total", map[string]string{"result": "unauthorised"})
+			writeGatewayError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		template, ok := templates[name]
+		if !ok {
+			writeGatewayError(w, http.StatusNotFound, fmt.Sprintf("No template named %q", name))
+			return
+		}
+
+		submission := gatewaySubmission{}
+		if err := json.Unmarshal(body, &submission); err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "The submission isn't valid JSON: "+err.Error())
+			return
+		}
+
+		task, problems := template.task(submission)
+		if len(problems) > 0 {
+			incCounter("sonic_gateway_submissions_total", map[string]string{"template": name, "result": "invalid"})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": problems})
+			return
+		}
+
+		if err := queue.Publish(r.Context(), template.Queue, &task); err != nil {
+			log.Printf("ERROR publishing gateway task to %s: %s \n", template.Queue, err.Error())
+			incCounter("sonic_gateway_submissions_total", map[string]string{"template": name, "result": "failed"})
+			writeGatewayError(w, http.StatusServiceUnavailable, "The task couldn't be queued")
+			return
+		}
+
+		log.Printf("INFO gateway queued task %s from template %s on %s \n", task.ID, name, template.Queue)
+		incCounter("sonic_gateway_submissions_total", map[string]string{"template": name, "result": "accepted"})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":    task.ID,
+			"queue": template.Queue,
+		})
+	})
+	return mux
+}
+
+/*
+ * Check a submission's X-Sonic-Signature, which must be sha256= followed by
+ * the hex encoded HMAC-SHA256 of its method, path, X-Sonic-Timestamp and
+ * body, each separated by a newline, keyed with GATEWAY_SECRET. The timestamp
+ * is in Unix seconds and must be within gatewayClockSkew of now, and a
+ * signature is refused if it's been seen before.
+ */
+func verifyGatewaySignature(method, path string, headers http.Header, body []byte, seen *gatewaySignatures, now time.Time) error {
+	timestamp := headers.Get("X-Sonic-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("X-Sonic-Timestamp must be a Unix timestamp")
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > gatewayClockSkew || skew < -gatewayClockSkew {
+		return fmt.Errorf("X-Sonic-Timestamp is more than %s from the gateway's clock", gatewayClockSkew)
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.GATEWAY_SECRET))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(headers.Get("X-Sonic-Signature"))) {
+		return fmt.Errorf("X-Sonic-Signature doesn't match the submission")
+	}
+
+	if !seen.claim(expected, time.Unix(seconds, 0).Add(gatewayClockSkew), now) {
+		return fmt.Errorf("X-Sonic-Signature has already been used")
+	}
+	return nil
+}
+
+/*
+ * Record a signature until it expires, reporting false if it was already
+ * recorded. Expired signatures are forgotten as their timestamps would be
+ * refused anyway.
+ */
+func (s *gatewaySignatures) claim(signature string, expires, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for seen, expiry := range s.expires {
+		if now.After(expiry) {
+			delete(s.expires, seen)
+		}
+	}
+
+	if _, ok := s.expires[signature]; ok {
+		return false
+	}
+	s.expires[signature] = expires
+	return true
+}
+
+/*
+ * Build the task for a submission, or describe everything wrong with it.
+ * Params become env_ tags, and the template's own tags win over any the
+ * submission sets.
+ */
+func (t *gatewayTemplate) task(submission gatewaySubmission) (kewpie.Task, []string) {
+	problems := []string{}
+	tags := kewpie.Tags{}
+
+	for tag, value := range submission.Tags {
+		if !t.allowsTag(tag) {
+			problems = append(problems, fmt.Sprintf("tag %s isn't allowed", tag))
+			continue
+		}
+		tags[tag] = value
+	}
+
+	for param := range submission.Params {
+		if _, ok := t.Params[param]; !ok {
+			problems = append(problems, fmt.Sprintf("param %s isn't defined by the template", param))
+		}
+	}
+	for param, spec := range t.Params {
+		value, ok := submission.Params[param]
+		if !ok {
+			if spec.Required {
+				problems = append(problems, fmt.Sprintf("param %s is required", param))
+				continue
+			}
+			value = spec.Default
+		}
+		if pattern := t.patterns[param]; pattern != nil && ok && !pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("param %s must match %s", param, spec.Pattern))
+			continue
+		}
+		tags["env_"+param] = value
+	}
+
+	if submission.DelaySeconds < 0 {
+		problems = append(problems, "delay_seconds can't be negative")
+	}
+
+	tags[envelopeVersionTag] = envelopeVersion
+	for tag, value := range t.Tags {
+		tags[tag] = value
+	}
+
+	sort.Strings(problems)
+	return kewpie.Task{
+		ID:    uuid.NewV4().String(),
+		Body:  t.Body,
+		Delay: time.Duration(submission.DelaySeconds) * time.Second,
+		Tags:  tags,
+	}, problems
+}
+
+/*
+ * Whether submissions may set a tag. Entries in allow_tags ending in * allow
+ * any tag with that prefix, eg. label_*.
+ */
+func (t *gatewayTemplate) allowsTag(tag string) bool {
+	for _, allowed := range t.AllowTags {
+		if allowed == tag {
+			return true
+		}
+		if strings.HasSuffix(allowed, "*") && strings.HasPrefix(tag, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
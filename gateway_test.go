@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const gatewayTestTemplates = `{
+	"report": {
+		"queue": "gateway_test",
+		"body": "./report.sh",
+		"tags": {"webhook_success": "http://example.com/success"},
+		"params": {
+			"REPORT_DATE": {"required": true, "pattern": "\\d{4}-\\d{2}-\\d{2}"},
+			"FORMAT": {"default": "csv"}
+		},
+		"allow_tags": ["label_*", "webhook_fail"]
+	}
+}`
+
+func withGatewayTemplates(t *testing.T) map[string]*gatewayTemplate {
+	file, err := ioutil.TempFile("", "sonic-gateway-")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(gatewayTestTemplates)
+	file.Close()
+
+	templates, err := loadGatewayTemplates(file.Name())
+	assert.Nil(t, err)
+	return templates
+}
+
+func submitToGateway(t *testing.T, server *httptest.Server, template string, submission interface{}, secret string) *http.Response {
+	body, err := json.Marshal(submission)
+	assert.Nil(t, err)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(http.MethodPost + "\n/tasks/" + template + "\n" + timestamp + "\n"))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/tasks/"+template, bytes.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("X-Sonic-Timestamp", timestamp)
+	req.Header.Set("X-Sonic-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	return res
+}
+
+func TestGateway(t *testing.T) {
+	config.GATEWAY_SECRET = "gateway-secret"
+	defer func() {
+		config.GATEWAY_SECRET = ""
+	}()
+	server := httptest.NewServer(gatewayHandler(withGatewayTemplates(t)))
+	defer server.Close()
+
+	res := submitToGateway(t, server, "report", map[string]interface{}{
+		"params": map[string]string{"REPORT_DATE": "2020-01-01"},
+		"tags":   map[string]string{"label_team": "billing", "webhook_success": "http://attacker.invalid"},
+	}, "gateway-secret")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	res = submitToGateway(t, server, "report", map[string]interface{}{
+		"params": map[string]string{"REPORT_DATE": "2020-01-01"},
+		"tags":   map[string]string{"label_team": "billing"},
+	}, "gateway-secret")
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	accepted := map[string]string{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&accepted))
+	assert.Equal(t, "gateway_test", accepted["queue"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := queue.Pop(ctx, "gateway_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, accepted["id"], task.ID)
+			assert.Equal(t, "./report.sh", task.Body)
+			assert.Equal(t, kewpie.Tags{
+				"webhook_success": "http://example.com/success",
+				"env_REPORT_DATE": "2020-01-01",
+				"env_FORMAT":      "csv",
+				"label_team":      "billing",
+				"sonic_version":   envelopeVersion,
+			}, task.Tags)
+			return false, nil
+		},
+	})
+	assert.Nil(t, err)
+}
+
+func TestGatewayRejects(t *testing.T) {
+	config.GATEWAY_SECRET = "gateway-secret"
+	defer func() {
+		config.GATEWAY_SECRET = ""
+	}()
+	server := httptest.NewServer(gatewayHandler(withGatewayTemplates(t)))
+	defer server.Close()
+
+	valid := map[string]interface{}{
+		"params": map[string]string{"REPORT_DATE": "2020-01-01"},
+	}
+
+	res := submitToGateway(t, server, "report", valid, "wrong-secret")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = submitToGateway(t, server, "missing", valid, "gateway-secret")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err := http.Get(server.URL + "/tasks/report")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res = submitToGateway(t, server, "report", map[string]interface{}{
+		"params": map[string]string{"REPORT_DATE": "2020-01-01; rm -rf /", "EXTRA": "x"},
+	}, "gateway-secret")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	problems := map[string][]string{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&problems))
+	assert.Equal(t, []string{
+		"param EXTRA isn't defined by the template",
+		`param REPORT_DATE must match \d{4}-\d{2}-\d{2}`,
+	}, problems["errors"])
+}
+
+func TestVerifyGatewaySignature(t *testing.T) {
+	config.GATEWAY_SECRET = "gateway-secret"
+	defer func() {
+		config.GATEWAY_SECRET = ""
+	}()
+
+	now := time.Unix(1600000000, 0)
+	headers := http.Header{}
+	headers.Set("X-Sonic-Timestamp", "1600000000")
+	mac := hmac.New(sha256.New, []byte("gateway-secret"))
+	mac.Write([]byte("POST\n/tasks/report\n1600000000\n{}"))
+	headers.Set("X-Sonic-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	seen := &gatewaySignatures{expires: map[string]time.Time{}}
+	assert.NotNil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte(`{"params":{}}`), seen, now))
+	assert.NotNil(t, verifyGatewaySignature("POST", "/tasks/other", headers, []byte("{}"), seen, now))
+	assert.NotNil(t, verifyGatewaySignature("PUT", "/tasks/report", headers, []byte("{}"), seen, now))
+	assert.NotNil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte("{}"), seen, now.Add(10*time.Minute)))
+	assert.Nil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte("{}"), seen, now))
+
+	headers.Del("X-Sonic-Timestamp")
+	assert.NotNil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte("{}"), seen, now))
+}
+
+func TestVerifyGatewaySignatureRefusesReplays(t *testing.T) {
+	config.GATEWAY_SECRET = "gateway-secret"
+	defer func() {
+		config.GATEWAY_SECRET = ""
+	}()
+
+	now := time.Unix(1600000000, 0)
+	headers := http.Header{}
+	headers.Set("X-Sonic-Timestamp", "1600000000")
+	mac := hmac.New(sha256.New, []byte("gateway-secret"))
+	mac.Write([]byte("POST\n/tasks/report\n1600000000\n{}"))
+	headers.Set("X-Sonic-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	seen := &gatewaySignatures{expires: map[string]time.Time{}}
+	assert.Nil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte("{}"), seen, now))
+	assert.NotNil(t, verifyGatewaySignature("POST", "/tasks/report", headers, []byte("{}"), seen, now.Add(time.Minute)))
+
+	// Once the timestamp is too old to be accepted the signature is forgotten
+	seen.claim("other", now.Add(time.Hour), now.Add(gatewayClockSkew+time.Second))
+	assert.Len(t, seen.expires, 1)
+}
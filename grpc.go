@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/paidright/sonic/config"
+	callback "github.com/paidright/sonic/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcClient delivers callbacks to GRPC_CALLBACK_ENDPOINT.
+var grpcClient callback.CallbacksClient
+
+/*
+ * Build the client for gRPC callbacks. It connects lazily, on the first
+ * callback, with the same TLS config, dialer and proxy as webhooks, so the
+ * WEBHOOK_TLS_* settings, WEBHOOK_CA_FILE, WEBHOOK_BLOCK_PRIVATE and
+ * WEBHOOK_PROXY apply to GRPC_CALLBACK_ENDPOINT too. There's no client
+ * without an endpoint.
+ */
+func newGRPCClient() (callback.CallbacksClient, error) {
+	if config.GRPC_CALLBACK_ENDPOINT == "" {
+		return nil, nil
+	}
+
+	endpoint, err := url.Parse(config.GRPC_CALLBACK_ENDPOINT)
+	if err != nil {
+		return nil, err
+	}
+	port := endpoint.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	tlsConfig, err := webhookTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The passthrough resolver hands the host to dialGRPC unresolved, so the
+	// proxy is picked and NO_PROXY matched by name, as for webhooks
+	conn, err := grpc.NewClient("passthrough:///"+net.JoinHostPort(endpoint.Hostname(), port),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithContextDialer(dialGRPC),
+		grpc.WithUserAgent("sonic"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return callback.NewCallbacksClient(conn), nil
+}
+
+/*
+ * Connect to the gRPC endpoint, through a CONNECT tunnel if webhookProxy
+ * picks a proxy for it. gRPC doesn't use its own proxy support with a custom
+ * dialer.
+ */
+func dialGRPC(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := webhookDialer()
+
+	proxy, err := webhookProxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), map[string]string{"http": "80", "https": "443"}[proxy.Scheme])
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"User-Agent": {"sonic"}},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Nothing more arrives until the TLS handshake starts, so nothing is lost
+	// with the reader
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused to connect to %s: %s", proxy.Host, addr, res.Status)
+	}
+	return conn, nil
+}
+
+/*
+ * Deliver an event to GRPC_CALLBACK_ENDPOINT as a TaskEvent, in place of its
+ * HTTP webhook. The webhook's headers are sent as metadata, and failures are
+ * retried like webhooks and reported with the same errors.
+ */
+func sendGRPCCallback(evt string, body webhookPayload) error {
+	payload, headers, err := buildWebhook(evt, body)
+	if err != nil {
+		return err
+	}
+
+	event := &callback.TaskEvent{
+		Event:       evt,
+		TaskId:      body.Task.ID,
+		Payload:     payload,
+		ContentType: headers.Get("Content-Type"),
+	}
+	if event.ContentType == "" {
+		event.ContentType = "application/json"
+	}
+	headers.Del("Content-Type")
+
+	log.Printf("INFO Sending a gRPC callback for event %s on %s \n", evt, config.GRPC_CALLBACK_ENDPOINT)
+	for attempt := 0; ; attempt++ {
+		switch callGRPC(headers, event) {
+		case codes.OK:
+			return nil
+		case codes.InvalidArgument, codes.FailedPrecondition:
+			return ErrWebhookBadRequest
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+			if attempt < config.WEBHOOK_RETRIES {
+				delay := webhookBackoff(attempt)
+				log.Printf("INFO retrying %s gRPC callback in %s \n", evt, delay)
+				time.Sleep(delay)
+				continue
+			}
+		}
+		return ErrWebhookServerFailed
+	}
+}
+
+/*
+ * Make a single Report call, limited to WEBHOOK_TIMEOUT, returning the status
+ * the endpoint answered with. Failing to reach it at all is UNAVAILABLE.
+ */
+func callGRPC(headers http.Header, event *callback.TaskEvent) codes.Code {
+	md := metadata.MD{}
+	for name, values := range headers {
+		md[strings.ToLower(name)] = values
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	if config.WEBHOOK_TIMEOUT > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.WEBHOOK_TIMEOUT)
+		defer cancel()
+	}
+
+	_, err := grpcClient.Report(ctx, event)
+	if err != nil {
+		log.Printf("ERROR gRPC callback error %+v\n", err)
+	}
+	return status.Code(err)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	callback "github.com/paidright/sonic/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCallbacks is a Callbacks service answering each call with the next of
+// its codes, and keeping the last one for any calls after that.
+type fakeCallbacks struct {
+	callback.UnimplementedCallbacksServer
+
+	mu       sync.Mutex
+	codes    []codes.Code
+	events   []*callback.TaskEvent
+	metadata []metadata.MD
+}
+
+func (f *fakeCallbacks) Report(ctx context.Context, event *callback.TaskEvent) (*callback.Ack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.events = append(f.events, event)
+	f.metadata = append(f.metadata, md)
+
+	code := f.codes[0]
+	if len(f.codes) > 1 {
+		f.codes = f.codes[1:]
+	}
+	if code != codes.OK {
+		return nil, status.Error(code, "fake callbacks")
+	}
+	return &callback.Ack{}, nil
+}
+
+func (f *fakeCallbacks) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+/*
+ * Serve callbacks on a local port, returning its address and a func to stop
+ * it.
+ */
+func serveGRPC(t *testing.T, callbacks *fakeCallbacks, opts ...grpc.ServerOption) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := grpc.NewServer(opts...)
+	callback.RegisterCallbacksServer(server, callbacks)
+	go server.Serve(listener)
+	return listener.Addr().String(), server.Stop
+}
+
+/*
+ * Point callbacks at a plain text server for callbacks, returning a func to
+ * put things back.
+ */
+func withGRPCEndpoint(t *testing.T, callbacks *fakeCallbacks) func() {
+	addr, stop := serveGRPC(t, callbacks)
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+
+	config.GRPC_CALLBACK_ENDPOINT = "https://" + addr
+	grpcClient = callback.NewCallbacksClient(conn)
+	return func() {
+		config.GRPC_CALLBACK_ENDPOINT = ""
+		config.WEBHOOK_RETRIES = 0
+		grpcClient = nil
+		conn.Close()
+		stop()
+	}
+}
+
+/*
+ * Write a CA, and a server and client certificate it signed, to dir,
+ * returning the server's certificate and a pool with the CA.
+ */
+func writeGRPCTestCerts(t *testing.T, dir string) (tls.Certificate, *x509.CertPool) {
+	expiry := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sonic test ca"},
+		NotAfter:              expiry,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     expiry,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "sonic"},
+		NotAfter:     expiry,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+	return serverCert, pool
+}
+
+func TestGRPCCallback(t *testing.T) {
+	callbacks := &fakeCallbacks{codes: []codes.Code{codes.OK}}
+	defer withGRPCEndpoint(t, callbacks)()
+	config.WEBHOOK_HEADERS = map[string]string{"X-Api-Key": "secret"}
+	defer func() {
+		config.WEBHOOK_HEADERS = map[string]string{}
+	}()
+
+	err := sendWebhook(successWebhook, kewpie.Task{
+		ID: "grpc-task",
+		Tags: kewpie.Tags{
+			"webhook_success": "http://receiver.invalid/success",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, callbacks.calls())
+
+	assert.Equal(t, []string{"secret"}, callbacks.metadata[0].Get("X-Api-Key"))
+
+	event := callbacks.events[0]
+	assert.Equal(t, "success", event.Event)
+	assert.Equal(t, "grpc-task", event.TaskId)
+	assert.Equal(t, "application/json", event.ContentType)
+
+	payload := webhookPayload{}
+	assert.Nil(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, "grpc-task", payload.ID)
+}
+
+func TestGRPCCallbackStatuses(t *testing.T) {
+	for code, expected := range map[codes.Code]error{
+		codes.OK:                 nil,
+		codes.InvalidArgument:    ErrWebhookBadRequest,
+		codes.FailedPrecondition: ErrWebhookBadRequest,
+		codes.Internal:           ErrWebhookServerFailed,
+		codes.Unavailable:        ErrWebhookServerFailed,
+	} {
+		reset := withGRPCEndpoint(t, &fakeCallbacks{codes: []codes.Code{code}})
+		err := sendWebhook(startWebhook, kewpie.Task{ID: "grpc-status"})
+		reset()
+		assert.Equal(t, expected, err, code.String())
+	}
+}
+
+func TestGRPCCallbackRetries(t *testing.T) {
+	callbacks := &fakeCallbacks{codes: []codes.Code{codes.Unavailable, codes.OK}}
+	reset := withGRPCEndpoint(t, callbacks)
+	config.WEBHOOK_RETRIES = 1
+
+	err := sendWebhook(startWebhook, kewpie.Task{ID: "grpc-retry"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, callbacks.calls())
+	reset()
+
+	callbacks = &fakeCallbacks{codes: []codes.Code{codes.Internal}}
+	defer withGRPCEndpoint(t, callbacks)()
+	config.WEBHOOK_RETRIES = 1
+
+	err = sendWebhook(startWebhook, kewpie.Task{ID: "grpc-retry"})
+	assert.Equal(t, ErrWebhookServerFailed, err)
+	assert.Equal(t, 1, callbacks.calls())
+}
+
+func TestGRPCCallbackMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, pool := writeGRPCTestCerts(t, dir)
+	callbacks := &fakeCallbacks{codes: []codes.Code{codes.OK}}
+	addr, stop := serveGRPC(t, callbacks, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	defer stop()
+
+	config.GRPC_CALLBACK_ENDPOINT = "https://" + addr
+	config.WEBHOOK_TLS_CA = filepath.Join(dir, "ca.crt")
+	defer func() {
+		config.GRPC_CALLBACK_ENDPOINT = ""
+		config.WEBHOOK_TLS_CERT = ""
+		config.WEBHOOK_TLS_KEY = ""
+		config.WEBHOOK_TLS_CA = ""
+		grpcClient = nil
+	}()
+
+	// Without a client certificate the endpoint refuses the connection
+	grpcClient, err = newGRPCClient()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrWebhookServerFailed, sendWebhook(successWebhook, kewpie.Task{ID: "grpc-tls"}))
+	assert.Equal(t, 0, callbacks.calls())
+
+	config.WEBHOOK_TLS_CERT = filepath.Join(dir, "client.crt")
+	config.WEBHOOK_TLS_KEY = filepath.Join(dir, "client.key")
+	grpcClient, err = newGRPCClient()
+	assert.Nil(t, err)
+	assert.Nil(t, sendWebhook(successWebhook, kewpie.Task{ID: "grpc-tls"}))
+	assert.Equal(t, 1, callbacks.calls())
+}
+
+func TestGRPCCallbackProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, _ := writeGRPCTestCerts(t, dir)
+	callbacks := &fakeCallbacks{codes: []codes.Code{codes.OK}}
+	addr, stop := serveGRPC(t, callbacks, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})))
+	defer stop()
+
+	tunnelled := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		select {
+		case tunnelled <- r.Host:
+		default:
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, conn)
+		go io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	config.GRPC_CALLBACK_ENDPOINT = "https://" + addr
+	config.WEBHOOK_TLS_CA = filepath.Join(dir, "ca.crt")
+	config.WEBHOOK_PROXY = proxy.URL
+	defer func() {
+		config.GRPC_CALLBACK_ENDPOINT = ""
+		config.WEBHOOK_TLS_CA = ""
+		config.WEBHOOK_PROXY = ""
+		grpcClient = nil
+	}()
+
+	grpcClient, err = newGRPCClient()
+	assert.Nil(t, err)
+	assert.Nil(t, sendWebhook(successWebhook, kewpie.Task{ID: "grpc-proxy"}))
+	assert.Equal(t, addr, <-tunnelled)
+	assert.Equal(t, 1, callbacks.calls())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// heartbeatOutputLimit is how much of the end of a task's combined output is
+// included in its heartbeat webhooks.
+var heartbeatOutputLimit int
+
+// heartbeat sends a task's heartbeat webhooks while its command runs.
+type heartbeat struct {
+	mu         sync.Mutex
+	wasAborted bool
+	stopped    chan struct{}
+	done       chan struct{}
+}
+
+/*
+ * Send the task's heartbeat webhook every HEARTBEAT_INTERVAL until stopped.
+ * The recent output is captured by adding a writer to output. If the
+ * receiver asks for the task to be aborted, abort is called.
+ */
+func startHeartbeat(task kewpie.Task, started time.Time, output *procOutput, abort func()) *heartbeat {
+	h := &heartbeat{
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if task.Tags["webhook_heartbeat"] == "" || config.HEARTBEAT_INTERVAL <= 0 {
+		close(h.done)
+		return h
+	}
+
+	var recent *tailBuffer
+	if heartbeatOutputLimit > 0 {
+		recent = newTailBuffer(heartbeatOutputLimit)
+		if output.combined != nil {
+			output.combined = io.MultiWriter(output.combined, recent)
+		} else {
+			output.combined = recent
+		}
+	}
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(config.HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-h.stopped:
+				return
+			case now := <-ticker.C:
+				payload := newWebhookPayload(task).withHeartbeat(now.Sub(started), recent)
+				err := sendWebhookPayload(heartbeatWebhook, payload)
+				if err == ErrWebhookAbortRequested {
+					log.Printf("INFO aborting task %s at the request of its heartbeat webhook \n", task.ID)
+					h.mu.Lock()
+					h.wasAborted = true
+					h.mu.Unlock()
+					abort()
+					return
+				}
+				if err != nil {
+					log.Printf("ERROR sending heartbeat webhook for task %s: %s \n", task.ID, err.Error())
+				}
+			}
+		}
+	}()
+
+	return h
+}
+
+/*
+ * Stop sending heartbeats, waiting for any in flight so none arrive after
+ * the task's success or fail webhook.
+ */
+func (h *heartbeat) stop() {
+	select {
+	case <-h.done:
+	default:
+		close(h.stopped)
+		<-h.done
+	}
+}
+
+/*
+ * Whether the heartbeat receiver asked for the task to be aborted.
+ */
+func (h *heartbeat) aborted() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.wasAborted
+}
+
+/*
+ * Describe how long the command has been running, and what it has written
+ * recently, in the payload.
+ */
+func (p webhookPayload) withHeartbeat(elapsed time.Duration, recent *tailBuffer) webhookPayload {
+	p.ElapsedSeconds = elapsed.Seconds()
+	if recent != nil {
+		out, truncated := recent.String()
+		p.Output = &out
+		p.OutputTruncated = truncated
+	}
+	return p
+}
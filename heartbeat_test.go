@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatWebhook(t *testing.T) {
+	config.HEARTBEAT_INTERVAL = 100 * time.Millisecond
+	heartbeatOutputLimit = 16
+	defer func() {
+		config.HEARTBEAT_INTERVAL = 30 * time.Second
+		heartbeatOutputLimit = 0
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	var mu sync.Mutex
+	heartbeats := []webhookPayload{}
+	successAt := time.Time{}
+	http.HandleFunc("/"+uniq+"/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		received := webhookPayload{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		mu.Lock()
+		heartbeats = append(heartbeats, received)
+		assert.True(t, successAt.IsZero(), "heartbeat sent after success")
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		successAt = time.Now()
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	_, err := handleTask(context.Background(), kewpie.Task{
+		Body: "sleep 0.35",
+		Tags: kewpie.Tags{
+			"webhook_heartbeat": "http://localhost:" + port + "/" + uniq + "/heartbeat",
+			"webhook_success":   "http://localhost:" + port + "/" + uniq + "/success",
+		},
+	})
+	assert.Nil(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.False(t, successAt.IsZero())
+	if assert.True(t, len(heartbeats) >= 2) {
+		assert.True(t, heartbeats[1].ElapsedSeconds > heartbeats[0].ElapsedSeconds)
+		if assert.NotNil(t, heartbeats[0].Output) {
+			assert.Equal(t, "", *heartbeats[0].Output)
+		}
+		assert.Nil(t, heartbeats[0].ExitCode)
+	}
+}
+
+func TestNoHeartbeatWithoutTag(t *testing.T) {
+	output := procOutput{}
+	startHeartbeat(kewpie.Task{}, time.Now(), &output, func() {}).stop()
+	assert.Nil(t, output.combined)
+}
+
+func TestHeartbeatAbort(t *testing.T) {
+	config.HEARTBEAT_INTERVAL = 50 * time.Millisecond
+	defer func() {
+		config.HEARTBEAT_INTERVAL = 30 * time.Second
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	http.HandleFunc("/"+uniq+"/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	http.HandleFunc("/"+uniq+"/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"abort": true}`))
+	})
+	cancelled := make(chan webhookPayload, 2)
+	http.HandleFunc("/"+uniq+"/cancel", func(w http.ResponseWriter, r *http.Request) {
+		received := webhookPayload{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		cancelled <- received
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, response := range []string{"status", "json"} {
+		started := time.Now()
+		requeue, err := handleTask(context.Background(), kewpie.Task{
+			Body: "sleep 5",
+			Tags: kewpie.Tags{
+				"webhook_heartbeat": "http://localhost:" + port + "/" + uniq + "/" + response,
+				"webhook_cancel":    "http://localhost:" + port + "/" + uniq + "/cancel",
+			},
+		})
+		assert.False(t, requeue)
+		assert.Equal(t, errCodeAborted, newTaskError(err).Code)
+		assert.True(t, time.Since(started) < 2*time.Second)
+
+		received := <-cancelled
+		if assert.NotNil(t, received.Error) {
+			assert.Equal(t, errCodeAborted, received.Error.Code)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// jailTag runs a task in another of the jails listed in JAILS.
+const jailTag = "jail"
+
+/*
+ * The FreeBSD jail a task runs in, if any: its jail tag, or JAIL. Tasks may
+ * only pick jails listed in JAILS, so a producer can't reach into any jail on
+ * the host.
+ */
+func taskJail(task kewpie.Task) (string, error) {
+	jail := task.Tags[jailTag]
+	if jail == "" {
+		return config.JAIL, nil
+	}
+	if jail == config.JAIL {
+		return jail, nil
+	}
+	for _, allowed := range config.JAILS {
+		if jail == allowed {
+			return jail, nil
+		}
+	}
+	return "", TaskError{
+		Code:    errCodeJailRejected,
+		Message: fmt.Sprintf("The jail %s is not one of JAILS", jail),
+		Details: map[string]string{
+			"jail": jail,
+		},
+	}
+}
+
+/*
+ * The command that runs a task's command in a pre-created jail with jexec.
+ * jexec passes its environment through, so the task's env_ tags apply, and
+ * JAIL_USER sets the user inside the jail the command runs as.
+ */
+func jailCommand(jail, command string, args []string) (string, []string) {
+	jexecArgs := []string{}
+	if config.JAIL_USER != "" {
+		jexecArgs = append(jexecArgs, "-U", config.JAIL_USER)
+	}
+	jexecArgs = append(jexecArgs, jail, command)
+	return config.JEXEC, append(jexecArgs, args...)
+}
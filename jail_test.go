@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeJexec prints how it was called and the task's environment, then runs
+// the command on the host.
+const fakeJexec = `#!/bin/sh
+echo "jexec $*"
+echo "GREETING=$GREETING"
+while [ "$1" = "-U" ]; do shift 2; done
+shift
+exec "$@"
+`
+
+func TestJailRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-jexec")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jexec := filepath.Join(dir, "jexec")
+	assert.Nil(t, ioutil.WriteFile(jexec, []byte(fakeJexec), 0755))
+
+	config.JEXEC = jexec
+	config.JAIL = "build"
+	config.JAILS = []string{"sign"}
+	config.JAIL_USER = "builder"
+	defer func() {
+		config.JEXEC = "jexec"
+		config.JAIL = ""
+		config.JAILS = []string{}
+		config.JAIL_USER = ""
+	}()
+
+	output := newTailBuffer(256)
+	task := kewpie.Task{
+		Body: "echo hai",
+		Tags: kewpie.Tags{
+			"env_GREETING": "hello",
+		},
+	}
+	assert.Nil(t, runTaskProcWithOutput(context.Background(), task, procOutput{combined: output}))
+	out, _ := output.String()
+	assert.Equal(t, "jexec -U builder build echo hai\nGREETING=hello\nhai\n", out)
+
+	task.Tags[jailTag] = "sign"
+	jail, err := taskJail(task)
+	assert.Nil(t, err)
+	assert.Equal(t, "sign", jail)
+
+	task.Tags[jailTag] = "prod"
+	taskErr := newTaskError(runTaskProc(context.Background(), task))
+	assert.Equal(t, errCodeJailRejected, taskErr.Code)
+	assert.False(t, taskErr.Retryable)
+}
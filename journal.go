@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// journaledEvents are the webhooks that report how a task ended. Nothing
+// else will tell the producer if they're lost, so they're journaled until
+// delivered.
+var journaledEvents = map[string]bool{
+	"success": true,
+	"fail":    true,
+	"timeout": true,
+	"cancel":  true,
+	"expired": true,
+}
+
+// journaledWebhook is the state persisted for each webhook in the journal.
+type journaledWebhook struct {
+	Event       string      `json:"event"`
+	TagName     string      `json:"tag_name"`
+	TaskID      string      `json:"task_id"`
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	Headers     http.Header `json:"headers"`
+	Payload     []byte      `json:"payload"`
+	JournaledAt time.Time   `json:"journaled_at"`
+	Attempts    int         `json:"attempts"`
+}
+
+// delivering holds the journal entries this process is delivering right now,
+// so the replayer leaves them alone.
+var delivering = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+/*
+ * Webhooks are only journaled when they can be persisted to STATE_DIR.
+ */
+func journalEnabled() bool {
+	return config.STATE_DIR != ""
+}
+
+func journalDir() string {
+	return filepath.Join(config.STATE_DIR, "webhooks")
+}
+
+/*
+ * Deliver a webhook, recording it in the journal first so that it's
+ * delivered after a restart if Sonic dies on the way. Entries are removed
+ * once the receiver answers, unless the receiver failed and keep is set, in
+ * which case the replayer keeps trying.
+ */
+func deliverJournaled(hook journaledWebhook, keep bool) error {
+	path := writeJournal(hook)
+	if path != "" {
+		delivering.Lock()
+		delivering.paths[path] = true
+		delivering.Unlock()
+		defer func() {
+			delivering.Lock()
+			delete(delivering.paths, path)
+			delivering.Unlock()
+		}()
+	}
+
+	err := deliverWebhook(hook.Method, hook.TagName, hook.URL, hook.Headers, hook.Payload)
+	if err != ErrWebhookServerFailed || !keep {
+		clearJournal(path)
+	} else if path != "" {
+		log.Printf("INFO %s webhook for task %s journaled for redelivery \n", hook.Event, hook.TaskID)
+	}
+	return err
+}
+
+/*
+ * Record a webhook in the journal. Returns the path of the entry, which is
+ * empty if the journal is disabled or writing failed.
+ */
+func writeJournal(hook journaledWebhook) string {
+	if !journalEnabled() {
+		return ""
+	}
+
+	if hook.JournaledAt.IsZero() {
+		hook.JournaledAt = time.Now()
+	}
+	contents, err := json.Marshal(hook)
+	if err != nil {
+		log.Printf("ERROR marshalling journaled webhook %+v\n", err)
+		return ""
+	}
+
+	if err := os.MkdirAll(journalDir(), 0700); err != nil {
+		log.Printf("ERROR creating webhook journal dir %s: %s \n", journalDir(), err.Error())
+		reportSubsystemFailure("state", err)
+		return ""
+	}
+
+	path := filepath.Join(journalDir(), hook.JournaledAt.UTC().Format("20060102T150405.000000000")+"-"+uuid.NewV4().String()+".json")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		log.Printf("ERROR writing journaled webhook %s: %s \n", path, err.Error())
+		reportSubsystemFailure("state", err)
+		return ""
+	}
+
+	return path
+}
+
+func clearJournal(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR removing journaled webhook %s: %s \n", path, err.Error())
+	}
+}
+
+/*
+ * Redeliver each journaled webhook, oldest first. Entries that still can't
+ * be delivered after WEBHOOK_JOURNAL_MAX_AGE are dropped.
+ */
+func replayJournal(ctx context.Context) {
+	paths, err := filepath.Glob(filepath.Join(journalDir(), "*.json"))
+	if err != nil {
+		log.Printf("ERROR listing journaled webhooks: %s \n", err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+
+		delivering.Lock()
+		busy := delivering.paths[path]
+		delivering.Unlock()
+		if busy {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("ERROR reading journaled webhook %s: %s \n", path, err.Error())
+			continue
+		}
+		hook := journaledWebhook{}
+		if err := json.Unmarshal(contents, &hook); err != nil {
+			log.Printf("ERROR parsing journaled webhook %s: %s \n", path, err.Error())
+			clearJournal(path)
+			continue
+		}
+
+		log.Printf("INFO redelivering %s webhook for task %s, journaled at %s \n", hook.Event, hook.TaskID, hook.JournaledAt.Format(time.RFC3339))
+		err = deliverWebhook(hook.Method, hook.TagName, hook.URL, hook.Headers, hook.Payload)
+		if err != ErrWebhookServerFailed {
+			clearJournal(path)
+			continue
+		}
+
+		if time.Since(hook.JournaledAt) > config.WEBHOOK_JOURNAL_MAX_AGE {
+			log.Printf("ERROR dropping %s webhook for task %s, undelivered since %s \n", hook.Event, hook.TaskID, hook.JournaledAt.Format(time.RFC3339))
+			incCounter("sonic_webhook_journal_dropped_total", map[string]string{"event": hook.Event})
+			clearJournal(path)
+			continue
+		}
+
+		hook.Attempts++
+		if contents, err := json.Marshal(hook); err == nil {
+			ioutil.WriteFile(path, contents, 0600)
+		}
+	}
+}
+
+/*
+ * Redeliver journaled webhooks straight away, to pick up any left by a
+ * previous run of Sonic, and then every WEBHOOK_JOURNAL_INTERVAL.
+ */
+func watchJournal(ctx context.Context) {
+	if !journalEnabled() {
+		return
+	}
+
+	for {
+		replayJournal(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.WEBHOOK_JOURNAL_INTERVAL):
+		}
+	}
+}
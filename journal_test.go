@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withJournal(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sonic-journal-")
+	assert.Nil(t, err)
+
+	config.STATE_DIR = dir
+	return func() {
+		config.STATE_DIR = ""
+		config.WEBHOOK_JOURNAL_MAX_AGE = 24 * time.Hour
+		os.RemoveAll(dir)
+	}
+}
+
+func journaledWebhooks(t *testing.T) []string {
+	paths, err := filepath.Glob(filepath.Join(journalDir(), "*.json"))
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestJournalRedeliversFailedWebhooks(t *testing.T) {
+	defer withJournal(t)()
+
+	status := http.StatusServiceUnavailable
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		ID: "journal-test",
+		Tags: kewpie.Tags{
+			"webhook_fail": server.URL,
+		},
+	}
+	assert.Equal(t, ErrWebhookServerFailed, sendWebhook(failWebhook, task))
+	assert.Len(t, journaledWebhooks(t), 1)
+
+	replayJournal(context.Background())
+	assert.Len(t, journaledWebhooks(t), 1)
+
+	status = http.StatusOK
+	replayJournal(context.Background())
+	assert.Len(t, journaledWebhooks(t), 0)
+	assert.Equal(t, 3, received)
+}
+
+func TestJournalClearsDeliveredWebhooks(t *testing.T) {
+	defer withJournal(t)()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_start":   server.URL,
+			"webhook_success": server.URL,
+		},
+	}
+	assert.Nil(t, sendWebhook(startWebhook, task))
+	assert.Nil(t, sendWebhook(successWebhook, task))
+	assert.Len(t, journaledWebhooks(t), 0)
+}
+
+func TestJournalReplaysAfterRestart(t *testing.T) {
+	defer withJournal(t)()
+
+	body := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, _ := ioutil.ReadAll(r.Body)
+		body = string(contents)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// As left behind by a process that died mid delivery
+	assert.NotEqual(t, "", writeJournal(journaledWebhook{
+		Event:   "success",
+		TagName: "webhook_success",
+		Method:  http.MethodPost,
+		URL:     server.URL,
+		Headers: http.Header{},
+		Payload: []byte(`{"id":"restarted"}`),
+	}))
+
+	replayJournal(context.Background())
+	assert.Equal(t, `{"id":"restarted"}`, body)
+	assert.Len(t, journaledWebhooks(t), 0)
+}
+
+func TestJournalDropsExpiredWebhooks(t *testing.T) {
+	defer withJournal(t)()
+	config.WEBHOOK_JOURNAL_MAX_AGE = time.Hour
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	writeJournal(journaledWebhook{
+		Event:       "fail",
+		TagName:     "webhook_fail",
+		Method:      http.MethodPost,
+		URL:         server.URL,
+		Headers:     http.Header{},
+		JournaledAt: time.Now().Add(-2 * time.Hour),
+	})
+
+	dropped := counterValue("sonic_webhook_journal_dropped_total", map[string]string{"event": "fail"})
+	replayJournal(context.Background())
+	assert.Len(t, journaledWebhooks(t), 0)
+	assert.Equal(t, dropped+1, counterValue("sonic_webhook_journal_dropped_total", map[string]string{"event": "fail"}))
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// kafkaSessionTimeout is how long the group coordinator waits without a
+// heartbeat before it decides a worker has died and rebalances its
+// partitions onto the rest of the group.
+const kafkaSessionTimeout = 30 * time.Second
+
+// kafkaHeartbeatInterval is how often a worker tells the coordinator it's
+// alive, including while a task runs.
+const kafkaHeartbeatInterval = 3 * time.Second
+
+// kafkaRetryPause is how long a partition is left alone after its next task
+// couldn't be requeued, before the task is handled again.
+const kafkaRetryPause = 5 * time.Second
+
+// kafkaRequestTimeout bounds every request to the brokers.
+const kafkaRequestTimeout = 30 * time.Second
+
+// ErrKafkaClosed is returned for operations on a closed Kafka connection.
+var ErrKafkaClosed = fmt.Errorf("The connection to Kafka is closed")
+
+// kafkaPartition identifies a partition of a topic.
+type kafkaPartition struct {
+	topic     string
+	partition int
+}
+
+// kafkaPending is a fetched record waiting to be handled, and when it's next
+// due to be looked at.
+type kafkaPending struct {
+	message kafka.Message
+	due     time.Time
+}
+
+// kafkaQueue is a queue backend on Kafka. Each queue is a topic of the same
+// name, consumed by a consumer group named KAFKA_GROUP so each partition,
+// and so each task, goes to one worker. Delayed tasks and retries wait in a
+// second topic, <queue>.delayed, which the group consumes too. A task's
+// offset is only committed once its handler returns, so a worker dying
+// mid-task leaves it to run again elsewhere.
+type kafkaQueue struct {
+	mu      sync.Mutex
+	client  *kafka.Client
+	writer  *kafka.Writer
+	dialer  *kafka.Dialer
+	reader  *kafka.Reader
+	topics  []string
+	closed  chan struct{}
+	order   []kafkaPartition
+	pending map[kafkaPartition][]kafkaPending
+	fetched map[kafkaPartition]int64
+}
+
+/*
+ * Connect to KAFKA_BROKERS and make sure each queue's topic exists, creating
+ * its delayed topic alongside it if need be. Workers don't join the consumer
+ * group until they first pop a task, so publishing alone, as the gateway
+ * does, doesn't trigger a rebalance.
+ */
+func (k *kafkaQueue) Connect(backend string, queues []string, connection interface{}) error {
+	mechanism, err := kafkaSASL()
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if config.KAFKA_TLS {
+		tlsConfig = &tls.Config{}
+	}
+
+	transport := &kafka.Transport{
+		TLS:      tlsConfig,
+		SASL:     mechanism,
+		ClientID: "sonic",
+	}
+	k.client = &kafka.Client{
+		Addr:      kafka.TCP(config.KAFKA_BROKERS...),
+		Timeout:   kafkaRequestTimeout,
+		Transport: transport,
+	}
+	k.writer = &kafka.Writer{
+		Addr:         kafka.TCP(config.KAFKA_BROKERS...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: time.Millisecond,
+		WriteTimeout: kafkaRequestTimeout,
+		Transport:    transport,
+		ErrorLogger:  kafkaErrorLogger,
+	}
+	k.dialer = &kafka.Dialer{
+		ClientID:      "sonic",
+		Timeout:       kafkaRequestTimeout,
+		DualStack:     true,
+		TLS:           tlsConfig,
+		SASLMechanism: mechanism,
+	}
+	k.closed = make(chan struct{})
+	k.order = []kafkaPartition{}
+	k.pending = map[kafkaPartition][]kafkaPending{}
+	k.fetched = map[kafkaPartition]int64{}
+	k.topics = []string{}
+	for _, name := range queues {
+		k.topics = append(k.topics, name, kafkaDelayed(name))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaRequestTimeout)
+	defer cancel()
+	partitions, err := k.partitions(ctx, k.topics)
+	if err != nil {
+		return err
+	}
+	for _, name := range queues {
+		if _, ok := partitions[name]; !ok {
+			return fmt.Errorf("Kafka topic %s doesn't exist", name)
+		}
+		if _, ok := partitions[kafkaDelayed(name)]; !ok {
+			if err := k.createTopic(kafkaDelayed(name), partitions[name]); err != nil {
+				return err
+			}
+			log.Printf("INFO created Kafka topic %s for queue %s \n", kafkaDelayed(name), name)
+		}
+	}
+	return nil
+}
+
+/*
+ * Leave the consumer group, so its partitions are reassigned straight away
+ * rather than after the session times out, and close every connection.
+ */
+func (k *kafkaQueue) Disconnect() error {
+	if k.closed == nil {
+		return nil
+	}
+
+	k.mu.Lock()
+	select {
+	case <-k.closed:
+		k.mu.Unlock()
+		return nil
+	default:
+	}
+	close(k.closed)
+	reader := k.reader
+	k.mu.Unlock()
+
+	var err error
+	if reader != nil {
+		err = reader.Close()
+	}
+	if writeErr := k.writer.Close(); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+/*
+ * Check a broker is answering.
+ */
+func (k *kafkaQueue) Healthy(ctx context.Context) error {
+	_, err := k.partitions(ctx, k.topics)
+	return err
+}
+
+/*
+ * Publish a task to a queue's topic, waiting for every in-sync replica to
+ * store it. Delayed tasks go to the queue's delayed topic instead, and are
+ * held there until they're due. Tasks are spread over the topic's
+ * partitions by ID.
+ */
+func (k *kafkaQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	topic := queueName
+	if payload.Delay >= time.Millisecond {
+		topic = kafkaDelayed(queueName)
+	}
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic,
+		Key:   []byte(payload.ID),
+		Value: body,
+	})
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done.
+ */
+func (k *kafkaQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := k.Pop(ctx, queueName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the next due task on a queue, from the partitions of its topics
+ * this worker is assigned, and handle it. Kafka keeps no per-message state,
+ * so a task that isn't due yet holds up the rest of its partition until it
+ * is, and redeliveries after a worker died can't be told apart from first
+ * deliveries.
+ */
+func (k *kafkaQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	reader := k.join()
+	for {
+		select {
+		case <-k.closed:
+			return ErrKafkaClosed
+		default:
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		part, pending, wake, ok := k.next(queueName)
+		if !ok {
+			if err := k.fetch(ctx, reader, wake); err != nil {
+				return err
+			}
+			continue
+		}
+		message := pending.message
+
+		task := kewpie.Task{}
+		if err := json.Unmarshal(message.Value, &task); err != nil {
+			log.Printf("ERROR skipping a record at %s/%d offset %d that isn't a task: %s \n", message.Topic, message.Partition, message.Offset, err.Error())
+			k.commit(reader, part)
+			continue
+		}
+
+		if time.Until(task.RunAt) > 0 {
+			if part.topic == kafkaDelayed(queueName) {
+				k.pause(part, task.RunAt)
+				continue
+			}
+			// Published to the queue's topic by something other than Sonic
+			if err := k.Publish(ctx, queueName, &task); err != nil {
+				return err
+			}
+			k.commit(reader, part)
+			continue
+		}
+
+		return k.handle(reader, queueName, part, task, handler)
+	}
+}
+
+func (k *kafkaQueue) handle(reader *kafka.Reader, queueName string, part kafkaPartition, task kewpie.Task, handler types.Handler) error {
+	requeue, err := handler.Handle(task)
+
+	if err != nil && requeue {
+		log.Println("ERROR kewpie task handler", err)
+		task.Attempts++
+		task.RunAt = time.Time{}
+		task.Delay = 0
+		if !task.NoExpBackoff {
+			task.Delay = util.CalcBackoff(task.Attempts + 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaRequestTimeout)
+		defer cancel()
+		if err := k.Publish(ctx, queueName, &task); err != nil {
+			// Leave the offset uncommitted so the task runs again
+			log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+			k.pause(part, time.Now().Add(kafkaRetryPause))
+			return nil
+		}
+	}
+	k.commit(reader, part)
+	return nil
+}
+
+/*
+ * The reader for the consumer group, joining it on first use. The group is
+ * rejoined by the reader whenever it rebalances, including while a task
+ * runs.
+ */
+func (k *kafkaQueue) join() *kafka.Reader {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.reader == nil {
+		k.reader = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:           config.KAFKA_BROKERS,
+			GroupID:           config.KAFKA_GROUP,
+			GroupTopics:       k.topics,
+			Dialer:            k.dialer,
+			MinBytes:          1,
+			MaxBytes:          4 << 20,
+			MaxWait:           config.KAFKA_FETCH_WAIT,
+			GroupBalancers:    []kafka.GroupBalancer{kafka.RangeGroupBalancer{}},
+			HeartbeatInterval: kafkaHeartbeatInterval,
+			SessionTimeout:    kafkaSessionTimeout,
+			RebalanceTimeout:  config.KAFKA_REBALANCE_TIMEOUT,
+			StartOffset:       kafka.FirstOffset,
+			ErrorLogger:       kafkaErrorLogger,
+		})
+	}
+	return k.reader
+}
+
+/*
+ * The first record waiting on one of a queue's partitions that's due.
+ * Partitions are taken in turn, so one busy partition doesn't starve the
+ * others. If none are due, returns when the next one will be, or when to
+ * stop waiting on a fetch and look again.
+ */
+func (k *kafkaQueue) next(queueName string) (kafkaPartition, kafkaPending, time.Time, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	wake := time.Now().Add(config.KAFKA_FETCH_WAIT)
+	for n := len(k.order); n > 0; n-- {
+		part := k.order[0]
+		k.order = append(k.order[1:], part)
+		if part.topic != queueName && part.topic != kafkaDelayed(queueName) {
+			continue
+		}
+		if len(k.pending[part]) == 0 {
+			continue
+		}
+		head := k.pending[part][0]
+		if time.Now().Before(head.due) {
+			if head.due.Before(wake) {
+				wake = head.due
+			}
+			continue
+		}
+		return part, head, wake, true
+	}
+	return kafkaPartition{}, kafkaPending{}, wake, false
+}
+
+/*
+ * Wait until wake for another record from the group's partitions, and add
+ * it to those waiting on its partition. Records fetched again after a
+ * rebalance, which are already waiting or handled, are dropped.
+ */
+func (k *kafkaQueue) fetch(ctx context.Context, reader *kafka.Reader, wake time.Time) error {
+	fetchCtx, cancel := context.WithDeadline(ctx, wake)
+	defer cancel()
+
+	message, err := reader.FetchMessage(fetchCtx)
+	if err == io.EOF {
+		return ErrKafkaClosed
+	}
+	if err != nil {
+		if fetchCtx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	k.add(message)
+	return nil
+}
+
+func (k *kafkaQueue) add(message kafka.Message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	part := kafkaPartition{topic: message.Topic, partition: message.Partition}
+	next, ok := k.fetched[part]
+	if ok && message.Offset < next {
+		return
+	}
+	if !ok {
+		k.order = append(k.order, part)
+	}
+	k.fetched[part] = message.Offset + 1
+	k.pending[part] = append(k.pending[part], kafkaPending{message: message})
+}
+
+/*
+ * Leave a partition's next record where it is until the given time.
+ */
+func (k *kafkaQueue) pause(part kafkaPartition, until time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.pending[part]) > 0 {
+		k.pending[part][0].due = until
+	}
+}
+
+/*
+ * Commit the offset past a partition's next record. If the group has
+ * rebalanced in the meantime, the task may run again on whichever worker
+ * now has the partition.
+ */
+func (k *kafkaQueue) commit(reader *kafka.Reader, part kafkaPartition) {
+	k.mu.Lock()
+	if len(k.pending[part]) == 0 {
+		k.mu.Unlock()
+		return
+	}
+	message := k.pending[part][0].message
+	k.pending[part] = k.pending[part][1:]
+	k.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaRequestTimeout)
+	defer cancel()
+	if err := reader.CommitMessages(ctx, message); err != nil {
+		log.Printf("ERROR committing offset %d of %s/%d, the task may run again: %s \n", message.Offset, message.Topic, message.Partition, err.Error())
+	}
+}
+
+/*
+ * Look up the number of partitions of each of the given topics that exists.
+ */
+func (k *kafkaQueue) partitions(ctx context.Context, topics []string) (map[string]int, error) {
+	select {
+	case <-k.closed:
+		return nil, ErrKafkaClosed
+	default:
+	}
+
+	metadata, err := k.client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := map[string]int{}
+	for _, topic := range metadata.Topics {
+		if errors.Is(topic.Error, kafka.UnknownTopicOrPartition) {
+			continue
+		}
+		if topic.Error != nil && !errors.Is(topic.Error, kafka.LeaderNotAvailable) {
+			return nil, fmt.Errorf("Looking up Kafka topic %s: %s", topic.Name, topic.Error)
+		}
+		partitions[topic.Name] = len(topic.Partitions)
+	}
+	return partitions, nil
+}
+
+/*
+ * Create a topic with the cluster's default replication.
+ */
+func (k *kafkaQueue) createTopic(topic string, partitions int) error {
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaRequestTimeout)
+	defer cancel()
+	response, err := k.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{
+		Topics: []kafka.TopicConfig{{
+			Topic:             topic,
+			NumPartitions:     partitions,
+			ReplicationFactor: -1,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := response.Errors[topic]; err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return fmt.Errorf("Creating Kafka topic %s: %s", topic, err)
+	}
+	return nil
+}
+
+/*
+ * The SASL mechanism to authenticate with, if KAFKA_SASL_MECHANISM is set.
+ * PLAIN sends the password as it is, so it should only be used with
+ * KAFKA_TLS. SCRAM never sends it, and checks the broker knows it too.
+ */
+func kafkaSASL() (sasl.Mechanism, error) {
+	switch config.KAFKA_SASL_MECHANISM {
+	case "":
+		return nil, nil
+	case "PLAIN":
+		return plain.Mechanism{
+			Username: config.KAFKA_SASL_USERNAME,
+			Password: config.KAFKA_SASL_PASSWORD,
+		}, nil
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, config.KAFKA_SASL_USERNAME, config.KAFKA_SASL_PASSWORD)
+	default:
+		return scram.Mechanism(scram.SHA256, config.KAFKA_SASL_USERNAME, config.KAFKA_SASL_PASSWORD)
+	}
+}
+
+// kafkaErrorLogger logs errors the Kafka client recovers from by itself,
+// such as losing a broker connection.
+var kafkaErrorLogger = kafka.LoggerFunc(func(msg string, args ...interface{}) {
+	log.Printf("ERROR kafka: "+msg+" \n", args...)
+})
+
+func kafkaDelayed(queueName string) string {
+	return queueName + ".delayed"
+}
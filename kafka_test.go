@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKafkaQueue() *kafkaQueue {
+	return &kafkaQueue{
+		topics:  []string{"kafka_test", "kafka_test.delayed"},
+		closed:  make(chan struct{}),
+		order:   []kafkaPartition{},
+		pending: map[kafkaPartition][]kafkaPending{},
+		fetched: map[kafkaPartition]int64{},
+	}
+}
+
+func TestKafkaQueuePending(t *testing.T) {
+	client := newTestKafkaQueue()
+	first := kafkaPartition{topic: "kafka_test", partition: 0}
+	delayed := kafkaPartition{topic: "kafka_test.delayed", partition: 1}
+
+	client.add(kafka.Message{Topic: "kafka_test", Partition: 0, Offset: 4})
+	client.add(kafka.Message{Topic: "kafka_test.delayed", Partition: 1, Offset: 7})
+	client.add(kafka.Message{Topic: "kafka_test.delayed", Partition: 1, Offset: 8})
+	client.add(kafka.Message{Topic: "other", Partition: 0, Offset: 1})
+
+	// Fetched again after a rebalance
+	client.add(kafka.Message{Topic: "kafka_test", Partition: 0, Offset: 4})
+	assert.Equal(t, 1, len(client.pending[first]))
+
+	// A delayed record that isn't due holds up the rest of its partition
+	due := time.Now().Add(50 * time.Millisecond)
+	client.pause(delayed, due)
+
+	part, pending, _, ok := client.next("kafka_test")
+	assert.True(t, ok)
+	assert.Equal(t, first, part)
+	assert.Equal(t, int64(4), pending.message.Offset)
+	client.pending[first] = nil
+
+	_, _, wake, ok := client.next("kafka_test")
+	assert.False(t, ok)
+	assert.Equal(t, due, wake)
+
+	time.Sleep(time.Until(due))
+	part, pending, _, ok = client.next("kafka_test")
+	assert.True(t, ok)
+	assert.Equal(t, delayed, part)
+	assert.Equal(t, int64(7), pending.message.Offset)
+
+	// Other queues' records are left for them
+	_, _, _, ok = client.next("missing")
+	assert.False(t, ok)
+	part, _, _, ok = client.next("other")
+	assert.True(t, ok)
+	assert.Equal(t, "other", part.topic)
+}
+
+func TestKafkaSASL(t *testing.T) {
+	mechanism, err := kafkaSASL()
+	assert.Nil(t, err)
+	assert.Nil(t, mechanism)
+
+	for _, name := range []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		reset := withKafkaSASL(name, "sonic", "hunter2")
+		mechanism, err := kafkaSASL()
+		reset()
+		assert.Nil(t, err)
+		assert.Equal(t, name, mechanism.Name())
+	}
+}
+
+func withKafkaSASL(mechanism, username, password string) func() {
+	config.KAFKA_SASL_MECHANISM = mechanism
+	config.KAFKA_SASL_USERNAME = username
+	config.KAFKA_SASL_PASSWORD = password
+	return func() {
+		config.KAFKA_SASL_MECHANISM = ""
+		config.KAFKA_SASL_USERNAME = ""
+		config.KAFKA_SASL_PASSWORD = ""
+	}
+}
+
+/*
+ * Run a task through a real Kafka cluster, with whatever authentication it
+ * needs, when KAFKA_TEST_BROKERS is set, eg. to localhost:9092. Set
+ * KAFKA_TEST_TLS=true and KAFKA_TEST_SASL_MECHANISM, KAFKA_TEST_SASL_USERNAME
+ * and KAFKA_TEST_SASL_PASSWORD to match the brokers' listener. A topic is
+ * created for the test.
+ */
+func TestKafkaQueueAgainstBrokers(t *testing.T) {
+	brokers := os.Getenv("KAFKA_TEST_BROKERS")
+	if brokers == "" {
+		t.Skip("KAFKA_TEST_BROKERS isn't set")
+	}
+	config.KAFKA_BROKERS = strings.Split(brokers, ",")
+	config.KAFKA_GROUP = "sonic_test"
+	config.KAFKA_REBALANCE_TIMEOUT = time.Minute
+	config.KAFKA_TLS = os.Getenv("KAFKA_TEST_TLS") == "true"
+	defer func() {
+		config.KAFKA_TLS = false
+	}()
+	defer withKafkaSASL(
+		os.Getenv("KAFKA_TEST_SASL_MECHANISM"),
+		os.Getenv("KAFKA_TEST_SASL_USERNAME"),
+		os.Getenv("KAFKA_TEST_SASL_PASSWORD"),
+	)()
+
+	queueName := "sonic_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	admin := &kafkaQueue{}
+	assert.Nil(t, admin.Connect("kafka", []string{}, nil))
+	assert.Nil(t, admin.createTopic(queueName, 1))
+	admin.Disconnect()
+
+	client := &kafkaQueue{}
+	assert.Nil(t, client.Connect("kafka", []string{queueName}, nil))
+	defer client.Disconnect()
+	assert.Nil(t, client.Healthy(context.Background()))
+
+	pop := func(handle func(task kewpie.Task) (bool, error)) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		assert.Nil(t, client.Pop(ctx, queueName, cliHandler{handleFunc: handle}))
+	}
+
+	assert.Nil(t, client.Publish(context.Background(), queueName, &kewpie.Task{
+		ID:           "3f0c2b8e-9d4a-4c6e-b1f7-5a8d2e9c0b3a",
+		Body:         "exit 1",
+		NoExpBackoff: true,
+	}))
+
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "3f0c2b8e-9d4a-4c6e-b1f7-5a8d2e9c0b3a", task.ID)
+		assert.Equal(t, 0, task.Attempts)
+		return true, fmt.Errorf("exit status 1")
+	})
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "3f0c2b8e-9d4a-4c6e-b1f7-5a8d2e9c0b3a", task.ID)
+		assert.Equal(t, 1, task.Attempts)
+		return false, nil
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// labelTagPrefix marks tags that describe a task for observability, eg.
+// label_team=billing. They're copied into metrics, log lines and the
+// command's environment.
+const labelTagPrefix = "label_"
+
+// otherLabelValue stands in for label values past LABEL_MAX_VALUES.
+const otherLabelValue = "other"
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// seenLabels tracks the label names and values used in metrics so far, to
+// bound the number of series they can create.
+var seenLabels = struct {
+	sync.Mutex
+	values map[string]map[string]bool
+}{values: map[string]map[string]bool{}}
+
+/*
+ * The task's labels, keyed by name without the label_ prefix. Names that
+ * can't be used as metric labels or environment variables are left out.
+ */
+func taskLabels(task kewpie.Task) map[string]string {
+	labels := map[string]string{}
+	for tag, value := range task.Tags {
+		name := strings.TrimPrefix(tag, labelTagPrefix)
+		if name == tag || !labelNamePattern.MatchString(name) {
+			continue
+		}
+		labels[name] = value
+	}
+	return labels
+}
+
+/*
+ * Add the task's labels to a metric's own labels. Only the first
+ * LABEL_MAX_NAMES label names are ever used, and values past the first
+ * LABEL_MAX_VALUES for each name are reported as "other", as every distinct
+ * combination is kept forever.
+ */
+func metricLabels(task kewpie.Task, labels map[string]string) map[string]string {
+	merged := map[string]string{}
+	for name, value := range labels {
+		merged[name] = value
+	}
+
+	seenLabels.Lock()
+	defer seenLabels.Unlock()
+
+	for name, value := range taskLabels(task) {
+		values, ok := seenLabels.values[name]
+		if !ok {
+			if len(seenLabels.values) >= config.LABEL_MAX_NAMES {
+				continue
+			}
+			values = map[string]bool{}
+			seenLabels.values[name] = values
+		}
+		if !values[value] {
+			if len(values) >= config.LABEL_MAX_VALUES {
+				value = otherLabelValue
+			} else {
+				values[value] = true
+			}
+		}
+		merged[labelTagPrefix+name] = value
+	}
+
+	return merged
+}
+
+/*
+ * The task's labels as SONIC_LABEL_<NAME>=value environment variables, so
+ * the command can tag its own telemetry the same way.
+ */
+func labelEnv(task kewpie.Task) []string {
+	env := []string{}
+	for name, value := range taskLabels(task) {
+		env = append(env, "SONIC_LABEL_"+strings.ToUpper(name)+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+/*
+ * The task's labels as space separated label_<name>=value fields for log
+ * lines, with a leading space if there are any.
+ */
+func labelFields(task kewpie.Task) string {
+	labels := taskLabels(task)
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := ""
+	for _, name := range names {
+		fields += " " + labelTagPrefix + name + "=" + quoteLabelValue(labels[name])
+	}
+	return fields
+}
+
+func quoteLabelValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+	}
+	return value
+}
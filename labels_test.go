@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskLabels(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"label_team":   "billing",
+			"label_bad-ne": "x",
+			"label_":       "x",
+			"env_FOO":      "bar",
+		},
+	}
+	assert.Equal(t, map[string]string{"team": "billing"}, taskLabels(task))
+	assert.Equal(t, []string{"SONIC_LABEL_TEAM=billing"}, labelEnv(task))
+	assert.Equal(t, " label_team=billing", labelFields(task))
+	assert.Contains(t, taskEnv(task), "SONIC_LABEL_TEAM=billing")
+}
+
+func TestLabelFieldsQuoting(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"label_pipeline": "nightly run",
+			"label_env":      "",
+		},
+	}
+	assert.Equal(t, ` label_env="" label_pipeline="nightly run"`, labelFields(task))
+}
+
+func TestMetricLabelCardinality(t *testing.T) {
+	config.LABEL_MAX_NAMES = len(seenLabels.values) + 1
+	config.LABEL_MAX_VALUES = 2
+	defer func() {
+		config.LABEL_MAX_NAMES = 10
+		config.LABEL_MAX_VALUES = 100
+	}()
+
+	labelled := func(tags kewpie.Tags) map[string]string {
+		return metricLabels(kewpie.Task{Tags: tags}, map[string]string{"result": "success"})
+	}
+
+	assert.Equal(t, map[string]string{"result": "success", "label_cardinality": "a"}, labelled(kewpie.Tags{"label_cardinality": "a"}))
+	assert.Equal(t, "b", labelled(kewpie.Tags{"label_cardinality": "b"})["label_cardinality"])
+	assert.Equal(t, otherLabelValue, labelled(kewpie.Tags{"label_cardinality": "c"})["label_cardinality"])
+	assert.Equal(t, "a", labelled(kewpie.Tags{"label_cardinality": "a"})["label_cardinality"])
+
+	// Past LABEL_MAX_NAMES new names are left out entirely
+	assert.Equal(t, map[string]string{"result": "success"}, labelled(kewpie.Tags{"label_another": "a"}))
+}
+
+func TestTaskResultMetric(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"label_metric_test": "mmm",
+		},
+	}
+	before := counterValue("sonic_tasks_total", map[string]string{"result": "success", "label_metric_test": "mmm"})
+	recordTaskResult(task, nil, 0)
+	assert.Equal(t, before+1, counterValue("sonic_tasks_total", map[string]string{"result": "success", "label_metric_test": "mmm"}))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+
+	"github.com/paidright/sonic/config"
+)
+
+/*
+ * Whether Sonic was started by launchd, which sets XPC_SERVICE_NAME for the
+ * jobs it runs.
+ */
+func underLaunchd() bool {
+	name := os.Getenv("XPC_SERVICE_NAME")
+	return name != "" && name != "0" && os.Getppid() == 1
+}
+
+/*
+ * Copy Sonic's log to the system log, where unified logging picks it up so
+ * it can be read with `log show` or Console, rather than only going to the
+ * job's StandardErrorPath. By default this happens when running under
+ * launchd.
+ */
+func setupUnifiedLogging() error {
+	if config.UNIFIED_LOGGING == "false" || (config.UNIFIED_LOGGING == "auto" && !underLaunchd()) {
+		return nil
+	}
+
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "sonic")
+	if err != nil {
+		return err
+	}
+
+	logOutput = io.MultiWriter(logOutput, syslogLevelWriter{writer})
+	log.SetOutput(logOutput)
+	return nil
+}
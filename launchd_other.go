@@ -0,0 +1,21 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/paidright/sonic/config"
+)
+
+// ErrUnifiedLoggingUnsupported is returned when unified logging is enabled
+// anywhere but macOS.
+var ErrUnifiedLoggingUnsupported = fmt.Errorf("Unified logging is only supported on macOS")
+
+func setupUnifiedLogging() error {
+	if config.UNIFIED_LOGGING == "true" {
+		return ErrUnifiedLoggingUnsupported
+	}
+	return nil
+}
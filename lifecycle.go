@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Phases of a task's lifecycle recorded in the lifecycle journal. A task is
+// started once its start webhook has been accepted, and finished once its
+// command has exited but before its outcome has been reported.
+const (
+	phaseStarted  = "started"
+	phaseFinished = "finished"
+)
+
+// lifecycleEntry is the state persisted for each task between its start
+// webhook and the webhook reporting its outcome.
+type lifecycleEntry struct {
+	Task      kewpie.Task `json:"task"`
+	Phase     string      `json:"phase"`
+	StartedAt time.Time   `json:"started_at"`
+	ErrorCode string      `json:"error_code,omitempty"`
+	ExitCode  *int        `json:"exit_code,omitempty"`
+}
+
+// lifecycle is a task's entry in the lifecycle journal. A nil lifecycle
+// records nothing.
+type lifecycle struct {
+	path  string
+	entry lifecycleEntry
+}
+
+func lifecycleDir() string {
+	return filepath.Join(config.STATE_DIR, "lifecycle")
+}
+
+/*
+ * Record that a task has started, before its command runs. Returns nil if
+ * STATE_DIR isn't set or the entry couldn't be written.
+ */
+func startLifecycle(task kewpie.Task) *lifecycle {
+	if config.STATE_DIR == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(lifecycleDir(), 0700); err != nil {
+		log.Printf("ERROR creating lifecycle dir %s: %s \n", lifecycleDir(), err.Error())
+		return nil
+	}
+
+	l := &lifecycle{
+		path:  filepath.Join(lifecycleDir(), uuid.NewV4().String()+".json"),
+		entry: lifecycleEntry{Task: task, Phase: phaseStarted, StartedAt: time.Now()},
+	}
+	if !l.write() {
+		return nil
+	}
+	return l
+}
+
+/*
+ * Record that the task's command has finished, before its outcome is
+ * reported.
+ */
+func (l *lifecycle) finished(err error) {
+	if l == nil {
+		return
+	}
+
+	l.entry.Phase = phaseFinished
+	if err != nil {
+		l.entry.ErrorCode = newTaskError(err).Code
+	}
+	if code, ok := routingExitCode(err); ok || err == nil {
+		l.entry.ExitCode = &code
+	}
+	l.write()
+}
+
+/*
+ * Remove the task's entry once its outcome has been reported, or handed to
+ * the webhook journal, or the task has been passed on elsewhere.
+ */
+func (l *lifecycle) clear() {
+	if l == nil {
+		return
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR removing lifecycle entry %s: %s \n", l.path, err.Error())
+	}
+}
+
+func (l *lifecycle) write() bool {
+	contents, err := json.Marshal(l.entry)
+	if err != nil {
+		log.Printf("ERROR marshalling lifecycle entry %+v\n", err)
+		return false
+	}
+	if err := ioutil.WriteFile(l.path, contents, 0600); err != nil {
+		log.Printf("ERROR writing lifecycle entry %s: %s \n", l.path, err.Error())
+		return false
+	}
+	return true
+}
+
+/*
+ * Reconcile the lifecycle journal left behind by a previous Sonic process.
+ * Each task it started but never reported the outcome of gets a late fail
+ * webhook, so its producer isn't left waiting on a task that will never
+ * finish. Tasks whose process was still running are left to
+ * restoreInFlight, which is told about them by their IDs in running.
+ */
+func restoreLifecycle(running map[string]bool) {
+	if config.STATE_DIR == "" {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(lifecycleDir(), "*.json"))
+	if err != nil {
+		log.Printf("ERROR listing lifecycle dir %s: %s \n", lifecycleDir(), err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		l := &lifecycle{path: path}
+		contents, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(contents, &l.entry)
+		}
+		if err != nil {
+			log.Printf("ERROR loading lifecycle entry %s: %s \n", path, err.Error())
+			l.clear()
+			continue
+		}
+
+		if l.entry.Task.ID != "" && running[l.entry.Task.ID] {
+			l.clear()
+			continue
+		}
+
+		log.Printf("INFO found task %s %s but never reported, sending a late fail webhook \n", l.entry.Task.ID, l.entry.Phase)
+		failUnreported(l.entry)
+		l.clear()
+	}
+}
+
+func failUnreported(entry lifecycleEntry) {
+	details := map[string]string{
+		"phase":      entry.Phase,
+		"started_at": entry.StartedAt.Format(time.RFC3339),
+	}
+	if entry.ErrorCode != "" {
+		details["error_code"] = entry.ErrorCode
+	}
+	if entry.ExitCode != nil {
+		details["exit_code"] = strconv.Itoa(*entry.ExitCode)
+	}
+
+	payload := webhookPayload{
+		Task: entry.Task,
+		Error: &TaskError{
+			Code:    errCodeInterrupted,
+			Message: "Sonic restarted before reporting the task's outcome",
+			Details: details,
+		},
+	}
+	if err := sendWebhookPayload(failWebhook, payload); err != nil {
+		log.Printf("ERROR sending failure webhook for unreported task %+v\n", entry.Task)
+	}
+}
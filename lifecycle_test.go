@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func lifecycleEntries(t *testing.T) []string {
+	paths, err := filepath.Glob(filepath.Join(lifecycleDir(), "*.json"))
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestLifecycleClearedOnceReported(t *testing.T) {
+	defer withJournal(t)()
+
+	_, err := handleTask(context.Background(), kewpie.Task{Body: "true"})
+	assert.Nil(t, err)
+	assert.Len(t, lifecycleEntries(t), 0)
+}
+
+func TestLifecycleSendsLateFailWebhook(t *testing.T) {
+	defer withJournal(t)()
+
+	failures := []webhookPayload{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := webhookPayload{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		failures = append(failures, payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tags := kewpie.Tags{"webhook_fail": server.URL}
+
+	// A task that exited 3 just before Sonic died
+	finished := startLifecycle(kewpie.Task{ID: "finished", Tags: tags})
+	finished.finished(exec.Command("sh", "-c", "exit 3").Run())
+
+	// A task whose process survived, which restoreInFlight reports
+	startLifecycle(kewpie.Task{ID: "running", Tags: tags})
+
+	restoreLifecycle(map[string]bool{"running": true})
+	assert.Len(t, lifecycleEntries(t), 0)
+
+	assert.Len(t, failures, 1)
+	assert.Equal(t, "finished", failures[0].ID)
+	assert.Equal(t, errCodeInterrupted, failures[0].Error.Code)
+	assert.Equal(t, phaseFinished, failures[0].Error.Details["phase"])
+	assert.Equal(t, "3", failures[0].Error.Details["exit_code"])
+	assert.Equal(t, errCodeProcExited, failures[0].Error.Details["error_code"])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// resourceLimits are the cgroup limits applied to a task. Zero means
+// unlimited.
+type resourceLimits struct {
+	cpus        float64
+	memoryBytes int64
+	pids        int64
+}
+
+func (l resourceLimits) any() bool {
+	return l.cpus > 0 || l.memoryBytes > 0 || l.pids > 0
+}
+
+/*
+ * Work out the limits for a task. The cpu_limit, memory_limit and pids_limit
+ * tags can lower CPU_LIMIT, MEMORY_LIMIT and PIDS_LIMIT for a task but never
+ * raise or remove them, as tags come from producers. Where a limit isn't
+ * configured the tag sets it.
+ */
+func taskLimits(task kewpie.Task) (resourceLimits, error) {
+	limits := resourceLimits{}
+
+	if config.CPU_LIMIT != "" {
+		cpus, err := parseCPULimit(config.CPU_LIMIT)
+		if err != nil {
+			return limits, err
+		}
+		limits.cpus = cpus
+	}
+	if task.Tags["cpu_limit"] != "" {
+		cpus, err := parseCPULimit(task.Tags["cpu_limit"])
+		if err != nil || cpus == 0 {
+			return limits, fmt.Errorf("Invalid cpu_limit tag %q, expected a number of CPUs above zero", task.Tags["cpu_limit"])
+		}
+		if limits.cpus == 0 || cpus < limits.cpus {
+			limits.cpus = cpus
+		}
+	}
+
+	if config.MEMORY_LIMIT != "" {
+		bytes, err := parseByteSize(config.MEMORY_LIMIT)
+		if err != nil {
+			return limits, err
+		}
+		limits.memoryBytes = bytes
+	}
+	if task.Tags["memory_limit"] != "" {
+		bytes, err := parseByteSize(task.Tags["memory_limit"])
+		if err != nil {
+			return limits, err
+		}
+		if bytes == 0 {
+			return limits, fmt.Errorf("Invalid memory_limit tag %q, expected a size above zero", task.Tags["memory_limit"])
+		}
+		if limits.memoryBytes == 0 || bytes < limits.memoryBytes {
+			limits.memoryBytes = bytes
+		}
+	}
+
+	if config.PIDS_LIMIT != "" {
+		count, err := parsePidsLimit(config.PIDS_LIMIT)
+		if err != nil {
+			return limits, err
+		}
+		limits.pids = count
+	}
+	if task.Tags["pids_limit"] != "" {
+		count, err := parsePidsLimit(task.Tags["pids_limit"])
+		if err != nil || count == 0 {
+			return limits, fmt.Errorf("Invalid pids_limit tag %q, expected a number of processes above zero", task.Tags["pids_limit"])
+		}
+		if limits.pids == 0 || count < limits.pids {
+			limits.pids = count
+		}
+	}
+
+	return limits, nil
+}
+
+func parseCPULimit(cpu string) (float64, error) {
+	cpus, err := strconv.ParseFloat(cpu, 64)
+	if err != nil || cpus < 0 {
+		return 0, fmt.Errorf("Invalid cpu limit %q, expected a number of CPUs", cpu)
+	}
+	return cpus, nil
+}
+
+func parsePidsLimit(pids string) (int64, error) {
+	count, err := strconv.ParseInt(pids, 10, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("Invalid pids limit %q, expected a number of processes", pids)
+	}
+	return count, nil
+}
+
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+/*
+ * Parse a size like 512M or 2G into bytes. Units are binary, and an optional
+ * trailing B or iB is accepted, so 512M, 512MB and 512MiB are all equal.
+ */
+func parseByteSize(size string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(size))
+	trimmed = strings.TrimSuffix(strings.TrimSuffix(trimmed, "B"), "I")
+
+	split := strings.IndexFunc(trimmed, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if split == -1 {
+		split = len(trimmed)
+	}
+
+	multiplier, ok := byteSizeUnits[trimmed[split:]]
+	if !ok {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+
+	value, err := strconv.ParseInt(trimmed[:split], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+
+	return value * multiplier, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for size, expected := range map[string]int64{
+		"1024":   1024,
+		"512M":   512 << 20,
+		"512MB":  512 << 20,
+		"512MiB": 512 << 20,
+		"2g":     2 << 30,
+	} {
+		bytes, err := parseByteSize(size)
+		assert.Nil(t, err, size)
+		assert.Equal(t, expected, bytes, size)
+	}
+
+	_, err := parseByteSize("lots")
+	assert.Error(t, err)
+}
+
+func TestTaskLimits(t *testing.T) {
+	config.CPU_LIMIT = "2"
+	config.MEMORY_LIMIT = "1G"
+	defer func() {
+		config.CPU_LIMIT = ""
+		config.MEMORY_LIMIT = ""
+	}()
+
+	limits, err := taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"cpu_limit": "0.5",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, limits.cpus)
+	assert.Equal(t, int64(1<<30), limits.memoryBytes)
+
+	_, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"memory_limit": "heaps",
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestTaskLimitsCantBeRaised(t *testing.T) {
+	config.CPU_LIMIT = "2"
+	config.MEMORY_LIMIT = "1G"
+	defer func() {
+		config.CPU_LIMIT = ""
+		config.MEMORY_LIMIT = ""
+	}()
+
+	limits, err := taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"cpu_limit":    "8",
+			"memory_limit": "16G",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, limits.cpus)
+	assert.Equal(t, int64(1<<30), limits.memoryBytes)
+
+	for _, tag := range []string{"cpu_limit", "memory_limit"} {
+		_, err = taskLimits(kewpie.Task{
+			Tags: kewpie.Tags{
+				tag: "0",
+			},
+		})
+		assert.Error(t, err, tag)
+	}
+
+	// Without a configured limit the tag sets one
+	config.CPU_LIMIT = ""
+	limits, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"cpu_limit": "8",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 8.0, limits.cpus)
+}
+
+func TestTaskPidsLimit(t *testing.T) {
+	config.PIDS_LIMIT = "64"
+	defer func() {
+		config.PIDS_LIMIT = ""
+	}()
+
+	limits, err := taskLimits(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(64), limits.pids)
+	assert.True(t, limits.any())
+
+	limits, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"pids_limit": "8",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), limits.pids)
+
+	_, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"pids_limit": "-1",
+		},
+	})
+	assert.Error(t, err)
+
+	// Tags can't raise the limit, or remove it
+	limits, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"pids_limit": "4096",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(64), limits.pids)
+
+	_, err = taskLimits(kewpie.Task{
+		Tags: kewpie.Tags{
+			"pids_limit": "0",
+		},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// logOutput is where Sonic's log is written: stderr, formatted as LOG_FORMAT
+// asks, and any system logs it's copied to.
+var logOutput io.Writer = os.Stderr
+
+// loggingTasks are the tasks being handled, by ID, so their log lines can
+// be attributed to them.
+var loggingTasks = struct {
+	sync.Mutex
+	tasks map[string]kewpie.Task
+}{tasks: map[string]kewpie.Task{}}
+
+/*
+ * Write the log as JSON objects or logfmt lines, one per line, when
+ * LOG_FORMAT asks for it, rather than as plain text.
+ */
+func setupStructuredLogging() {
+	if config.LOG_FORMAT == "text" {
+		return
+	}
+
+	logOutput = structuredLogWriter{out: os.Stderr, format: config.LOG_FORMAT}
+	log.SetFlags(0)
+	log.SetOutput(logOutput)
+}
+
+/*
+ * Attribute log lines to a task while it's being handled. Returns a function
+ * that stops doing so.
+ */
+func logTask(task kewpie.Task) func() {
+	if task.ID == "" {
+		return func() {}
+	}
+
+	loggingTasks.Lock()
+	loggingTasks.tasks[task.ID] = task
+	loggingTasks.Unlock()
+
+	return func() {
+		loggingTasks.Lock()
+		delete(loggingTasks.tasks, task.ID)
+		loggingTasks.Unlock()
+	}
+}
+
+/*
+ * The task a log line is about: the task being handled whose ID it
+ * mentions first, or failing that the only task being handled.
+ */
+func loggedTask(msg string) (kewpie.Task, bool) {
+	loggingTasks.Lock()
+	defer loggingTasks.Unlock()
+
+	found, first := kewpie.Task{}, -1
+	for id, task := range loggingTasks.tasks {
+		if i := strings.Index(msg, id); i >= 0 && (first < 0 || i < first) {
+			found, first = task, i
+		}
+	}
+	if first >= 0 {
+		return found, true
+	}
+	if len(loggingTasks.tasks) == 1 {
+		for _, task := range loggingTasks.tasks {
+			return task, true
+		}
+	}
+	return kewpie.Task{}, false
+}
+
+// structuredLogWriter rewrites each line from the standard logger with its
+// level, the queue, and the task it's about if there is one.
+type structuredLogWriter struct {
+	out    io.Writer
+	format string
+}
+
+// logField is one field of a structured log line.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func (s structuredLogWriter) Write(p []byte) (int, error) {
+	level, msg := parseLogLine(string(p))
+
+	fields := []logField{
+		{"time", time.Now().UTC().Format(time.RFC3339Nano)},
+		{"level", level},
+		{"msg", msg},
+		{"queue", config.QUEUE},
+	}
+	if task, ok := loggedTask(msg); ok {
+		fields = append(fields, logField{"task_id", task.ID}, logField{"attempt", task.Attempts + 1})
+	}
+
+	var line []byte
+	if s.format == "json" {
+		line = formatJSONLog(fields)
+	} else {
+		line = formatLogfmt(fields)
+	}
+	if _, err := s.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+ * Split a line from the standard logger into its level and message. Lines
+ * are prefixed with INFO or ERROR, and anything else is info.
+ */
+func parseLogLine(line string) (string, string) {
+	msg := strings.TrimSpace(line)
+	for _, level := range []string{"ERROR", "INFO"} {
+		if strings.HasPrefix(strings.ToUpper(msg), level) {
+			return strings.ToLower(level), strings.TrimSpace(msg[len(level):])
+		}
+	}
+	return "info", msg
+}
+
+func formatJSONLog(fields []logField) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString("{")
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			value, _ = json.Marshal(err.Error())
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func formatLogfmt(fields []logField) []byte {
+	pairs := []string{}
+	for _, field := range fields {
+		value := ""
+		switch v := field.value.(type) {
+		case string:
+			value = v
+		case int:
+			value = strconv.Itoa(v)
+		}
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, field.key+"="+value)
+	}
+	return []byte(strings.Join(pairs, " ") + "\n")
+}
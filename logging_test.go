@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLine(t *testing.T) {
+	level, msg := parseLogLine("INFO listening on queue: jobs \n")
+	assert.Equal(t, "info", level)
+	assert.Equal(t, "listening on queue: jobs", msg)
+
+	level, msg = parseLogLine("ERROR queue unhealthy: connection reset \n")
+	assert.Equal(t, "error", level)
+	assert.Equal(t, "queue unhealthy: connection reset", msg)
+
+	level, msg = parseLogLine("Error marshalling JSON oops\n")
+	assert.Equal(t, "error", level)
+	assert.Equal(t, "marshalling JSON oops", msg)
+
+	level, msg = parseLogLine("Sending a http post\n")
+	assert.Equal(t, "info", level)
+	assert.Equal(t, "Sending a http post", msg)
+}
+
+func TestStructuredLogJSON(t *testing.T) {
+	out := bytes.Buffer{}
+	logger := log.New(structuredLogWriter{out: &out, format: "json"}, "", 0)
+
+	logger.Printf("INFO listening on queue: %s \n", config.QUEUE)
+	line := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "listening on queue: "+config.QUEUE, line["msg"])
+	assert.Equal(t, config.QUEUE, line["queue"])
+	assert.NotEmpty(t, line["time"])
+	_, ok := line["task_id"]
+	assert.False(t, ok)
+
+	// The only task being handled owns every line
+	defer logTask(kewpie.Task{ID: "first", Attempts: 2})()
+	out.Reset()
+	logger.Printf("ERROR sending failure webhook \n")
+	line = map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "first", line["task_id"])
+	assert.Equal(t, float64(3), line["attempt"])
+
+	// With more than one, lines go to the task they mention
+	defer logTask(kewpie.Task{ID: "second"})()
+	out.Reset()
+	logger.Printf("INFO urgent task second preempting task first \n")
+	line = map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "second", line["task_id"])
+	assert.Equal(t, float64(1), line["attempt"])
+
+	out.Reset()
+	logger.Printf("INFO reconnected \n")
+	line = map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	_, ok = line["task_id"]
+	assert.False(t, ok)
+}
+
+func TestStructuredLogfmt(t *testing.T) {
+	out := bytes.Buffer{}
+	logger := log.New(structuredLogWriter{out: &out, format: "logfmt"}, "", 0)
+
+	defer logTask(kewpie.Task{ID: "first"})()
+	logger.Printf("ERROR task failed: exit status 1 \n")
+
+	line := out.String()
+	assert.True(t, strings.HasPrefix(line, "time="))
+	assert.True(t, strings.HasSuffix(line, " level=error msg=\"task failed: exit status 1\" queue="+config.QUEUE+" task_id=first attempt=1\n"), line)
+}
@@ -1,22 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	kewpie "github.com/davidbanham/kewpie_go/v3"
 	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
 	"github.com/paidright/sonic/config"
 )
 
@@ -29,33 +32,165 @@ const (
 	startWebhook
 	successWebhook
 	failWebhook
+	timeoutWebhook
+	heartbeatWebhook
+	cancelWebhook
+	retryWebhook
+	expiredWebhook
 )
 
-var queue kewpie.Kewpie
+// Roles the start webhook can play. In authorise mode the receiver decides
+// whether the task runs, and in notify mode it's only told that it has.
+const (
+	startModeAuthorise = "authorise"
+	startModeNotify    = "notify"
+)
+
+var queue = &queueConnection{}
+
+var rlimits []rlimitSetting
+
+// webhookOutputLimit is how much of the end of each of a task's stdout and
+// stderr is included in its success and fail webhooks.
+var webhookOutputLimit int
 
 func init() {
 	if len(os.Args) > 1 && os.Args[1] == "--version" {
 		fmt.Println(currentVersion)
 		os.Exit(0)
 	}
+	if len(os.Args) > 1 && os.Args[1] == rlimitShimArg {
+		os.Exit(runRlimitShim(os.Args[2:]))
+	}
+
+	setupStructuredLogging()
+	if err := setupUnifiedLogging(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupSyslog(); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.INIT_MODE {
+		startReaper()
+	}
+
+	configured, err := configuredRlimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rlimits = configured
+
+	client, err := newWebhookClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookClient = client
+
+	callbacks, err := newGRPCClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grpcClient = callbacks
 
-	queue.Connect(config.KEWPIE_BACKEND, []string{config.QUEUE}, nil)
+	tmpl, err := parseWebhookTemplate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookTemplate = tmpl
+
+	limit, err := parseByteSize(config.WEBHOOK_OUTPUT_LIMIT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhookOutputLimit = int(limit)
+
+	limit, err = parseByteSize(config.HEARTBEAT_OUTPUT_LIMIT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	heartbeatOutputLimit = int(limit)
+
+	if config.DEADLINE_WARNING_SIGNAL != "" {
+		signal, err := parseSignal(config.DEADLINE_WARNING_SIGNAL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deadlineSignal = signal
+	}
+
+	if config.DEDUPE_WINDOW > 0 {
+		store, err := newDedupeStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		dedupe = store
+	}
+
+	if config.TRANSFORM_SCRIPT != "" {
+		if _, err := loadTransformScript(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	queue.Connect(config.KEWPIE_BACKEND, queueNames(), nil)
 
 	log.Printf("INFO listening on queue: %s \n", config.QUEUE)
 
+	if config.METRICS_ADDR != "" {
+		serveMetrics(config.METRICS_ADDR)
+	}
+
+	if len(config.CAPABILITIES) > 0 {
+		log.Printf("INFO advertising capabilities: %v \n", config.CAPABILITIES)
+	}
+
 	go func() {
+		down := false
 		for {
 			if err := queue.Healthy(context.Background()); err != nil {
-				log.Printf("ERROR queue unhealthy: %s \n", err.Error())
-				queue.Disconnect()
-				return
+				if !down {
+					log.Printf("ERROR queue unhealthy: %s \n", err.Error())
+					queue.Disconnect()
+					if !config.RECONNECT {
+						return
+					}
+				}
+				// Wait for the subscription to reconnect
+				down = true
+			} else {
+				down = false
 			}
 			time.Sleep(1 * time.Second)
-			continue
 		}
 	}()
 }
 
+/*
+ * The queues Sonic connects to.
+ */
+func queueNames() []string {
+	queues := []string{config.QUEUE}
+	if config.PREEMPT_QUEUE != "" {
+		queues = append(queues, config.PREEMPT_QUEUE)
+	}
+	if config.CANCEL_QUEUE != "" {
+		queues = append(queues, config.CANCEL_QUEUE)
+	}
+	if config.DEAD_LETTER_QUEUE != "" {
+		queues = append(queues, config.DEAD_LETTER_QUEUE)
+	}
+	for name := range config.CALLBACK_QUEUES {
+		queues = append(queues, name)
+	}
+	for name := range config.QUEUE_WEIGHTS {
+		if name != config.QUEUE {
+			queues = append(queues, name)
+		}
+	}
+	return queues
+}
+
 type cliHandler struct {
 	handleFunc func(types.Task) (bool, error)
 }
@@ -77,7 +212,27 @@ func main() {
 		}
 	}()
 
+	restoreLifecycle(inFlightTaskIDs())
+	restoreInFlight()
+	go watchParked(ctx)
+	go watchJournal(ctx)
+	go watchSpill(ctx)
+
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Exit(runBackfill(ctx, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gateway" {
+		os.Exit(runGateway(ctx, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(ctx, os.Args[2:]))
+	}
+
+	prepareImages()
+	defer containers.drain()
+
 	if err := subscribe(ctx); err != nil {
+		containers.drain()
 		log.Fatal("ERROR", err)
 	}
 }
@@ -85,9 +240,18 @@ func main() {
 // ErrWebhookServerFailed is returned as the catch all error on a callback.
 var ErrWebhookServerFailed = fmt.Errorf("The upstream server failed when trying to send the start webhook")
 
-// ErrWebhookBadRequest is returned when sonic issues a callback which returns an Http 400 code
+// ErrWebhookBadRequest is returned when sonic issues a callback which returns
+// a status in WEBHOOK_ABORT_STATUSES, by default an Http 400 code
 var ErrWebhookBadRequest = fmt.Errorf("The upstream server indicated the request was bad")
 
+// ErrWebhookAbortRequested is returned when a heartbeat webhook responds
+// asking for the task to be aborted
+var ErrWebhookAbortRequested = fmt.Errorf("The upstream server asked for the task to be aborted")
+
+// ErrWebhookNotAllowed is returned when a webhook URL isn't permitted by
+// WEBHOOK_URL_ALLOWLIST
+var ErrWebhookNotAllowed = fmt.Errorf("The webhook URL is not allowed by policy")
+
 // ErrUnknownWebhook is returned when a user specifies an event unknown to Kewpie
 var ErrUnknownWebhook = fmt.Errorf("Unknown web hook")
 
@@ -99,37 +263,50 @@ var ErrUnknownWebhook = fmt.Errorf("Unknown web hook")
  */
 func subscribe(ctx context.Context) error {
 	running := false
+	activity := newSubscribeActivity()
 
-	handler := cliHandler{
-		handleFunc: func(task kewpie.Task) (bool, error) {
-			running = true
-			defer func() {
-				running = false
-			}()
+	subscribeSideQueues(ctx)
 
-			// Signal start
-			if requeue, err := signalTaskStart(task); err != nil {
-				return requeue, err
-			}
+	handle := func(ctx context.Context, task kewpie.Task, ack ackFunc) (bool, error) {
+		// Wait out any urgent task before starting another
+		urgentSlot.Lock()
+		urgentSlot.Unlock()
 
-			// Run proc, signal fail if it does fail
+		taskSlot.Lock()
+		defer taskSlot.Unlock()
 
-			if err := runProc(ctx, task.Body); err != nil {
-				if err := sendWebhook(failWebhook, task); err != nil {
-					log.Printf("ERROR sending failure webhook for task %+v\n", task)
-				}
-				return config.RETRY, err
-			}
+		running = true
+		activity.delivered()
+		defer func() {
+			running = false
+			activity.finished()
+		}()
 
-			// Signal success/complete
-			if retry, err := signalTaskSuccess(task); err != nil {
-				log.Printf("ERROR sending success webhook for task %+v\n", task)
-				return config.RETRY && retry, err
-			}
+		return handleTaskWithAck(ctx, task, ack)
+	}
 
-			return false, nil
-		},
+	// Tasks are handled in the context of the queue they came from, so any
+	// republished go back to it
+	handlerFor := func(ctx context.Context) types.Handler {
+		return cliHandler{
+			handleFunc: func(task kewpie.Task) (bool, error) {
+				return handle(ctx, task, nil)
+			},
+		}
+	}
+
+	if config.ACK_MODE != ackAfterWebhook {
+		acker := newEarlyAcker(ctx, handle)
+		defer acker.wait()
+		handlerFor = func(ctx context.Context) types.Handler {
+			return cliHandler{
+				handleFunc: func(task kewpie.Task) (bool, error) {
+					return acker.handleIn(ctx, task)
+				},
+			}
+		}
 	}
+	handler := handlerFor(ctx)
 
 	if config.DIE_IF_IDLE {
 		go func() {
@@ -153,7 +330,269 @@ func subscribe(ctx context.Context) error {
 	if config.SINGLE_SHOT {
 		return queue.Pop(ctx, config.QUEUE, handler)
 	}
-	return queue.Subscribe(ctx, config.QUEUE, handler)
+	if len(config.QUEUE_WEIGHTS) > 0 {
+		return subscribeWeighted(ctx, handlerFor)
+	}
+	return subscribeWithReconnect(ctx, func(ctx context.Context) error {
+		return subscribeWithStallDetection(ctx, handler, activity)
+	})
+}
+
+/*
+ * Subscribe to the queues consumed alongside the main queue. They're
+ * subscribed to again whenever Sonic reconnects.
+ */
+func subscribeSideQueues(ctx context.Context) {
+	if config.PREEMPT_QUEUE != "" {
+		subscribeUrgent(ctx)
+	}
+	if config.CANCEL_QUEUE != "" {
+		subscribeCancellations(ctx)
+	}
+}
+
+/*
+ * Handle a single task popped from the queue. The bool tells Kewpie whether
+ * the task needs to be requeued.
+ */
+func handleTask(ctx context.Context, task kewpie.Task) (bool, error) {
+	return handleTaskWithAck(ctx, task, nil)
+}
+
+/*
+ * Handle a task, calling ack when it reaches the point set by ACK_MODE. A nil
+ * ack acknowledges the task only once handling is complete. Tasks that fail
+ * and won't be requeued are dead lettered.
+ */
+func handleTaskWithAck(ctx context.Context, task kewpie.Task, ack ackFunc) (bool, error) {
+	defer logTask(task)()
+	ctx, span := startTaskSpan(ctx, task)
+	requeue, err := handleTaskAttempt(ctx, task, ack)
+	span.end(requeue, err)
+	if err != nil && !requeue && config.SHADOW_TEMPLATE == "" {
+		deadLetter(task, err)
+	}
+	return requeue, err
+}
+
+func handleTaskAttempt(ctx context.Context, task kewpie.Task, ack ackFunc) (bool, error) {
+	if name, err := unavailableSubsystem(); err != nil {
+		log.Printf("ERROR not running task %s while %s is unavailable, requeueing it \n", task.ID, name)
+		incCounter("sonic_tasks_deferred_total", map[string]string{"subsystem": name})
+		return true, subsystemUnavailableError(name, err)
+	}
+
+	if config.SHADOW_TEMPLATE != "" {
+		return handleShadowTask(ctx, task)
+	}
+
+	// Nothing else about a task can be trusted until its format is known
+	if err := checkEnvelope(task); err != nil {
+		log.Printf("ERROR rejecting task in an unsupported format %+v\n", task)
+		failTask(task, err)
+		return false, err
+	}
+
+	task = applyTagAliases(task)
+
+	if taskExpired(task) {
+		return expireTask(task)
+	}
+
+	if runAt := taskDueAt(task); time.Until(runAt) > delayTolerance {
+		return deferTask(ctx, task, runAt)
+	}
+
+	if unmet := unmetRequirements(task); len(unmet) > 0 {
+		return passOnTask(ctx, task, unmet)
+	}
+
+	transformed, err := transformTask(ctx, task)
+	if err != nil {
+		log.Printf("ERROR transform script rejected task %+v\n", task)
+		failTask(task, err)
+		return taskRetryable(task, err), err
+	}
+	task = transformed
+
+	if config.STRICT_TAGS {
+		if err := checkTags(task); err != nil {
+			log.Printf("ERROR rejecting task with unrecognised tags %+v\n", task)
+			failTask(task, err)
+			return false, err
+		}
+	}
+
+	if handled, requeue, err := enforceBudget(ctx, task); handled {
+		return requeue, err
+	}
+
+	if parkingEnabled() {
+		if reason := hostCondition(task); reason != "" {
+			return parkTask(task, reason)
+		}
+	}
+
+	if run, requeue, err := claimDedupeID(task); !run {
+		return requeue, err
+	}
+
+	// Signal start
+	startSent := time.Now()
+	if requeue, err := signalTaskStart(task); err != nil {
+		return requeue, err
+	}
+	startWebhookTime := time.Since(startSent)
+	lifecycle := startLifecycle(task)
+	defer lifecycle.clear()
+
+	if ack != nil && config.ACK_MODE == ackBeforeExec {
+		ack(false, nil)
+	}
+
+	// Run proc, signal fail if it does fail
+
+	runTask, variant := routeCanary(task)
+	started := time.Now()
+
+	output := procOutput{usage: &resourceUsage{}}
+	var stdout, stderr *tailBuffer
+	if webhookOutputLimit > 0 {
+		stdout = newTailBuffer(webhookOutputLimit)
+		stderr = newTailBuffer(webhookOutputLimit)
+		output.stdout = stdout
+		output.stderr = stderr
+	}
+
+	var capture *outputCapture
+	if config.SHADOW_QUEUE != "" {
+		capture = newOutputCapture()
+		output.combined = capture
+	}
+
+	runCtx, abortRun := context.WithCancel(ctx)
+	heartbeat := startHeartbeat(task, started, &output, abortRun)
+	cancelled := trackCancellable(task, abortRun)
+	err = runTaskProcWithOutput(runCtx, runTask, output)
+	heartbeat.stop()
+	wasCancelled := cancelled()
+	abortRun()
+	if heartbeat.aborted() {
+		err = TaskError{
+			Code:    errCodeAborted,
+			Message: "The task was aborted by its heartbeat webhook",
+		}
+	} else if wasCancelled {
+		err = TaskError{
+			Code:    errCodeAborted,
+			Message: "The task was cancelled from CANCEL_QUEUE",
+		}
+	}
+
+	lifecycle.finished(err)
+
+	if capture != nil {
+		publishShadowCopy(ctx, task, err, capture)
+	}
+
+	finished := time.Now()
+	payload := newWebhookPayload(task).withRun(started, finished, err).withUsage(output.usage).withWebhookTime(startWebhookTime)
+	if webhookOutputLimit > 0 {
+		payload = payload.withOutput(stdout, stderr)
+	}
+
+	recordBudgetUsage(task, finished.Sub(started))
+	recordTaskResult(task, err, finished.Sub(started))
+	recordCanaryResult(variant, err)
+
+	if ack != nil && config.ACK_MODE == ackAfterExec {
+		ack(false, nil)
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if newTaskError(err).Code == errCodePreempted {
+			return republishPreempted(ctx, task)
+		} else if parkingEnabled() && shouldPark(err) {
+			return parkTask(task, fmt.Sprintf("exited with code %d", exitCode(err)))
+		}
+		failTaskPayload(payload, err)
+		requeue := taskRetryable(task, err)
+		if requeue {
+			signalTaskRetry(payload, err)
+		}
+		return requeue, err
+	}
+
+	// Signal success/complete
+	if retry, err := signalTaskSuccess(payload); err != nil {
+		log.Printf("ERROR sending success webhook for task %+v\n", task)
+		return retryEnabled(task) && retry, err
+	}
+
+	return false, nil
+}
+
+/*
+ * Send the fail webhook for a task, describing err. Tasks that ran out of
+ * time go to the timeout webhook instead, and aborted tasks to the cancel
+ * webhook, if the task has one. A webhook_exit_<code> tag matching the
+ * command's exit code takes precedence over all of them.
+ */
+func failTask(task kewpie.Task, err error) {
+	failTaskPayload(newWebhookPayload(task), err)
+}
+
+func failTaskPayload(payload webhookPayload, err error) {
+	task := payload.Task
+	taskErr := newTaskError(err)
+	taskErr.Retryable = taskRetryable(task, err)
+	payload.Error = &taskErr
+
+	var event Webhook = failWebhook
+	if taskErr.Code == errCodeTimedOut && task.Tags["webhook_timeout"] != "" {
+		event = timeoutWebhook
+	}
+	if taskErr.Code == errCodeAborted && task.Tags["webhook_cancel"] != "" {
+		event = cancelWebhook
+	}
+
+	if code, ok := routingExitCode(err); ok {
+		tagName := webhookExitTagPrefix + strconv.Itoa(code)
+		if task.Tags[tagName] != "" {
+			if err := sendTaggedWebhook("fail", tagName, payload); err != nil {
+				log.Printf("ERROR sending failure webhook for task %+v\n", task)
+			}
+			return
+		}
+	}
+
+	if err := sendWebhookPayload(event, payload); err != nil {
+		log.Printf("ERROR sending failure webhook for task %+v\n", task)
+	}
+}
+
+/*
+ * Tell the task's retry webhook that it failed with err and is being
+ * requeued, so callers can track flapping tasks. The delay before the next attempt is
+ * Kewpie's default backoff, unless the task opted out of it.
+ */
+func signalTaskRetry(payload webhookPayload, err error) {
+	task := payload.Task
+	taskErr := newTaskError(err)
+	payload.Error = &taskErr
+	payload.NextAttempt = payload.Attempt + 1
+	delay := time.Duration(0)
+	if !task.NoExpBackoff {
+		delay = util.CalcBackoff(task.Attempts + 2)
+	}
+	seconds := delay.Seconds()
+	payload.RetryDelaySeconds = &seconds
+
+	if err := sendWebhookPayload(retryWebhook, payload); err != nil {
+		log.Printf("ERROR sending retry webhook for task %+v\n", task)
+	}
 }
 
 /*
@@ -161,20 +600,339 @@ func subscribe(ctx context.Context) error {
  * stdout, and errors to stderr.
  */
 func runProc(ctx context.Context, cli string) error {
-	command, args := getCommandAndArgs(cli)
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return runTaskProc(ctx, kewpie.Task{Body: cli})
+}
 
-	return cmd.Run()
+func runTaskProc(ctx context.Context, task kewpie.Task) error {
+	return runTaskProcWithOutput(ctx, task, procOutput{})
+}
+
+/*
+ * Run the body of a task, applying any process options requested in its
+ * tags. Tags named env_<NAME> are set as environment variables, and with the
+ * tty tag set the command runs attached to a pseudo-terminal. In ephemeral
+ * workspace mode the command runs in a fresh directory, exposed as
+ * SONIC_WORKSPACE, which is deleted when it exits. If CPU or memory limits
+ * apply, or cgroup accounting is available, the command is placed in its own
+ * cgroup. Commands running longer than MAX_TASK_RUNTIME, or their timeout tag,
+ * are killed, and are told their deadline in SONIC_DEADLINE. The writers in output receive copies
+ * of everything the command writes to stdout and stderr, and its usage what
+ * the command consumed.
+ */
+func runTaskProcWithOutput(ctx context.Context, task kewpie.Task, output procOutput) error {
+	maxRuntime, err := taskRuntime(task)
+	if err != nil {
+		return err
+	}
+
+	procCtx, cancel := context.WithCancel(ctx)
+	if maxRuntime > 0 {
+		procCtx, cancel = context.WithTimeout(ctx, maxRuntime)
+	}
+	defer cancel()
+
+	task, err = fetchTaskScript(procCtx, task)
+	if err != nil {
+		return err
+	}
+
+	command, args := getCommandAndArgs(task.Body)
+	script := isScript(task)
+	if script {
+		command, args = scriptInterpreter(task.Body)
+	} else if config.TASK_SHELL != "" {
+		command, args = shellCommand(task.Body)
+	}
+	taskCommand := command
+	scriptPath := ""
+	image := taskImage(task)
+	container := ""
+	jail, err := taskJail(task)
+	if err != nil {
+		return err
+	}
+	limits, err := taskLimits(task)
+	if err != nil {
+		return err
+	}
+	priority, err := taskPriorityFor(task)
+	if err != nil {
+		return err
+	}
+	affinity, err := taskAffinity(task)
+	if err != nil {
+		return err
+	}
+	if image != "" {
+		// Limits and credentials go to the container rather than the exec
+		// client, which runs on the host
+		if priority.setNice || priority.setIOClass {
+			return ErrContainerPriority
+		}
+		user, err := containerUser(task)
+		if err != nil {
+			return err
+		}
+		if err := checkImage(image); err != nil {
+			return err
+		}
+		id, err := containers.acquire(procCtx, image)
+		if err != nil {
+			return containerStartError(image, err)
+		}
+		// Removing the container also kills anything left running in it
+		defer removeContainer(id)
+		container = id
+		if err := limitContainer(procCtx, container, limits, affinity); err != nil {
+			return containerStartError(image, err)
+		}
+		command, args = containerCommand(container, command, args, task, user)
+	} else if jail != "" {
+		command, args = jailCommand(jail, command, args)
+	} else if script {
+		path, err := writeScript(task.Body)
+		if err != nil {
+			return err
+		}
+		defer removeScript(path)
+		scriptPath = path
+		command = resolveInterpreter(command)
+		args = append(args, path)
+	} else {
+		resolved, err := lookupCommand(command)
+		if err != nil {
+			return classifyStartError(command, err)
+		}
+		command = resolved
+	}
+	cmd := exec.CommandContext(procCtx, command, args...)
+	prepareProcessGroup(cmd)
+	cmd.WaitDelay = taskWaitDelay
+	if config.TASK_SHELL != "" && !script && container == "" && jail == "" {
+		setShellCmdLine(cmd, task.Body)
+	}
+	cmd.Env = taskEnv(task)
+	if customTaskPath() {
+		cmd.Env = append(cmd.Env, "PATH="+taskPath())
+	}
+
+	deadline, _ := procCtx.Deadline()
+	if !deadline.IsZero() {
+		cmd.Env = append(cmd.Env, "SONIC_DEADLINE="+deadline.UTC().Format(time.RFC3339))
+	}
+	cmd.Env = append(cmd.Env, traceEnv(procCtx, task)...)
+
+	if container == "" {
+		if err := applyCredentials(cmd, task); err != nil {
+			return err
+		}
+		if err := applyRlimits(cmd, rlimits); err != nil {
+			return err
+		}
+	}
+	if scriptPath != "" {
+		if err := chownForChild(cmd, scriptPath); err != nil {
+			return err
+		}
+	}
+
+	if config.EPHEMERAL_WORKSPACE {
+		workspace, err := ioutil.TempDir(config.WORKSPACE_ROOT, "sonic-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.RemoveAll(workspace); err != nil {
+				log.Printf("ERROR removing workspace %s: %s \n", workspace, err.Error())
+			}
+		}()
+		if err := chownForChild(cmd, workspace); err != nil {
+			return err
+		}
+		cmd.Dir = workspace
+		cmd.Env = append(cmd.Env, "SONIC_WORKSPACE="+workspace)
+	}
+
+	var cgroup *taskCgroup
+	if container == "" {
+		cgroup, err = createCgroup(limits)
+		if err != nil {
+			return err
+		}
+	}
+	if cgroup != nil {
+		defer cgroup.remove()
+	}
+
+	prefix := outputPrefix(task)
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if config.OUTPUT_PREFIX {
+		prefixedStdout := newPrefixedWriter(os.Stdout, prefix)
+		prefixedStderr := newPrefixedWriter(os.Stderr, prefix)
+		defer prefixedStdout.flush()
+		defer prefixedStderr.flush()
+		stdout, stderr = prefixedStdout, prefixedStderr
+	}
+	if shippedStdout, shippedStderr, flush := syslogOutput(prefix); shippedStdout != nil {
+		defer flush()
+		stdout = io.MultiWriter(stdout, shippedStdout)
+		stderr = io.MultiWriter(stderr, shippedStderr)
+	}
+	if output.stdout != nil {
+		stdout = io.MultiWriter(stdout, output.stdout)
+	}
+	if output.stderr != nil {
+		stderr = io.MultiWriter(stderr, output.stderr)
+	}
+	if output.combined != nil {
+		// stdout and stderr are copied concurrently
+		combined := &lockedWriter{out: output.combined}
+		stdout = io.MultiWriter(stdout, combined)
+		stderr = io.MultiWriter(stderr, combined)
+	}
+
+	var watchdog *outputWatchdog
+	if config.NO_OUTPUT_TIMEOUT > 0 {
+		watchdog = newOutputWatchdog(config.NO_OUTPUT_TIMEOUT, cancel)
+		defer watchdog.stop()
+		stdout = watchdog.wrap(stdout)
+		stderr = watchdog.wrap(stderr)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if script && (container != "" || jail != "") {
+		// Scripts are passed into containers and jails on stdin, which the
+		// pty would take the place of
+		if task.Tags["tty"] == "true" {
+			return fmt.Errorf("Script bodies can't be run in a container or jail with the tty tag")
+		}
+		cmd.Stdin = strings.NewReader(task.Body)
+	}
+
+	var pty *ptyAttachment
+	if task.Tags["tty"] == "true" {
+		attached, err := attachPty(cmd, stdout)
+		if err != nil {
+			return err
+		}
+		pty = attached
+		defer pty.wait()
+	}
+
+	energy := startEnergyMeter()
+	if err := startTrackedChild(cmd); err != nil {
+		return classifyStartError(command, err)
+	}
+	defer untrackChild(cmd.Process.Pid)
+	wasPreempted := trackPreemptible(ctx, task, cmd, cancel)
+	defer wasPreempted()
+	defer clearInFlight(saveInFlight(task, cmd.Process.Pid, time.Now()))
+
+	if pty != nil {
+		pty.started()
+	}
+
+	defer warnBeforeDeadline(cmd.Process, deadline)()
+
+	abort := func(err error) error {
+		log.Printf("ERROR setting up pid %d, killing it: %s \n", cmd.Process.Pid, err.Error())
+		cancel()
+		cmd.Wait()
+		return err
+	}
+
+	if container == "" {
+		// The child can run briefly before its priority and affinity are
+		// applied, as Go offers no hook between fork and exec
+		if err := applyPriority(cmd.Process.Pid, priority); err != nil {
+			return abort(err)
+		}
+
+		if err := applyAffinity(cmd.Process.Pid, affinity); err != nil {
+			return abort(err)
+		}
+	}
+
+	if cgroup != nil {
+		if err := cgroup.add(cmd.Process.Pid); err != nil {
+			return abort(err)
+		}
+		defer cgroup.watch(cancel)()
+	}
+
+	err = cmd.Wait()
+	if err == exec.ErrWaitDelay {
+		// The command exited cleanly, but left something running that
+		// still holds its output
+		log.Printf("INFO task %s exited but left processes holding its output, no longer waiting on them \n", task.ID)
+		err = nil
+	}
+
+	if output.usage != nil {
+		*output.usage = processUsage(cmd.ProcessState)
+		if cgroup != nil {
+			cgroup.account(output.usage)
+		}
+		energy.account(output.usage)
+	}
+
+	if wasPreempted() {
+		return TaskError{
+			Code:      errCodePreempted,
+			Message:   "The task was killed to make way for an urgent task",
+			Retryable: true,
+		}
+	}
+
+	if procCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = TaskError{
+			Code:    errCodeTimedOut,
+			Message: "The task ran for longer than " + maxRuntime.String() + " and was killed",
+			Details: map[string]string{
+				"max_task_runtime": maxRuntime.String(),
+			},
+			Retryable: true,
+		}
+	}
+
+	if watchdog != nil {
+		err = watchdog.classify(err)
+	}
+
+	if cgroup != nil {
+		err = cgroup.classify(err)
+	}
+
+	if container != "" {
+		err = classifyContainerError(container, image, taskCommand, err)
+	}
+
+	return err
 }
 
 /*
  * Signal that the task is about to commence. The bool tells Kewpie whether the
- * task needs to be requeued
+ * task needs to be requeued. The payload says which attempt this is, and with
+ * the suppress_duplicate_start tag set, redeliveries skip the start webhook
+ * entirely so receivers see a single start per task. In notify mode the
+ * webhook's outcome is ignored, so a failing receiver never stops the task.
  */
 func signalTaskStart(task kewpie.Task) (bool, error) {
-	if err := sendWebhook(startWebhook, task); err == ErrWebhookServerFailed {
+	redelivery := task.Attempts > 0
+	if redelivery && task.Tags["suppress_duplicate_start"] == "true" {
+		log.Printf("INFO suppressing start webhook for attempt %d of task %+v\n", task.Attempts+1, task)
+		return false, nil
+	}
+
+	if startWebhookMode(task) == startModeNotify {
+		if err := sendWebhookPayload(startWebhook, newWebhookPayload(task)); err != nil {
+			log.Printf("ERROR sending start webhook, running task %s anyway as it only notifies: %s \n", task.ID, err.Error())
+		}
+		return false, nil
+	}
+
+	if err := sendWebhookPayload(startWebhook, newWebhookPayload(task)); err == ErrWebhookServerFailed {
 		log.Printf("ERROR webhook error will requeue for task %+v\n", task)
 		return true, err
 	} else if err == ErrWebhookBadRequest {
@@ -187,12 +945,29 @@ func signalTaskStart(task kewpie.Task) (bool, error) {
 	return false, nil
 }
 
+/*
+ * Whether the task's start webhook authorises it to run or merely notifies
+ * the receiver, from its webhook_start_mode tag or START_WEBHOOK_MODE.
+ */
+func startWebhookMode(task kewpie.Task) string {
+	mode := task.Tags["webhook_start_mode"]
+	switch mode {
+	case "":
+		return config.START_WEBHOOK_MODE
+	case startModeAuthorise, startModeNotify:
+		return mode
+	}
+	log.Printf("ERROR task %s has an unknown webhook_start_mode %q, treating it as %s \n", task.ID, mode, startModeAuthorise)
+	return startModeAuthorise
+}
+
 /*
  * Signal that the task has succeeded. The bool tells Kewpie whether the
  * task needs to be requeued
  */
-func signalTaskSuccess(task kewpie.Task) (bool, error) {
-	if err := sendWebhook(successWebhook, task); err == ErrWebhookServerFailed {
+func signalTaskSuccess(payload webhookPayload) (bool, error) {
+	task := payload.Task
+	if err := sendWebhookPayload(successWebhook, payload); err == ErrWebhookServerFailed {
 		log.Printf("ERROR webhook error will requeue for task %+v\n", task)
 		return true, err
 	} else if err == ErrWebhookBadRequest {
@@ -205,6 +980,18 @@ func signalTaskSuccess(task kewpie.Task) (bool, error) {
 	return false, nil
 }
 
+// lockedWriter serialises writes to an underlying writer.
+type lockedWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Write(p)
+}
+
 /*
  * Load command and arguments from the cli text. Golang is very forgiving
  * when it parses the string, even handling empty strings!
@@ -239,62 +1026,3 @@ func contextWithSigterm(ctx context.Context) context.Context {
 
 	return ctxWithCancel
 }
-
-/*
- * When kewpie pulls a message of a queue, it communicates the progress
- * of Sonic's execution via 3 webhooks, start, fail and success which
- * issues a HTTP post to an end point defined in the task.Tags map.
- */
-func sendWebhook(event Webhook, task kewpie.Task) error {
-	evt, err := webhookToString(event)
-	if err != nil {
-		return err
-	}
-
-	tagName := "webhook_" + evt
-	if task.Tags[tagName] == "" {
-		return nil
-	}
-
-	payload, err := json.Marshal(task)
-	if err != nil {
-		log.Printf("Error marshalling JSON %+v\n", err)
-		return err
-	}
-
-	log.Printf("INFO Sending a http post for event %+v on the url %+v\n", tagName, task.Tags[tagName])
-	res, err := http.Post(task.Tags[tagName], "application/json", bytes.NewReader(payload))
-
-	if err != nil {
-		log.Printf("ERROR webhook error %+v\n", err)
-		return ErrWebhookServerFailed
-	}
-
-	log.Printf("INFO Response code from post %+v\n", res.StatusCode)
-	if res.StatusCode == 400 {
-		return ErrWebhookBadRequest
-	}
-
-	if res.StatusCode >= 200 && res.StatusCode < 300 {
-		return nil
-	}
-
-	return ErrWebhookServerFailed
-}
-
-/*
- * We represent Webhooks a using integers to make the code a bit safer. golang is a bit
- * loose with it's enums.
- */
-func webhookToString(hook Webhook) (string, error) {
-	switch hook {
-	case 1:
-		return "start", nil
-	case 2:
-		return "success", nil
-	case 3:
-		return "fail", nil
-	default:
-		return "", ErrUnknownWebhook
-	}
-}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"testing"
@@ -47,6 +48,28 @@ func TestRunProcWithNoCmd(t *testing.T) {
 	cancel()
 }
 
+func TestEphemeralWorkspace(t *testing.T) {
+	root, err := ioutil.TempDir("", "sonic-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	config.EPHEMERAL_WORKSPACE = true
+	config.WORKSPACE_ROOT = root
+	defer func() {
+		config.EPHEMERAL_WORKSPACE = false
+		config.WORKSPACE_ROOT = ""
+	}()
+
+	assert.Nil(t, runProc(context.Background(), "touch sonic_workspace_marker"))
+
+	_, err = os.Stat("sonic_workspace_marker")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := ioutil.ReadDir(root)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
+
 func TestSubscribe(t *testing.T) {
 	_, path := getPathForTest()
 
@@ -305,6 +328,157 @@ func TestWebhookWithSuccess(t *testing.T) {
 	cancel()
 }
 
+func TestWebhookWithTimeoutEvent(t *testing.T) {
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	config.MAX_TASK_RUNTIME = 50 * time.Millisecond
+	defer func() {
+		config.MAX_TASK_RUNTIME = 0
+	}()
+
+	called := map[string]bool{}
+
+	http.HandleFunc("/"+uniq+"/timeout", func(w http.ResponseWriter, r *http.Request) {
+		called["timeout"] = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/"+uniq+"/fail", func(w http.ResponseWriter, r *http.Request) {
+		called["fail"] = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "sleep 5",
+		Tags: kewpie.Tags{
+			"webhook_timeout": "http://localhost:" + port + "/" + uniq + "/timeout",
+			"webhook_fail":    "http://localhost:" + port + "/" + uniq + "/fail",
+		},
+	})
+
+	assert.False(t, requeue)
+	assert.Equal(t, errCodeTimedOut, newTaskError(err).Code)
+	assert.True(t, called["timeout"])
+	assert.False(t, called["fail"])
+}
+
+func TestStartWebhookOnRedelivery(t *testing.T) {
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	received := []webhookPayload{}
+	http.HandleFunc("/"+uniq+"/start", func(w http.ResponseWriter, r *http.Request) {
+		body := webhookPayload{}
+		payload, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(payload, &body))
+		received = append(received, body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	task := kewpie.Task{
+		Body:     "echo " + uniq,
+		Attempts: 1,
+		Tags: kewpie.Tags{
+			"webhook_start": "http://localhost:" + port + "/" + uniq + "/start",
+		},
+	}
+
+	requeue, err := signalTaskStart(task)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, 2, received[0].Attempt)
+		assert.True(t, received[0].Redelivery)
+	}
+
+	task.Tags["suppress_duplicate_start"] = "true"
+	requeue, err = signalTaskStart(task)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Len(t, received, 1)
+}
+
+func TestWebhookRunDetails(t *testing.T) {
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	received := map[string]webhookPayload{}
+	for _, event := range []string{"success", "fail"} {
+		event := event
+		http.HandleFunc("/"+uniq+"/"+event, func(w http.ResponseWriter, r *http.Request) {
+			body := webhookPayload{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			received[event] = body
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+
+	tags := kewpie.Tags{
+		"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+		"webhook_fail":    "http://localhost:" + port + "/" + uniq + "/fail",
+	}
+
+	_, err := handleTask(context.Background(), kewpie.Task{Body: "sleep 0.1", Tags: tags})
+	assert.Nil(t, err)
+	if success, ok := received["success"]; assert.True(t, ok) {
+		assert.Equal(t, 0, *success.ExitCode)
+		assert.Equal(t, 1, success.Attempt)
+		assert.True(t, success.DurationSeconds >= 0.1)
+		assert.True(t, success.FinishedAt.After(*success.StartedAt))
+	}
+
+	_, err = handleTask(context.Background(), kewpie.Task{Body: "false", Attempts: 2, Tags: tags})
+	assert.NotNil(t, err)
+	if fail, ok := received["fail"]; assert.True(t, ok) {
+		assert.Equal(t, 1, *fail.ExitCode)
+		assert.Equal(t, 3, fail.Attempt)
+		assert.NotNil(t, fail.StartedAt)
+	}
+}
+
+func TestWebhookOutput(t *testing.T) {
+	webhookOutputLimit = 4
+	defer func() {
+		webhookOutputLimit = 0
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	received := webhookPayload{}
+	http.HandleFunc("/"+uniq+"/fail", func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	_, err := handleTask(context.Background(), kewpie.Task{
+		Body: "ls /nonexistent-" + uniq,
+		Tags: kewpie.Tags{
+			"webhook_fail": "http://localhost:" + port + "/" + uniq + "/fail",
+		},
+	})
+	assert.NotNil(t, err)
+	if assert.NotNil(t, received.Stdout) && assert.NotNil(t, received.Stderr) {
+		assert.Equal(t, "", *received.Stdout)
+		assert.Equal(t, "ory\n", *received.Stderr)
+		assert.True(t, received.OutputTruncated)
+	}
+}
+
 func TestInvalidWebhooks(t *testing.T) {
 	uniq := uuid.NewV4().String()
 	path := "/tmp/" + uniq
@@ -357,3 +531,34 @@ func getPathForTest() (string, string) {
 
 	return uniq, path
 }
+
+func TestStartWebhookNotifyMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"webhook_start": server.URL,
+		},
+	}
+	requeue, err := signalTaskStart(task)
+	assert.True(t, requeue)
+	assert.Equal(t, ErrWebhookServerFailed, err)
+
+	task.Tags["webhook_start_mode"] = startModeNotify
+	requeue, err = signalTaskStart(task)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+
+	config.START_WEBHOOK_MODE = startModeNotify
+	defer func() {
+		config.START_WEBHOOK_MODE = startModeAuthorise
+	}()
+	delete(task.Tags, "webhook_start_mode")
+	requeue, err = signalTaskStart(task)
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ErrMemoryClosed is returned for operations on a disconnected memory queue.
+var ErrMemoryClosed = fmt.Errorf("The memory queue is disconnected")
+
+// memoryDelivery records what a handler made of a task popped from a memory
+// queue.
+type memoryDelivery struct {
+	Task     kewpie.Task
+	Err      error
+	Requeued bool
+}
+
+// memoryQueue is a queue backend held in the worker's memory, for tests and
+// local development. Queues are created when they're first used, and
+// everything is lost when the process exits. Unlike the other backends it
+// keeps a record of every task it delivers, so tests can check how each one
+// was handled.
+type memoryQueue struct {
+	mu        sync.Mutex
+	queues    map[string][]kewpie.Task
+	delivered map[string][]memoryDelivery
+	wake      chan struct{}
+	closed    bool
+}
+
+/*
+ * Start with empty queues, then publish the tasks in MEMORY_TASKS, if set,
+ * to QUEUE.
+ */
+func (m *memoryQueue) Connect(backend string, queues []string, connection interface{}) error {
+	m.mu.Lock()
+	m.queues = map[string][]kewpie.Task{}
+	m.delivered = map[string][]memoryDelivery{}
+	m.wake = make(chan struct{})
+	m.closed = false
+	for _, name := range queues {
+		m.queues[name] = []kewpie.Task{}
+	}
+	m.mu.Unlock()
+
+	if config.MEMORY_TASKS == "" {
+		return nil
+	}
+	tasks, err := readMemoryTasks(config.MEMORY_TASKS)
+	if err != nil {
+		return err
+	}
+	for i := range tasks {
+		if err := m.Publish(context.Background(), config.QUEUE, &tasks[i]); err != nil {
+			return err
+		}
+	}
+	log.Printf("INFO published %d tasks from %s to %s \n", len(tasks), config.MEMORY_TASKS, config.QUEUE)
+	return nil
+}
+
+func (m *memoryQueue) Disconnect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.wake)
+	}
+	return nil
+}
+
+func (m *memoryQueue) Healthy(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrMemoryClosed
+	}
+	return nil
+}
+
+/*
+ * Add a task to the back of a queue.
+ */
+func (m *memoryQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrMemoryClosed
+	}
+	m.queues[queueName] = append(m.queues[queueName], *payload)
+
+	// Wake every pop waiting for a task
+	close(m.wake)
+	m.wake = make(chan struct{})
+	return nil
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done.
+ */
+func (m *memoryQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := m.Pop(ctx, queueName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the first due task on a queue and handle it. If the handler
+ * fails and asks for a requeue, the task goes to the back of the queue with
+ * its attempts counted and Kewpie's usual backoff.
+ */
+func (m *memoryQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		task, wait, wake, err := m.take(queueName)
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return m.handle(queueName, task, handler)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (m *memoryQueue) handle(queueName string, task kewpie.Task, handler types.Handler) error {
+	requeue, err := handler.Handle(task)
+
+	m.mu.Lock()
+	m.delivered[queueName] = append(m.delivered[queueName], memoryDelivery{
+		Task:     task,
+		Err:      err,
+		Requeued: err != nil && requeue,
+	})
+	m.mu.Unlock()
+
+	if err == nil || !requeue {
+		return nil
+	}
+
+	log.Println("ERROR kewpie task handler", err)
+	task.Attempts++
+	task.RunAt = time.Time{}
+	task.Delay = 0
+	if !task.NoExpBackoff {
+		task.Delay = util.CalcBackoff(task.Attempts + 1)
+	}
+	return m.Publish(context.Background(), queueName, &task)
+}
+
+/*
+ * Take the first due task from a queue. If none are due, returns how long
+ * until the next one is, and a channel that's closed when another task is
+ * published.
+ */
+func (m *memoryQueue) take(queueName string) (kewpie.Task, time.Duration, chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return kewpie.Task{}, 0, nil, ErrMemoryClosed
+	}
+
+	wait := time.Hour
+	tasks := m.queues[queueName]
+	for i, task := range tasks {
+		until := time.Until(task.RunAt)
+		if until <= 0 {
+			m.queues[queueName] = append(tasks[:i:i], tasks[i+1:]...)
+			return task, 0, nil, nil
+		}
+		if until < wait {
+			wait = until
+		}
+	}
+	return kewpie.Task{}, wait, m.wake, nil
+}
+
+/*
+ * The tasks waiting on a queue, due or not, in the order they were
+ * published.
+ */
+func (m *memoryQueue) Waiting(queueName string) []kewpie.Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]kewpie.Task{}, m.queues[queueName]...)
+}
+
+/*
+ * Every task delivered from a queue so far, and what its handler made of
+ * it, in the order they were handled.
+ */
+func (m *memoryQueue) Delivered(queueName string) []memoryDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]memoryDelivery{}, m.delivered[queueName]...)
+}
+
+/*
+ * Wait until at least count tasks have been delivered from a queue and
+ * handled, returning them all.
+ */
+func (m *memoryQueue) WaitDelivered(ctx context.Context, queueName string, count int) ([]memoryDelivery, error) {
+	for {
+		if delivered := m.Delivered(queueName); len(delivered) >= count {
+			return delivered, nil
+		}
+		select {
+		case <-ctx.Done():
+			return m.Delivered(queueName), ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+/*
+ * Empty a queue, and forget what's been delivered from it.
+ */
+func (m *memoryQueue) Reset(queueName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.queues, queueName)
+	delete(m.delivered, queueName)
+}
+
+/*
+ * Read tasks from a file of Kewpie task JSON, one per line. Blank lines are
+ * skipped.
+ */
+func readMemoryTasks(path string) ([]kewpie.Task, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tasks := []kewpie.Task{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		task := kewpie.Task{}
+		if err := json.Unmarshal(scanner.Bytes(), &task); err != nil {
+			return nil, fmt.Errorf("%s line %d isn't a task: %s", path, line, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, scanner.Err()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withMemoryQueue(t *testing.T) *memoryQueue {
+	client := &memoryQueue{}
+	assert.Nil(t, client.Connect("memory", []string{"memory_test"}, nil))
+	return client
+}
+
+func TestMemoryQueue(t *testing.T) {
+	client := withMemoryQueue(t)
+	defer client.Disconnect()
+
+	assert.Nil(t, client.Publish(context.Background(), "memory_test", &kewpie.Task{ID: "first", Body: "echo one"}))
+	assert.Nil(t, client.Publish(context.Background(), "memory_test", &kewpie.Task{Body: "echo two"}))
+	waiting := client.Waiting("memory_test")
+	assert.Equal(t, 2, len(waiting))
+	assert.Equal(t, "first", waiting[0].ID)
+	assert.NotEqual(t, "", waiting[1].ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go client.Subscribe(ctx, "memory_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			if task.Body == "echo two" {
+				return false, fmt.Errorf("exit status 1")
+			}
+			return false, nil
+		},
+	})
+
+	delivered, err := client.WaitDelivered(ctx, "memory_test", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", delivered[0].Task.ID)
+	assert.Nil(t, delivered[0].Err)
+	assert.Equal(t, "echo two", delivered[1].Task.Body)
+	assert.NotNil(t, delivered[1].Err)
+	assert.False(t, delivered[1].Requeued)
+	assert.Equal(t, 0, len(client.Waiting("memory_test")))
+}
+
+func TestMemoryQueueRequeue(t *testing.T) {
+	client := withMemoryQueue(t)
+	defer client.Disconnect()
+
+	assert.Nil(t, client.Publish(context.Background(), "memory_test", &kewpie.Task{Body: "exit 1"}))
+	assert.Nil(t, client.Pop(context.Background(), "memory_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			return true, fmt.Errorf("exit status 1")
+		},
+	}))
+
+	assert.True(t, client.Delivered("memory_test")[0].Requeued)
+	waiting := client.Waiting("memory_test")
+	assert.Equal(t, 1, len(waiting))
+	assert.Equal(t, 1, waiting[0].Attempts)
+	assert.True(t, time.Until(waiting[0].RunAt) > 30*time.Second)
+}
+
+func TestMemoryQueueDelayed(t *testing.T) {
+	client := withMemoryQueue(t)
+	defer client.Disconnect()
+
+	assert.Nil(t, client.Publish(context.Background(), "memory_test", &kewpie.Task{Body: "echo later", Delay: time.Hour}))
+	assert.Nil(t, client.Publish(context.Background(), "memory_test", &kewpie.Task{Body: "echo soon", Delay: 100 * time.Millisecond}))
+
+	// Tasks that aren't due don't hold up those behind them
+	start := time.Now()
+	assert.Nil(t, client.Pop(context.Background(), "memory_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "echo soon", task.Body)
+			return false, nil
+		},
+	}))
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.Pop(ctx, "memory_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			t.Fatal("nothing is due")
+			return false, nil
+		},
+	}))
+}
+
+func TestMemoryQueueWakes(t *testing.T) {
+	client := withMemoryQueue(t)
+	defer client.Disconnect()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Publish(context.Background(), "memory_other", &kewpie.Task{Body: "echo hi"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, client.Pop(ctx, "memory_other", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			return false, nil
+		},
+	}))
+	assert.Nil(t, ctx.Err())
+}
+
+func TestMemoryQueueDisconnect(t *testing.T) {
+	client := withMemoryQueue(t)
+
+	done := make(chan error)
+	go func() {
+		done <- client.Subscribe(context.Background(), "memory_test", cliHandler{
+			handleFunc: func(task kewpie.Task) (bool, error) {
+				return false, nil
+			},
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Nil(t, client.Disconnect())
+	assert.Equal(t, ErrMemoryClosed, <-done)
+	assert.Equal(t, ErrMemoryClosed, client.Healthy(context.Background()))
+	assert.Equal(t, ErrMemoryClosed, client.Publish(context.Background(), "memory_test", &kewpie.Task{}))
+}
+
+func TestMemoryQueueSeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-memory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tasks.jsonl")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{\"id\": \"one\", \"body\": \"echo one\"}\n\n{\"body\": \"echo two\"}\n"), 0600))
+	config.MEMORY_TASKS = path
+	defer func() {
+		config.MEMORY_TASKS = ""
+	}()
+
+	client := withMemoryQueue(t)
+	defer client.Disconnect()
+	waiting := client.Waiting(config.QUEUE)
+	assert.Equal(t, 2, len(waiting))
+	assert.Equal(t, "one", waiting[0].ID)
+	assert.Equal(t, "echo two", waiting[1].Body)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{\"body\": \"echo one\"}\nnope\n"), 0600))
+	err = (&memoryQueue{}).Connect("memory", nil, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// counters holds every counter Sonic has incremented, keyed by name and then
+// by rendered label set. They're exposed in the Prometheus text format, and
+// pushed to StatsD as they change if METRICS_BACKEND asks for it.
+var counters = struct {
+	sync.Mutex
+	values map[string]map[string]float64
+}{values: map[string]map[string]float64{}}
+
+/*
+ * Increment a counter. Label values must be drawn from a small fixed set, as
+ * each distinct combination is kept forever.
+ */
+func incCounter(name string, labels map[string]string) {
+	addCounter(name, labels, 1)
+}
+
+func addCounter(name string, labels map[string]string, value float64) {
+	counters.Lock()
+	if counters.values[name] == nil {
+		counters.values[name] = map[string]float64{}
+	}
+	counters.values[name][renderLabels(labels)] += value
+	counters.Unlock()
+
+	pushCounter(name, labels, value)
+}
+
+func counterValue(name string, labels map[string]string) float64 {
+	counters.Lock()
+	defer counters.Unlock()
+
+	return counters.values[name][renderLabels(labels)]
+}
+
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[name])
+		pairs = append(pairs, name+`="`+value+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/*
+ * Count a finished run of a task and the time it took, labelled with the
+ * task's labels.
+ */
+func recordTaskResult(task kewpie.Task, err error, elapsed time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	addCounter("sonic_task_seconds_total", metricLabels(task, nil), elapsed.Seconds())
+	incCounter("sonic_tasks_total", metricLabels(task, map[string]string{"result": result}))
+	log.Printf("INFO task %s finished with result=%s duration=%s%s \n", task.ID, result, elapsed, labelFields(task))
+}
+
+/*
+ * Write every counter in the Prometheus text exposition format.
+ */
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	counters.Lock()
+	defer counters.Unlock()
+
+	names := []string{}
+	for name := range counters.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+		series := []string{}
+		for labels := range counters.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, counters.values[name][labels])
+		}
+	}
+}
+
+// metricsListener holds why metrics can't be served, if they can't.
+var metricsListener = struct {
+	sync.Mutex
+	err error
+}{err: fmt.Errorf("Not listening yet")}
+
+/*
+ * Serve metrics for scraping on addr, unless they're pushed to StatsD, along
+ * with the readiness report at /ready. Failure to listen isn't fatal, as
+ * tasks can still run without metrics unless FAIL_CLOSED says otherwise, and
+ * listening is retried every subsystemProbeInterval.
+ */
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	if config.METRICS_BACKEND == metricsPrometheus {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+	mux.HandleFunc("/ready", readinessHandler)
+
+	go func() {
+		for {
+			listener, err := net.Listen("tcp", addr)
+			if err == nil {
+				setMetricsListening(nil)
+				log.Printf("INFO serving metrics on %s \n", addr)
+				err = http.Serve(listener, mux)
+			}
+			log.Printf("ERROR serving metrics: %s \n", err.Error())
+			setMetricsListening(err)
+			time.Sleep(subsystemProbeInterval)
+		}
+	}()
+}
+
+func setMetricsListening(err error) {
+	metricsListener.Lock()
+	metricsListener.err = err
+	metricsListener.Unlock()
+	reportSubsystemFailure("metrics", err)
+}
+
+func metricsListening() error {
+	metricsListener.Lock()
+	defer metricsListener.Unlock()
+	return metricsListener.err
+}
+
+/*
+ * Probe the metrics subsystem: whichever sink METRICS_BACKEND chose, and the
+ * listener on METRICS_ADDR if one is set.
+ */
+func probeMetrics() error {
+	if config.METRICS_BACKEND != metricsPrometheus {
+		if err := statsdPushing(); err != nil {
+			return err
+		}
+	}
+	if config.METRICS_ADDR != "" {
+		return metricsListening()
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	incCounter("sonic_test_total", map[string]string{"b": "2", "a": `say "hi"`})
+	incCounter("sonic_test_total", map[string]string{"b": "2", "a": `say "hi"`})
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, recorder.Body.String(), "# TYPE sonic_test_total counter\n")
+	assert.Contains(t, recorder.Body.String(), `sonic_test_total{a="say \"hi\"",b="2"} 2`)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// migrateReport summarises a migration. It's printed to stdout as JSON when
+// the run finishes.
+type migrateReport struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Queue    string        `json:"queue"`
+	ToQueue  string        `json:"to_queue"`
+	Migrated int           `json:"migrated"`
+	Resumed  int           `json:"resumed"`
+	Failed   int           `json:"failed"`
+	Duration time.Duration `json:"duration"`
+	Drained  bool          `json:"drained"`
+	Journal  string        `json:"journal"`
+}
+
+// migrateJournal records the tasks already published to the destination, by
+// source task ID and checksum, so an interrupted migration can resume without
+// publishing any of them twice.
+type migrateJournal struct {
+	file      *os.File
+	checksums map[string]string
+}
+
+/*
+ * Entry point for `sonic migrate`. Moves every task from a queue on one
+ * backend to a queue on another, returning the process exit code.
+ */
+func runMigrate(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "backend to move tasks from")
+	to := flags.String("to", "", "backend to move tasks to")
+	queueName := flags.String("queue", config.QUEUE, "queue to move tasks from")
+	toQueue := flags.String("to-queue", "", "queue to move tasks to, if it's named differently")
+	journalPath := flags.String("journal", "", "file recording migrated tasks, so the migration can be resumed (default sonic-migrate-<queue>.journal)")
+	idle := flags.Duration("idle", 5*time.Second, "how long the queue must be empty before it is considered drained")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" || *queueName == "" {
+		log.Println("ERROR migrate needs --from, --to and --queue")
+		return 2
+	}
+	if *toQueue == "" {
+		*toQueue = *queueName
+	}
+	if *from == *to && *queueName == *toQueue {
+		log.Println("ERROR migrate can't move a queue onto itself")
+		return 2
+	}
+	if *journalPath == "" {
+		*journalPath = "sonic-migrate-" + *queueName + ".journal"
+	}
+
+	journal, err := openMigrateJournal(*journalPath)
+	if err != nil {
+		log.Printf("ERROR opening migration journal %s: %s \n", *journalPath, err.Error())
+		return 1
+	}
+	defer journal.file.Close()
+
+	source := &queueConnection{}
+	if err := source.Connect(*from, []string{*queueName}, nil); err != nil {
+		log.Printf("ERROR connecting to %s: %s \n", *from, err.Error())
+		return 1
+	}
+	defer source.Disconnect()
+	destination := &queueConnection{}
+	if err := destination.Connect(*to, []string{*toQueue}, nil); err != nil {
+		log.Printf("ERROR connecting to %s: %s \n", *to, err.Error())
+		return 1
+	}
+	defer destination.Disconnect()
+
+	report := migrate(ctx, source, destination, *queueName, *toQueue, journal, *idle)
+	report.From = *from
+	report.To = *to
+	report.Journal = *journalPath
+
+	log.Printf("INFO migration of %s from %s to %s finished in %s: %d migrated, %d resumed, %d failed \n", report.Queue, report.From, report.To, report.Duration, report.Migrated, report.Resumed, report.Failed)
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		log.Println("ERROR writing migration report", err)
+	}
+
+	if report.Failed > 0 || !report.Drained {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Move tasks from source to destination until the source queue has been
+ * empty for idle. Each task is published to the destination and journaled
+ * before it's removed from the source, so a task is never lost, and one
+ * that's already in the journal is only removed. The first task that can't
+ * be published is left on the source and stops the migration.
+ */
+func migrate(ctx context.Context, source, destination QueueBackend, queueName, toQueue string, journal *migrateJournal, idle time.Duration) migrateReport {
+	report := migrateReport{Queue: queueName, ToQueue: toQueue}
+	started := time.Now()
+
+	var failure error
+	handler := cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			checksum, err := taskChecksum(task)
+			if err != nil {
+				failure = err
+				return true, err
+			}
+
+			if journal.checksums[task.ID] == checksum {
+				report.Resumed++
+				return false, nil
+			}
+			if previous, ok := journal.checksums[task.ID]; ok {
+				log.Printf("ERROR task %s changed since it was migrated, checksum %s is now %s, migrating it again \n", task.ID, previous, checksum)
+			}
+
+			copied := task
+			copied.Delay = 0
+			if err := destination.Publish(ctx, toQueue, &copied); err != nil {
+				failure = err
+				return true, err
+			}
+			if err := journal.record(task.ID, checksum); err != nil {
+				failure = err
+				return true, err
+			}
+			report.Migrated++
+			return false, nil
+		},
+	}
+
+	for ctx.Err() == nil && failure == nil {
+		if !popWithin(ctx, source, queueName, handler, idle) {
+			report.Drained = ctx.Err() == nil
+			break
+		}
+	}
+	if failure != nil {
+		log.Printf("ERROR stopping migration of %s: %s \n", queueName, failure.Error())
+		report.Failed++
+	}
+
+	report.Duration = time.Since(started)
+	return report
+}
+
+/*
+ * A checksum of everything about a task that the destination must preserve.
+ */
+func taskChecksum(task kewpie.Task) (string, error) {
+	contents, err := json.Marshal(struct {
+		ID           string      `json:"id"`
+		Body         string      `json:"body"`
+		Tags         kewpie.Tags `json:"tags"`
+		Attempts     int         `json:"attempts"`
+		NoExpBackoff bool        `json:"no_exp_backoff"`
+		RunAt        time.Time   `json:"run_at"`
+	}{task.ID, task.Body, task.Tags, task.Attempts, task.NoExpBackoff, task.RunAt.UTC()})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+ * Open a migration journal, reading back what a previous run recorded.
+ */
+func openMigrateJournal(path string) (*migrateJournal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &migrateJournal{file: file, checksums: map[string]string{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The checksum comes first, as task IDs are up to the backend and
+		// may contain anything
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 || fields[1] == "" {
+			// A line cut short by a crash, whose task wasn't removed from
+			// the source yet
+			continue
+		}
+		journal.checksums[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(journal.checksums) > 0 {
+		log.Printf("INFO resuming migration, %d tasks already migrated according to %s \n", len(journal.checksums), path)
+	}
+	return journal, nil
+}
+
+func (j *migrateJournal) record(id, checksum string) error {
+	if _, err := fmt.Fprintf(j.file, "%s %s\n", checksum, id); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.checksums[id] = checksum
+	return nil
+}
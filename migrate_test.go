@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPublisher is a queue that can't be published to.
+type failingPublisher struct {
+	QueueBackend
+}
+
+func (f failingPublisher) Publish(ctx context.Context, queueName string, task *types.Task) error {
+	return fmt.Errorf("destination unavailable")
+}
+
+func tempMigrateJournal(t *testing.T) (*migrateJournal, string, func()) {
+	dir, err := ioutil.TempDir("", "sonic-migrate")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "migrate.journal")
+	journal, err := openMigrateJournal(path)
+	assert.Nil(t, err)
+	return journal, path, func() {
+		journal.file.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func drainQueue(t *testing.T, queueName string) []kewpie.Task {
+	tasks := []kewpie.Task{}
+	for popWithin(context.Background(), queue, queueName, cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			tasks = append(tasks, task)
+			return false, nil
+		},
+	}, 200*time.Millisecond) {
+	}
+	return tasks
+}
+
+func TestMigrate(t *testing.T) {
+	journal, path, cleanup := tempMigrateJournal(t)
+	defer cleanup()
+
+	for _, body := range []string{"echo one", "echo two", "echo three"} {
+		assert.Nil(t, queue.Publish(context.Background(), "migrate_src", &kewpie.Task{
+			Body: body,
+			Tags: kewpie.Tags{"label_team": "billing"},
+		}))
+	}
+
+	report := migrate(context.Background(), queue, queue, "migrate_src", "migrate_dst", journal, 200*time.Millisecond)
+	assert.Equal(t, 3, report.Migrated)
+	assert.Equal(t, 0, report.Failed)
+	assert.True(t, report.Drained)
+
+	migrated := drainQueue(t, "migrate_dst")
+	assert.Equal(t, 3, len(migrated))
+	for _, task := range migrated {
+		assert.Equal(t, "billing", task.Tags["label_team"])
+		_, ok := journal.checksums[task.ID]
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0, len(drainQueue(t, "migrate_src")))
+
+	reopened, err := openMigrateJournal(path)
+	assert.Nil(t, err)
+	defer reopened.file.Close()
+	assert.Equal(t, journal.checksums, reopened.checksums)
+}
+
+func TestMigrateResumes(t *testing.T) {
+	journal, _, cleanup := tempMigrateJournal(t)
+	defer cleanup()
+
+	task := kewpie.Task{ID: "2d4f0fe4-7c7a-4d0c-9c4b-4ad1f4b4d1a0", Body: "echo resumed"}
+	assert.Nil(t, queue.Publish(context.Background(), "migrate_resume_src", &task))
+	popped := drainQueue(t, "migrate_resume_src")
+	assert.Equal(t, 1, len(popped))
+
+	// The previous run published and journaled the task, but was interrupted
+	// before removing it from the source
+	checksum, err := taskChecksum(popped[0])
+	assert.Nil(t, err)
+	assert.Nil(t, journal.record(popped[0].ID, checksum))
+	// Redelivered as it was, rather than with its delay applied again
+	popped[0].Delay = 0
+	assert.Nil(t, queue.Publish(context.Background(), "migrate_resume_src", &popped[0]))
+
+	report := migrate(context.Background(), queue, queue, "migrate_resume_src", "migrate_resume_dst", journal, 200*time.Millisecond)
+	assert.Equal(t, 0, report.Migrated)
+	assert.Equal(t, 1, report.Resumed)
+	assert.True(t, report.Drained)
+	assert.Equal(t, 0, len(drainQueue(t, "migrate_resume_dst")))
+	assert.Equal(t, 0, len(drainQueue(t, "migrate_resume_src")))
+}
+
+func TestMigrateStopsOnFailure(t *testing.T) {
+	journal, _, cleanup := tempMigrateJournal(t)
+	defer cleanup()
+
+	assert.Nil(t, queue.Publish(context.Background(), "migrate_fail_src", &kewpie.Task{Body: "echo kept", NoExpBackoff: true}))
+
+	report := migrate(context.Background(), queue, failingPublisher{queue}, "migrate_fail_src", "migrate_fail_dst", journal, 200*time.Millisecond)
+	assert.Equal(t, 0, report.Migrated)
+	assert.Equal(t, 1, report.Failed)
+	assert.False(t, report.Drained)
+	assert.Equal(t, 0, len(journal.checksums))
+
+	// The task stays on the source
+	kept := drainQueue(t, "migrate_fail_src")
+	assert.Equal(t, 1, len(kept))
+	assert.Equal(t, "echo kept", kept[0].Body)
+}
+
+func TestTaskChecksum(t *testing.T) {
+	task := kewpie.Task{ID: "abc", Body: "echo hi", Tags: kewpie.Tags{"timeout": "1m"}}
+	original, err := taskChecksum(task)
+	assert.Nil(t, err)
+
+	// Delay only matters when publishing, RunAt is what's preserved
+	task.Delay = time.Minute
+	same, err := taskChecksum(task)
+	assert.Nil(t, err)
+	assert.Equal(t, original, same)
+
+	task.Tags = kewpie.Tags{"timeout": "2m"}
+	changed, err := taskChecksum(task)
+	assert.Nil(t, err)
+	assert.NotEqual(t, original, changed)
+}
+
+func TestOpenMigrateJournalSkipsTornLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	checksum, err := taskChecksum(kewpie.Task{ID: "complete"})
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "migrate.journal")
+	contents := checksum + " complete\n" + checksum[:10]
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+	journal, err := openMigrateJournal(path)
+	assert.Nil(t, err)
+	defer journal.file.Close()
+	assert.Equal(t, map[string]string{"complete": checksum}, journal.checksums)
+}
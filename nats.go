@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// natsStreamUnsafe matches the characters NATS doesn't allow in stream names.
+var natsStreamUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// ErrNATSClosed is returned for operations on a closed NATS connection.
+var ErrNATSClosed = fmt.Errorf("The connection to NATS is closed")
+
+// natsQueue is a queue backend on NATS JetStream. Each queue is a work queue
+// stream, SONIC_<QUEUE>, bound to the subject sonic.<queue>, and workers
+// share a durable pull consumer named NATS_DURABLE so each task goes to one
+// of them.
+type natsQueue struct {
+	conn *nats.Conn
+	js   jetstream.JetStream
+
+	mu        sync.Mutex
+	consumers map[string]jetstream.Consumer
+}
+
+/*
+ * Connect to NATS_URL and make sure each queue has its stream and consumer.
+ * nats:// URLs connect in plain text and tls:// URLs over TLS. Any
+ * credentials in the URL are sent as a user and password, or a token if
+ * there's no password. The client reconnects on its own if the connection
+ * drops.
+ */
+func (n *natsQueue) Connect(backend string, queues []string, connection interface{}) error {
+	server, err := url.Parse(config.NATS_URL)
+	if err != nil || (server.Scheme != "nats" && server.Scheme != "tls") {
+		return fmt.Errorf("NATS_URL must be a nats:// or tls:// URL")
+	}
+
+	conn, err := nats.Connect(config.NATS_URL,
+		nats.Name("sonic"),
+		nats.Timeout(10*time.Second),
+		nats.ErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			log.Printf("ERROR NATS: %s \n", err.Error())
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.conn = conn
+	n.js = js
+	n.consumers = map[string]jetstream.Consumer{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, name := range queues {
+		if err := n.ensureStream(ctx, name); err != nil {
+			n.Disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *natsQueue) Disconnect() error {
+	if n.conn == nil {
+		return nil
+	}
+	n.conn.Close()
+	return nil
+}
+
+/*
+ * Check the connection is up and JetStream is answering.
+ */
+func (n *natsQueue) Healthy(ctx context.Context) error {
+	if n.conn == nil || n.conn.IsClosed() {
+		return ErrNATSClosed
+	}
+	_, err := n.js.AccountInfo(ctx)
+	return err
+}
+
+/*
+ * Publish a task to a queue's stream, waiting for JetStream to confirm it's
+ * stored. Delays are honoured when the task is pulled, as JetStream has no
+ * delayed delivery of its own.
+ */
+func (n *natsQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = n.js.Publish(ctx, natsSubject(queueName), body)
+	return err
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done.
+ */
+func (n *natsQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := n.Pop(ctx, queueName, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the next task on a queue and handle it. While the handler runs
+ * the message is kept from being redelivered to another worker. Afterwards
+ * it's acknowledged, unless the handler failed and asked for a requeue, in
+ * which case it's published again with its attempts counted and Kewpie's
+ * usual backoff.
+ */
+func (n *natsQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	consumer, err := n.consumer(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if n.conn.IsClosed() {
+			return ErrNATSClosed
+		}
+
+		batch, err := consumer.Fetch(1, jetstream.FetchMaxWait(config.NATS_PULL_EXPIRY))
+		if err != nil {
+			return err
+		}
+
+		var msg jetstream.Msg
+		select {
+		case msg = <-batch.Messages():
+		case <-ctx.Done():
+			// A task pulled after giving up goes straight back
+			go func() {
+				for msg := range batch.Messages() {
+					msg.Nak()
+				}
+			}()
+			return ctx.Err()
+		}
+		if msg == nil {
+			// Nothing to deliver before the pull expired
+			if err := batch.Error(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		task := kewpie.Task{}
+		if err := json.Unmarshal(msg.Data(), &task); err != nil {
+			log.Printf("ERROR discarding a message on %s that isn't a task: %s \n", msg.Subject(), err.Error())
+			msg.Term()
+			continue
+		}
+
+		if wait := time.Until(task.RunAt); wait > 0 {
+			msg.NakWithDelay(wait)
+			continue
+		}
+
+		// Redeliveries after a worker died count as attempts too
+		if metadata, err := msg.Metadata(); err == nil && metadata.NumDelivered > 1 {
+			task.Attempts += int(metadata.NumDelivered - 1)
+		}
+
+		return n.handle(queueName, msg, task, handler)
+	}
+}
+
+func (n *natsQueue) handle(queueName string, msg jetstream.Msg, task kewpie.Task, handler types.Handler) error {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(config.NATS_ACK_WAIT / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+
+	requeue, err := handler.Handle(task)
+	close(done)
+
+	if err != nil && requeue {
+		log.Println("ERROR kewpie task handler", err)
+		task.Attempts++
+		task.RunAt = time.Time{}
+		task.Delay = 0
+		if !task.NoExpBackoff {
+			task.Delay = util.CalcBackoff(task.Attempts + 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := n.Publish(ctx, queueName, &task); err != nil {
+			// Leave it to JetStream to redeliver instead
+			log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+			if task.Delay > 0 {
+				return msg.NakWithDelay(task.Delay)
+			}
+			return msg.Nak()
+		}
+	}
+	return msg.Ack()
+}
+
+/*
+ * Create a queue's stream if it doesn't exist yet, and the shared consumer
+ * on it.
+ */
+func (n *natsQueue) ensureStream(ctx context.Context, queueName string) error {
+	stream := natsStream(queueName)
+
+	if _, err := n.js.Stream(ctx, stream); err != nil {
+		if !errors.Is(err, jetstream.ErrStreamNotFound) {
+			return err
+		}
+		_, err := n.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      stream,
+			Subjects:  []string{natsSubject(queueName)},
+			Retention: jetstream.WorkQueuePolicy,
+			Storage:   jetstream.FileStorage,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("INFO created NATS stream %s for queue %s \n", stream, queueName)
+	}
+
+	consumer, err := n.js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       config.NATS_DURABLE,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       config.NATS_ACK_WAIT,
+		MaxDeliver:    -1,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		FilterSubject: natsSubject(queueName),
+	})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.consumers[queueName] = consumer
+	return nil
+}
+
+/*
+ * The shared consumer on a queue's stream, setting the stream up if the
+ * queue wasn't one Sonic connected with.
+ */
+func (n *natsQueue) consumer(ctx context.Context, queueName string) (jetstream.Consumer, error) {
+	n.mu.Lock()
+	consumer, ok := n.consumers[queueName]
+	n.mu.Unlock()
+	if ok {
+		return consumer, nil
+	}
+
+	if err := n.ensureStream(ctx, queueName); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.consumers[queueName], nil
+}
+
+func natsSubject(queueName string) string {
+	return "sonic." + queueName
+}
+
+func natsStream(queueName string) string {
+	return "SONIC_" + strings.ToUpper(natsStreamUnsafe.ReplaceAllString(queueName, "_"))
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeJetStream speaks just enough of the NATS protocol and JetStream API to
+// serve a single work queue stream to the NATS client.
+type fakeJetStream struct {
+	sync.Mutex
+	listener net.Listener
+	streams  map[string]bool
+	messages [][]byte
+	acks     []string
+	pulls    []fakeJetStreamPull
+	seq      int
+}
+
+// fakeJetStreamPull is a pull waiting for a message to be published.
+type fakeJetStreamPull struct {
+	deliver func(subject, reply string, body []byte)
+	expired *bool
+}
+
+func newFakeJetStream(t *testing.T) *fakeJetStream {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := &fakeJetStream{listener: listener, streams: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeJetStream) serve(conn net.Conn) {
+	defer conn.Close()
+	var writeMu sync.Mutex
+	send := func(format string, args ...interface{}) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		fmt.Fprintf(conn, format, args...)
+	}
+
+	// Subjects the client subscribed to, by subscription ID
+	var subsMu sync.Mutex
+	subscriptions := map[string]string{}
+	sid := func(subject string) string {
+		subsMu.Lock()
+		defer subsMu.Unlock()
+		for id, pattern := range subscriptions {
+			if natsSubjectMatches(pattern, subject) {
+				return id
+			}
+		}
+		return ""
+	}
+	deliver := func(subject, inbox, reply string, body []byte) {
+		if reply != "" {
+			reply += " "
+		}
+		send("MSG %s %s %s%d\r\n%s\r\n", subject, sid(inbox), reply, len(body), body)
+	}
+	status := func(inbox, status string) {
+		headers := "NATS/1.0 " + status + "\r\n\r\n"
+		send("HMSG %s %s %d %d\r\n%s\r\n", inbox, sid(inbox), len(headers), len(headers), headers)
+	}
+
+	send("INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"jetstream\":true,\"max_payload\":1048576}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			send("PONG\r\n")
+		case "SUB":
+			subsMu.Lock()
+			subscriptions[fields[len(fields)-1]] = fields[1]
+			subsMu.Unlock()
+		case "UNSUB":
+			subsMu.Lock()
+			delete(subscriptions, fields[1])
+			subsMu.Unlock()
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			io.ReadFull(reader, payload)
+			payload = payload[:size]
+			if strings.ToUpper(fields[0]) == "HPUB" {
+				headerSize, _ := strconv.Atoi(fields[len(fields)-2])
+				payload = payload[headerSize:]
+				fields = fields[:len(fields)-1]
+			}
+			inbox := ""
+			if len(fields) == 4 {
+				inbox = fields[2]
+			}
+			s.handle(fields[1], inbox, payload, deliver, status)
+		}
+	}
+}
+
+func (s *fakeJetStream) handle(subject, inbox string, payload []byte, deliver func(string, string, string, []byte), status func(string, string)) {
+	s.Lock()
+	defer s.Unlock()
+	reply := func(body string) {
+		deliver(inbox, inbox, "", []byte(body))
+	}
+
+	switch {
+	case subject == "$JS.API.INFO":
+		reply(`{"streams":1}`)
+	case strings.HasPrefix(subject, "$JS.API.STREAM.INFO."):
+		name := strings.TrimPrefix(subject, "$JS.API.STREAM.INFO.")
+		if s.streams[name] {
+			reply(`{"config":{"name":"` + name + `"}}`)
+		} else {
+			reply(`{"error":{"code":404,"err_code":10059,"description":"stream not found"}}`)
+		}
+	case strings.HasPrefix(subject, "$JS.API.STREAM.CREATE."):
+		name := strings.TrimPrefix(subject, "$JS.API.STREAM.CREATE.")
+		s.streams[name] = true
+		reply(`{"config":{"name":"` + name + `"}}`)
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.CREATE."):
+		request := struct {
+			Stream string                 `json:"stream_name"`
+			Config map[string]interface{} `json:"config"`
+		}{}
+		json.Unmarshal(payload, &request)
+		info, _ := json.Marshal(map[string]interface{}{
+			"stream_name": request.Stream,
+			"name":        request.Config["durable_name"],
+			"config":      request.Config,
+		})
+		reply(string(info))
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.MSG.NEXT."):
+		pull := fakeJetStreamPull{
+			deliver: func(subject, reply string, body []byte) {
+				deliver(subject, inbox, reply, body)
+			},
+			expired: new(bool),
+		}
+		if len(s.messages) > 0 {
+			s.pull(pull)
+			return
+		}
+		request := struct {
+			Expires time.Duration `json:"expires"`
+		}{}
+		json.Unmarshal(payload, &request)
+		s.pulls = append(s.pulls, pull)
+		time.AfterFunc(request.Expires, func() {
+			s.Lock()
+			defer s.Unlock()
+			if !*pull.expired {
+				*pull.expired = true
+				status(inbox, "408 Request Timeout")
+			}
+		})
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		s.acks = append(s.acks, string(payload))
+	case subject == "sonic.nats_test":
+		s.messages = append(s.messages, payload)
+		reply(`{"stream":"SONIC_NATS_TEST","seq":` + strconv.Itoa(len(s.messages)) + `}`)
+		for len(s.pulls) > 0 && len(s.messages) > 0 {
+			pull := s.pulls[0]
+			s.pulls = s.pulls[1:]
+			if !*pull.expired {
+				s.pull(pull)
+			}
+		}
+	default:
+		reply(`{"error":{"code":400,"description":"unexpected subject"}}`)
+	}
+}
+
+/*
+ * Deliver the first message to a pull. The fake delivers every message as
+ * its second delivery.
+ */
+func (s *fakeJetStream) pull(pull fakeJetStreamPull) {
+	*pull.expired = true
+	s.seq++
+	body := s.messages[0]
+	s.messages = s.messages[1:]
+	ack := fmt.Sprintf("$JS.ACK.SONIC_NATS_TEST.sonic.2.%d.%d.0.0", s.seq, s.seq)
+	pull.deliver("sonic.nats_test", ack, body)
+}
+
+func natsSubjectMatches(pattern, subject string) bool {
+	patterns := strings.Split(pattern, ".")
+	subjects := strings.Split(subject, ".")
+	for i, token := range patterns {
+		if token == ">" {
+			return len(subjects) > i
+		}
+		if i >= len(subjects) || (token != "*" && token != subjects[i]) {
+			return false
+		}
+	}
+	return len(patterns) == len(subjects)
+}
+
+func withFakeJetStream(t *testing.T) (*fakeJetStream, *natsQueue) {
+	server := newFakeJetStream(t)
+	config.NATS_URL = "nats://" + server.listener.Addr().String()
+
+	client := &natsQueue{}
+	assert.Nil(t, client.Connect("nats", []string{"nats_test"}, nil))
+	return server, client
+}
+
+func TestNATSQueue(t *testing.T) {
+	server, client := withFakeJetStream(t)
+	defer server.listener.Close()
+	defer client.Disconnect()
+
+	server.Lock()
+	assert.True(t, server.streams["SONIC_NATS_TEST"])
+	server.Unlock()
+	assert.Nil(t, client.Healthy(context.Background()))
+
+	assert.Nil(t, client.Publish(context.Background(), "nats_test", &kewpie.Task{Body: "echo hi"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.Pop(ctx, "nats_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "echo hi", task.Body)
+			assert.NotEqual(t, "", task.ID)
+			// The fake delivers every message as a redelivery
+			assert.Equal(t, 1, task.Attempts)
+			return false, nil
+		},
+	})
+	assert.Nil(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, []string{"+ACK"}, server.acks)
+}
+
+func TestNATSQueueWaits(t *testing.T) {
+	server, client := withFakeJetStream(t)
+	defer server.listener.Close()
+	defer client.Disconnect()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Publish(context.Background(), "nats_test", &kewpie.Task{Body: "echo later"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.Pop(ctx, "nats_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			assert.Equal(t, "echo later", task.Body)
+			return false, nil
+		},
+	})
+	assert.Nil(t, err)
+}
+
+func TestNATSQueueRequeue(t *testing.T) {
+	server, client := withFakeJetStream(t)
+	defer server.listener.Close()
+	defer client.Disconnect()
+
+	assert.Nil(t, client.Publish(context.Background(), "nats_test", &kewpie.Task{Body: "exit 1", NoExpBackoff: true}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.Pop(ctx, "nats_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			return true, fmt.Errorf("exit status 1")
+		},
+	})
+	assert.Nil(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, []string{"+ACK"}, server.acks)
+	assert.Equal(t, 1, len(server.messages))
+
+	requeued := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(server.messages[0], &requeued))
+	assert.Equal(t, "exit 1", requeued.Body)
+	assert.Equal(t, 2, requeued.Attempts)
+}
+
+func TestNATSQueueDelayed(t *testing.T) {
+	server, client := withFakeJetStream(t)
+	defer server.listener.Close()
+	defer client.Disconnect()
+
+	assert.Nil(t, client.Publish(context.Background(), "nats_test", &kewpie.Task{Body: "echo later", Delay: time.Minute}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := client.Pop(ctx, "nats_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			t.Fatal("a delayed task shouldn't run early")
+			return false, nil
+		},
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	time.Sleep(50 * time.Millisecond)
+	server.Lock()
+	defer server.Unlock()
+	assert.Equal(t, 1, len(server.acks))
+	assert.True(t, strings.HasPrefix(server.acks[0], `-NAK {"delay": `))
+}
+
+func TestNATSQueueCancelled(t *testing.T) {
+	server, client := withFakeJetStream(t)
+	defer server.listener.Close()
+	defer client.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.Subscribe(ctx, "nats_test", cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			t.Fatal("nothing should be delivered")
+			return false, nil
+		},
+	})
+	assert.Nil(t, err)
+}
+
+func TestNATSStream(t *testing.T) {
+	assert.Equal(t, "SONIC_REPORTS", natsStream("reports"))
+	assert.Equal(t, "SONIC_BILLING_DAILY", natsStream("billing.daily"))
+}
+
+/*
+ * Run tasks through a real server when NATS_TEST_URL is set, eg. to
+ * nats://localhost:4222 for a nats-server started with -js. A stream is
+ * created for the test and deleted afterwards.
+ */
+func TestNATSQueueAgainstServer(t *testing.T) {
+	url := os.Getenv("NATS_TEST_URL")
+	if url == "" {
+		t.Skip("NATS_TEST_URL isn't set")
+	}
+	config.NATS_URL = url
+
+	queueName := "sonic_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	client := &natsQueue{}
+	assert.Nil(t, client.Connect("nats", []string{queueName}, nil))
+	defer client.Disconnect()
+	defer client.js.DeleteStream(context.Background(), natsStream(queueName))
+	assert.Nil(t, client.Healthy(context.Background()))
+
+	pop := func(handle func(task kewpie.Task) (bool, error)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		assert.Nil(t, client.Pop(ctx, queueName, cliHandler{handleFunc: handle}))
+	}
+
+	assert.Nil(t, client.Publish(context.Background(), queueName, &kewpie.Task{
+		ID:           "5d0c7a9e-3b1f-4e2a-8c6d-9f4b2e1a7c30",
+		Body:         "exit 1",
+		NoExpBackoff: true,
+	}))
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "5d0c7a9e-3b1f-4e2a-8c6d-9f4b2e1a7c30", task.ID)
+		assert.Equal(t, 0, task.Attempts)
+		return true, fmt.Errorf("exit status 1")
+	})
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "5d0c7a9e-3b1f-4e2a-8c6d-9f4b2e1a7c30", task.ID)
+		assert.Equal(t, 1, task.Attempts)
+		return false, nil
+	})
+
+	// Delayed tasks are put back until they're due
+	assert.Nil(t, client.Publish(context.Background(), queueName, &kewpie.Task{Body: "echo later", Delay: time.Second}))
+	published := time.Now()
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "echo later", task.Body)
+		assert.True(t, time.Since(published) >= 900*time.Millisecond)
+		return false, nil
+	})
+}
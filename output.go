@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unicode/utf8"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// procOutput receives copies of what a command writes, in addition to
+// Sonic's own stdout and stderr. Any of the writers may be nil. If usage is
+// set it's filled in with what the command consumed once it exits.
+type procOutput struct {
+	combined io.Writer
+	stdout   io.Writer
+	stderr   io.Writer
+	usage    *resourceUsage
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	mu        sync.Mutex
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.truncated = true
+		b.buf = append([]byte{}, b.buf[len(b.buf)-b.limit:]...)
+	}
+
+	return len(p), nil
+}
+
+/*
+ * The captured output, and whether anything before it was dropped. A
+ * character split by the cut is dropped too.
+ */
+func (b *tailBuffer) String() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tail := b.buf
+	if b.truncated {
+		for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+	}
+
+	return string(tail), b.truncated
+}
+
+// prefixedLineLimit is how much of a line a prefixedWriter holds back
+// waiting for its end, so commands that draw progress bars without newlines
+// are still seen.
+const prefixedLineLimit = 64 * 1024
+
+// prefixedWriter writes each line with a prefix. Whole lines are written at
+// once, so lines from tasks sharing Sonic's stdout don't interleave.
+type prefixedWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	prefix  []byte
+	pending []byte
+}
+
+func newPrefixedWriter(out io.Writer, prefix string) *prefixedWriter {
+	return &prefixedWriter{out: out, prefix: []byte(prefix)}
+}
+
+func (w *prefixedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, p...)
+	lines := []byte{}
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			break
+		}
+		lines = append(lines, w.prefix...)
+		lines = append(lines, w.pending[:end+1]...)
+		w.pending = w.pending[end+1:]
+	}
+	if len(w.pending) > prefixedLineLimit {
+		lines = append(lines, w.prefix...)
+		lines = append(lines, w.pending...)
+		lines = append(lines, '\n')
+		w.pending = nil
+	}
+
+	if len(lines) > 0 {
+		if _, err := w.out.Write(lines); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+/*
+ * Write out a final line that didn't end with a newline.
+ */
+func (w *prefixedWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return
+	}
+	line := append(append(append([]byte{}, w.prefix...), w.pending...), '\n')
+	w.pending = nil
+	w.out.Write(line)
+}
+
+/*
+ * The prefix for a run of a task's output lines: its ID, and a short ID for
+ * this run so that retries can be told apart.
+ */
+func outputPrefix(task kewpie.Task) string {
+	run := randomHex(4)
+	if task.ID == "" {
+		return "[" + run + "] "
+	}
+	return "[" + task.ID + " " + run + "] "
+}
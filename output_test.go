@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailBuffer(t *testing.T) {
+	buf := newTailBuffer(8)
+	buf.Write([]byte("hello"))
+
+	out, truncated := buf.String()
+	assert.Equal(t, "hello", out)
+	assert.False(t, truncated)
+
+	buf.Write([]byte(" world"))
+	out, truncated = buf.String()
+	assert.Equal(t, "lo world", out)
+	assert.True(t, truncated)
+
+	// Characters split by the cut are dropped
+	buf = newTailBuffer(3)
+	buf.Write([]byte("ab£cd"))
+	out, _ = buf.String()
+	assert.Equal(t, "cd", out)
+}
+
+func TestPrefixedWriter(t *testing.T) {
+	out := bytes.Buffer{}
+	writer := newPrefixedWriter(&out, "[task] ")
+
+	writer.Write([]byte("one\ntw"))
+	assert.Equal(t, "[task] one\n", out.String())
+	writer.Write([]byte("o\nthree\nfour"))
+	assert.Equal(t, "[task] one\n[task] two\n[task] three\n", out.String())
+
+	writer.flush()
+	assert.Equal(t, "[task] one\n[task] two\n[task] three\n[task] four\n", out.String())
+	writer.flush()
+	assert.Equal(t, "[task] one\n[task] two\n[task] three\n[task] four\n", out.String())
+
+	// Long lines aren't held back forever
+	out.Reset()
+	writer.Write([]byte(strings.Repeat("x", prefixedLineLimit+1)))
+	assert.Equal(t, "[task] "+strings.Repeat("x", prefixedLineLimit+1)+"\n", out.String())
+}
+
+func TestOutputPrefix(t *testing.T) {
+	assert.Regexp(t, regexp.MustCompile(`^\[report-42 [0-9a-f]{8}\] $`), outputPrefix(kewpie.Task{ID: "report-42"}))
+	assert.Regexp(t, regexp.MustCompile(`^\[[0-9a-f]{8}\] $`), outputPrefix(kewpie.Task{}))
+	assert.NotEqual(t, outputPrefix(kewpie.Task{ID: "report-42"}), outputPrefix(kewpie.Task{ID: "report-42"}))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// hostRequiresTag lists paths, such as devices, that must exist on the host
+// for a task to run.
+const hostRequiresTag = "host_requires"
+
+// taskSlot is held while a task from the main queue or the parking lot runs,
+// so the two never run side by side.
+var taskSlot sync.Mutex
+
+// parkedTask is the state persisted for each parked task.
+type parkedTask struct {
+	Task     kewpie.Task `json:"task"`
+	Reason   string      `json:"reason"`
+	ParkedAt time.Time   `json:"parked_at"`
+}
+
+/*
+ * Tasks are only parked when they can be persisted to STATE_DIR.
+ */
+func parkingEnabled() bool {
+	return config.STATE_DIR != ""
+}
+
+func parkedDir() string {
+	return filepath.Join(config.STATE_DIR, "parked")
+}
+
+/*
+ * Describe why this host can't run the task right now, or return an empty
+ * string if it can.
+ */
+func hostCondition(task kewpie.Task) string {
+	if config.PARK_MIN_FREE_DISK != "" {
+		minimum, err := parseByteSize(config.PARK_MIN_FREE_DISK)
+		if err != nil {
+			log.Printf("ERROR parsing PARK_MIN_FREE_DISK: %s \n", err.Error())
+		} else if free, err := freeDiskBytes(parkDiskPath()); err == nil && int64(free) < minimum {
+			return fmt.Sprintf("only %d bytes free on %s", free, parkDiskPath())
+		}
+	}
+
+	for _, path := range strings.Split(task.Tags[hostRequiresTag], ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Sprintf("%s is missing", path)
+		}
+	}
+
+	return ""
+}
+
+func parkDiskPath() string {
+	if config.PARK_DISK_PATH != "" {
+		return config.PARK_DISK_PATH
+	}
+	if config.WORKSPACE_ROOT != "" {
+		return config.WORKSPACE_ROOT
+	}
+	return os.TempDir()
+}
+
+/*
+ * Whether a failed task exited with one of PARK_EXIT_CODES, which the
+ * command uses to say the host, rather than the task, is at fault.
+ */
+func shouldPark(err error) bool {
+	return config.PARK_EXIT_CODES[exitCode(err)]
+}
+
+/*
+ * Set a task aside on this host until the condition that stopped it clears,
+ * instead of cycling it through retries. Returns the requeue decision for
+ * Kewpie, which requeues the task if it couldn't be parked.
+ */
+func parkTask(task kewpie.Task, reason string) (bool, error) {
+	log.Printf("INFO parking task %s: %s \n", task.ID, reason)
+
+	contents, err := json.Marshal(parkedTask{Task: task, Reason: reason, ParkedAt: time.Now()})
+	if err != nil {
+		log.Printf("ERROR marshalling parked task %+v\n", err)
+		return true, err
+	}
+
+	if err := os.MkdirAll(parkedDir(), 0700); err != nil {
+		log.Printf("ERROR creating parking dir %s: %s \n", parkedDir(), err.Error())
+		reportSubsystemFailure("state", err)
+		return true, err
+	}
+
+	path := filepath.Join(parkedDir(), time.Now().UTC().Format("20060102T150405.000000000")+"-"+uuid.NewV4().String()+".json")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		log.Printf("ERROR writing parked task %s: %s \n", path, err.Error())
+		reportSubsystemFailure("state", err)
+		return true, err
+	}
+
+	incCounter("sonic_tasks_parked_total", nil)
+	return false, nil
+}
+
+/*
+ * Run each parked task whose host condition has cleared, oldest first. Tasks
+ * that hit a host condition again are parked again.
+ */
+func retryParked(ctx context.Context) {
+	paths, err := filepath.Glob(filepath.Join(parkedDir(), "*.json"))
+	if err != nil {
+		log.Printf("ERROR listing parked tasks: %s \n", err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("ERROR reading parked task %s: %s \n", path, err.Error())
+			continue
+		}
+		parked := parkedTask{}
+		if err := json.Unmarshal(contents, &parked); err != nil {
+			log.Printf("ERROR parsing parked task %s: %s \n", path, err.Error())
+			continue
+		}
+
+		if reason := hostCondition(parked.Task); reason != "" {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("ERROR removing parked task %s: %s \n", path, err.Error())
+			continue
+		}
+
+		log.Printf("INFO retrying parked task %s, parked since %s because %s \n", parked.Task.ID, parked.ParkedAt.Format(time.RFC3339), parked.Reason)
+		handleTask(ctx, parked.Task)
+	}
+}
+
+/*
+ * Retry parked tasks straight away, to pick up any left by a previous run of
+ * Sonic, and then every PARK_RETRY_INTERVAL.
+ */
+func watchParked(ctx context.Context) {
+	if !parkingEnabled() {
+		return
+	}
+
+	for {
+		taskSlot.Lock()
+		retryParked(ctx)
+		taskSlot.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.PARK_RETRY_INTERVAL):
+		}
+	}
+}
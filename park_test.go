@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withParking(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sonic-park-")
+	assert.Nil(t, err)
+
+	config.STATE_DIR = dir
+	return dir, func() {
+		config.STATE_DIR = ""
+		config.PARK_EXIT_CODES = map[int]bool{}
+		os.RemoveAll(dir)
+	}
+}
+
+func parkedTasks(t *testing.T) []string {
+	paths, err := filepath.Glob(filepath.Join(parkedDir(), "*.json"))
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestParkMissingDevice(t *testing.T) {
+	dir, cleanup := withParking(t)
+	defer cleanup()
+
+	device := filepath.Join(dir, "device")
+	task := kewpie.Task{Body: "true", Tags: kewpie.Tags{hostRequiresTag: device}}
+	assert.Contains(t, hostCondition(task), "is missing")
+
+	parked := counterValue("sonic_tasks_parked_total", nil)
+	requeue, err := handleTask(context.Background(), task)
+	assert.Nil(t, err)
+	assert.False(t, requeue)
+	assert.Equal(t, parked+1, counterValue("sonic_tasks_parked_total", nil))
+	assert.Len(t, parkedTasks(t), 1)
+
+	retryParked(context.Background())
+	assert.Len(t, parkedTasks(t), 1)
+
+	assert.Nil(t, ioutil.WriteFile(device, []byte{}, 0600))
+	assert.Equal(t, "", hostCondition(task))
+
+	retryParked(context.Background())
+	assert.Len(t, parkedTasks(t), 0)
+}
+
+func TestParkExitCode(t *testing.T) {
+	_, cleanup := withParking(t)
+	defer cleanup()
+
+	config.PARK_EXIT_CODES = map[int]bool{1: true}
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{Body: "false"})
+	assert.Nil(t, err)
+	assert.False(t, requeue)
+	assert.Len(t, parkedTasks(t), 1)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+/*
+ * Find the require_<capability> tags on a task that this worker doesn't
+ * satisfy. A required value of true is met by any worker advertising the
+ * capability, anything else must match the advertised value exactly.
+ */
+func unmetRequirements(task kewpie.Task) []string {
+	unmet := []string{}
+
+	for tag, required := range task.Tags {
+		if !strings.HasPrefix(tag, "require_") {
+			continue
+		}
+		capability := strings.TrimPrefix(tag, "require_")
+		advertised, ok := config.CAPABILITIES[capability]
+		if !ok || (required != "true" && required != advertised) {
+			unmet = append(unmet, capability)
+		}
+	}
+
+	sort.Strings(unmet)
+	return unmet
+}
+
+/*
+ * Hand a task this worker can't run back to the queue for another worker to
+ * pick up. It's republished straight away rather than requeued, so it isn't
+ * held back by retry backoff or counted as a failed attempt. Returns the
+ * requeue decision for Kewpie.
+ */
+func passOnTask(ctx context.Context, task kewpie.Task, unmet []string) (bool, error) {
+	log.Printf("INFO passing on task %s, this worker lacks %s \n", task.ID, strings.Join(unmet, ", "))
+
+	if err := publishOrSpill(ctx, sourceQueue(ctx), &task); err != nil {
+		log.Printf("ERROR republishing task %s: %s \n", task.ID, err.Error())
+		return true, err
+	}
+
+	return false, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmetRequirements(t *testing.T) {
+	config.CAPABILITIES = map[string]string{
+		"gpu":    "true",
+		"region": "us-east",
+	}
+	defer func() {
+		config.CAPABILITIES = map[string]string{}
+	}()
+
+	assert.Empty(t, unmetRequirements(kewpie.Task{
+		Tags: kewpie.Tags{
+			"require_gpu":    "true",
+			"require_region": "us-east",
+		},
+	}))
+
+	assert.Equal(t, []string{"big-mem", "region"}, unmetRequirements(kewpie.Task{
+		Tags: kewpie.Tags{
+			"require_big-mem": "true",
+			"require_region":  "eu-west",
+		},
+	}))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/paidright/sonic/config"
+)
+
+/*
+ * Whether WEBHOOK_URL_ALLOWLIST permits webhooks to a URL. Webhook URLs come
+ * from task tags, which may be untrusted, so without this any producer can
+ * make workers send requests wherever they like. Patterns without a scheme
+ * match the URL's host, and may use globs, eg. *.example.com. Patterns with
+ * a scheme, eg. https://hooks.example.com/sonic/, match URLs with the same
+ * scheme and host whose path starts with the pattern's. An empty allowlist
+ * permits everything.
+ */
+func webhookURLAllowed(rawURL string) bool {
+	return urlAllowed(rawURL, config.WEBHOOK_URL_ALLOWLIST)
+}
+
+/*
+ * Whether SCRIPT_URL_ALLOWLIST permits downloading a script_url, matched the
+ * same way as WEBHOOK_URL_ALLOWLIST.
+ */
+func scriptURLAllowed(rawURL string) bool {
+	return urlAllowed(rawURL, config.SCRIPT_URL_ALLOWLIST)
+}
+
+func urlAllowed(rawURL string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil || target.Hostname() == "" {
+		return false
+	}
+
+	for _, pattern := range allowlist {
+		if !strings.Contains(pattern, "://") {
+			if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target.Hostname())); matched {
+				return true
+			}
+			continue
+		}
+
+		prefix, err := url.Parse(pattern)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(prefix.Scheme, target.Scheme) || !strings.EqualFold(prefix.Host, target.Host) {
+			continue
+		}
+		if pathHasPrefix(target.Path, prefix.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * Whether a URL path is prefix, or is beneath it, so /sonic doesn't match
+ * /sonicabc.
+ */
+func pathHasPrefix(p, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+// errBlockedAddress is returned when dialling a webhook receiver at a
+// private address with WEBHOOK_BLOCK_PRIVATE set.
+var errBlockedAddress = fmt.Errorf("Webhooks to private addresses are blocked")
+
+// privateNetworks are the ranges WEBHOOK_BLOCK_PRIVATE refuses: loopback,
+// RFC 1918, carrier grade NAT, link local (including cloud metadata
+// endpoints), IPv6 unique local, and unspecified addresses.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+/*
+ * Whether webhooks may connect to an IP with WEBHOOK_BLOCK_PRIVATE set.
+ * Networks in WEBHOOK_ALLOWED_NETWORKS are permitted even if private.
+ */
+func webhookAddressAllowed(ip net.IP) bool {
+	return addressAllowed(ip, config.WEBHOOK_ALLOWED_NETWORKS)
+}
+
+func addressAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Check the address a webhook is about to connect to. This runs after the
+ * host is resolved, for each address tried, so a receiver can't get past it
+ * by resolving to a private address only once it has been checked.
+ */
+func checkWebhookAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAddressAllowed(ip) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+/*
+ * Whether a webhook request failed because its receiver's address is blocked.
+ */
+func blockedAddressError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	return err == errBlockedAddress
+}
+
+// errRedirectNotAllowed is returned when a webhook receiver redirects to a
+// URL WEBHOOK_URL_ALLOWLIST doesn't permit.
+var errRedirectNotAllowed = fmt.Errorf("Webhook redirects outside WEBHOOK_URL_ALLOWLIST are refused")
+
+/*
+ * Follow webhook redirects up to WEBHOOK_MAX_REDIRECTS deep, as long as they
+ * stay within WEBHOOK_URL_ALLOWLIST. Past that depth the redirect response
+ * itself is returned, and treated as a failure.
+ */
+func checkWebhookRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > config.WEBHOOK_MAX_REDIRECTS {
+		return http.ErrUseLastResponse
+	}
+	if !webhookURLAllowed(req.URL.String()) {
+		return errRedirectNotAllowed
+	}
+	return nil
+}
+
+/*
+ * Whether a webhook request failed because it was redirected somewhere it
+ * isn't allowed to go.
+ */
+func refusedRedirectError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	return err == errRedirectNotAllowed
+}
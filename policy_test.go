@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookURLAllowed(t *testing.T) {
+	assert.True(t, webhookURLAllowed("http://169.254.169.254/latest/meta-data"))
+
+	config.WEBHOOK_URL_ALLOWLIST = []string{"*.example.com", "https://hooks.partner.io/sonic"}
+	defer func() {
+		config.WEBHOOK_URL_ALLOWLIST = []string{}
+	}()
+
+	for rawURL, allowed := range map[string]bool{
+		"https://api.example.com/done":            true,
+		"http://API.Example.com:8080/done":        true,
+		"https://example.com.evil.io/done":        false,
+		"https://hooks.partner.io/sonic":          true,
+		"https://hooks.partner.io/sonic/success":  true,
+		"https://hooks.partner.io/sonicabc":       false,
+		"http://hooks.partner.io/sonic/success":   false,
+		"https://hooks.partner.io.evil.io/sonic/": false,
+		"http://169.254.169.254/latest/meta-data": false,
+		"/dev/null": false,
+		"https://user@hooks.partner.io/sonic/done": true,
+	} {
+		assert.Equal(t, allowed, webhookURLAllowed(rawURL), rawURL)
+	}
+}
+
+func TestWebhookPolicyViolation(t *testing.T) {
+	config.WEBHOOK_URL_ALLOWLIST = []string{"hooks.example.com"}
+	defer func() {
+		config.WEBHOOK_URL_ALLOWLIST = []string{}
+	}()
+
+	labels := map[string]string{"event": "start"}
+	violations := counterValue("sonic_webhook_policy_violations_total", labels)
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"webhook_start": "http://169.254.169.254/latest/meta-data",
+		},
+	})
+	assert.False(t, requeue)
+	assert.Equal(t, errCodePolicyViolation, newTaskError(err).Code)
+	assert.Equal(t, violations+1, counterValue("sonic_webhook_policy_violations_total", labels))
+}
+
+func TestWebhookBlockPrivate(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config.WEBHOOK_BLOCK_PRIVATE = true
+	client, err := newWebhookClient()
+	assert.Nil(t, err)
+	webhookClient = client
+	defer func() {
+		config.WEBHOOK_BLOCK_PRIVATE = false
+		config.WEBHOOK_ALLOWED_NETWORKS = []*net.IPNet{}
+		webhookClient = http.DefaultClient
+	}()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL,
+		},
+	}
+
+	labels := map[string]string{"event": "success"}
+	violations := counterValue("sonic_webhook_policy_violations_total", labels)
+	assert.Equal(t, ErrWebhookNotAllowed, sendWebhook(successWebhook, task))
+	assert.Equal(t, violations+1, counterValue("sonic_webhook_policy_violations_total", labels))
+	assert.Equal(t, 0, calls)
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	config.WEBHOOK_ALLOWED_NETWORKS = []*net.IPNet{loopback}
+	assert.Nil(t, sendWebhook(successWebhook, task))
+	assert.Equal(t, 1, calls)
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"10.1.2.3":        false,
+		"172.31.255.255":  false,
+		"172.32.0.1":      true,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+		"2606:4700::1111": true,
+	} {
+		assert.Equal(t, allowed, webhookAddressAllowed(net.ParseIP(address)), address)
+	}
+}
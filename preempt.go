@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// How a running task is made way for when an urgent task arrives.
+const (
+	preemptPause   = "pause"
+	preemptRequeue = "requeue"
+)
+
+// urgentTaskKey marks the context of a task taken from PREEMPT_QUEUE, which
+// can't itself be preempted.
+type urgentTaskKey struct{}
+
+// preemptible is the task currently running from the main queue, if any.
+var preemptible = struct {
+	sync.Mutex
+	task      kewpie.Task
+	pid       int
+	cancel    context.CancelFunc
+	running   bool
+	preempted bool
+}{}
+
+// urgentSlot is held while an urgent task runs, so the main queue doesn't
+// start another task alongside it.
+var urgentSlot sync.Mutex
+
+/*
+ * Record a started task process as the one an urgent task would preempt.
+ * Returns a function that reports whether it was preempted and clears it.
+ */
+func trackPreemptible(ctx context.Context, task kewpie.Task, cmd *exec.Cmd, cancel context.CancelFunc) func() bool {
+	if config.PREEMPT_QUEUE == "" || ctx.Value(urgentTaskKey{}) != nil {
+		return func() bool { return false }
+	}
+
+	preemptible.Lock()
+	defer preemptible.Unlock()
+
+	preemptible.task = task
+	preemptible.pid = cmd.Process.Pid
+	preemptible.cancel = cancel
+	preemptible.running = true
+	preemptible.preempted = false
+
+	return func() bool {
+		preemptible.Lock()
+		defer preemptible.Unlock()
+
+		preemptible.running = false
+		return preemptible.preempted
+	}
+}
+
+/*
+ * Consume PREEMPT_QUEUE alongside the main queue. Each urgent task runs as
+ * soon as it arrives, and any task already running is paused until the urgent
+ * one finishes, or killed and republished, according to PREEMPT_MODE.
+ */
+func subscribeUrgent(ctx context.Context) {
+	handler := cliHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			urgentSlot.Lock()
+			defer urgentSlot.Unlock()
+
+			resume := preemptRunning(task)
+			defer resume()
+
+			return handleTaskWithAck(context.WithValue(withSourceQueue(ctx, config.PREEMPT_QUEUE), urgentTaskKey{}, true), task, nil)
+		},
+	}
+
+	go func() {
+		if err := queue.Subscribe(ctx, config.PREEMPT_QUEUE, handler); err != nil {
+			log.Printf("ERROR subscribing to %s: %s \n", config.PREEMPT_QUEUE, err.Error())
+		}
+	}()
+}
+
+/*
+ * Make way for an urgent task. Returns a function to resume the preempted
+ * task once the urgent one is done.
+ */
+func preemptRunning(urgent kewpie.Task) func() {
+	preemptible.Lock()
+	defer preemptible.Unlock()
+
+	if !preemptible.running || preemptible.preempted {
+		return func() {}
+	}
+
+	pid := preemptible.pid
+	log.Printf("INFO urgent task %s preempting task %s \n", urgent.ID, preemptible.task.ID)
+	incCounter("sonic_preemptions_total", map[string]string{"mode": config.PREEMPT_MODE})
+
+	if config.PREEMPT_MODE == preemptRequeue {
+		preemptible.preempted = true
+		preemptible.cancel()
+		return func() {}
+	}
+
+	if err := stopProcess(pid); err != nil {
+		log.Printf("ERROR pausing pid %d: %s \n", pid, err.Error())
+		return func() {}
+	}
+
+	return func() {
+		log.Printf("INFO resuming pid %d \n", pid)
+		if err := continueProcess(pid); err != nil {
+			log.Printf("ERROR resuming pid %d: %s \n", pid, err.Error())
+		}
+	}
+}
+
+/*
+ * Republish a task that was killed to make way for an urgent one, so it runs
+ * again from the start. Returns the requeue decision for Kewpie.
+ */
+func republishPreempted(ctx context.Context, task kewpie.Task) (bool, error) {
+	log.Printf("INFO republishing preempted task %s \n", task.ID)
+
+	if err := publishOrSpill(ctx, sourceQueue(ctx), &task); err != nil {
+		log.Printf("ERROR republishing task %s: %s \n", task.ID, err.Error())
+		return true, err
+	}
+
+	return false, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreemptPause(t *testing.T) {
+	defer withPreemption(preemptPause)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := startPreemptible(t, ctx)
+
+	preemptible.Lock()
+	pid := preemptible.pid
+	preemptible.Unlock()
+
+	// Signals are delivered asynchronously
+	waitForState := func(stopped bool) {
+		for i := 0; i < 100; i++ {
+			state, _, err := readProcStat(pid)
+			assert.Nil(t, err)
+			if (state == "T") == stopped {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("pid %d never reached stopped=%t", pid, stopped)
+	}
+
+	resume := preemptRunning(kewpie.Task{ID: "urgent"})
+	waitForState(true)
+
+	resume()
+	waitForState(false)
+
+	cancel()
+	<-done
+}
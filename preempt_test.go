@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withPreemption(mode string) func() {
+	config.PREEMPT_QUEUE = "urgent_test"
+	config.PREEMPT_MODE = mode
+	return func() {
+		config.PREEMPT_QUEUE = ""
+		config.PREEMPT_MODE = preemptPause
+	}
+}
+
+/*
+ * Start a long running task in the background, returning once it's running
+ * and can be preempted.
+ */
+func startPreemptible(t *testing.T, ctx context.Context) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- runTaskProc(ctx, kewpie.Task{Body: "sleep 5"})
+	}()
+
+	for i := 0; i < 100; i++ {
+		preemptible.Lock()
+		running := preemptible.running
+		preemptible.Unlock()
+		if running {
+			return done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("task never started")
+	return done
+}
+
+func TestPreemptRequeue(t *testing.T) {
+	defer withPreemption(preemptRequeue)()
+
+	done := startPreemptible(t, context.Background())
+	preemptRunning(kewpie.Task{ID: "urgent"})()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, errCodePreempted, newTaskError(err).Code)
+	case <-time.After(2 * time.Second):
+		t.Fatal("preempted task was not killed")
+	}
+}
+
+func TestUrgentTasksAreNotPreemptible(t *testing.T) {
+	defer withPreemption(preemptRequeue)()
+
+	preemptible.Lock()
+	preemptible.task = kewpie.Task{}
+	preemptible.Unlock()
+
+	ctx := context.WithValue(context.Background(), urgentTaskKey{}, true)
+	assert.Nil(t, runTaskProc(ctx, kewpie.Task{Body: "true"}))
+
+	preemptible.Lock()
+	defer preemptible.Unlock()
+	assert.Equal(t, "", preemptible.task.Body)
+}
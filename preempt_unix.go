@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+/*
+ * Pause a task and everything it has started, as tasks lead their own process
+ * group.
+ */
+func stopProcess(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGSTOP)
+}
+
+func continueProcess(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGCONT)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ErrPauseUnsupported is returned when PREEMPT_MODE=pause is used on Windows,
+// which has no equivalent of SIGSTOP.
+var ErrPauseUnsupported = fmt.Errorf("Pausing tasks is not supported on windows, use PREEMPT_MODE=requeue")
+
+func stopProcess(pid int) error {
+	return ErrPauseUnsupported
+}
+
+func continueProcess(pid int) error {
+	return ErrPauseUnsupported
+}
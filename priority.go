@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// taskPriority is the CPU and IO scheduling priority of a task process.
+type taskPriority struct {
+	nice       int
+	setNice    bool
+	ioClass    int
+	ioLevel    int
+	setIOClass bool
+}
+
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+/*
+ * Work out the scheduling priority for a task. The nice_level and
+ * ionice_class tags override NICE_LEVEL and IONICE_CLASS, but only to lower
+ * the task's priority, as tags come from producers. Without NICE_LEVEL or
+ * IONICE_CLASS, tags can't ask for more than the default of nice 0 and
+ * best-effort:4.
+ */
+func taskPriorityFor(task kewpie.Task) (taskPriority, error) {
+	priority := taskPriority{}
+
+	if config.NICE_LEVEL != "" {
+		level, err := parseNiceLevel(config.NICE_LEVEL)
+		if err != nil {
+			return priority, err
+		}
+		priority.nice = level
+		priority.setNice = true
+	}
+	if task.Tags["nice_level"] != "" {
+		level, err := parseNiceLevel(task.Tags["nice_level"])
+		if err != nil {
+			return priority, err
+		}
+		if level < priority.nice {
+			return priority, fmt.Errorf("The nice_level tag can't be below %d", priority.nice)
+		}
+		priority.nice = level
+		priority.setNice = true
+	}
+
+	priority.ioClass, priority.ioLevel = ioniceClasses["best-effort"], 4
+	if config.IONICE_CLASS != "" {
+		class, level, err := parseIoniceClass(config.IONICE_CLASS)
+		if err != nil {
+			return priority, err
+		}
+		priority.ioClass = class
+		priority.ioLevel = level
+		priority.setIOClass = true
+	}
+	if task.Tags["ionice_class"] != "" {
+		class, level, err := parseIoniceClass(task.Tags["ionice_class"])
+		if err != nil {
+			return priority, err
+		}
+		if !ioniceNoHigher(class, level, priority.ioClass, priority.ioLevel) {
+			return priority, fmt.Errorf("The ionice_class tag %q can't ask for a higher IO priority than %s", task.Tags["ionice_class"], ioniceName(priority.ioClass, priority.ioLevel))
+		}
+		priority.ioClass = class
+		priority.ioLevel = level
+		priority.setIOClass = true
+	}
+
+	return priority, nil
+}
+
+func parseNiceLevel(nice string) (int, error) {
+	level, err := strconv.Atoi(nice)
+	if err != nil || level < -20 || level > 19 {
+		return 0, fmt.Errorf("Invalid nice level %q, expected -20 to 19", nice)
+	}
+	return level, nil
+}
+
+/*
+ * Whether an IO class and level are no higher a priority than another.
+ * Classes run from realtime down to idle, and levels within a class from 0
+ * down to 7. Idle has no levels.
+ */
+func ioniceNoHigher(class, level, thanClass, thanLevel int) bool {
+	if class != thanClass {
+		return class > thanClass
+	}
+	return class == ioniceClasses["idle"] || level >= thanLevel
+}
+
+func ioniceName(class, level int) string {
+	for name, value := range ioniceClasses {
+		if value == class {
+			if name == "idle" {
+				return name
+			}
+			return fmt.Sprintf("%s:%d", name, level)
+		}
+	}
+	return strconv.Itoa(class)
+}
+
+/*
+ * Parse an IO scheduling class such as idle or best-effort:7. The level after
+ * the colon ranges from 0 (highest) to 7 and defaults to 4.
+ */
+func parseIoniceClass(ionice string) (int, int, error) {
+	parts := strings.SplitN(ionice, ":", 2)
+
+	class, ok := ioniceClasses[parts[0]]
+	if !ok {
+		return 0, 0, fmt.Errorf("Invalid ionice class %q, expected realtime, best-effort or idle", ionice)
+	}
+
+	level := 4
+	if len(parts) == 2 {
+		parsed, err := strconv.Atoi(parts[1])
+		if err != nil || parsed < 0 || parsed > 7 {
+			return 0, 0, fmt.Errorf("Invalid ionice level in %q, expected 0 to 7", ionice)
+		}
+		level = parsed
+	}
+
+	return class, level, nil
+}
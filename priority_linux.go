@@ -0,0 +1,28 @@
+package main
+
+import "syscall"
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+/*
+ * Set the scheduling priority of a running process.
+ */
+func applyPriority(pid int, priority taskPriority) error {
+	if priority.setNice {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, priority.nice); err != nil {
+			return err
+		}
+	}
+
+	if priority.setIOClass {
+		ioprio := priority.ioClass<<ioprioClassShift | priority.ioLevel
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(ioprio)); errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
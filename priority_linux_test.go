@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProcWithPriority(t *testing.T) {
+	assert.Nil(t, runTaskProc(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"nice_level":   "5",
+			"ionice_class": "best-effort",
+		},
+	}))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// ErrPriorityUnsupported is returned when a nice level or ionice class is
+// requested on a platform Sonic can't apply it on.
+var ErrPriorityUnsupported = fmt.Errorf("Setting task priority is only supported on linux")
+
+func applyPriority(pid int, priority taskPriority) error {
+	if priority.setNice || priority.setIOClass {
+		return ErrPriorityUnsupported
+	}
+	return nil
+}
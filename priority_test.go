@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskPriorityFor(t *testing.T) {
+	config.NICE_LEVEL = "10"
+	config.IONICE_CLASS = "idle"
+	defer func() {
+		config.NICE_LEVEL = ""
+		config.IONICE_CLASS = ""
+	}()
+
+	priority, err := taskPriorityFor(kewpie.Task{
+		Tags: kewpie.Tags{
+			"nice_level": "15",
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, priority.setNice)
+	assert.Equal(t, 15, priority.nice)
+	assert.True(t, priority.setIOClass)
+	assert.Equal(t, 3, priority.ioClass)
+
+	config.IONICE_CLASS = "best-effort:2"
+	priority, err = taskPriorityFor(kewpie.Task{
+		Tags: kewpie.Tags{
+			"ionice_class": "best-effort:7",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, priority.nice)
+	assert.Equal(t, 2, priority.ioClass)
+	assert.Equal(t, 7, priority.ioLevel)
+}
+
+func TestTaskPriorityForCantBeRaised(t *testing.T) {
+	config.NICE_LEVEL = "10"
+	config.IONICE_CLASS = "best-effort:4"
+	defer func() {
+		config.NICE_LEVEL = ""
+		config.IONICE_CLASS = ""
+	}()
+
+	for _, tags := range []kewpie.Tags{
+		{"nice_level": "9"},
+		{"nice_level": "-20"},
+		{"ionice_class": "realtime"},
+		{"ionice_class": "best-effort:3"},
+	} {
+		_, err := taskPriorityFor(kewpie.Task{Tags: tags})
+		assert.Error(t, err, tags)
+	}
+
+	priority, err := taskPriorityFor(kewpie.Task{Tags: kewpie.Tags{"ionice_class": "idle"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, priority.ioClass)
+
+	// Without config, tags can only ask for the default priority or lower
+	config.NICE_LEVEL = ""
+	config.IONICE_CLASS = ""
+	_, err = taskPriorityFor(kewpie.Task{Tags: kewpie.Tags{"nice_level": "-1"}})
+	assert.Error(t, err)
+	_, err = taskPriorityFor(kewpie.Task{Tags: kewpie.Tags{"ionice_class": "realtime:7"}})
+	assert.Error(t, err)
+
+	priority, err = taskPriorityFor(kewpie.Task{Tags: kewpie.Tags{"nice_level": "0", "ionice_class": "best-effort:4"}})
+	assert.Nil(t, err)
+	assert.True(t, priority.setNice)
+	assert.True(t, priority.setIOClass)
+
+	priority, err = taskPriorityFor(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.False(t, priority.setNice)
+	assert.False(t, priority.setIOClass)
+}
+
+func TestTaskPriorityForInvalid(t *testing.T) {
+	_, err := taskPriorityFor(kewpie.Task{
+		Tags: kewpie.Tags{
+			"nice_level": "99",
+		},
+	})
+	assert.Error(t, err)
+
+	_, err = taskPriorityFor(kewpie.Task{
+		Tags: kewpie.Tags{
+			"ionice_class": "whenever",
+		},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+ * Read the state and parent pid of a process from /proc/<pid>/stat. The
+ * command name is parenthesised and may contain spaces, so fields are
+ * counted from the last closing paren.
+ */
+func readProcStat(pid int) (string, int, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return "", 0, err
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fields[0], ppid, nil
+}
+
+/*
+ * Read the start time of a process, in clock ticks since boot. Together with
+ * the pid this identifies a process even if the pid has been reused.
+ */
+func procStartTime(pid int) (uint64, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// starttime is field 22 of stat, the 20th after the command name
+	if len(fields) < 20 {
+		return 0, syscall.EINVAL
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+func procStatFields(pid int) ([]string, error) {
+	contents, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	stat := string(contents)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 2 {
+		return nil, syscall.EINVAL
+	}
+
+	return fields, nil
+}
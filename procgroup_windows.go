@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Windows has no process groups to signal, so cancelling a task kills only
+// the command.
+func prepareProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ptyDrainGrace is how long output is still copied from the terminal after
+// the child exits, while anything it left running in the background holds
+// the terminal open.
+var ptyDrainGrace = 2 * time.Second
+
+// ptyAttachment connects a child process to a pseudo-terminal and copies
+// everything written to the terminal into an output writer.
+type ptyAttachment struct {
+	master *os.File
+	slave  *os.File
+	done   chan struct{}
+}
+
+/*
+ * Allocate a pseudo-terminal and make it the controlling terminal and stdio
+ * of cmd. Output is copied to out until the child closes the terminal.
+ */
+func attachPty(cmd *exec.Cmd, out io.Writer) (*ptyAttachment, error) {
+	// The master is non-blocking so the copy from it can be cut short
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := 0
+	if err := ioctl(uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	var ptyNumber uint32
+	if err := ioctl(uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNumber))); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(ptyNumber)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+
+	attachment := &ptyAttachment{
+		master: master,
+		slave:  slave,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(attachment.done)
+		// Reading the master returns EIO once the child side is closed
+		io.Copy(out, master)
+	}()
+
+	return attachment, nil
+}
+
+/*
+ * Release the parent's handle on the terminal once the child has started, so
+ * the output copy ends when the child exits.
+ */
+func (p *ptyAttachment) started() {
+	p.slave.Close()
+}
+
+/*
+ * Wait for all terminal output to be copied, then release the terminal. A
+ * descendant of the child can keep the terminal open long after the child
+ * has exited, so the copy is only waited on for ptyDrainGrace before it's
+ * cut off.
+ */
+func (p *ptyAttachment) wait() {
+	p.slave.Close()
+	select {
+	case <-p.done:
+	case <-time.After(ptyDrainGrace):
+		// Closing the master ends the read the copy is waiting in
+		p.master.Close()
+		<-p.done
+		return
+	}
+	p.master.Close()
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachPty(t *testing.T) {
+	out := &bytes.Buffer{}
+	cmd := exec.Command("sh", "-c", "test -t 1 && echo is a tty")
+
+	pty, err := attachPty(cmd, out)
+	assert.Nil(t, err)
+
+	assert.Nil(t, cmd.Start())
+	pty.started()
+	assert.Nil(t, cmd.Wait())
+	pty.wait()
+
+	assert.Contains(t, out.String(), "is a tty")
+}
+
+func TestAttachPtyBackgroundChild(t *testing.T) {
+	ptyDrainGrace = 200 * time.Millisecond
+	defer func() {
+		ptyDrainGrace = 2 * time.Second
+	}()
+
+	out := &bytes.Buffer{}
+	// The sleep ignores the hangup when the shell exits, and keeps the
+	// terminal open
+	cmd := exec.Command("sh", "-c", "trap '' HUP; sleep 30 & echo $!; echo started")
+
+	pty, err := attachPty(cmd, out)
+	assert.Nil(t, err)
+
+	assert.Nil(t, cmd.Start())
+	pty.started()
+	assert.Nil(t, cmd.Wait())
+
+	waited := time.Now()
+	pty.wait()
+	assert.True(t, time.Since(waited) >= 200*time.Millisecond)
+	assert.True(t, time.Since(waited) < 5*time.Second)
+	assert.Contains(t, out.String(), "started")
+
+	if pid, err := strconv.Atoi(strings.Fields(out.String())[0]); err == nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// ErrPtyUnsupported is returned when a task asks for a tty on a platform
+// where Sonic can't allocate one.
+var ErrPtyUnsupported = errors.New("tty allocation is only supported on linux")
+
+type ptyAttachment struct{}
+
+func attachPty(cmd *exec.Cmd, out io.Writer) (*ptyAttachment, error) {
+	return nil, ErrPtyUnsupported
+}
+
+func (p *ptyAttachment) started() {}
+
+func (p *ptyAttachment) wait() {}
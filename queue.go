@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+)
+
+// QueueBackend is what Sonic needs from a queue backend. Kewpie provides
+// most of them, and Sonic provides the rest itself. A backend acknowledges a
+// task once the handler passed to Pop or Subscribe returns for it: with no
+// error it's acked, with an error and requeue set it's nacked and delivered
+// again, and with an error alone it's dropped. Backends that can't tell
+// whether a task was acked, eg. because the worker died, should redeliver it.
+type QueueBackend interface {
+	Connect(backend string, queues []string, connection interface{}) error
+	Disconnect() error
+	Healthy(ctx context.Context) error
+	Publish(ctx context.Context, queueName string, payload *kewpie.Task) error
+	Subscribe(ctx context.Context, queueName string, handler types.Handler) error
+	Pop(ctx context.Context, queueName string, handler types.Handler) error
+}
+
+// queueBackends makes a new client for each backend Sonic provides itself,
+// and any registered with RegisterQueueBackend, by the KEWPIE_BACKEND that
+// selects it.
+var queueBackends = map[string]func() QueueBackend{
+	"memory": func() QueueBackend { return &memoryQueue{} },
+	"folder": func() QueueBackend { return &folderQueue{} },
+	"nats":   func() QueueBackend { return &natsQueue{} },
+	"amqp":   func() QueueBackend { return &amqpQueue{} },
+	"kafka":  func() QueueBackend { return &kafkaQueue{} },
+	"redis":  func() QueueBackend { return &redisQueue{} },
+	"sqs":    func() QueueBackend { return &sqsQueue{} },
+}
+
+/*
+ * Add a queue backend, selected by setting KEWPIE_BACKEND to its name. It's
+ * meant to be called from the init function of a file compiled in alongside
+ * Sonic's own, so it panics if the name is taken, as that's a mistake in the
+ * build rather than in how Sonic is run.
+ */
+func RegisterQueueBackend(name string, backend func() QueueBackend) {
+	if backend == nil {
+		panic("sonic: queue backend " + name + " is nil")
+	}
+	if _, ok := queueBackends[name]; ok {
+		panic("sonic: queue backend " + name + " is already registered")
+	}
+	queueBackends[name] = backend
+}
+
+// queueConnection delegates to the client for the backend it was last
+// connected to. The client is replaced each time it connects, eg. when Sonic
+// reconnects after an outage.
+type queueConnection struct {
+	mu     sync.RWMutex
+	client QueueBackend
+}
+
+/*
+ * Connect to the named backend. Backends that aren't registered are left to
+ * Kewpie.
+ */
+func (q *queueConnection) Connect(backend string, queues []string, connection interface{}) error {
+	var client QueueBackend = &kewpie.Kewpie{}
+	if newBackend, ok := queueBackends[backend]; ok {
+		client = newBackend()
+	}
+
+	q.mu.Lock()
+	q.client = client
+	q.mu.Unlock()
+	return client.Connect(backend, queues, connection)
+}
+
+func (q *queueConnection) backend() QueueBackend {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.client
+}
+
+func (q *queueConnection) Disconnect() error {
+	return q.backend().Disconnect()
+}
+
+func (q *queueConnection) Healthy(ctx context.Context) error {
+	return q.backend().Healthy(ctx)
+}
+
+func (q *queueConnection) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	return q.backend().Publish(ctx, queueName, payload)
+}
+
+func (q *queueConnection) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	return q.backend().Subscribe(ctx, queueName, handler)
+}
+
+func (q *queueConnection) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	return q.backend().Pop(ctx, queueName, handler)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingBackend is a custom backend that records what it was connected
+// to, and publishes to a memory queue.
+type recordingBackend struct {
+	*memoryQueue
+	backend string
+	queues  []string
+}
+
+func (r *recordingBackend) Connect(backend string, queues []string, connection interface{}) error {
+	r.backend = backend
+	r.queues = queues
+	return r.memoryQueue.Connect(backend, queues, connection)
+}
+
+/*
+ * Swap the client the shared queue connection delegates to, for the length
+ * of a test. The connection itself is never replaced, since background
+ * goroutines hold on to it.
+ */
+func withQueueBackend(client QueueBackend) func() {
+	queue.mu.Lock()
+	original := queue.client
+	queue.client = client
+	queue.mu.Unlock()
+	return func() {
+		queue.mu.Lock()
+		queue.client = original
+		queue.mu.Unlock()
+	}
+}
+
+func TestRegisterQueueBackend(t *testing.T) {
+	custom := &recordingBackend{memoryQueue: &memoryQueue{}}
+	RegisterQueueBackend("recording_test", func() QueueBackend { return custom })
+	defer delete(queueBackends, "recording_test")
+
+	connection := &queueConnection{}
+	assert.Nil(t, connection.Connect("recording_test", []string{"custom_test"}, nil))
+	defer connection.Disconnect()
+	assert.Equal(t, "recording_test", custom.backend)
+	assert.Equal(t, []string{"custom_test"}, custom.queues)
+
+	assert.Nil(t, connection.Publish(context.Background(), "custom_test", &kewpie.Task{Body: "echo hi"}))
+	assert.Equal(t, 1, len(custom.Waiting("custom_test")))
+
+	assert.Panics(t, func() {
+		RegisterQueueBackend("recording_test", func() QueueBackend { return custom })
+	})
+	assert.Panics(t, func() {
+		RegisterQueueBackend("memory", func() QueueBackend { return custom })
+	})
+	assert.Panics(t, func() {
+		RegisterQueueBackend("nil_test", nil)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+)
+
+// children holds the pids of the processes Sonic started itself. The reaper
+// must leave these alone so that exec.Cmd.Wait still sees their exit status,
+// so every command Sonic runs has to be started through startTrackedChild.
+var children = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+/*
+ * Start the command and record its pid atomically, so the reaper can never
+ * observe the process before it is tracked.
+ */
+func startTrackedChild(cmd *exec.Cmd) error {
+	children.Lock()
+	defer children.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+
+	return nil
+}
+
+func untrackChild(pid int) {
+	children.Lock()
+	defer children.Unlock()
+	delete(children.pids, pid)
+}
+
+func isTrackedChild(pid int) bool {
+	children.Lock()
+	defer children.Unlock()
+	return children.pids[pid]
+}
+
+/*
+ * Run the command to completion as a tracked child, in place of cmd.Run.
+ */
+func runTrackedChild(cmd *exec.Cmd) error {
+	if err := startTrackedChild(cmd); err != nil {
+		return err
+	}
+	defer untrackChild(cmd.Process.Pid)
+
+	return cmd.Wait()
+}
+
+/*
+ * Run the command as a tracked child and return its stdout, in place of
+ * cmd.Output.
+ */
+func outputTrackedChild(cmd *exec.Cmd) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+
+	err := runTrackedChild(cmd)
+	return stdout.Bytes(), err
+}
+
+/*
+ * Run the command as a tracked child and return its stdout and stderr
+ * interleaved, in place of cmd.CombinedOutput.
+ */
+func combinedOutputTrackedChild(cmd *exec.Cmd) ([]byte, error) {
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := runTrackedChild(cmd)
+	return output.Bytes(), err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const prSetChildSubreaper = 36
+
+/*
+ * Become a subreaper so that orphaned descendants of tasks are reparented to
+ * Sonic rather than init, then reap them as they exit. When Sonic is PID 1 in
+ * a container nothing else would, and zombies would accumulate forever.
+ */
+func startReaper() {
+	if os.Getpid() != 1 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+			log.Printf("ERROR unable to become a child subreaper: %s \n", errno.Error())
+			return
+		}
+	}
+
+	log.Println("INFO init mode enabled, reaping orphaned processes")
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGCHLD)
+
+		// SIGCHLD is coalesced, so sweep periodically as well in case one is missed
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sigCh:
+			case <-ticker.C:
+			}
+			reapOrphans()
+		}
+	}()
+}
+
+/*
+ * Reap every zombie child that isn't a process Sonic is waiting on. Calling
+ * wait4(-1) would race with exec.Cmd.Wait, so zombies are found via /proc and
+ * reaped individually. Anything Sonic runs itself must be started through
+ * startTrackedChild, or its Wait will fail with ECHILD when the reaper wins.
+ */
+func reapOrphans() {
+	self := os.Getpid()
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		log.Printf("ERROR reading /proc: %s \n", err.Error())
+		return
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		state, ppid, err := readProcStat(pid)
+		if err != nil || ppid != self || state != "Z" || isTrackedChild(pid) {
+			continue
+		}
+
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err != nil {
+			log.Printf("ERROR reaping pid %d: %s \n", pid, err.Error())
+			continue
+		}
+		log.Printf("INFO reaped orphaned pid %d with status %d \n", pid, status.ExitStatus())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapOrphans(t *testing.T) {
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Start())
+
+	time.Sleep(50 * time.Millisecond)
+
+	state, _, err := readProcStat(cmd.Process.Pid)
+	assert.Nil(t, err)
+	assert.Equal(t, "Z", state)
+
+	reapOrphans()
+
+	_, err = syscall.Wait4(cmd.Process.Pid, nil, syscall.WNOHANG, nil)
+	assert.Equal(t, syscall.ECHILD, err)
+}
+
+func TestReapOrphansSkipsTrackedChildren(t *testing.T) {
+	cmd := exec.Command("true")
+	assert.Nil(t, startTrackedChild(cmd))
+	defer untrackChild(cmd.Process.Pid)
+
+	time.Sleep(50 * time.Millisecond)
+
+	reapOrphans()
+
+	assert.Nil(t, cmd.Wait())
+}
+
+func TestReapOrphansLeavesRunningCommandsAlone(t *testing.T) {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				reapOrphans()
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, runTrackedChild(exec.Command("true")))
+
+		output, err := outputTrackedChild(exec.Command("echo", "hello"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\n", string(output))
+
+		output, err = combinedOutputTrackedChild(exec.Command("sh", "-c", "echo oops >&2; exit 3"))
+		assert.Equal(t, "oops\n", string(output))
+		if exitErr, ok := err.(*exec.ExitError); assert.True(t, ok) {
+			assert.Equal(t, 3, exitErr.ExitCode())
+		}
+	}
+
+	close(stop)
+	<-stopped
+}
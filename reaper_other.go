@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "log"
+
+/*
+ * Zombie reaping relies on Linux subreaper support, so init mode is a no-op
+ * elsewhere.
+ */
+func startReaper() {
+	log.Println("INFO init mode is only supported on linux, ignoring")
+}
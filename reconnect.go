@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/paidright/sonic/config"
+)
+
+/*
+ * Run a subscription to QUEUE, and whenever it ends with the context still
+ * live, eg. because the backend went away, reconnect with backoff and run it
+ * again. Without RECONNECT the subscription's error is returned instead.
+ * Reconnects are counted by result in the sonic_queue_reconnects_total
+ * metric.
+ */
+func subscribeWithReconnect(ctx context.Context, subscribe func(context.Context) error) error {
+	attempt := 0
+	for {
+		started := time.Now()
+		err := subscribe(ctx)
+		if ctx.Err() != nil || !config.RECONNECT {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("ERROR subscription to queue %s ended: %s \n", config.QUEUE, err.Error())
+		} else {
+			log.Printf("ERROR subscription to queue %s ended \n", config.QUEUE)
+		}
+
+		// A subscription that ran for a while was a recovery, so the next
+		// outage starts the backoff afresh
+		if time.Since(started) > config.RECONNECT_BACKOFF_MAX {
+			attempt = 0
+		}
+
+		for {
+			delay := reconnectBackoff(attempt)
+			attempt++
+			log.Printf("INFO reconnecting to queue %s in %s \n", config.QUEUE, delay)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+
+			if err := queue.Connect(config.KEWPIE_BACKEND, queueNames(), nil); err != nil {
+				log.Printf("ERROR reconnecting to queue %s: %s \n", config.QUEUE, err.Error())
+				incCounter("sonic_queue_reconnects_total", map[string]string{"result": "failed"})
+				continue
+			}
+			break
+		}
+
+		log.Printf("INFO reconnected to queue %s \n", config.QUEUE)
+		incCounter("sonic_queue_reconnects_total", map[string]string{"result": "succeeded"})
+		go flushSpill(ctx)
+		subscribeSideQueues(ctx)
+	}
+}
+
+/*
+ * The delay before the nth attempt to reconnect. It doubles with each
+ * attempt up to RECONNECT_BACKOFF_MAX, with jitter so a fleet of workers
+ * doesn't reconnect in lockstep to a recovering backend.
+ */
+func reconnectBackoff(attempt int) time.Duration {
+	delay := config.RECONNECT_BACKOFF_BASE
+	for i := 0; i < attempt && delay < config.RECONNECT_BACKOFF_MAX; i++ {
+		delay *= 2
+	}
+	if delay > config.RECONNECT_BACKOFF_MAX {
+		delay = config.RECONNECT_BACKOFF_MAX
+	}
+
+	// Full jitter over the upper half of the window
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyBackend is a memory backend that refuses the first connect after
+// construction.
+type flakyBackend struct {
+	*memoryQueue
+	mu       sync.Mutex
+	connects int
+}
+
+func (f *flakyBackend) Connect(backend string, queues []string, connection interface{}) error {
+	f.mu.Lock()
+	f.connects++
+	connects := f.connects
+	f.mu.Unlock()
+	if connects == 1 {
+		return fmt.Errorf("connection refused")
+	}
+	return f.memoryQueue.Connect(backend, queues, connection)
+}
+
+func withReconnectBackoff(base, max time.Duration) func() {
+	config.RECONNECT_BACKOFF_BASE = base
+	config.RECONNECT_BACKOFF_MAX = max
+	return func() {
+		config.RECONNECT_BACKOFF_BASE = time.Second
+		config.RECONNECT_BACKOFF_MAX = time.Minute
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	defer withReconnectBackoff(100*time.Millisecond, time.Second)()
+
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		delay := reconnectBackoff(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, attempt)
+	}
+}
+
+func TestSubscribeWithReconnect(t *testing.T) {
+	defer withReconnectBackoff(time.Millisecond, 10*time.Millisecond)()
+
+	flaky := &flakyBackend{memoryQueue: &memoryQueue{}}
+	RegisterQueueBackend("flaky_test", func() QueueBackend { return flaky })
+	defer delete(queueBackends, "flaky_test")
+
+	backend := config.KEWPIE_BACKEND
+	config.KEWPIE_BACKEND = "flaky_test"
+	defer withQueueBackend(queue.backend())()
+	defer func() {
+		config.KEWPIE_BACKEND = backend
+	}()
+
+	failed := counterValue("sonic_queue_reconnects_total", map[string]string{"result": "failed"})
+	succeeded := counterValue("sonic_queue_reconnects_total", map[string]string{"result": "succeeded"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subscriptions := 0
+	err := subscribeWithReconnect(ctx, func(ctx context.Context) error {
+		subscriptions++
+		if subscriptions == 1 {
+			return fmt.Errorf("connection reset")
+		}
+		// Resubscribed on the new connection
+		assert.Equal(t, flaky, queue.backend())
+		cancel()
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, subscriptions)
+	assert.Equal(t, 2, flaky.connects)
+	assert.Equal(t, failed+1, counterValue("sonic_queue_reconnects_total", map[string]string{"result": "failed"}))
+	assert.Equal(t, succeeded+1, counterValue("sonic_queue_reconnects_total", map[string]string{"result": "succeeded"}))
+}
+
+func TestSubscribeWithoutReconnect(t *testing.T) {
+	config.RECONNECT = false
+	defer func() {
+		config.RECONNECT = true
+	}()
+
+	subscriptions := 0
+	err := subscribeWithReconnect(context.Background(), func(ctx context.Context) error {
+		subscriptions++
+		return fmt.Errorf("connection reset")
+	})
+	assert.EqualError(t, err, "connection reset")
+	assert.Equal(t, 1, subscriptions)
+}
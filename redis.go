@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	"github.com/redis/go-redis/v9"
+	uuid "github.com/satori/go.uuid"
+)
+
+// redisPromote atomically moves tasks that are due from a queue's delayed set
+// onto its stream.
+var redisPromote = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, task in ipairs(due) do
+	redis.call('XADD', KEYS[2], '*', 'task', task)
+	redis.call('ZREM', KEYS[1], task)
+end
+return #due`)
+
+// ErrRedisClosed is returned for operations on a closed Redis connection.
+var ErrRedisClosed = fmt.Errorf("The connection to Redis is closed")
+
+// redisEntry is a stream entry read by a consumer.
+type redisEntry struct {
+	id         string
+	task       []byte
+	deliveries int
+}
+
+// redisQueue is a queue backend on Redis Streams. Each queue is a stream of
+// the same name, read by a consumer group named REDIS_GROUP so each task
+// goes to one worker, and acknowledged and deleted once it's handled.
+// Delayed tasks and retries wait in a sorted set, <queue>.delayed, until
+// they're due. Tasks left pending by a worker that died are claimed by
+// another once they've been idle for REDIS_CLAIM_IDLE.
+type redisQueue struct {
+	client   *redis.Client
+	consumer string
+	queues   []string
+
+	mu     sync.Mutex
+	held   map[string][]redisEntry
+	closed chan struct{}
+}
+
+/*
+ * Connect to REDIS_URL and make sure each queue's stream has the consumer
+ * group, creating both if need be.
+ */
+func (r *redisQueue) Connect(backend string, queues []string, connection interface{}) error {
+	client, err := newRedisClient(config.REDIS_URL)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	r.consumer = fmt.Sprintf("%s-%s", hostname, uuid.NewV4().String()[:8])
+	r.client = client
+	r.queues = queues
+	r.held = map[string][]redisEntry{}
+	r.closed = make(chan struct{})
+
+	ctx := context.Background()
+	for _, name := range queues {
+		if err := client.XGroupCreateMkStream(ctx, name, config.REDIS_GROUP, "0").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			r.Disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Close the connections. Queues this worker has nothing pending on are
+ * left by removing it from their consumer group, so groups don't fill up
+ * with the names of workers that have gone.
+ */
+func (r *redisQueue) Disconnect() error {
+	if r.closed == nil {
+		return nil
+	}
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+
+	ctx := context.Background()
+	for _, name := range r.queues {
+		pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   name,
+			Group:    config.REDIS_GROUP,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: r.consumer,
+		}).Result()
+		if (err == nil && len(pending) == 0) || err == redis.Nil {
+			r.client.XGroupDelConsumer(ctx, name, config.REDIS_GROUP, r.consumer)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.closed)
+	return r.client.Close()
+}
+
+/*
+ * Check Redis is answering.
+ */
+func (r *redisQueue) Healthy(ctx context.Context) error {
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.client.Ping(ctx).Err()
+}
+
+/*
+ * Publish a task to a queue's stream. Delayed tasks are added to the
+ * queue's delayed set instead, and moved onto the stream when they're due.
+ */
+func (r *redisQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if payload.Delay >= time.Millisecond {
+		return r.client.ZAdd(ctx, redisDelayed(queueName), redis.Z{
+			Score:  float64(redisMillis(payload.RunAt)),
+			Member: string(body),
+		}).Err()
+	}
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: queueName,
+		Values: []string{"task", string(body)},
+	}).Err()
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done,
+ * reading up to BATCH_SIZE of them from the stream at once.
+ */
+func (r *redisQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	for {
+		err := r.popBatch(ctx, queueName, config.BATCH_SIZE, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for the next task on a queue and handle it. Tasks that have sat
+ * pending on another worker for REDIS_CLAIM_IDLE are claimed first, and
+ * those redeliveries count as attempts. While the handler runs its task is
+ * kept from being claimed. Afterwards it's acknowledged and deleted from
+ * the stream, unless the handler failed and asked for a requeue, in which
+ * case it's published again with its attempts counted and Kewpie's usual
+ * backoff first.
+ */
+func (r *redisQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	return r.popBatch(ctx, queueName, 1, handler)
+}
+
+/*
+ * Read up to count entries from a queue at once and handle each in turn,
+ * waiting until there's at least one task. Entries read but not yet handled
+ * are kept from being claimed, and are handled first by the next pop if
+ * this one is cut short.
+ */
+func (r *redisQueue) popBatch(ctx context.Context, queueName string, count int, handler types.Handler) error {
+	for {
+		if err := r.open(); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := redisPromote.Run(context.Background(), r.client, []string{redisDelayed(queueName), queueName}, redisMillis(time.Now())).Err(); err != nil {
+			return err
+		}
+
+		entries, err := r.next(queueName, count)
+		if err != nil {
+			return err
+		}
+
+		handled := false
+		for i, entry := range entries {
+			if ctx.Err() != nil {
+				// Keep them for the next pop rather than leave them to be claimed
+				r.hold(queueName, entries[i:])
+				return ctx.Err()
+			}
+
+			task := kewpie.Task{}
+			if err := json.Unmarshal(entry.task, &task); err != nil {
+				log.Printf("ERROR discarding entry %s on %s that isn't a task: %s \n", entry.id, queueName, err)
+				if err := r.finish(queueName, entry.id); err != nil {
+					r.hold(queueName, entries[i+1:])
+					return err
+				}
+				continue
+			}
+
+			if time.Until(task.RunAt) > 0 {
+				if err := r.Publish(ctx, queueName, &task); err != nil {
+					r.hold(queueName, entries[i:])
+					return err
+				}
+				if err := r.finish(queueName, entry.id); err != nil {
+					r.hold(queueName, entries[i+1:])
+					return err
+				}
+				continue
+			}
+
+			// Redeliveries after a worker died count as attempts too
+			task.Attempts += entry.deliveries - 1
+
+			if err := r.handle(queueName, entry, entries[i+1:], task, handler); err != nil {
+				r.hold(queueName, entries[i+1:])
+				return err
+			}
+			handled = true
+		}
+		if handled {
+			return nil
+		}
+	}
+}
+
+/*
+ * Handle a task, keeping its entry and the rest of its batch from being
+ * claimed while it runs.
+ */
+func (r *redisQueue) handle(queueName string, entry redisEntry, rest []redisEntry, task kewpie.Task, handler types.Handler) error {
+	ids := []string{entry.id}
+	for _, waiting := range rest {
+		ids = append(ids, waiting.id)
+	}
+	done := make(chan struct{})
+	interval := config.REDIS_CLAIM_IDLE / 2
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Claiming them again resets how long they've been idle
+				r.client.XClaimJustID(context.Background(), &redis.XClaimArgs{
+					Stream:   queueName,
+					Group:    config.REDIS_GROUP,
+					Consumer: r.consumer,
+					Messages: ids,
+				})
+			}
+		}
+	}()
+
+	requeue, err := handler.Handle(task)
+	close(done)
+
+	if err != nil && requeue {
+		log.Println("ERROR kewpie task handler", err)
+		task.Attempts++
+		task.RunAt = time.Time{}
+		task.Delay = 0
+		if !task.NoExpBackoff {
+			task.Delay = util.CalcBackoff(task.Attempts + 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := r.Publish(ctx, queueName, &task); err != nil {
+			// Leave it pending to be claimed again instead
+			log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+			return nil
+		}
+	}
+	return r.finish(queueName, entry.id)
+}
+
+/*
+ * The next entries for this worker: those it read but didn't handle, one
+ * left idle by another worker, or up to count new ones, waiting up to
+ * REDIS_BLOCK for them.
+ */
+func (r *redisQueue) next(queueName string, count int) ([]redisEntry, error) {
+	r.mu.Lock()
+	held := r.held[queueName]
+	delete(r.held, queueName)
+	r.mu.Unlock()
+	if len(held) > 0 {
+		return held, nil
+	}
+
+	entry, ok, err := r.claim(queueName)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return []redisEntry{entry}, nil
+	}
+
+	streams, err := r.client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
+		Group:    config.REDIS_GROUP,
+		Consumer: r.consumer,
+		Streams:  []string{queueName, ">"},
+		Count:    int64(count),
+		Block:    config.REDIS_BLOCK,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []redisEntry{}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			entry := redisEntryFrom(message)
+			entry.deliveries = 1
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+/*
+ * Keep entries read but not handled for the next pop.
+ */
+func (r *redisQueue) hold(queueName string, entries []redisEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held[queueName] = append(append([]redisEntry{}, entries...), r.held[queueName]...)
+}
+
+/*
+ * Claim an entry that's been pending on another worker for at least
+ * REDIS_CLAIM_IDLE, presumably because that worker died. The entry is read
+ * before it's claimed, and only its ID claimed, as servers differ on what
+ * they answer for entries deleted from the stream while pending.
+ */
+func (r *redisQueue) claim(queueName string) (redisEntry, bool, error) {
+	ctx := context.Background()
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: queueName,
+		Group:  config.REDIS_GROUP,
+		Start:  "-",
+		End:    "+",
+		Count:  10,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return redisEntry{}, false, err
+	}
+
+	for _, waiting := range pending {
+		if waiting.Consumer == r.consumer || waiting.Idle < config.REDIS_CLAIM_IDLE {
+			continue
+		}
+
+		messages, err := r.client.XRangeN(ctx, queueName, waiting.ID, waiting.ID, 1).Result()
+		if err != nil {
+			return redisEntry{}, false, err
+		}
+		if len(messages) == 0 {
+			// Deleted from the stream while pending
+			r.client.XAck(ctx, queueName, config.REDIS_GROUP, waiting.ID)
+			continue
+		}
+
+		claimed, err := r.client.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   queueName,
+			Group:    config.REDIS_GROUP,
+			Consumer: r.consumer,
+			MinIdle:  config.REDIS_CLAIM_IDLE,
+			Messages: []string{waiting.ID},
+		}).Result()
+		if err != nil {
+			return redisEntry{}, false, err
+		}
+		if len(claimed) == 0 {
+			// Another worker got to it first
+			continue
+		}
+
+		entry := redisEntryFrom(messages[0])
+		entry.deliveries = int(waiting.RetryCount) + 1
+		log.Printf("INFO claimed task entry %s on %s from %s, idle for %s \n", waiting.ID, queueName, waiting.Consumer, waiting.Idle)
+		return entry, true, nil
+	}
+	return redisEntry{}, false, nil
+}
+
+/*
+ * Acknowledge an entry and delete it from the stream, as each queue is a
+ * work queue for one consumer group.
+ */
+func (r *redisQueue) finish(queueName, id string) error {
+	ctx := context.Background()
+	if err := r.client.XAck(ctx, queueName, config.REDIS_GROUP, id).Err(); err != nil {
+		return err
+	}
+	return r.client.XDel(ctx, queueName, id).Err()
+}
+
+func (r *redisQueue) open() error {
+	select {
+	case <-r.closed:
+		return ErrRedisClosed
+	default:
+		return nil
+	}
+}
+
+/*
+ * A client for the Redis at a URL, which connects when it's first used.
+ * redis:// URLs connect in plain text and rediss:// URLs over TLS. Any
+ * credentials in the URL are sent with AUTH, a lone user being taken as a
+ * password, and the database is chosen by the path.
+ */
+func newRedisClient(rawURL string) (*redis.Client, error) {
+	if !strings.HasPrefix(rawURL, "redis://") && !strings.HasPrefix(rawURL, "rediss://") {
+		return nil, fmt.Errorf("REDIS_URL must be a redis:// or rediss:// URL")
+	}
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL isn't valid: %s", strings.TrimPrefix(err.Error(), "redis: "))
+	}
+	if options.Password == "" && options.Username != "" {
+		options.Password = options.Username
+		options.Username = ""
+	}
+	options.DialTimeout = 10 * time.Second
+	options.ReadTimeout = 30 * time.Second
+	options.WriteTimeout = 30 * time.Second
+	return redis.NewClient(options), nil
+}
+
+/*
+ * An entry read from a stream, taking the task from its task field.
+ */
+func redisEntryFrom(message redis.XMessage) redisEntry {
+	entry := redisEntry{id: message.ID}
+	if task, ok := message.Values["task"].(string); ok {
+		entry.task = []byte(task)
+	}
+	return entry
+}
+
+func redisMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func redisDelayed(queueName string) string {
+	return queueName + ".delayed"
+}
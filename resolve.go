@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// envInterpreter is the program #! lines use to find an interpreter in PATH.
+const envInterpreter = "env"
+
+/*
+ * The PATH commands are looked up in and run with. This is TASK_PATH if it's
+ * set, or Sonic's own PATH, behind any QUEUE_SEARCH_ROOTS for this worker's
+ * queue.
+ */
+func taskPath() string {
+	path := os.Getenv("PATH")
+	if config.TASK_PATH != "" {
+		path = config.TASK_PATH
+	}
+
+	roots := config.QUEUE_SEARCH_ROOTS[config.QUEUE]
+	if len(roots) == 0 {
+		return path
+	}
+	return strings.Join(append(append([]string{}, roots...), path), string(os.PathListSeparator))
+}
+
+/*
+ * Whether commands run with a different PATH to Sonic's own.
+ */
+func customTaskPath() bool {
+	return config.TASK_PATH != "" || len(config.QUEUE_SEARCH_ROOTS[config.QUEUE]) > 0
+}
+
+/*
+ * Find a command in taskPath, as exec.LookPath does in PATH. Commands given as
+ * a path are returned unchanged.
+ */
+func lookupCommand(command string) (string, error) {
+	if strings.ContainsAny(command, `/\`) {
+		return command, nil
+	}
+
+	for _, dir := range filepath.SplitList(taskPath()) {
+		if dir == "" {
+			dir = "."
+		}
+		if resolved, err := exec.LookPath(filepath.Join(dir, command)); err == nil {
+			return resolved, nil
+		}
+	}
+
+	return "", &exec.Error{Name: command, Err: exec.ErrNotFound}
+}
+
+// scriptTag marks a task whose body is a script without a #! line.
+const scriptTag = "script"
+
+/*
+ * Whether a task's body is a script, rather than a command line. Scripts
+ * start with a #! line, or are tagged with script=true.
+ */
+func isScript(task kewpie.Task) bool {
+	return strings.HasPrefix(task.Body, "#!") || task.Tags[scriptTag] == "true"
+}
+
+/*
+ * The interpreter and arguments for a script body, from its #! line. Scripts
+ * without one, or with a bare #!, use SCRIPT_INTERPRETER, and the "/usr/bin/env name" form runs name
+ * directly.
+ */
+func scriptInterpreter(body string) (string, []string) {
+	fields := []string{}
+	if strings.HasPrefix(body, "#!") {
+		line := strings.SplitN(body, "\n", 2)[0]
+		fields = strings.Fields(strings.TrimPrefix(line, "#!"))
+	}
+	if len(fields) == 0 {
+		fields = strings.Fields(config.SCRIPT_INTERPRETER)
+	}
+
+	interpreter, args := fields[0], fields[1:]
+	if filepath.Base(interpreter) == envInterpreter && len(args) > 0 {
+		interpreter, args = args[0], args[1:]
+	}
+
+	return interpreter, args
+}
+
+/*
+ * Find a script's interpreter on this worker. Interpreters are looked up by
+ * name in taskPath if the path given doesn't exist, so a script written for
+ * /usr/local/bin/python3 also runs on images with /usr/bin/python3. If it
+ * can't be found the interpreter is returned unchanged, to fail on start.
+ */
+func resolveInterpreter(interpreter string) string {
+	if filepath.IsAbs(interpreter) {
+		if _, err := os.Stat(interpreter); err == nil {
+			return interpreter
+		}
+	}
+
+	resolved, err := lookupCommand(filepath.Base(interpreter))
+	if err != nil {
+		return interpreter
+	}
+	return resolved
+}
+
+/*
+ * Write a script body to a file only its owner can read, to be passed to its
+ * interpreter. The file is created in WORKSPACE_ROOT, or the system temp
+ * directory.
+ */
+func writeScript(body string) (string, error) {
+	file, err := ioutil.TempFile(config.WORKSPACE_ROOT, "sonic-script-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.WriteString(body); err != nil {
+		file.Close()
+		removeScript(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		removeScript(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func removeScript(path string) {
+	if err := os.Remove(path); err != nil {
+		log.Printf("ERROR removing script %s: %s \n", path, err.Error())
+	}
+}
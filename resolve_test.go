@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskPath(t *testing.T) {
+	assert.Equal(t, os.Getenv("PATH"), taskPath())
+	assert.False(t, customTaskPath())
+
+	config.TASK_PATH = "/opt/bin"
+	config.QUEUE_SEARCH_ROOTS = map[string][]string{
+		config.QUEUE: {"/opt/reports/bin", "/opt/shared/bin"},
+		"other":      {"/opt/other/bin"},
+	}
+	defer func() {
+		config.TASK_PATH = ""
+		config.QUEUE_SEARCH_ROOTS = map[string][]string{}
+	}()
+
+	sep := string(os.PathListSeparator)
+	assert.Equal(t, "/opt/reports/bin"+sep+"/opt/shared/bin"+sep+"/opt/bin", taskPath())
+	assert.True(t, customTaskPath())
+}
+
+func TestLookupCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-roots-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tool := filepath.Join(dir, "sonic-test-tool")
+	assert.Nil(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\necho tool\n"), 0755))
+
+	_, err = lookupCommand("sonic-test-tool")
+	assert.Equal(t, errCodeCommandNotFound, newTaskError(classifyStartError("sonic-test-tool", err)).Code)
+
+	config.QUEUE_SEARCH_ROOTS = map[string][]string{config.QUEUE: {dir}}
+	defer func() {
+		config.QUEUE_SEARCH_ROOTS = map[string][]string{}
+	}()
+
+	resolved, err := lookupCommand("sonic-test-tool")
+	assert.Nil(t, err)
+	assert.Equal(t, tool, resolved)
+
+	output := newTailBuffer(64)
+	assert.Nil(t, runTaskProcWithOutput(context.Background(), kewpie.Task{Body: "sonic-test-tool"}, procOutput{combined: output}))
+	out, _ := output.String()
+	assert.Equal(t, "tool\n", out)
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	interpreter, args := scriptInterpreter("#!/bin/bash -e\necho hi")
+	assert.Equal(t, "/bin/bash", interpreter)
+	assert.Equal(t, []string{"-e"}, args)
+
+	interpreter, args = scriptInterpreter("#!/usr/bin/env python3\nprint('hi')")
+	assert.Equal(t, "python3", interpreter)
+	assert.Empty(t, args)
+
+	interpreter, _ = scriptInterpreter("#!\necho hi")
+	assert.Equal(t, config.SCRIPT_INTERPRETER, interpreter)
+
+	interpreter, args = scriptInterpreter("echo hi")
+	assert.Equal(t, config.SCRIPT_INTERPRETER, interpreter)
+	assert.Empty(t, args)
+
+	assert.True(t, isScript(kewpie.Task{Body: "#!/bin/sh\necho hi"}))
+	assert.True(t, isScript(kewpie.Task{Body: "echo hi", Tags: kewpie.Tags{scriptTag: "true"}}))
+	assert.False(t, isScript(kewpie.Task{Body: "echo hi"}))
+}
+
+func TestRunScriptBody(t *testing.T) {
+	output := newTailBuffer(64)
+	err := runTaskProcWithOutput(context.Background(), kewpie.Task{
+		Body: "#!/definitely/not/here/sh\nGREETING=hello\necho $GREETING world\n",
+	}, procOutput{combined: output})
+	assert.Nil(t, err)
+
+	out, _ := output.String()
+	assert.Equal(t, "hello world\n", out)
+}
+
+func TestRunTaggedScript(t *testing.T) {
+	output := newTailBuffer(256)
+	err := runTaskProcWithOutput(context.Background(), kewpie.Task{
+		Body: "echo $0\nls -l $0 | cut -c1-10\n",
+		Tags: kewpie.Tags{scriptTag: "true"},
+	}, procOutput{combined: output})
+	assert.Nil(t, err)
+
+	out, _ := output.String()
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], "sonic-script-")
+		assert.Equal(t, "-rw-------", lines[1])
+
+		_, err = os.Stat(lines[0])
+		assert.True(t, os.IsNotExist(err))
+	}
+}
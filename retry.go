@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// Tags a producer sets to decide whether its task is retried, overriding
+// RETRY.
+const (
+	retryOnFailureTag = "retry_on_failure"
+	maxAttemptsTag    = "max_attempts"
+)
+
+/*
+ * Whether a task that fails should be requeued, if its error can be retried.
+ * The retry_on_failure tag takes precedence over RETRY, and once a task has
+ * had max_attempts attempts it isn't retried again.
+ */
+func retryEnabled(task kewpie.Task) bool {
+	retry := config.RETRY
+	switch value := task.Tags[retryOnFailureTag]; value {
+	case "":
+	case "true":
+		retry = true
+	case "false":
+		retry = false
+	default:
+		log.Printf("ERROR task %s has an invalid %s %q, using RETRY instead \n", task.ID, retryOnFailureTag, value)
+	}
+	if !retry {
+		return false
+	}
+
+	value := task.Tags[maxAttemptsTag]
+	if value == "" {
+		return true
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil || max < 1 {
+		log.Printf("ERROR task %s has an invalid %s %q, ignoring it \n", task.ID, maxAttemptsTag, value)
+		return true
+	}
+	return task.Attempts+1 < max
+}
+
+/*
+ * Whether a task that failed with err will be requeued.
+ */
+func taskRetryable(task kewpie.Task, err error) bool {
+	return retryEnabled(task) && newTaskError(err).Retryable
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryEnabled(t *testing.T) {
+	assert.False(t, retryEnabled(kewpie.Task{}))
+	assert.True(t, retryEnabled(kewpie.Task{Tags: kewpie.Tags{retryOnFailureTag: "true"}}))
+	assert.False(t, retryEnabled(kewpie.Task{Tags: kewpie.Tags{retryOnFailureTag: "nope"}}))
+
+	config.RETRY = true
+	defer func() {
+		config.RETRY = false
+	}()
+
+	assert.True(t, retryEnabled(kewpie.Task{}))
+	assert.False(t, retryEnabled(kewpie.Task{Tags: kewpie.Tags{retryOnFailureTag: "false"}}))
+	assert.True(t, retryEnabled(kewpie.Task{Tags: kewpie.Tags{retryOnFailureTag: "nope"}}))
+
+	// The third attempt is the last of three
+	assert.True(t, retryEnabled(kewpie.Task{Attempts: 1, Tags: kewpie.Tags{maxAttemptsTag: "3"}}))
+	assert.False(t, retryEnabled(kewpie.Task{Attempts: 2, Tags: kewpie.Tags{maxAttemptsTag: "3"}}))
+	assert.False(t, retryEnabled(kewpie.Task{Tags: kewpie.Tags{maxAttemptsTag: "1"}}))
+	assert.True(t, retryEnabled(kewpie.Task{Attempts: 5, Tags: kewpie.Tags{maxAttemptsTag: "0"}}))
+	assert.True(t, retryEnabled(kewpie.Task{Attempts: 5, Tags: kewpie.Tags{maxAttemptsTag: "lots"}}))
+}
+
+func TestRetryOnFailureTag(t *testing.T) {
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		Body: "false",
+		Tags: kewpie.Tags{retryOnFailureTag: "true"},
+	})
+	assert.True(t, requeue)
+	assert.NotNil(t, err)
+
+	// Errors that can't be retried still aren't
+	requeue, err = handleTask(context.Background(), kewpie.Task{
+		Body: "definitely_not_a_real_command",
+		Tags: kewpie.Tags{retryOnFailureTag: "true"},
+	})
+	assert.False(t, requeue)
+	assert.NotNil(t, err)
+}
+
+func TestMaxAttemptsTag(t *testing.T) {
+	config.RETRY = true
+	config.DEAD_LETTER_QUEUE = "max_attempts_test"
+	defer func() {
+		config.RETRY = false
+		config.DEAD_LETTER_QUEUE = ""
+	}()
+
+	task := kewpie.Task{
+		Body: "false",
+		Tags: kewpie.Tags{maxAttemptsTag: "2"},
+	}
+	requeue, err := handleTask(context.Background(), task)
+	assert.True(t, requeue)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(drainQueue(t, "max_attempts_test")))
+
+	task.Attempts = 1
+	requeue, err = handleTask(context.Background(), task)
+	assert.False(t, requeue)
+	assert.NotNil(t, err)
+
+	dead := drainQueue(t, "max_attempts_test")
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, "2", dead[0].Tags[deadLetterAttemptsTag])
+}
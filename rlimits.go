@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/paidright/sonic/config"
+)
+
+// rlimitSetting is a resource limit applied to every task process.
+type rlimitSetting struct {
+	name  string
+	value uint64
+}
+
+/*
+ * Parse the RLIMIT_NOFILE, RLIMIT_NPROC and RLIMIT_FSIZE config. RLIMIT_FSIZE
+ * accepts sizes like 10G. Unset limits are left alone.
+ */
+func configuredRlimits() ([]rlimitSetting, error) {
+	settings := []rlimitSetting{}
+
+	for name, value := range map[string]string{
+		"RLIMIT_NOFILE": config.RLIMIT_NOFILE,
+		"RLIMIT_NPROC":  config.RLIMIT_NPROC,
+	} {
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q", name, value)
+		}
+		settings = append(settings, rlimitSetting{name: name, value: parsed})
+	}
+
+	if config.RLIMIT_FSIZE != "" {
+		parsed, err := parseByteSize(config.RLIMIT_FSIZE)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("Invalid RLIMIT_FSIZE %q", config.RLIMIT_FSIZE)
+		}
+		settings = append(settings, rlimitSetting{name: "RLIMIT_FSIZE", value: uint64(parsed)})
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Not all of these are exported by the syscall package
+var rlimitResources = map[string]int{
+	"RLIMIT_FSIZE":  1,
+	"RLIMIT_NPROC":  6,
+	"RLIMIT_NOFILE": 7,
+}
+
+// rlimitShimArg makes sonic set the rlimits that follow it on itself, then
+// exec the task's command in its place.
+const rlimitShimArg = "--exec-with-rlimits"
+
+/*
+ * Run a task's command through sonic itself, which sets the resource limits
+ * before it execs the command, so the command never runs without them. Both
+ * the soft and hard limits are set so the task can't raise them again.
+ */
+func applyRlimits(cmd *exec.Cmd, settings []rlimitSetting) error {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := []string{self, rlimitShimArg}
+	for _, setting := range settings {
+		args = append(args, setting.name+"="+strconv.FormatUint(setting.value, 10))
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+/*
+ * The child side of applyRlimits. Takes the limits, then the command's path
+ * and its full argv, and only returns if the exec fails.
+ */
+func runRlimitShim(args []string) int {
+	for len(args) > 0 && args[0] != "--" {
+		name, value, _ := strings.Cut(args[0], "=")
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		resource, ok := rlimitResources[name]
+		if err != nil || !ok {
+			fmt.Fprintf(os.Stderr, "ERROR invalid rlimit %q \n", args[0])
+			return 127
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: parsed, Max: parsed}); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR setting %s: %s \n", name, err.Error())
+			return 127
+		}
+		args = args[1:]
+	}
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "ERROR no command to run after setting rlimits \n")
+		return 127
+	}
+
+	err := syscall.Exec(args[1], args[2:], os.Environ())
+	fmt.Fprintf(os.Stderr, "ERROR running %s: %s \n", args[1], err.Error())
+	return 127
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"regexp"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyRlimits(t *testing.T) {
+	config.RLIMIT_NOFILE = "64"
+	config.RLIMIT_FSIZE = "1M"
+	defer func() {
+		config.RLIMIT_NOFILE = ""
+		config.RLIMIT_FSIZE = ""
+	}()
+
+	settings, err := configuredRlimits()
+	assert.Nil(t, err)
+	assert.Len(t, settings, 2)
+
+	cmd := exec.Command("cat", "/proc/self/limits")
+	assert.Nil(t, applyRlimits(cmd, settings))
+	assert.Equal(t, "cat", cmd.Args[len(cmd.Args)-2])
+
+	// cat reads its own limits, so they were set before it ran
+	limits, err := cmd.Output()
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`Max open files\s+64\s+64`), string(limits))
+	assert.Regexp(t, regexp.MustCompile(`Max file size\s+1048576\s+1048576`), string(limits))
+}
+
+func TestConfiguredRlimitsInvalid(t *testing.T) {
+	config.RLIMIT_NPROC = "lots"
+	defer func() {
+		config.RLIMIT_NPROC = ""
+	}()
+
+	_, err := configuredRlimits()
+	assert.Error(t, err)
+}
+
+func TestRunTaskProcAppliesRlimits(t *testing.T) {
+	config.RLIMIT_NOFILE = "32"
+	defer func() {
+		config.RLIMIT_NOFILE = ""
+	}()
+	configured, err := configuredRlimits()
+	assert.Nil(t, err)
+	previous := rlimits
+	rlimits = configured
+	defer func() {
+		rlimits = previous
+	}()
+
+	output := &bytes.Buffer{}
+	err = runTaskProcWithOutput(context.Background(), kewpie.Task{
+		Body: "cat /proc/self/limits",
+	}, procOutput{combined: output})
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`Max open files\s+32\s+32`), output.String())
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ErrRlimitsUnsupported is returned when rlimits are configured on a platform
+// without setrlimit.
+var ErrRlimitsUnsupported = fmt.Errorf("Setting rlimits for tasks is only supported on linux")
+
+const rlimitShimArg = "--exec-with-rlimits"
+
+func applyRlimits(cmd *exec.Cmd, settings []rlimitSetting) error {
+	if len(settings) > 0 {
+		return ErrRlimitsUnsupported
+	}
+	return nil
+}
+
+func runRlimitShim(args []string) int {
+	fmt.Fprintln(os.Stderr, ErrRlimitsUnsupported)
+	return 127
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// Tags a primary worker adds to the copy of a task it sends to the shadow
+// queue, recording how the primary run went.
+const (
+	shadowExitCodeTag   = "sonic_primary_exit_code"
+	shadowOutputHashTag = "sonic_primary_output_sha256"
+	shadowOutputTag     = "sonic_primary_output"
+)
+
+/*
+ * Publish a copy of a task the primary worker has run to SHADOW_QUEUE, with
+ * its results attached. The normalised output is included when it was small
+ * enough to capture, so the shadow can diff against it. Webhook tags are
+ * removed so that nothing the shadow does is visible to the producer.
+ */
+func publishShadowCopy(ctx context.Context, task kewpie.Task, runErr error, output *outputCapture) {
+	tags := kewpie.Tags{}
+	for tag, value := range task.Tags {
+		if !strings.HasPrefix(tag, "webhook_") {
+			tags[tag] = value
+		}
+	}
+	tags[shadowExitCodeTag] = strconv.Itoa(exitCode(runErr))
+	tags[shadowOutputHashTag] = output.digest()
+	if normalised := output.normalised(); normalised != nil {
+		tags[shadowOutputTag] = string(normalised)
+	}
+
+	shadow := kewpie.Task{
+		Body: task.Body,
+		Tags: tags,
+	}
+
+	if err := queue.Publish(ctx, config.SHADOW_QUEUE, &shadow); err != nil {
+		log.Printf("ERROR publishing shadow copy of task %s: %s \n", task.ID, err.Error())
+	}
+}
+
+/*
+ * Run a shadow copy of a production task using SHADOW_TEMPLATE, and compare
+ * its exit code and output with the primary's. The result is only reported
+ * in metrics: no webhooks are sent and the task is never requeued.
+ */
+func handleShadowTask(ctx context.Context, task kewpie.Task) (bool, error) {
+	body, err := renderCommandTemplate(config.SHADOW_TEMPLATE, task)
+	if err != nil {
+		log.Printf("ERROR rendering shadow command for task %s: %s \n", task.ID, err.Error())
+		incCounter("sonic_shadow_runs_total", map[string]string{"result": "error"})
+		return false, err
+	}
+
+	shadowTask := task
+	shadowTask.Body = body
+	shadowTask.Tags = kewpie.Tags{}
+	for tag, value := range task.Tags {
+		if !strings.HasPrefix(tag, "webhook_") {
+			shadowTask.Tags[tag] = value
+		}
+	}
+
+	output := newOutputCapture()
+	runErr := runTaskProcWithOutput(ctx, shadowTask, procOutput{combined: output})
+
+	result := compareShadowResult(task, runErr, output.digest())
+	log.Printf("INFO shadow run of task %s: %s \n", task.ID, result)
+	incCounter("sonic_shadow_runs_total", map[string]string{"result": result})
+
+	if result == "exit_mismatch" || result == "output_mismatch" {
+		report := shadowReport{
+			TaskID:          task.ID,
+			Result:          result,
+			PrimaryExitCode: task.Tags[shadowExitCodeTag],
+			ShadowExitCode:  exitCode(runErr),
+		}
+		if primary, ok := task.Tags[shadowOutputTag]; ok && output.normalised() != nil {
+			report.Diff = diffOutputs([]byte(primary), output.normalised())
+		}
+		reportShadowMismatch(report)
+	}
+
+	return false, nil
+}
+
+/*
+ * Render a command from a Go template, given the task as its data.
+ */
+func renderCommandTemplate(text string, task kewpie.Task) (string, error) {
+	tmpl, err := template.New("command").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	rendered := &bytes.Buffer{}
+	if err := tmpl.Execute(rendered, task); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+/*
+ * Classify a shadow run against the primary results recorded in its tags.
+ */
+func compareShadowResult(task kewpie.Task, runErr error, outputHash string) string {
+	if task.Tags[shadowExitCodeTag] == "" {
+		return "no_primary"
+	}
+	if task.Tags[shadowExitCodeTag] != strconv.Itoa(exitCode(runErr)) {
+		return "exit_mismatch"
+	}
+	if task.Tags[shadowOutputHashTag] != outputHash {
+		return "output_mismatch"
+	}
+	return "match"
+}
+
+/*
+ * The exit code of a finished command, or -1 if it didn't exit normally.
+ */
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
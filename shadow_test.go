@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os/exec"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderCommandTemplate(t *testing.T) {
+	rendered, err := renderCommandTemplate("/opt/v2/{{.Body}} --report {{.Tags.report_id}}", kewpie.Task{
+		Body: "report",
+		Tags: kewpie.Tags{"report_id": "42"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/v2/report --report 42", rendered)
+}
+
+func TestCompareShadowResult(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			shadowExitCodeTag:   "0",
+			shadowOutputHashTag: "abc",
+		},
+	}
+
+	assert.Equal(t, "match", compareShadowResult(task, nil, "abc"))
+	assert.Equal(t, "output_mismatch", compareShadowResult(task, nil, "def"))
+	assert.Equal(t, "exit_mismatch", compareShadowResult(task, exec.Command("false").Run(), "abc"))
+	assert.Equal(t, "no_primary", compareShadowResult(kewpie.Task{}, nil, "abc"))
+}
+
+func TestHandleShadowTask(t *testing.T) {
+	config.SHADOW_TEMPLATE = "echo {{.Body}}"
+	defer func() {
+		config.SHADOW_TEMPLATE = ""
+	}()
+
+	hash := sha256.Sum256([]byte("shadowed\n"))
+	labels := map[string]string{"result": "match"}
+	before := counterValue("sonic_shadow_runs_total", labels)
+
+	requeue, err := handleTaskWithAck(context.Background(), kewpie.Task{
+		Body: "shadowed",
+		Tags: kewpie.Tags{
+			shadowExitCodeTag:   "0",
+			shadowOutputHashTag: hex.EncodeToString(hash[:]),
+			"webhook_success":   "http://localhost:1/never",
+		},
+	}, nil)
+
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, counterValue("sonic_shadow_runs_total", labels))
+}
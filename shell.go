@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"unicode/utf16"
+
+	"github.com/paidright/sonic/config"
+)
+
+// Shells task bodies can be run with, set in TASK_SHELL.
+const (
+	shellSh         = "sh"
+	shellPowerShell = "powershell"
+	shellCmd        = "cmd"
+)
+
+/*
+ * The command that runs a task's body in TASK_SHELL. PowerShell is given the
+ * body base64 encoded, which sidesteps its quoting rules entirely. cmd.exe
+ * doesn't follow the quoting conventions Go uses for arguments, so its
+ * command line is built separately by setShellCmdLine.
+ */
+func shellCommand(body string) (string, []string) {
+	switch config.TASK_SHELL {
+	case shellPowerShell:
+		return powerShellCommand, []string{"-NoProfile", "-NonInteractive", "-EncodedCommand", encodePowerShell(body)}
+	case shellCmd:
+		return "cmd", []string{"/d", "/s", "/c", body}
+	default:
+		return "/bin/sh", []string{"-c", body}
+	}
+}
+
+/*
+ * Encode a script as PowerShell's -EncodedCommand expects: base64 of its
+ * UTF-16LE encoding.
+ */
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	encoded := make([]byte, len(units)*2)
+	for i, unit := range units {
+		encoded[i*2] = byte(unit)
+		encoded[i*2+1] = byte(unit >> 8)
+	}
+	return base64.StdEncoding.EncodeToString(encoded)
+}
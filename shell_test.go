@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellCommand(t *testing.T) {
+	config.TASK_SHELL = shellPowerShell
+	defer func() {
+		config.TASK_SHELL = ""
+	}()
+
+	command, args := shellCommand(`Write-Output "hi"`)
+	assert.Equal(t, powerShellCommand, command)
+	assert.Equal(t, []string{"-NoProfile", "-NonInteractive", "-EncodedCommand", "VwByAGkAdABlAC0ATwB1AHQAcAB1AHQAIAAiAGgAaQAiAA=="}, args)
+
+	config.TASK_SHELL = shellCmd
+	command, args = shellCommand(`echo "hi" & exit 1`)
+	assert.Equal(t, "cmd", command)
+	assert.Equal(t, []string{"/d", "/s", "/c", `echo "hi" & exit 1`}, args)
+}
+
+func TestRunInShell(t *testing.T) {
+	config.TASK_SHELL = shellSh
+	defer func() {
+		config.TASK_SHELL = ""
+	}()
+
+	output := newTailBuffer(64)
+	err := runTaskProcWithOutput(context.Background(), kewpie.Task{Body: `echo "hello  world" | tr a-z A-Z`}, procOutput{combined: output})
+	assert.Nil(t, err)
+
+	out, _ := output.String()
+	assert.Equal(t, "HELLO  WORLD\n", out)
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os/exec"
+
+// powerShellCommand is PowerShell Core, the only PowerShell off Windows.
+const powerShellCommand = "pwsh"
+
+func setShellCmdLine(cmd *exec.Cmd, body string) {}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+
+	"github.com/paidright/sonic/config"
+)
+
+const powerShellCommand = "powershell"
+
+/*
+ * cmd.exe takes everything after /c as the command, stripping only the outer
+ * quotes with /s, rather than parsing escaped arguments as Go writes them.
+ * Build its command line by hand so the body reaches it unchanged.
+ */
+func setShellCmdLine(cmd *exec.Cmd, body string) {
+	if config.TASK_SHELL != shellCmd {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CmdLine = `cmd /d /s /c "` + body + `"`
+}
@@ -0,0 +1,282 @@
+// Package sonicclient builds and publishes Sonic tasks, so producers don't
+// have to hand roll the tags Sonic reads.
+//
+//	task := sonicclient.NewTask("./report.sh").
+//		WithWebhooks(sonicclient.Webhooks{Success: "https://example.com/done"}).
+//		WithTimeout(10 * time.Minute).
+//		WithEnv("REPORT_DATE", "2020-01-01")
+//	err := task.Publish(ctx, queue, "reports")
+//
+// Mistakes, like a relative webhook URL or an invalid environment variable
+// name, are reported by Build and Publish before anything is sent.
+package sonicclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+)
+
+// EnvelopeVersion is the version of Sonic's task format that tasks are built
+// in. It's sent in the sonic_version tag, so workers too old to understand a
+// task reject it rather than misinterpret it.
+const EnvelopeVersion = "1.0"
+
+// namePattern matches the names Sonic accepts for environment variables and
+// labels.
+var namePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Publisher is the part of a Kewpie client used to publish tasks.
+type Publisher interface {
+	Publish(ctx context.Context, queueName string, payload *kewpie.Task) error
+}
+
+// Webhooks are the URLs Sonic calls as a task progresses. Empty ones aren't
+// called.
+type Webhooks struct {
+	Start     string
+	Success   string
+	Fail      string
+	Timeout   string
+	Heartbeat string
+	Cancel    string
+	Retry     string
+}
+
+// Task builds a Sonic task. Each method records its tag and returns the task,
+// so calls can be chained, and any problems are reported together by Build.
+type Task struct {
+	body   string
+	delay  time.Duration
+	tags   kewpie.Tags
+	errors []string
+}
+
+/*
+ * Start building a task that runs cmd.
+ */
+func NewTask(cmd string) *Task {
+	task := &Task{
+		body: cmd,
+		tags: kewpie.Tags{},
+	}
+	if strings.TrimSpace(cmd) == "" {
+		task.invalid("the command is empty")
+	}
+	return task
+}
+
+/*
+ * Set the URLs Sonic calls on each event.
+ */
+func (t *Task) WithWebhooks(webhooks Webhooks) *Task {
+	t.withWebhook("webhook_start", webhooks.Start)
+	t.withWebhook("webhook_success", webhooks.Success)
+	t.withWebhook("webhook_fail", webhooks.Fail)
+	t.withWebhook("webhook_timeout", webhooks.Timeout)
+	t.withWebhook("webhook_heartbeat", webhooks.Heartbeat)
+	t.withWebhook("webhook_cancel", webhooks.Cancel)
+	t.withWebhook("webhook_retry", webhooks.Retry)
+	return t
+}
+
+/*
+ * Send the fail webhook for commands that exit with code to a URL of its own.
+ */
+func (t *Task) WithExitWebhook(code int, webhook string) *Task {
+	if code < 0 || code > 255 {
+		t.invalid("exit code %d is out of range", code)
+		return t
+	}
+	t.withWebhook("webhook_exit_"+strconv.Itoa(code), webhook)
+	return t
+}
+
+/*
+ * Send a header with every webhook, eg. an API key the receiver requires.
+ */
+func (t *Task) WithWebhookHeader(name, value string) *Task {
+	if name == "" || strings.ContainsAny(name, " :\r\n") {
+		t.invalid("invalid webhook header name %q", name)
+		return t
+	}
+	t.tags["webhook_header_"+name] = value
+	return t
+}
+
+/*
+ * Send token as a bearer token with every webhook.
+ */
+func (t *Task) WithWebhookAuthToken(token string) *Task {
+	t.tags["webhook_auth_token"] = token
+	return t
+}
+
+/*
+ * Publish the task's events to a Kewpie queue instead of sending webhooks.
+ * The queue must be in the worker's CALLBACK_QUEUES.
+ */
+func (t *Task) WithCallbackQueue(queue string) *Task {
+	if queue == "" {
+		t.invalid("the callback queue is empty")
+		return t
+	}
+	t.tags["callback_queue"] = queue
+	return t
+}
+
+/*
+ * Kill the command if it runs for longer than timeout. Workers never let a
+ * task run past their own MAX_TASK_RUNTIME.
+ */
+func (t *Task) WithTimeout(timeout time.Duration) *Task {
+	if timeout <= 0 {
+		t.invalid("the timeout must be positive, not %s", timeout)
+		return t
+	}
+	t.tags["timeout"] = timeout.String()
+	return t
+}
+
+/*
+ * Set an environment variable for the command.
+ */
+func (t *Task) WithEnv(name, value string) *Task {
+	if !namePattern.MatchString(name) {
+		t.invalid("invalid environment variable name %q", name)
+		return t
+	}
+	t.tags["env_"+name] = value
+	return t
+}
+
+/*
+ * Label the task for observability. Labels are added to the worker's metrics
+ * and log lines, and set as SONIC_LABEL_<NAME> for the command.
+ */
+func (t *Task) WithLabel(name, value string) *Task {
+	if !namePattern.MatchString(name) {
+		t.invalid("invalid label name %q", name)
+		return t
+	}
+	t.tags["label_"+name] = value
+	return t
+}
+
+/*
+ * Limit the command to a number of CPUs, eg. 0.5.
+ */
+func (t *Task) WithCPULimit(cpus float64) *Task {
+	if cpus <= 0 {
+		t.invalid("the CPU limit must be positive, not %g", cpus)
+		return t
+	}
+	t.tags["cpu_limit"] = strconv.FormatFloat(cpus, 'f', -1, 64)
+	return t
+}
+
+/*
+ * Limit the command's memory, in bytes.
+ */
+func (t *Task) WithMemoryLimit(bytes int64) *Task {
+	if bytes <= 0 {
+		t.invalid("the memory limit must be positive, not %d", bytes)
+		return t
+	}
+	t.tags["memory_limit"] = strconv.FormatInt(bytes, 10)
+	return t
+}
+
+/*
+ * Run the command attached to a pseudo-terminal.
+ */
+func (t *Task) WithTTY() *Task {
+	t.tags["tty"] = "true"
+	return t
+}
+
+/*
+ * Only send the start webhook on the task's first attempt.
+ */
+func (t *Task) WithSuppressDuplicateStart() *Task {
+	t.tags["suppress_duplicate_start"] = "true"
+	return t
+}
+
+/*
+ * Wait for delay before the task is run.
+ */
+func (t *Task) WithDelay(delay time.Duration) *Task {
+	if delay < 0 {
+		t.invalid("the delay can't be negative, not %s", delay)
+		return t
+	}
+	t.delay = delay
+	return t
+}
+
+/*
+ * Set a tag this package has no helper for. Prefer the typed helpers, which
+ * check their values.
+ */
+func (t *Task) WithTag(name, value string) *Task {
+	if name == "" {
+		t.invalid("the tag name is empty")
+		return t
+	}
+	t.tags[name] = value
+	return t
+}
+
+/*
+ * Build the Kewpie task, or describe everything wrong with it.
+ */
+func (t *Task) Build() (kewpie.Task, error) {
+	if len(t.errors) > 0 {
+		return kewpie.Task{}, fmt.Errorf("Invalid Sonic task: %s", strings.Join(t.errors, "; "))
+	}
+
+	tags := kewpie.Tags{}
+	tags["sonic_version"] = EnvelopeVersion
+	for name, value := range t.tags {
+		tags[name] = value
+	}
+	return kewpie.Task{
+		Body:  t.body,
+		Delay: t.delay,
+		Tags:  tags,
+	}, nil
+}
+
+/*
+ * Build the task and publish it to a queue.
+ */
+func (t *Task) Publish(ctx context.Context, publisher Publisher, queueName string) error {
+	task, err := t.Build()
+	if err != nil {
+		return err
+	}
+	return publisher.Publish(ctx, queueName, &task)
+}
+
+func (t *Task) withWebhook(tag, webhook string) {
+	if webhook == "" {
+		return
+	}
+	parsed, err := url.Parse(webhook)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		t.invalid("%s must be an absolute http:// or https:// URL, not %q", tag, webhook)
+		return
+	}
+	t.tags[tag] = webhook
+}
+
+func (t *Task) invalid(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
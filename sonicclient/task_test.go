@@ -0,0 +1,86 @@
+package sonicclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingPublisher struct {
+	queue string
+	tasks []kewpie.Task
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	p.queue = queueName
+	p.tasks = append(p.tasks, *payload)
+	return nil
+}
+
+func TestBuild(t *testing.T) {
+	task, err := NewTask("./report.sh").
+		WithWebhooks(Webhooks{
+			Start:   "http://example.com/start",
+			Success: "https://example.com/success",
+		}).
+		WithExitWebhook(2, "https://example.com/empty").
+		WithWebhookHeader("X-Api-Key", "secret").
+		WithTimeout(10*time.Minute).
+		WithEnv("REPORT_DATE", "2020-01-01").
+		WithLabel("team", "billing").
+		WithCPULimit(0.5).
+		WithMemoryLimit(512 << 20).
+		WithDelay(time.Minute).
+		Build()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "./report.sh", task.Body)
+	assert.Equal(t, time.Minute, task.Delay)
+	assert.Equal(t, kewpie.Tags{
+		"webhook_start":            "http://example.com/start",
+		"webhook_success":          "https://example.com/success",
+		"webhook_exit_2":           "https://example.com/empty",
+		"webhook_header_X-Api-Key": "secret",
+		"timeout":                  "10m0s",
+		"env_REPORT_DATE":          "2020-01-01",
+		"label_team":               "billing",
+		"cpu_limit":                "0.5",
+		"memory_limit":             "536870912",
+		"sonic_version":            EnvelopeVersion,
+	}, task.Tags)
+}
+
+func TestBuildInvalid(t *testing.T) {
+	_, err := NewTask("").
+		WithWebhooks(Webhooks{Fail: "/relative"}).
+		WithTimeout(0).
+		WithEnv("2FAST", "x").
+		WithLabel("team-name", "billing").
+		Build()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the command is empty")
+	assert.Contains(t, err.Error(), "webhook_fail must be an absolute")
+	assert.Contains(t, err.Error(), "the timeout must be positive")
+	assert.Contains(t, err.Error(), `invalid environment variable name "2FAST"`)
+	assert.Contains(t, err.Error(), `invalid label name "team-name"`)
+}
+
+func TestPublish(t *testing.T) {
+	publisher := &recordingPublisher{}
+
+	err := NewTask("true").WithTTY().Publish(context.Background(), publisher, "reports")
+	assert.Nil(t, err)
+	assert.Equal(t, "reports", publisher.queue)
+	assert.Equal(t, 1, len(publisher.tasks))
+	assert.Equal(t, "true", publisher.tasks[0].Tags["tty"])
+
+	err = NewTask("true").WithEnv("", "x").Publish(context.Background(), publisher, "reports")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(publisher.tasks))
+}
+
+// A Kewpie client can publish tasks directly.
+var _ Publisher = &kewpie.Kewpie{}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// spilledTask is the state persisted for each task that couldn't be
+// published while the backend was unreachable.
+type spilledTask struct {
+	Queue     string      `json:"queue"`
+	Task      kewpie.Task `json:"task"`
+	SpilledAt time.Time   `json:"spilled_at"`
+}
+
+// flushing serialises flushes of the spillover buffer, so a task isn't
+// published twice by the watcher and a reconnect racing each other.
+var flushing sync.Mutex
+
+/*
+ * Tasks are only spilled when they can be persisted to STATE_DIR.
+ */
+func spillEnabled() bool {
+	return config.STATE_DIR != ""
+}
+
+func spillDir() string {
+	return filepath.Join(config.STATE_DIR, "spill")
+}
+
+/*
+ * Publish a task, and if the backend can't take it right now, spill it to
+ * STATE_DIR to be published once the backend is back. An error is only
+ * returned if the task was neither published nor spilled.
+ */
+func publishOrSpill(ctx context.Context, queueName string, task *kewpie.Task) error {
+	err := queue.Publish(ctx, queueName, task)
+	if err == nil || !spillEnabled() {
+		return err
+	}
+
+	if !writeSpill(spilledTask{Queue: queueName, Task: *task}) {
+		return err
+	}
+	log.Printf("INFO spilled task %s for %s until the queue is reachable: %s \n", task.ID, queueName, err.Error())
+	incCounter("sonic_publish_spilled_total", map[string]string{"queue": queueName})
+	return nil
+}
+
+/*
+ * Record a task in the spillover buffer. Returns whether it was written.
+ */
+func writeSpill(spilled spilledTask) bool {
+	if spilled.SpilledAt.IsZero() {
+		spilled.SpilledAt = time.Now()
+	}
+	contents, err := json.Marshal(spilled)
+	if err != nil {
+		log.Printf("ERROR marshalling spilled task %+v\n", err)
+		return false
+	}
+
+	if err := os.MkdirAll(spillDir(), 0700); err != nil {
+		log.Printf("ERROR creating spill dir %s: %s \n", spillDir(), err.Error())
+		reportSubsystemFailure("state", err)
+		return false
+	}
+
+	path := filepath.Join(spillDir(), spilled.SpilledAt.UTC().Format("20060102T150405.000000000")+"-"+uuid.NewV4().String()+".json")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		log.Printf("ERROR writing spilled task %s: %s \n", path, err.Error())
+		reportSubsystemFailure("state", err)
+		return false
+	}
+
+	return true
+}
+
+/*
+ * Publish each spilled task, oldest first. The flush stops at the first
+ * task the backend still won't take, so tasks are published in the order
+ * they were spilled.
+ */
+func flushSpill(ctx context.Context) {
+	if !spillEnabled() {
+		return
+	}
+
+	flushing.Lock()
+	defer flushing.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(spillDir(), "*.json"))
+	if err != nil {
+		log.Printf("ERROR listing spilled tasks: %s \n", err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("ERROR reading spilled task %s: %s \n", path, err.Error())
+			continue
+		}
+		spilled := spilledTask{}
+		if err := json.Unmarshal(contents, &spilled); err != nil {
+			log.Printf("ERROR parsing spilled task %s: %s \n", path, err.Error())
+			clearSpill(path)
+			continue
+		}
+
+		if err := queue.Publish(ctx, spilled.Queue, &spilled.Task); err != nil {
+			log.Printf("ERROR publishing spilled task %s to %s, spilled at %s: %s \n", spilled.Task.ID, spilled.Queue, spilled.SpilledAt.Format(time.RFC3339), err.Error())
+			return
+		}
+		log.Printf("INFO published spilled task %s to %s, spilled at %s \n", spilled.Task.ID, spilled.Queue, spilled.SpilledAt.Format(time.RFC3339))
+		incCounter("sonic_publish_unspilled_total", map[string]string{"queue": spilled.Queue})
+		clearSpill(path)
+	}
+}
+
+func clearSpill(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR removing spilled task %s: %s \n", path, err.Error())
+	}
+}
+
+/*
+ * Publish spilled tasks straight away, to pick up any left by a previous
+ * run of Sonic, and then every SPILL_FLUSH_INTERVAL.
+ */
+func watchSpill(ctx context.Context) {
+	if !spillEnabled() {
+		return
+	}
+
+	for {
+		flushSpill(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.SPILL_FLUSH_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// unreachableBackend is a memory backend whose publishes fail while down is
+// set.
+type unreachableBackend struct {
+	*memoryQueue
+	mu   sync.Mutex
+	down bool
+}
+
+func (u *unreachableBackend) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	u.mu.Lock()
+	down := u.down
+	u.mu.Unlock()
+	if down {
+		return fmt.Errorf("connection refused")
+	}
+	return u.memoryQueue.Publish(ctx, queueName, payload)
+}
+
+func (u *unreachableBackend) setDown(down bool) {
+	u.mu.Lock()
+	u.down = down
+	u.mu.Unlock()
+}
+
+func withUnreachableQueue(t *testing.T) (*unreachableBackend, func()) {
+	dir, err := ioutil.TempDir("", "sonic-spill-")
+	assert.Nil(t, err)
+	config.STATE_DIR = dir
+
+	backend := &unreachableBackend{memoryQueue: &memoryQueue{}, down: true}
+	assert.Nil(t, backend.Connect("memory", []string{config.QUEUE}, nil))
+
+	restore := withQueueBackend(backend)
+	return backend, func() {
+		restore()
+		config.STATE_DIR = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func spilledTasks(t *testing.T) []string {
+	paths, err := filepath.Glob(filepath.Join(spillDir(), "*.json"))
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestSpill(t *testing.T) {
+	backend, restore := withUnreachableQueue(t)
+	defer restore()
+
+	spilled := counterValue("sonic_publish_spilled_total", map[string]string{"queue": config.QUEUE})
+	unspilled := counterValue("sonic_publish_unspilled_total", map[string]string{"queue": config.QUEUE})
+
+	assert.Nil(t, publishOrSpill(context.Background(), config.QUEUE, &kewpie.Task{ID: "first", Body: "true"}))
+	assert.Nil(t, publishOrSpill(context.Background(), config.QUEUE, &kewpie.Task{ID: "second", Body: "true"}))
+	assert.Len(t, spilledTasks(t), 2)
+	assert.Equal(t, spilled+2, counterValue("sonic_publish_spilled_total", map[string]string{"queue": config.QUEUE}))
+
+	// Still down
+	flushSpill(context.Background())
+	assert.Len(t, spilledTasks(t), 2)
+	assert.Equal(t, 0, len(backend.Waiting(config.QUEUE)))
+
+	backend.setDown(false)
+	flushSpill(context.Background())
+	assert.Len(t, spilledTasks(t), 0)
+	assert.Equal(t, unspilled+2, counterValue("sonic_publish_unspilled_total", map[string]string{"queue": config.QUEUE}))
+
+	waiting := backend.Waiting(config.QUEUE)
+	assert.Equal(t, 2, len(waiting))
+	assert.Equal(t, "first", waiting[0].ID)
+	assert.Equal(t, "second", waiting[1].ID)
+}
+
+func TestSpillDisabled(t *testing.T) {
+	_, restore := withUnreachableQueue(t)
+	defer restore()
+	config.STATE_DIR = ""
+
+	assert.EqualError(t, publishOrSpill(context.Background(), config.QUEUE, &kewpie.Task{Body: "true"}), "connection refused")
+}
+
+func TestSpillDelayedTask(t *testing.T) {
+	backend, restore := withUnreachableQueue(t)
+	defer restore()
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "7a1c2e3f-4b5d-4e6f-8a9b-0c1d2e3f4a5b",
+		Body: "definitely_not_a_real_command",
+		Tags: kewpie.Tags{delayTag: "1h"},
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+	assert.Len(t, spilledTasks(t), 1)
+
+	backend.setDown(false)
+	flushSpill(context.Background())
+	waiting := backend.Waiting(config.QUEUE)
+	assert.Equal(t, 1, len(waiting))
+	assert.Equal(t, "7a1c2e3f-4b5d-4e6f-8a9b-0c1d2e3f4a5b", waiting[0].ID)
+	assert.NotEmpty(t, waiting[0].Tags[runAtTag])
+}
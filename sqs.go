@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/davidbanham/kewpie_go/v3/util"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// sqsMaxDelay is the longest SQS will delay a message. Tasks due later are
+// published with it, and published again when they're received early.
+const sqsMaxDelay = 15 * time.Minute
+
+// sqsMaxBatch is the most messages SQS returns from one receive.
+const sqsMaxBatch = 10
+
+// ErrSQSClosed is returned for operations on a disconnected SQS queue.
+var ErrSQSClosed = fmt.Errorf("The SQS connection is closed")
+
+// sqsQueue takes tasks from Amazon SQS in place of Kewpie's SQS backend, and
+// in the same message format, so producers using Kewpie are unaffected. Unlike
+// Kewpie's, it keeps extending a task's visibility timeout while it runs, so
+// long tasks aren't delivered to another worker mid-run.
+type sqsQueue struct {
+	svc    *sqs.SQS
+	mu     sync.Mutex
+	urls   map[string]string
+	closed bool
+}
+
+/*
+ * Find the URL of each queue, creating any that don't exist.
+ */
+func (s *sqsQueue) Connect(backend string, queues []string, connection interface{}) error {
+	sess, err := sqsSession()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.svc = sqs.New(sess)
+	s.urls = map[string]string{}
+	s.closed = false
+	s.mu.Unlock()
+
+	for _, name := range queues {
+		if _, err := s.url(context.Background(), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Open an AWS session for SQS. SQS_REGION overrides the region, and
+ * otherwise it's found the way the AWS CLI finds it: from AWS_REGION or
+ * AWS_DEFAULT_REGION, the shared config file, or the metadata of the EC2
+ * instance Sonic is running on.
+ */
+func sqsSession() (*session.Session, error) {
+	awsConfig := aws.NewConfig()
+	if config.SQS_REGION != "" {
+		awsConfig = awsConfig.WithRegion(config.SQS_REGION)
+	}
+	if config.SQS_ENDPOINT != "" {
+		awsConfig = awsConfig.WithEndpoint(config.SQS_ENDPOINT)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := ec2metadata.New(sess).Region()
+		if err != nil {
+			return nil, fmt.Errorf("No AWS region is configured for SQS, set SQS_REGION or AWS_REGION")
+		}
+		sess.Config.Region = aws.String(region)
+	}
+
+	return sess, nil
+}
+
+func (s *sqsQueue) Disconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+/*
+ * Check SQS can be reached with the worker's credentials.
+ */
+func (s *sqsQueue) Healthy(ctx context.Context) error {
+	if s.isClosed() {
+		return ErrSQSClosed
+	}
+	_, err := s.svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(config.QUEUE),
+	})
+	return err
+}
+
+/*
+ * Send a task to a queue, with its details in the message attributes Kewpie
+ * uses.
+ */
+func (s *sqsQueue) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	if payload.Delay != 0 {
+		payload.RunAt = time.Now().Add(payload.Delay)
+	} else if payload.RunAt.IsZero() {
+		payload.RunAt = time.Now()
+	}
+	payload.Delay = payload.RunAt.Sub(time.Now())
+	if payload.ID == "" {
+		payload.ID = uuid.NewV4().String()
+	}
+
+	if s.isClosed() {
+		return ErrSQSClosed
+	}
+	url, err := s.url(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	tags, err := json.Marshal(payload.Tags)
+	if err != nil {
+		return err
+	}
+	delay := payload.Delay
+	if delay > sqsMaxDelay {
+		delay = sqsMaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	_, err = s.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(url),
+		MessageBody:  aws.String(payload.Body),
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"ID":           sqsString(payload.ID),
+			"RunAt":        sqsString(payload.RunAt.UTC().Format(time.RFC3339)),
+			"NoExpBackoff": sqsString(strconv.FormatBool(payload.NoExpBackoff)),
+			"Attempts": {
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(strconv.Itoa(payload.Attempts)),
+			},
+			"Tags": sqsString(string(tags)),
+		},
+	})
+	return err
+}
+
+/*
+ * Handle tasks from a queue one at a time until the context is done,
+ * receiving up to BATCH_SIZE of them at once, or 10 at most.
+ */
+func (s *sqsQueue) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	count := config.BATCH_SIZE
+	if count > sqsMaxBatch {
+		count = sqsMaxBatch
+	}
+	for {
+		err := s.popBatch(ctx, queueName, count, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Wait for a task on a queue and handle it. Its visibility timeout is
+ * extended every half SQS_VISIBILITY_TIMEOUT while it runs, and the message
+ * is deleted once it's handled. If a worker dies its task is delivered again
+ * once the timeout passes, and that counts as an attempt.
+ */
+func (s *sqsQueue) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	return s.popBatch(ctx, queueName, 1, handler)
+}
+
+/*
+ * Receive up to count messages from a queue at once and handle each in
+ * turn, waiting until there's at least one task. Messages waiting their turn
+ * have their visibility timeouts extended too.
+ */
+func (s *sqsQueue) popBatch(ctx context.Context, queueName string, count int, handler types.Handler) error {
+	url, err := s.url(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if s.isClosed() {
+			return ErrSQSClosed
+		}
+
+		output, err := s.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(url),
+			MaxNumberOfMessages:   aws.Int64(int64(count)),
+			VisibilityTimeout:     aws.Int64(int64(config.SQS_VISIBILITY_TIMEOUT / time.Second)),
+			WaitTimeSeconds:       aws.Int64(int64(config.SQS_WAIT / time.Second)),
+			AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		handled := false
+		for i, message := range output.Messages {
+			if ctx.Err() != nil {
+				// Let another worker have them straight away
+				for _, waiting := range output.Messages[i:] {
+					s.release(url, waiting)
+				}
+				return ctx.Err()
+			}
+
+			task, err := parseSQSMessage(message)
+			if err != nil {
+				// Left for the queue's redrive policy, if it has one, to move aside
+				log.Printf("ERROR skipping message %s on %s as it isn't a task: %s \n", aws.StringValue(message.MessageId), queueName, err.Error())
+				continue
+			}
+
+			// Delays longer than SQS allows are made up of several
+			if time.Until(task.RunAt) > time.Second {
+				task.Delay = 0
+				if err := s.Publish(ctx, queueName, &task); err != nil {
+					return err
+				}
+				if err := s.delete(url, message); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := s.handle(queueName, url, message, output.Messages[i+1:], task, handler); err != nil {
+				return err
+			}
+			handled = true
+		}
+		if handled {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+ * Handle a task, extending the visibility timeouts of its message and the
+ * rest of its batch while it runs.
+ */
+func (s *sqsQueue) handle(queueName, url string, message *sqs.Message, rest []*sqs.Message, task kewpie.Task, handler types.Handler) error {
+	done := make(chan struct{})
+	timeout := config.SQS_VISIBILITY_TIMEOUT
+	id := task.ID
+	receipts := []*string{message.ReceiptHandle}
+	for _, waiting := range rest {
+		receipts = append(receipts, waiting.ReceiptHandle)
+	}
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), timeout/2)
+				for _, receipt := range receipts {
+					_, err := s.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+						QueueUrl:          aws.String(url),
+						ReceiptHandle:     receipt,
+						VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+					})
+					if err != nil {
+						log.Printf("ERROR extending visibility timeout of task %s on %s: %s \n", id, queueName, err.Error())
+					}
+				}
+				cancel()
+			}
+		}
+	}()
+
+	requeue, err := handler.Handle(task)
+	close(done)
+
+	if err != nil && requeue {
+		log.Println("ERROR kewpie task handler", err)
+		task.Attempts++
+		task.RunAt = time.Time{}
+		task.Delay = 0
+		if !task.NoExpBackoff {
+			task.Delay = util.CalcBackoff(task.Attempts + 1)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Publish(ctx, queueName, &task); err != nil {
+			// Leave it to be delivered again once it's visible instead
+			log.Printf("ERROR requeueing task %s on %s: %s \n", task.ID, queueName, err.Error())
+			return nil
+		}
+	}
+	return s.delete(url, message)
+}
+
+/*
+ * The URL of a queue, creating it the way Kewpie does if it doesn't exist.
+ */
+func (s *sqsQueue) url(ctx context.Context, queueName string) (string, error) {
+	s.mu.Lock()
+	url, ok := s.urls[queueName]
+	s.mu.Unlock()
+	if ok {
+		return url, nil
+	}
+
+	output, err := s.svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err == nil {
+		url = aws.StringValue(output.QueueUrl)
+	} else if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == sqs.ErrCodeQueueDoesNotExist {
+		created, err := s.svc.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
+			QueueName: aws.String(queueName),
+			Attributes: map[string]*string{
+				"ReceiveMessageWaitTimeSeconds": aws.String("20"),
+				"MessageRetentionPeriod":        aws.String("1209600"),
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		log.Printf("INFO created SQS queue %s \n", queueName)
+		url = aws.StringValue(created.QueueUrl)
+	} else {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.urls[queueName] = url
+	s.mu.Unlock()
+	return url, nil
+}
+
+func (s *sqsQueue) delete(url string, message *sqs.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(url),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return err
+}
+
+func (s *sqsQueue) release(url string, message *sqs.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(url),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+}
+
+func (s *sqsQueue) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+/*
+ * Read a task from a message in Kewpie's format. Messages from Kewpie itself
+ * have no ID attribute, so they're known by their message ID. Each delivery
+ * after the first counts as an attempt.
+ */
+func parseSQSMessage(message *sqs.Message) (kewpie.Task, error) {
+	task := kewpie.Task{
+		ID:   aws.StringValue(message.MessageId),
+		Body: aws.StringValue(message.Body),
+	}
+	attributes := map[string]string{}
+	for name, value := range message.MessageAttributes {
+		attributes[name] = aws.StringValue(value.StringValue)
+	}
+
+	if attributes["ID"] != "" {
+		task.ID = attributes["ID"]
+	}
+	runAt, err := time.Parse(time.RFC3339, attributes["RunAt"])
+	if err != nil {
+		return task, fmt.Errorf("RunAt %q isn't a time", attributes["RunAt"])
+	}
+	task.RunAt = runAt
+	task.NoExpBackoff = attributes["NoExpBackoff"] == "true"
+	if attributes["Attempts"] != "" {
+		if task.Attempts, err = strconv.Atoi(attributes["Attempts"]); err != nil {
+			return task, fmt.Errorf("Attempts %q isn't a number", attributes["Attempts"])
+		}
+	}
+	if attributes["Tags"] != "" {
+		if err := json.Unmarshal([]byte(attributes["Tags"]), &task.Tags); err != nil {
+			return task, fmt.Errorf("Tags aren't valid: %s", err)
+		}
+	}
+
+	if received, err := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount])); err == nil && received > 1 {
+		task.Attempts += received - 1
+	}
+	return task, nil
+}
+
+func sqsString(value string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(value),
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSQSMessage is a message in one of fakeSQS's queues.
+type fakeSQSMessage struct {
+	id         string
+	body       string
+	attributes map[string]string
+	types      map[string]string
+	delay      int64
+	visibleAt  time.Time
+	received   int
+	receipt    string
+}
+
+// fakeSQS speaks just enough of the SQS query protocol to serve Sonic.
+// Receives wait briefly rather than for the full long poll.
+type fakeSQS struct {
+	sync.Mutex
+	server   *httptest.Server
+	queues   map[string][]*fakeSQSMessage
+	created  []string
+	deleted  []string
+	extended int
+	receives []int
+	waits    []string
+	nextID   int
+}
+
+func newFakeSQS() *fakeSQS {
+	fake := &fakeSQS{queues: map[string][]*fakeSQSMessage{}}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (s *fakeSQS) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+
+	if action == "ReceiveMessage" {
+		s.receive(w, r)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch action {
+	case "GetQueueUrl":
+		name := r.Form.Get("QueueName")
+		if _, ok := s.queues[name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>The specified queue does not exist.</Message></Error><RequestId>1</RequestId></ErrorResponse>", sqs.ErrCodeQueueDoesNotExist)
+			return
+		}
+		fmt.Fprintf(w, "<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>%s</QueueUrl></GetQueueUrlResult></GetQueueUrlResponse>", s.queueURL(name))
+	case "CreateQueue":
+		name := r.Form.Get("QueueName")
+		s.queues[name] = nil
+		s.created = append(s.created, name)
+		fmt.Fprintf(w, "<CreateQueueResponse><CreateQueueResult><QueueUrl>%s</QueueUrl></CreateQueueResult></CreateQueueResponse>", s.queueURL(name))
+	case "ListQueues":
+		fmt.Fprint(w, "<ListQueuesResponse><ListQueuesResult></ListQueuesResult></ListQueuesResponse>")
+	case "SendMessage":
+		message := &fakeSQSMessage{
+			body:       r.Form.Get("MessageBody"),
+			attributes: map[string]string{},
+			types:      map[string]string{},
+		}
+		message.delay, _ = strconv.ParseInt(r.Form.Get("DelaySeconds"), 10, 64)
+		message.visibleAt = time.Now().Add(time.Duration(message.delay) * time.Second)
+		for i := 1; r.Form.Get(fmt.Sprintf("MessageAttribute.%d.Name", i)) != ""; i++ {
+			prefix := fmt.Sprintf("MessageAttribute.%d.", i)
+			name := r.Form.Get(prefix + "Name")
+			message.attributes[name] = r.Form.Get(prefix + "Value.StringValue")
+			message.types[name] = r.Form.Get(prefix + "Value.DataType")
+		}
+		s.add(s.queueName(r), message)
+		fmt.Fprintf(w, "<SendMessageResponse><SendMessageResult><MD5OfMessageBody>%x</MD5OfMessageBody><MessageId>%s</MessageId></SendMessageResult></SendMessageResponse>", md5.Sum([]byte(message.body)), message.id)
+	case "DeleteMessage":
+		name := s.queueName(r)
+		for i, message := range s.queues[name] {
+			if message.receipt == r.Form.Get("ReceiptHandle") {
+				s.deleted = append(s.deleted, message.id)
+				s.queues[name] = append(s.queues[name][:i], s.queues[name][i+1:]...)
+				break
+			}
+		}
+		fmt.Fprint(w, "<DeleteMessageResponse></DeleteMessageResponse>")
+	case "ChangeMessageVisibility":
+		timeout, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		for _, message := range s.queues[s.queueName(r)] {
+			if message.receipt == r.Form.Get("ReceiptHandle") {
+				message.visibleAt = time.Now().Add(time.Duration(timeout) * time.Second)
+				if timeout > 0 {
+					s.extended++
+				}
+			}
+		}
+		fmt.Fprint(w, "<ChangeMessageVisibilityResponse></ChangeMessageVisibilityResponse>")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (s *fakeSQS) receive(w http.ResponseWriter, r *http.Request) {
+	name := s.queueName(r)
+	timeout, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+	max, _ := strconv.Atoi(r.Form.Get("MaxNumberOfMessages"))
+	s.Lock()
+	s.waits = append(s.waits, r.Form.Get("WaitTimeSeconds"))
+	s.Unlock()
+	deadline := time.Now().Add(200 * time.Millisecond)
+
+	for {
+		s.Lock()
+		received := []*fakeSQSMessage{}
+		for _, message := range s.queues[name] {
+			if len(received) == max || message.visibleAt.After(time.Now()) {
+				continue
+			}
+			message.received++
+			message.receipt = fmt.Sprintf("%s-%d", message.id, message.received)
+			message.visibleAt = time.Now().Add(time.Duration(timeout) * time.Second)
+			received = append(received, message)
+		}
+		if len(received) > 0 {
+			s.receives = append(s.receives, len(received))
+			fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+			for _, message := range received {
+				fmt.Fprintf(w, "<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle><MD5OfBody>%x</MD5OfBody><Body>%s</Body>", message.id, message.receipt, md5.Sum([]byte(message.body)), xmlText(message.body))
+				fmt.Fprintf(w, "<Attribute><Name>ApproximateReceiveCount</Name><Value>%d</Value></Attribute>", message.received)
+				for key, value := range message.attributes {
+					fmt.Fprintf(w, "<MessageAttribute><Name>%s</Name><Value><StringValue>%s</StringValue><DataType>%s</DataType></Value></MessageAttribute>", key, xmlText(value), message.types[key])
+				}
+				fmt.Fprint(w, "</Message>")
+			}
+			fmt.Fprint(w, "</ReceiveMessageResult></ReceiveMessageResponse>")
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+
+		if time.Now().After(deadline) || r.Context().Err() != nil {
+			fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult></ReceiveMessageResult></ReceiveMessageResponse>")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeSQS) add(name string, message *fakeSQSMessage) {
+	s.nextID++
+	message.id = fmt.Sprintf("message-%d", s.nextID)
+	s.queues[name] = append(s.queues[name], message)
+}
+
+func (s *fakeSQS) queueURL(name string) string {
+	return s.server.URL + "/queue/" + name
+}
+
+func (s *fakeSQS) queueName(r *http.Request) string {
+	return strings.TrimPrefix(r.Form.Get("QueueUrl"), s.server.URL+"/queue/")
+}
+
+func (s *fakeSQS) messages(name string) []*fakeSQSMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*fakeSQSMessage{}, s.queues[name]...)
+}
+
+func xmlText(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(value)
+}
+
+func withFakeSQS(t *testing.T) (*fakeSQS, *sqsQueue) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "sonic")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	server := newFakeSQS()
+	config.SQS_REGION = "ap-southeast-2"
+	config.SQS_ENDPOINT = server.server.URL
+	config.SQS_VISIBILITY_TIMEOUT = 90 * time.Second
+
+	client := &sqsQueue{}
+	assert.Nil(t, client.Connect("sqs", []string{"sqs_test"}, nil))
+	return server, client
+}
+
+func closeFakeSQS(server *fakeSQS) {
+	server.server.Close()
+	config.SQS_REGION = ""
+	config.SQS_ENDPOINT = ""
+	config.SQS_VISIBILITY_TIMEOUT = 90 * time.Second
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+}
+
+func popSQS(t *testing.T, client *sqsQueue, handle func(task kewpie.Task) (bool, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, client.Pop(ctx, "sqs_test", cliHandler{handleFunc: handle}))
+}
+
+func TestSQSQueue(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	assert.Nil(t, client.Healthy(context.Background()))
+	server.Lock()
+	assert.Equal(t, []string{"sqs_test"}, server.created)
+	server.Unlock()
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{
+		ID:   "2b1e4c1a-51a4-4d5e-bb3e-0f1ad8b2a6c7",
+		Body: "echo <hi>",
+		Tags: kewpie.Tags{"label_team": "billing"},
+	}))
+
+	messages := server.messages("sqs_test")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "Number", messages[0].types["Attempts"])
+	assert.Equal(t, "false", messages[0].attributes["NoExpBackoff"])
+	tags := kewpie.Tags{}
+	assert.Nil(t, json.Unmarshal([]byte(messages[0].attributes["Tags"]), &tags))
+	assert.Equal(t, "billing", tags["label_team"])
+
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "2b1e4c1a-51a4-4d5e-bb3e-0f1ad8b2a6c7", task.ID)
+		assert.Equal(t, "echo <hi>", task.Body)
+		assert.Equal(t, "billing", task.Tags["label_team"])
+		assert.Equal(t, 0, task.Attempts)
+		return false, nil
+	})
+
+	server.Lock()
+	assert.Equal(t, []string{messages[0].id}, server.deleted)
+	server.Unlock()
+	assert.Equal(t, 0, len(server.messages("sqs_test")))
+}
+
+func TestSQSQueueRequeue(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "false"}))
+
+	var id string
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		id = task.ID
+		return true, fmt.Errorf("try again")
+	})
+
+	messages := server.messages("sqs_test")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, id, messages[0].attributes["ID"])
+	assert.Equal(t, "1", messages[0].attributes["Attempts"])
+	assert.True(t, messages[0].delay > 0)
+}
+
+func TestSQSQueueReject(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "false"}))
+
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		return false, fmt.Errorf("no good")
+	})
+
+	assert.Equal(t, 0, len(server.messages("sqs_test")))
+	server.Lock()
+	assert.Equal(t, 1, len(server.deleted))
+	server.Unlock()
+}
+
+func TestSQSQueueHeartbeat(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+	config.SQS_VISIBILITY_TIMEOUT = time.Second
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "sleep 2"}))
+
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		time.Sleep(1500 * time.Millisecond)
+
+		// Still hidden from other workers, well past the visibility timeout
+		messages := server.messages("sqs_test")
+		server.Lock()
+		assert.True(t, messages[0].visibleAt.After(time.Now()))
+		assert.Equal(t, 1, messages[0].received)
+		server.Unlock()
+		return false, nil
+	})
+
+	server.Lock()
+	assert.True(t, server.extended >= 2)
+	assert.Equal(t, 1, len(server.deleted))
+	server.Unlock()
+}
+
+func TestSQSQueueRedelivered(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "true", Attempts: 1}))
+	// As if a worker died holding it
+	server.Lock()
+	server.queues["sqs_test"][0].received = 2
+	server.Unlock()
+
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, 3, task.Attempts)
+		return false, nil
+	})
+}
+
+func TestSQSQueueDelayed(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "true", Delay: time.Hour}))
+	messages := server.messages("sqs_test")
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, int64(sqsMaxDelay/time.Second), messages[0].delay)
+
+	// As if the first delay has passed
+	server.Lock()
+	server.queues["sqs_test"][0].visibleAt = time.Now()
+	server.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := client.Pop(ctx, "sqs_test", cliHandler{handleFunc: func(task kewpie.Task) (bool, error) {
+		t.Error("handled a task that isn't due")
+		return false, nil
+	}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Sent again for the rest of the delay
+	remaining := server.messages("sqs_test")
+	assert.Equal(t, 1, len(remaining))
+	assert.NotEqual(t, messages[0].id, remaining[0].id)
+	assert.Equal(t, messages[0].attributes["ID"], remaining[0].attributes["ID"])
+	assert.Equal(t, messages[0].attributes["RunAt"], remaining[0].attributes["RunAt"])
+	assert.Equal(t, int64(sqsMaxDelay/time.Second), remaining[0].delay)
+}
+
+func TestSQSQueueCancelled(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, client.Subscribe(ctx, "sqs_test", cliHandler{handleFunc: func(task kewpie.Task) (bool, error) {
+		t.Error("handled a task from an empty queue")
+		return false, nil
+	}}))
+
+	assert.Nil(t, client.Disconnect())
+	assert.Equal(t, ErrSQSClosed, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "true"}))
+}
+
+func TestParseSQSMessage(t *testing.T) {
+	// As sent by Kewpie, which has no ID attribute
+	task, err := parseSQSMessage(&sqs.Message{
+		MessageId: aws.String("6a3f0f5e-7d4b-4f3c-9c1e-2b8d5e0a9f12"),
+		Body:      aws.String("echo hi"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"RunAt":        sqsString("2019-05-01T00:00:00Z"),
+			"NoExpBackoff": sqsString("true"),
+			"Attempts":     {DataType: aws.String("Number"), StringValue: aws.String("2")},
+			"Tags":         sqsString(`{"label_team":"billing"}`),
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "6a3f0f5e-7d4b-4f3c-9c1e-2b8d5e0a9f12", task.ID)
+	assert.Equal(t, "echo hi", task.Body)
+	assert.Equal(t, 2, task.Attempts)
+	assert.True(t, task.NoExpBackoff)
+	assert.Equal(t, "billing", task.Tags["label_team"])
+	assert.Equal(t, 2019, task.RunAt.Year())
+
+	_, err = parseSQSMessage(&sqs.Message{
+		MessageId: aws.String("not-a-task"),
+		Body:      aws.String("echo hi"),
+	})
+	assert.NotNil(t, err)
+}
+
+func TestSQSQueueBatch(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+	config.BATCH_SIZE = 20
+	defer func() {
+		config.BATCH_SIZE = 1
+	}()
+
+	for i := 0; i < 12; i++ {
+		assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: fmt.Sprintf("echo %d", i)}))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handled := 0
+	assert.Nil(t, client.Subscribe(ctx, "sqs_test", cliHandler{handleFunc: func(task kewpie.Task) (bool, error) {
+		handled++
+		if handled == 11 {
+			cancel()
+		}
+		return false, nil
+	}}))
+
+	assert.Equal(t, 11, handled)
+	server.Lock()
+	assert.Equal(t, []int{10, 2}, server.receives)
+	server.Unlock()
+
+	// The message cut off by the cancel is let go at once
+	messages := server.messages("sqs_test")
+	assert.Equal(t, 1, len(messages))
+	server.Lock()
+	assert.False(t, messages[0].visibleAt.After(time.Now()))
+	server.Unlock()
+}
+
+func TestSQSQueueWait(t *testing.T) {
+	server, client := withFakeSQS(t)
+	defer closeFakeSQS(server)
+	config.SQS_WAIT = 0
+	defer func() {
+		config.SQS_WAIT = 20 * time.Second
+	}()
+
+	assert.Nil(t, client.Publish(context.Background(), "sqs_test", &kewpie.Task{Body: "true"}))
+	popSQS(t, client, func(task kewpie.Task) (bool, error) {
+		return false, nil
+	})
+
+	server.Lock()
+	assert.Equal(t, []string{"0"}, server.waits)
+	server.Unlock()
+}
+
+/*
+ * Run against a real SQS, or a local one such as localstack, when
+ * SQS_TEST_ENDPOINT is set, eg. to http://localhost:4566. The usual AWS
+ * credentials and region are used, and a queue is created for the test.
+ */
+func TestSQSQueueAgainstEndpoint(t *testing.T) {
+	endpoint := os.Getenv("SQS_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SQS_TEST_ENDPOINT isn't set")
+	}
+	config.SQS_ENDPOINT = endpoint
+	config.SQS_VISIBILITY_TIMEOUT = 2 * time.Second
+	config.SQS_WAIT = time.Second
+	defer func() {
+		config.SQS_ENDPOINT = ""
+		config.SQS_VISIBILITY_TIMEOUT = 90 * time.Second
+		config.SQS_WAIT = 20 * time.Second
+	}()
+
+	queueName := "sonic_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	client := &sqsQueue{}
+	assert.Nil(t, client.Connect("sqs", []string{queueName}, nil))
+	defer func() {
+		if url, err := client.url(context.Background(), queueName); err == nil {
+			client.svc.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: aws.String(url)})
+		}
+		client.Disconnect()
+	}()
+	assert.Nil(t, client.Healthy(context.Background()))
+
+	pop := func(handle func(task kewpie.Task) (bool, error)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		assert.Nil(t, client.Pop(ctx, queueName, cliHandler{handleFunc: handle}))
+	}
+
+	assert.Nil(t, client.Publish(context.Background(), queueName, &kewpie.Task{
+		ID:           "6d2f9a4e-3b1c-4e7a-8f5d-0a9b8c7d6e5f",
+		Body:         "echo <hi>",
+		NoExpBackoff: true,
+		Tags:         kewpie.Tags{"label_team": "billing"},
+	}))
+
+	// Outlives the visibility timeout, so it's only kept from being delivered
+	// again by the heartbeat, then fails and is requeued
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "6d2f9a4e-3b1c-4e7a-8f5d-0a9b8c7d6e5f", task.ID)
+		assert.Equal(t, "echo <hi>", task.Body)
+		assert.Equal(t, "billing", task.Tags["label_team"])
+		assert.Equal(t, 0, task.Attempts)
+		time.Sleep(5 * time.Second)
+		return true, fmt.Errorf("try again")
+	})
+
+	pop(func(task kewpie.Task) (bool, error) {
+		assert.Equal(t, "6d2f9a4e-3b1c-4e7a-8f5d-0a9b8c7d6e5f", task.ID)
+		assert.Equal(t, 1, task.Attempts)
+		return false, nil
+	})
+
+	// Nothing is left behind to be delivered again
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	err := client.Pop(ctx, queueName, cliHandler{handleFunc: func(task kewpie.Task) (bool, error) {
+		t.Errorf("unexpected redelivery of task %s", task.ID)
+		return false, nil
+	}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
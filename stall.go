@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/davidbanham/kewpie_go/v3/types"
+	"github.com/paidright/sonic/config"
+)
+
+// stallProbeTimeout bounds how long a health check of an idle queue
+// connection may take before the connection is considered stalled.
+const stallProbeTimeout = 10 * time.Second
+
+// subscribeActivity records when the subscription last delivered a task, and
+// whether one is being handled now.
+type subscribeActivity struct {
+	sync.Mutex
+	lastDelivery time.Time
+	busy         bool
+}
+
+func newSubscribeActivity() *subscribeActivity {
+	return &subscribeActivity{lastDelivery: time.Now()}
+}
+
+func (a *subscribeActivity) delivered() {
+	a.Lock()
+	defer a.Unlock()
+	a.busy = true
+	a.lastDelivery = time.Now()
+}
+
+func (a *subscribeActivity) finished() {
+	a.Lock()
+	defer a.Unlock()
+	a.busy = false
+	a.lastDelivery = time.Now()
+}
+
+/*
+ * Whether the subscription looks stalled. Once nothing has been delivered
+ * for SUBSCRIBE_STALL_TIMEOUT the backend is probed, and if the probe fails
+ * or hangs the connection is stalled. A healthy probe means the queue is
+ * simply empty, and restarts the clock.
+ */
+func (a *subscribeActivity) stalled(ctx context.Context, probe func(context.Context) error) bool {
+	a.Lock()
+	idle := time.Since(a.lastDelivery)
+	busy := a.busy
+	a.Unlock()
+	if busy || idle < config.SUBSCRIBE_STALL_TIMEOUT {
+		return false
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, stallProbeTimeout)
+	defer cancel()
+
+	// A stalled connection may not honour the context, so don't wait on it
+	result := make(chan error, 1)
+	go func() {
+		result <- probe(probeCtx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-probeCtx.Done():
+		err = probeCtx.Err()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err == nil {
+		log.Printf("INFO nothing delivered from queue %s for %s, but it's healthy \n", config.QUEUE, idle.Round(time.Second))
+		a.Lock()
+		a.lastDelivery = time.Now()
+		a.Unlock()
+		return false
+	}
+
+	log.Printf("ERROR subscription to queue %s looks stalled, nothing delivered for %s and the probe failed: %s \n", config.QUEUE, idle.Round(time.Second), err.Error())
+	incCounter("sonic_subscribe_stalls_total", nil)
+	return true
+}
+
+/*
+ * Subscribe to QUEUE, reconnecting whenever the subscription stalls. Without
+ * SUBSCRIBE_STALL_TIMEOUT this is a plain subscription.
+ */
+func subscribeWithStallDetection(ctx context.Context, handler types.Handler, activity *subscribeActivity) error {
+	if config.SUBSCRIBE_STALL_TIMEOUT <= 0 {
+		return queue.Subscribe(ctx, config.QUEUE, handler)
+	}
+
+	for {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		stalled := make(chan struct{})
+		go func() {
+			interval := config.SUBSCRIBE_STALL_TIMEOUT / 4
+			if interval < time.Second {
+				interval = time.Second
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-attemptCtx.Done():
+					return
+				case <-ticker.C:
+					if activity.stalled(attemptCtx, queue.Healthy) {
+						close(stalled)
+						cancel()
+						// Closing the connection unblocks backends that
+						// don't honour the context
+						queue.Disconnect()
+						return
+					}
+				}
+			}
+		}()
+
+		err := queue.Subscribe(attemptCtx, config.QUEUE, handler)
+		cancel()
+
+		select {
+		case <-stalled:
+		default:
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		log.Printf("INFO reconnecting to queue %s \n", config.QUEUE)
+		if err := queue.Connect(config.KEWPIE_BACKEND, queueNames(), nil); err != nil {
+			return err
+		}
+		subscribeSideQueues(ctx)
+		activity.finished()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeStallDetection(t *testing.T) {
+	config.SUBSCRIBE_STALL_TIMEOUT = time.Minute
+	defer func() {
+		config.SUBSCRIBE_STALL_TIMEOUT = 0
+	}()
+
+	healthy := func(ctx context.Context) error { return nil }
+	broken := func(ctx context.Context) error { return fmt.Errorf("connection reset") }
+	hung := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	activity := newSubscribeActivity()
+	assert.False(t, activity.stalled(context.Background(), broken))
+
+	// A task that's running for a long time isn't a stall
+	activity.delivered()
+	activity.lastDelivery = time.Now().Add(-time.Hour)
+	assert.False(t, activity.stalled(context.Background(), broken))
+	activity.finished()
+
+	activity.lastDelivery = time.Now().Add(-time.Hour)
+	assert.False(t, activity.stalled(context.Background(), healthy))
+	assert.True(t, time.Since(activity.lastDelivery) < time.Minute)
+
+	before := counterValue("sonic_subscribe_stalls_total", nil)
+	activity.lastDelivery = time.Now().Add(-time.Hour)
+	assert.True(t, activity.stalled(context.Background(), broken))
+	assert.Equal(t, before+1, counterValue("sonic_subscribe_stalls_total", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.False(t, activity.stalled(ctx, hung))
+}
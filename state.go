@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// inFlight is the state persisted for each running task so that a restarted
+// Sonic can find out what its predecessor left behind.
+type inFlight struct {
+	Task          kewpie.Task `json:"task"`
+	StartedAt     time.Time   `json:"started_at"`
+	PID           int         `json:"pid"`
+	ProcStartTime uint64      `json:"proc_start_time,omitempty"`
+}
+
+/*
+ * Record that a task is running as pid. Returns the path of the state file,
+ * which is empty if state persistence is disabled or failed.
+ */
+func saveInFlight(task kewpie.Task, pid int, startedAt time.Time) string {
+	if config.STATE_DIR == "" {
+		return ""
+	}
+
+	state := inFlight{Task: task, StartedAt: startedAt, PID: pid}
+	if procStarted, err := procStartTime(pid); err == nil {
+		state.ProcStartTime = procStarted
+	}
+
+	contents, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("ERROR marshalling in-flight state %+v\n", err)
+		return ""
+	}
+
+	path := filepath.Join(config.STATE_DIR, strconv.Itoa(pid)+".json")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		log.Printf("ERROR writing in-flight state %s: %s \n", path, err.Error())
+		reportSubsystemFailure("state", err)
+		return ""
+	}
+
+	return path
+}
+
+func clearInFlight(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR removing in-flight state %s: %s \n", path, err.Error())
+	}
+}
+
+/*
+ * Load the state left behind by a previous Sonic process. Each task it was
+ * running is failed cleanly, so the producer isn't left waiting on a task that
+ * will never finish. If the task's process survived, the orphan policy decides
+ * whether it is killed straight away or adopted and waited on first.
+ */
+func restoreInFlight() {
+	if config.STATE_DIR == "" {
+		return
+	}
+
+	if err := os.MkdirAll(config.STATE_DIR, 0700); err != nil {
+		log.Printf("ERROR creating state dir %s: %s \n", config.STATE_DIR, err.Error())
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.STATE_DIR, "*.json"))
+	if err != nil {
+		log.Printf("ERROR listing state dir %s: %s \n", config.STATE_DIR, err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		state, err := loadInFlight(path)
+		if err != nil {
+			log.Printf("ERROR loading in-flight state %s: %s \n", path, err.Error())
+			clearInFlight(path)
+			continue
+		}
+
+		log.Printf("INFO found task interrupted by restart, pid %d started at %s \n", state.PID, state.StartedAt)
+
+		process := findOrphan(state)
+		if process != nil && config.ORPHAN_POLICY == "adopt" {
+			go adoptOrphan(path, state, process)
+			continue
+		}
+
+		if process != nil {
+			if err := killProcessGroup(process); err != nil {
+				log.Printf("ERROR killing interrupted pid %d: %s \n", state.PID, err.Error())
+			}
+		}
+
+		failInterrupted(state, false)
+		clearInFlight(path)
+	}
+}
+
+/*
+ * Find the process a task was running in, if it is still alive. Where the
+ * platform allows it, the process start time is compared to the one recorded
+ * so that an unrelated process that has since reused the pid is left alone.
+ */
+func findOrphan(state inFlight) *os.Process {
+	process, err := os.FindProcess(state.PID)
+	if err != nil || !processAlive(process) {
+		return nil
+	}
+
+	if state.ProcStartTime != 0 {
+		if procStarted, err := procStartTime(state.PID); err != nil || procStarted != state.ProcStartTime {
+			return nil
+		}
+	}
+
+	return process
+}
+
+/*
+ * Wait for an orphaned task process to finish before failing the task. Its
+ * exit status can't be recovered as it isn't Sonic's child, so the task is
+ * still reported as interrupted. The state file is kept until the process is
+ * gone in case Sonic restarts again in the meantime.
+ */
+func adoptOrphan(path string, state inFlight, process *os.Process) {
+	log.Printf("INFO adopting orphaned pid %d \n", state.PID)
+
+	for findOrphan(state) != nil {
+		time.Sleep(1 * time.Second)
+	}
+
+	failInterrupted(state, true)
+	clearInFlight(path)
+}
+
+/*
+ * The IDs of the tasks a previous Sonic process left in-flight state for,
+ * which restoreInFlight will report.
+ */
+func inFlightTaskIDs() map[string]bool {
+	ids := map[string]bool{}
+	if config.STATE_DIR == "" {
+		return ids
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(config.STATE_DIR, "*.json"))
+	for _, path := range paths {
+		if state, err := loadInFlight(path); err == nil && state.Task.ID != "" {
+			ids[state.Task.ID] = true
+		}
+	}
+	return ids
+}
+
+func loadInFlight(path string) (inFlight, error) {
+	state := inFlight{}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+
+	return state, json.Unmarshal(contents, &state)
+}
+
+func processAlive(process *os.Process) bool {
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+func failInterrupted(state inFlight, adopted bool) {
+	payload := webhookPayload{
+		Task: state.Task,
+		Error: &TaskError{
+			Code:    errCodeInterrupted,
+			Message: "Sonic restarted while the task was running",
+			Details: map[string]string{
+				"pid":        strconv.Itoa(state.PID),
+				"started_at": state.StartedAt.Format(time.RFC3339),
+				"adopted":    strconv.FormatBool(adopted),
+			},
+		},
+	}
+	if err := sendWebhookPayload(failWebhook, payload); err != nil {
+		log.Printf("ERROR sending failure webhook for interrupted task %+v\n", state.Task)
+	}
+}
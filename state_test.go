@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndClearInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-state-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config.STATE_DIR = dir
+	defer func() {
+		config.STATE_DIR = ""
+	}()
+
+	task := kewpie.Task{Body: "sleep 1"}
+	path := saveInFlight(task, 1234, time.Now())
+	assert.NotEmpty(t, path)
+
+	state, err := loadInFlight(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1234, state.PID)
+	assert.Equal(t, "sleep 1", state.Task.Body)
+
+	clearInFlight(path)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreInFlight(t *testing.T) {
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	received := webhookPayload{}
+	http.HandleFunc("/"+uniq+"/fail", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(body, &received))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	dir, err := ioutil.TempDir("", "sonic-state-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config.STATE_DIR = dir
+	defer func() {
+		config.STATE_DIR = ""
+	}()
+
+	// A process that has already exited stands in for one lost in a restart
+	finished := exec.Command("true")
+	assert.Nil(t, finished.Run())
+
+	path := saveInFlight(kewpie.Task{
+		Body: "echo " + uniq,
+		Tags: kewpie.Tags{
+			"webhook_fail": "http://localhost:" + port + "/" + uniq + "/fail",
+		},
+	}, finished.Process.Pid, time.Now())
+
+	restoreInFlight()
+
+	if assert.NotNil(t, received.Error) {
+		assert.Equal(t, errCodeInterrupted, received.Error.Code)
+	}
+	assert.Equal(t, "echo "+uniq, received.Body)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreInFlightKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-state-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config.STATE_DIR = dir
+	defer func() {
+		config.STATE_DIR = ""
+	}()
+
+	// A task that has started a child of its own before the restart
+	cmd := exec.CommandContext(context.Background(), "sh", "-c", "sleep 30 & echo $!; wait")
+	prepareProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	assert.Nil(t, err)
+	assert.Nil(t, cmd.Start())
+	defer cmd.Wait()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.Nil(t, err)
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	assert.Nil(t, err)
+
+	saveInFlight(kewpie.Task{Body: "sleep 30"}, cmd.Process.Pid, time.Now())
+
+	restoreInFlight()
+
+	// The child may linger as a zombie until it's reaped
+	assert.Eventually(t, func() bool {
+		stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(child) + "/stat")
+		return err != nil || strings.Contains(string(stat), ") Z ")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFindOrphan(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	assert.Nil(t, cmd.Start())
+	defer cmd.Wait()
+
+	procStarted, err := procStartTime(cmd.Process.Pid)
+	assert.Nil(t, err)
+
+	state := inFlight{PID: cmd.Process.Pid, ProcStartTime: procStarted}
+	assert.NotNil(t, findOrphan(state))
+
+	state.ProcStartTime = procStarted + 1
+	assert.Nil(t, findOrphan(state))
+
+	assert.Nil(t, cmd.Process.Kill())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/paidright/sonic/config"
+)
+
+// The sinks METRICS_BACKEND can choose between.
+const (
+	metricsPrometheus = "prometheus"
+	metricsStatsd     = "statsd"
+	metricsDogStatsd  = "dogstatsd"
+)
+
+// statsd is the connection counters are pushed over when METRICS_BACKEND is
+// statsd or dogstatsd, and why the last push failed, if it did.
+var statsd = struct {
+	sync.Mutex
+	conn net.Conn
+	err  error
+}{}
+
+// statsdEscaper replaces the characters that delimit the StatsD line
+// format, so a label value can't corrupt a metric.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+
+/*
+ * Push an increment of a counter to STATSD_ADDR, if counters are pushed.
+ * Failures are kept for the metrics subsystem's probe rather than reported
+ * here, since reporting a failure increments a counter itself.
+ */
+func pushCounter(name string, labels map[string]string, value float64) {
+	if config.METRICS_BACKEND == metricsPrometheus {
+		return
+	}
+
+	line := []byte(formatStatsd(name, labels, value))
+
+	statsd.Lock()
+	defer statsd.Unlock()
+
+	if statsd.conn == nil {
+		conn, err := net.Dial("udp", config.STATSD_ADDR)
+		if err != nil {
+			statsd.err = err
+			return
+		}
+		statsd.conn = conn
+	}
+
+	_, err := statsd.conn.Write(line)
+	if err != nil {
+		statsd.conn.Close()
+		statsd.conn = nil
+	}
+	statsd.err = err
+}
+
+/*
+ * Render a counter increment as a StatsD line. DogStatsD carries labels as
+ * tags. Plain StatsD has no tags, so label values are appended to the name
+ * in the order of their label names, eg. sonic_tasks_total.success.
+ */
+func formatStatsd(name string, labels map[string]string, value float64) string {
+	names := []string{}
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	amount := strconv.FormatFloat(value, 'f', -1, 64)
+
+	if config.METRICS_BACKEND == metricsDogStatsd {
+		line := name + ":" + amount + "|c"
+		tags := []string{}
+		for _, label := range names {
+			tags = append(tags, label+":"+statsdEscaper.Replace(labels[label]))
+		}
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return line
+	}
+
+	for _, label := range names {
+		name += "." + strings.Replace(statsdEscaper.Replace(labels[label]), ".", "_", -1)
+	}
+	return name + ":" + amount + "|c"
+}
+
+func statsdPushing() error {
+	statsd.Lock()
+	defer statsd.Unlock()
+	return statsd.err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withStatsd(t *testing.T, backend string) (net.PacketConn, func()) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	config.METRICS_BACKEND = backend
+	config.STATSD_ADDR = listener.LocalAddr().String()
+	return listener, func() {
+		config.METRICS_BACKEND = metricsPrometheus
+		config.STATSD_ADDR = "127.0.0.1:8125"
+		statsd.Lock()
+		if statsd.conn != nil {
+			statsd.conn.Close()
+		}
+		statsd.conn = nil
+		statsd.err = nil
+		statsd.Unlock()
+		listener.Close()
+	}
+}
+
+func readStatsd(t *testing.T, listener net.PacketConn) string {
+	buf := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	assert.Nil(t, err)
+	return string(buf[:n])
+}
+
+func TestFormatStatsd(t *testing.T) {
+	config.METRICS_BACKEND = metricsStatsd
+	defer func() {
+		config.METRICS_BACKEND = metricsPrometheus
+	}()
+
+	assert.Equal(t, "sonic_tasks_delayed_total:1|c", formatStatsd("sonic_tasks_delayed_total", nil, 1))
+	assert.Equal(t, "sonic_tasks_total.billing.success:1|c", formatStatsd("sonic_tasks_total", map[string]string{"result": "success", "label_team": "billing"}, 1))
+	assert.Equal(t, "sonic_publish_spilled_total.jobs_eu_1:1|c", formatStatsd("sonic_publish_spilled_total", map[string]string{"queue": "jobs.eu:1"}, 1))
+
+	config.METRICS_BACKEND = metricsDogStatsd
+	assert.Equal(t, "sonic_task_seconds_total:1.5|c", formatStatsd("sonic_task_seconds_total", nil, 1.5))
+	assert.Equal(t, "sonic_tasks_total:1|c|#label_team:billing,result:success", formatStatsd("sonic_tasks_total", map[string]string{"result": "success", "label_team": "billing"}, 1))
+	assert.Equal(t, "sonic_publish_spilled_total:1|c|#queue:jobs.eu_1", formatStatsd("sonic_publish_spilled_total", map[string]string{"queue": "jobs.eu:1"}, 1))
+}
+
+func TestStatsdPush(t *testing.T) {
+	listener, restore := withStatsd(t, metricsDogStatsd)
+	defer restore()
+
+	before := counterValue("sonic_preemptions_total", map[string]string{"mode": "statsd_test"})
+	incCounter("sonic_preemptions_total", map[string]string{"mode": "statsd_test"})
+	assert.Equal(t, "sonic_preemptions_total:1|c|#mode:statsd_test", readStatsd(t, listener))
+
+	// Still counted for the readiness report and tests
+	assert.Equal(t, before+1, counterValue("sonic_preemptions_total", map[string]string{"mode": "statsd_test"}))
+	assert.Nil(t, probeMetrics())
+}
+
+func TestStatsdPushFailure(t *testing.T) {
+	_, restore := withStatsd(t, metricsStatsd)
+	defer restore()
+	config.STATSD_ADDR = "statsd.invalid:notaport"
+
+	incCounter("sonic_preemptions_total", map[string]string{"mode": "statsd_test"})
+	assert.NotNil(t, probeMetrics())
+}
@@ -0,0 +1,109 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+
+	"github.com/paidright/sonic/config"
+)
+
+// syslogFacilities are the facilities SYSLOG_FACILITY can name.
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogShipper is the connection to SYSLOG_ADDR, if Sonic ships its log
+// and commands' output there.
+var syslogShipper *syslog.Writer
+
+/*
+ * Connect to the syslog endpoint in SYSLOG_ADDR, either the local daemon or
+ * a udp:// or tcp:// URL, and copy Sonic's log to it.
+ */
+func setupSyslog() error {
+	if config.SYSLOG_ADDR == "" {
+		return nil
+	}
+
+	priority := syslog.LOG_INFO | syslogFacilities[config.SYSLOG_FACILITY]
+	var writer *syslog.Writer
+	var err error
+	if config.SYSLOG_ADDR == "local" {
+		writer, err = syslog.New(priority, config.SYSLOG_TAG)
+	} else {
+		parsed, parseErr := url.Parse(config.SYSLOG_ADDR)
+		if parseErr != nil {
+			return parseErr
+		}
+		writer, err = syslog.Dial(parsed.Scheme, parsed.Host, priority, config.SYSLOG_TAG)
+	}
+	if err != nil {
+		return err
+	}
+
+	syslogShipper = writer
+	logOutput = io.MultiWriter(logOutput, syslogLevelWriter{writer})
+	log.SetOutput(logOutput)
+	return nil
+}
+
+/*
+ * Writers that ship a command's stdout and stderr to syslog a line at a
+ * time, each line starting with prefix. stdout is logged at the info level
+ * and stderr at warning. Returns nil writers if output isn't shipped, and a
+ * function to ship any final line that didn't end with a newline.
+ */
+func syslogOutput(prefix string) (io.Writer, io.Writer, func()) {
+	if syslogShipper == nil {
+		return nil, nil, func() {}
+	}
+
+	stdout := newPrefixedWriter(syslogLineWriter{syslogShipper.Info}, prefix)
+	stderr := newPrefixedWriter(syslogLineWriter{syslogShipper.Warning}, prefix)
+	return stdout, stderr, func() {
+		stdout.flush()
+		stderr.flush()
+	}
+}
+
+// syslogLevelWriter logs ERROR lines at the error level, and everything else
+// as info.
+type syslogLevelWriter struct {
+	writer *syslog.Writer
+}
+
+func (s syslogLevelWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("ERROR")) {
+		return len(p), s.writer.Err(string(p))
+	}
+	return len(p), s.writer.Info(string(p))
+}
+
+// syslogLineWriter sends each line written to it as its own syslog message.
+type syslogLineWriter struct {
+	send func(string) error
+}
+
+func (s syslogLineWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n")) {
+		if err := s.send(string(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,93 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogLineWriter(t *testing.T) {
+	sent := []string{}
+	writer := syslogLineWriter{func(line string) error {
+		sent = append(sent, line)
+		return nil
+	}}
+
+	n, err := writer.Write([]byte("one\ntwo\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, []string{"one", "two"}, sent)
+}
+
+func TestSyslogShipping(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	config.SYSLOG_ADDR = "udp://" + listener.LocalAddr().String()
+	defer func() {
+		config.SYSLOG_ADDR = ""
+		syslogShipper.Close()
+		syslogShipper = nil
+		logOutput = os.Stderr
+		log.SetOutput(os.Stderr)
+	}()
+	assert.Nil(t, setupSyslog())
+
+	received := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	next := func() string {
+		select {
+		case message := <-received:
+			return message
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	log.Printf("ERROR shipped to syslog \n")
+	message := next()
+	// The daemon facility at the error level
+	assert.True(t, strings.HasPrefix(message, "<27>"), message)
+	assert.Contains(t, message, "sonic[")
+	assert.Contains(t, message, "ERROR shipped to syslog")
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "6b1d2c3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e",
+		Body: "echo shipped",
+	})
+	assert.False(t, requeue)
+	assert.Nil(t, err)
+
+	found := false
+	for message := next(); message != ""; message = next() {
+		if strings.Contains(message, "shipped") && !strings.Contains(message, "ERROR") {
+			// The daemon facility at the info level
+			assert.True(t, strings.HasPrefix(message, "<30>"), message)
+			assert.Contains(t, message, "[6b1d2c3e-4f5a-4b6c-8d7e-9f0a1b2c3d4e ")
+			found = true
+			break
+		}
+	}
+	assert.True(t, found)
+}
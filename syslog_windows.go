@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/paidright/sonic/config"
+)
+
+// ErrSyslogUnsupported is returned when SYSLOG_ADDR is set on windows.
+var ErrSyslogUnsupported = fmt.Errorf("Shipping logs to syslog is not supported on windows")
+
+func setupSyslog() error {
+	if config.SYSLOG_ADDR != "" {
+		return ErrSyslogUnsupported
+	}
+	return nil
+}
+
+func syslogOutput(prefix string) (io.Writer, io.Writer, func()) {
+	return nil, nil, func() {}
+}
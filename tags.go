@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// reservedTagPrefixes are the tag namespaces Sonic owns. In strict mode any
+// tag within them that Sonic doesn't recognise is rejected.
+var reservedTagPrefixes = []string{"webhook_", "sonic_"}
+
+// knownTags are the reserved tags Sonic understands.
+var knownTags = map[string]bool{
+	"webhook_start":     true,
+	"webhook_success":   true,
+	"webhook_fail":      true,
+	"webhook_timeout":   true,
+	"webhook_heartbeat": true,
+	"webhook_cancel":    true,
+	"webhook_retry":     true,
+	"webhook_expired":   true,
+
+	"webhook_auth_token":       true,
+	"webhook_start_mode":       true,
+	"webhook_method":           true,
+	"webhook_method_start":     true,
+	"webhook_method_success":   true,
+	"webhook_method_fail":      true,
+	"webhook_method_timeout":   true,
+	"webhook_method_heartbeat": true,
+	"webhook_method_cancel":    true,
+	"webhook_method_retry":     true,
+	"webhook_method_expired":   true,
+
+	envelopeVersionTag: true,
+
+	shadowExitCodeTag:   true,
+	shadowOutputHashTag: true,
+	shadowOutputTag:     true,
+
+	deadLetterCodeTag:     true,
+	deadLetterErrorTag:    true,
+	deadLetterExitCodeTag: true,
+	deadLetterAttemptsTag: true,
+	deadLetterAtTag:       true,
+	deadLetterHostTag:     true,
+}
+
+/*
+ * Find any tags in Sonic's reserved namespaces that it doesn't recognise,
+ * which are almost always producer typos like webhook_succes.
+ */
+func unknownTags(task kewpie.Task) []string {
+	unknown := []string{}
+
+	for tag := range task.Tags {
+		if knownTags[tag] || strings.HasPrefix(tag, webhookHeaderTagPrefix) || strings.HasPrefix(tag, webhookExitTagPrefix) {
+			continue
+		}
+		for _, prefix := range reservedTagPrefixes {
+			if strings.HasPrefix(tag, prefix) {
+				unknown = append(unknown, tag)
+				break
+			}
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+/*
+ * Check a task's tags in strict mode, describing any unrecognised ones in a
+ * TaskError.
+ */
+func checkTags(task kewpie.Task) error {
+	unknown := unknownTags(task)
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	return TaskError{
+		Code:    errCodeUnknownTag,
+		Message: fmt.Sprintf("Unrecognised tags: %s", strings.Join(unknown, ", ")),
+		Details: map[string]string{
+			"tags": strings.Join(unknown, ","),
+		},
+	}
+}
+
+/*
+ * Rename any aliased tags to the tag they stand in for, so producers can be
+ * migrated off legacy tag names gradually. Where a task sets both, the
+ * canonical tag wins. The task's own tag map is left untouched.
+ */
+func applyTagAliases(task kewpie.Task) kewpie.Task {
+	if len(config.TAG_ALIASES) == 0 || len(task.Tags) == 0 {
+		return task
+	}
+
+	tags := kewpie.Tags{}
+	for tag, value := range task.Tags {
+		tags[tag] = value
+	}
+
+	for alias, canonical := range config.TAG_ALIASES {
+		value, ok := tags[alias]
+		if !ok {
+			continue
+		}
+		delete(tags, alias)
+		if _, exists := task.Tags[canonical]; !exists {
+			tags[canonical] = value
+		}
+	}
+
+	task.Tags = tags
+	return task
+}
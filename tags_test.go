@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownTags(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_start":  "http://example.com/start",
+			"webhook_succes": "http://example.com/success",
+			"sonic_wat":      "true",
+			"customer_id":    "123",
+
+			"webhook_header_X-Api-Key": "secret",
+			"webhook_exit_2":           "http://example.com/no-data",
+		},
+	}
+
+	assert.Equal(t, []string{"sonic_wat", "webhook_succes"}, unknownTags(task))
+}
+
+func TestCheckTags(t *testing.T) {
+	assert.Nil(t, checkTags(kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_fail": "http://example.com/fail",
+		},
+	}))
+
+	err := checkTags(kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_error": "http://example.com/fail",
+		},
+	})
+	assert.Equal(t, errCodeUnknownTag, newTaskError(err).Code)
+}
+
+func TestApplyTagAliases(t *testing.T) {
+	config.TAG_ALIASES = map[string]string{
+		"callback_url": "webhook_success",
+		"error_url":    "webhook_fail",
+	}
+	defer func() {
+		config.TAG_ALIASES = map[string]string{}
+	}()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"callback_url": "http://example.com/legacy",
+			"error_url":    "http://example.com/legacy_fail",
+			"webhook_fail": "http://example.com/fail",
+		},
+	}
+
+	aliased := applyTagAliases(task)
+
+	assert.Equal(t, kewpie.Tags{
+		"webhook_success": "http://example.com/legacy",
+		"webhook_fail":    "http://example.com/fail",
+	}, aliased.Tags)
+	assert.Equal(t, "http://example.com/legacy", task.Tags["callback_url"])
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+)
+
+// The tags carrying a task's W3C trace context, as the traceparent and
+// tracestate headers of the request that enqueued it would.
+const (
+	traceparentTag = "traceparent"
+	tracestateTag  = "tracestate"
+)
+
+// traceExportTimeout is how long a span export may take before it's given
+// up on.
+const traceExportTimeout = 10 * time.Second
+
+// The OTLP span kind and status codes Sonic uses.
+const (
+	otlpKindConsumer = 5
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// taskSpanKey holds the span covering a task in its context.
+type taskSpanKey struct{}
+
+// taskSpan covers one attempt at a task, from its start webhook to its
+// outcome.
+type taskSpan struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	flags      string
+	tracestate string
+	task       kewpie.Task
+	start      time.Time
+}
+
+/*
+ * Tracing is enabled when there's a collector to export spans to.
+ */
+func tracingEnabled() bool {
+	return config.OTEL_EXPORTER_OTLP_ENDPOINT != ""
+}
+
+/*
+ * Parse a W3C traceparent, returning its trace ID, parent span ID and flags.
+ * Versions after 00 may append fields, which are ignored.
+ */
+func parseTraceparent(value string) (traceID, spanID, flags string, err error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", "", fmt.Errorf("traceparent must be version-traceid-parentid-flags")
+	}
+	if !isLowerHex(parts[0], 2) || parts[0] == "ff" {
+		return "", "", "", fmt.Errorf("traceparent has an invalid version")
+	}
+	if !isLowerHex(parts[1], 32) || parts[1] == strings.Repeat("0", 32) {
+		return "", "", "", fmt.Errorf("traceparent has an invalid trace ID")
+	}
+	if !isLowerHex(parts[2], 16) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", "", fmt.Errorf("traceparent has an invalid parent ID")
+	}
+	if !isLowerHex(parts[3], 2) {
+		return "", "", "", fmt.Errorf("traceparent has invalid flags")
+	}
+	return parts[1], parts[2], parts[3], nil
+}
+
+func isLowerHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(bytes int) string {
+	id := make([]byte, bytes)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/*
+ * Start a span for a task, as a child of the trace in its traceparent tag,
+ * or the root of a new trace if it doesn't have one. Returns a nil span if
+ * tracing is disabled.
+ */
+func startTaskSpan(ctx context.Context, task kewpie.Task) (context.Context, *taskSpan) {
+	if !tracingEnabled() {
+		return ctx, nil
+	}
+
+	span := &taskSpan{
+		traceID:    randomHex(16),
+		spanID:     randomHex(8),
+		flags:      "01",
+		tracestate: task.Tags[tracestateTag],
+		task:       task,
+		start:      time.Now(),
+	}
+	if value := task.Tags[traceparentTag]; value != "" {
+		traceID, parentID, flags, err := parseTraceparent(value)
+		if err != nil {
+			log.Printf("ERROR ignoring traceparent of task %s: %s \n", task.ID, err.Error())
+		} else {
+			span.traceID, span.parentID, span.flags = traceID, parentID, flags
+		}
+	}
+
+	return context.WithValue(ctx, taskSpanKey{}, span), span
+}
+
+func (s *taskSpan) sampled() bool {
+	flags, _ := strconv.ParseUint(s.flags, 16, 8)
+	return flags&1 == 1
+}
+
+func (s *taskSpan) traceparent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-" + s.flags
+}
+
+/*
+ * End the span and export it, if its trace is sampled, recording whether
+ * the task failed and if it's being requeued.
+ */
+func (s *taskSpan) end(requeue bool, err error) {
+	if s == nil || !s.sampled() {
+		return
+	}
+
+	attributes := []otlpAttribute{
+		stringAttribute("messaging.system", config.KEWPIE_BACKEND),
+		stringAttribute("messaging.destination.name", config.QUEUE),
+		stringAttribute("messaging.message.id", s.task.ID),
+		boolAttribute("sonic.requeue", requeue),
+	}
+	status := otlpStatus{Code: otlpStatusOK}
+	if err != nil {
+		taskErr := newTaskError(err)
+		attributes = append(attributes, stringAttribute("sonic.error_code", taskErr.Code))
+		status = otlpStatus{Code: otlpStatusError, Message: taskErr.Message}
+	}
+
+	exportSpan(otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		TraceState:        s.tracestate,
+		Name:              config.QUEUE + " process",
+		Kind:              otlpKindConsumer,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        attributes,
+		Status:            status,
+	})
+}
+
+/*
+ * The environment that passes a task's trace context on to its command, as
+ * TRACEPARENT and TRACESTATE. With tracing enabled the command's spans are
+ * children of the task's span, and otherwise of the task's traceparent tag.
+ */
+func traceEnv(ctx context.Context, task kewpie.Task) []string {
+	traceparent := task.Tags[traceparentTag]
+	if span, ok := ctx.Value(taskSpanKey{}).(*taskSpan); ok {
+		traceparent = span.traceparent()
+	}
+	if traceparent == "" {
+		return nil
+	}
+
+	env := []string{"TRACEPARENT=" + traceparent}
+	if task.Tags[tracestateTag] != "" {
+		env = append(env, "TRACESTATE="+task.Tags[tracestateTag])
+	}
+	return env
+}
+
+// otlpTraces is the body of an OTLP/HTTP export request, in its JSON
+// encoding.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func boolAttribute(key string, value bool) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{BoolValue: &value}}
+}
+
+/*
+ * Send a span to the collector at OTEL_EXPORTER_OTLP_ENDPOINT. Failures are
+ * logged and counted in sonic_trace_export_failures_total, but never fail
+ * the task.
+ */
+func exportSpan(span otlpSpan) {
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{stringAttribute("service.name", config.OTEL_SERVICE_NAME)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "sonic", Version: currentVersion},
+				Spans: []otlpSpan{span},
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("ERROR marshalling span %+v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(config.OTEL_EXPORTER_OTLP_ENDPOINT, "/") + "/v1/traces"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("ERROR building span export to %s: %s \n", url, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Printf("ERROR exporting span in trace %s: %s \n", span.TraceID, err.Error())
+		incCounter("sonic_trace_export_failures_total", nil)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		log.Printf("ERROR exporting span to %s, response code %d \n", url, res.StatusCode)
+		incCounter("sonic_trace_export_failures_total", nil)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, flags, err := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+	assert.Equal(t, "01", flags)
+
+	// Later versions may add fields
+	_, _, _, err = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.Nil(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		_, _, _, err := parseTraceparent(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestTraceEnv(t *testing.T) {
+	task := kewpie.Task{Tags: kewpie.Tags{
+		traceparentTag: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		tracestateTag:  "vendor=value",
+	}}
+	assert.Nil(t, traceEnv(context.Background(), kewpie.Task{}))
+
+	// Passed through untouched without tracing
+	assert.Equal(t, []string{
+		"TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"TRACESTATE=vendor=value",
+	}, traceEnv(context.Background(), task))
+
+	config.OTEL_EXPORTER_OTLP_ENDPOINT = "http://localhost:4318"
+	defer func() {
+		config.OTEL_EXPORTER_OTLP_ENDPOINT = ""
+	}()
+
+	ctx, span := startTaskSpan(context.Background(), task)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.traceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.parentID)
+	assert.Equal(t, []string{
+		"TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.spanID + "-01",
+		"TRACESTATE=vendor=value",
+	}, traceEnv(ctx, task))
+}
+
+func TestTaskSpanExported(t *testing.T) {
+	exported := make(chan otlpTraces, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		traces := otlpTraces{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&traces))
+		exported <- traces
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config.OTEL_EXPORTER_OTLP_ENDPOINT = server.URL
+	defer func() {
+		config.OTEL_EXPORTER_OTLP_ENDPOINT = ""
+	}()
+
+	requeue, err := handleTask(context.Background(), kewpie.Task{
+		ID:   "3f2a1b0c-9d8e-4f7a-b6c5-d4e3f2a1b0c9",
+		Body: "false",
+		Tags: kewpie.Tags{traceparentTag: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	})
+	assert.False(t, requeue)
+	assert.NotNil(t, err)
+
+	traces := <-exported
+	if !assert.Len(t, traces.ResourceSpans, 1) || !assert.Len(t, traces.ResourceSpans[0].ScopeSpans, 1) {
+		return
+	}
+	assert.Equal(t, "sonic", *traces.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID)
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].ParentSpanID)
+		assert.Len(t, spans[0].SpanID, 16)
+		assert.Equal(t, otlpKindConsumer, spans[0].Kind)
+		assert.Equal(t, otlpStatusError, spans[0].Status.Code)
+	}
+
+	// Traces the producer didn't sample aren't exported
+	_, span := startTaskSpan(context.Background(), kewpie.Task{
+		Tags: kewpie.Tags{traceparentTag: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+	})
+	span.end(false, nil)
+	assert.Len(t, exported, 0)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// transformScript is the compiled TRANSFORM_SCRIPT, loaded the first time a
+// task needs it.
+var transformScript struct {
+	sync.Mutex
+	path string
+	fn   starlark.Callable
+	err  error
+}
+
+/*
+ * Load TRANSFORM_SCRIPT and find its transform function. The script runs in
+ * an interpreter embedded in Sonic: it can't load other files, touch the
+ * filesystem or network, or start processes, so all it can do is compute a
+ * new task from the old one.
+ */
+func loadTransformScript() (starlark.Callable, error) {
+	transformScript.Lock()
+	defer transformScript.Unlock()
+
+	if transformScript.path == config.TRANSFORM_SCRIPT {
+		return transformScript.fn, transformScript.err
+	}
+
+	transformScript.path = config.TRANSFORM_SCRIPT
+	transformScript.fn, transformScript.err = compileTransformScript(config.TRANSFORM_SCRIPT)
+	return transformScript.fn, transformScript.err
+}
+
+func compileTransformScript(path string) (starlark.Callable, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &starlark.Thread{Name: "load " + path}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, src, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fn, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't define a transform function", path)
+	}
+	return fn, nil
+}
+
+/*
+ * Pass a task through the transform function in TRANSFORM_SCRIPT, if one is
+ * configured. The function is given the task as a dict and returns it,
+ * possibly changed, or None to leave it as it is. It can rewrite the body
+ * or tags, add env_ tags, or set veto to a reason to stop the task running.
+ */
+func transformTask(ctx context.Context, task kewpie.Task) (kewpie.Task, error) {
+	if config.TRANSFORM_SCRIPT == "" {
+		return task, nil
+	}
+
+	fn, err := loadTransformScript()
+	if err != nil {
+		return task, transformError("Unable to load the transform script: %s", err.Error())
+	}
+
+	thread := &starlark.Thread{Name: "transform " + task.ID}
+	timer := time.AfterFunc(config.TRANSFORM_TIMEOUT, func() {
+		thread.Cancel("the transform script took longer than TRANSFORM_TIMEOUT")
+	})
+	defer timer.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+
+	input, err := taskToStarlark(task)
+	if err != nil {
+		return task, transformError("Unable to pass the task to the transform script: %s", err.Error())
+	}
+
+	result, err := starlark.Call(thread, fn, starlark.Tuple{input}, nil)
+	if err != nil {
+		return task, transformError("The transform script failed: %s", err.Error())
+	}
+	if result == starlark.None {
+		return task, nil
+	}
+
+	output, ok := result.(*starlark.Dict)
+	if !ok {
+		return task, transformError("The transform script returned a %s rather than a dict", result.Type())
+	}
+
+	if reason, found, _ := output.Get(starlark.String("veto")); found && bool(reason.Truth()) {
+		message, ok := starlark.AsString(reason)
+		if !ok {
+			message = reason.String()
+		}
+		return task, TaskError{
+			Code:    errCodeVetoed,
+			Message: message,
+		}
+	}
+
+	transformed, err := taskFromStarlark(task, output)
+	if err != nil {
+		return task, transformError("The transform script returned an invalid task: %s", err.Error())
+	}
+	return transformed, nil
+}
+
+func transformError(format string, args ...interface{}) error {
+	return TaskError{
+		Code:      errCodeTransformFailed,
+		Message:   fmt.Sprintf(format, args...),
+		Retryable: true,
+	}
+}
+
+/*
+ * Describe a task to the transform script. The script gets its own copy, so
+ * it's free to change it in place.
+ */
+func taskToStarlark(task kewpie.Task) (*starlark.Dict, error) {
+	tags := starlark.NewDict(len(task.Tags))
+	names := []string{}
+	for name := range task.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tags.SetKey(starlark.String(name), starlark.String(task.Tags[name])); err != nil {
+			return nil, err
+		}
+	}
+
+	dict := starlark.NewDict(4)
+	fields := []starlark.Tuple{
+		{starlark.String("id"), starlark.String(task.ID)},
+		{starlark.String("body"), starlark.String(task.Body)},
+		{starlark.String("attempts"), starlark.MakeInt(task.Attempts)},
+		{starlark.String("tags"), tags},
+	}
+	for _, field := range fields {
+		if err := dict.SetKey(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+/*
+ * Apply the body and tags the transform script returned to the task. The
+ * queue's bookkeeping, like the ID and attempts, belongs to Sonic, so the
+ * script can't change it.
+ */
+func taskFromStarlark(task kewpie.Task, dict *starlark.Dict) (kewpie.Task, error) {
+	if value, found, _ := dict.Get(starlark.String("body")); found {
+		body, ok := starlark.AsString(value)
+		if !ok {
+			return task, fmt.Errorf("body is a %s rather than a string", value.Type())
+		}
+		task.Body = body
+	}
+
+	if value, found, _ := dict.Get(starlark.String("tags")); found {
+		tagDict, ok := value.(*starlark.Dict)
+		if !ok {
+			return task, fmt.Errorf("tags is a %s rather than a dict", value.Type())
+		}
+		tags := kewpie.Tags{}
+		for _, item := range tagDict.Items() {
+			name, ok := starlark.AsString(item[0])
+			if !ok {
+				return task, fmt.Errorf("tag %s isn't named by a string", item[0].String())
+			}
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				return task, fmt.Errorf("tag %s is a %s rather than a string", name, item[1].Type())
+			}
+			tags[name] = value
+		}
+		task.Tags = tags
+	}
+
+	return task, nil
+}
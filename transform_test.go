@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withTransformScript(t *testing.T, script string) func() {
+	file, err := ioutil.TempFile("", "sonic-transform-*.star")
+	assert.Nil(t, err)
+	_, err = file.WriteString(script)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	config.TRANSFORM_SCRIPT = file.Name()
+	return func() {
+		config.TRANSFORM_SCRIPT = ""
+		os.Remove(file.Name())
+	}
+}
+
+func TestTransformTaskWithoutScript(t *testing.T) {
+	task := kewpie.Task{Body: "echo hai"}
+
+	transformed, err := transformTask(context.Background(), task)
+	assert.Nil(t, err)
+	assert.Equal(t, task, transformed)
+}
+
+func TestTransformTaskRewrite(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    task["id"] = "nope"
+    task["attempts"] = 10
+    task["body"] = task["body"].replace("original", "rewritten")
+    task["tags"]["env_GREETING"] = "hai"
+    if task["tags"].get("team") == "billing":
+        task["tags"]["container_image"] = "billing:1"
+    return task
+`)()
+
+	transformed, err := transformTask(context.Background(), kewpie.Task{
+		ID:       "abc",
+		Body:     "echo original",
+		Attempts: 1,
+		Tags:     kewpie.Tags{"team": "billing"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", transformed.ID)
+	assert.Equal(t, 1, transformed.Attempts)
+	assert.Equal(t, "echo rewritten", transformed.Body)
+	assert.Equal(t, kewpie.Tags{
+		"team":            "billing",
+		"env_GREETING":    "hai",
+		"container_image": "billing:1",
+	}, transformed.Tags)
+}
+
+func TestTransformTaskUnchanged(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    return None
+`)()
+
+	task := kewpie.Task{ID: "abc", Body: "echo original", Tags: kewpie.Tags{"team": "billing"}}
+	transformed, err := transformTask(context.Background(), task)
+	assert.Nil(t, err)
+	assert.Equal(t, task, transformed)
+}
+
+func TestTransformTaskVeto(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    return {"veto": "not today"}
+`)()
+
+	_, err := transformTask(context.Background(), kewpie.Task{Body: "echo original"})
+	taskErr := newTaskError(err)
+	assert.Equal(t, errCodeVetoed, taskErr.Code)
+	assert.Equal(t, "not today", taskErr.Message)
+	assert.False(t, taskErr.Retryable)
+}
+
+func TestTransformTaskFailure(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    return task["missing"]
+`)()
+
+	_, err := transformTask(context.Background(), kewpie.Task{Body: "echo original"})
+	assert.Equal(t, errCodeTransformFailed, newTaskError(err).Code)
+}
+
+func TestTransformTaskInvalidResult(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    task["tags"]["retries"] = 3
+    return task
+`)()
+
+	_, err := transformTask(context.Background(), kewpie.Task{Body: "echo original"})
+	assert.Equal(t, errCodeTransformFailed, newTaskError(err).Code)
+}
+
+func TestTransformTaskSandboxed(t *testing.T) {
+	for _, script := range []string{
+		`load("other.star", "x")
+def transform(task):
+    return task
+`,
+		`def transform(task):
+    return open("/etc/passwd")
+`,
+		`x = 1
+`,
+	} {
+		func() {
+			defer withTransformScript(t, script)()
+
+			_, err := transformTask(context.Background(), kewpie.Task{Body: "echo original"})
+			assert.Equal(t, errCodeTransformFailed, newTaskError(err).Code)
+		}()
+	}
+}
+
+func TestTransformTaskTimeout(t *testing.T) {
+	defer withTransformScript(t, `
+def transform(task):
+    for i in range(1000000000):
+        pass
+    return task
+`)()
+	config.TRANSFORM_TIMEOUT = 50 * time.Millisecond
+	defer func() {
+		config.TRANSFORM_TIMEOUT = 10 * time.Second
+	}()
+
+	started := time.Now()
+	_, err := transformTask(context.Background(), kewpie.Task{Body: "echo original"})
+	assert.Equal(t, errCodeTransformFailed, newTaskError(err).Code)
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "os"
+
+// resourceUsage describes what a task's command consumed, as reported in the
+// success and fail webhooks. Source is "cgroup" when it was read from the
+// task's cgroup, which counts every descendant, or "rusage" when only the
+// command and the children it waited for are counted.
+type resourceUsage struct {
+	Source              string   `json:"source"`
+	UserCPUSeconds      float64  `json:"user_cpu_seconds"`
+	SystemCPUSeconds    float64  `json:"system_cpu_seconds"`
+	CPUThrottledSeconds *float64 `json:"cpu_throttled_seconds,omitempty"`
+	MemoryPeakBytes     *int64   `json:"memory_peak_bytes,omitempty"`
+	MaxRSSBytes         *int64   `json:"max_rss_bytes,omitempty"`
+
+	// Only set with ENERGY_TELEMETRY
+	EnergyJoules *float64 `json:"energy_joules,omitempty"`
+	EnergySource string   `json:"energy_source,omitempty"`
+	CO2Grams     *float64 `json:"co2_grams,omitempty"`
+}
+
+/*
+ * Describe what an exited process consumed from its rusage.
+ */
+func processUsage(state *os.ProcessState) resourceUsage {
+	if state == nil {
+		return resourceUsage{}
+	}
+
+	usage := resourceUsage{
+		Source:           "rusage",
+		UserCPUSeconds:   state.UserTime().Seconds(),
+		SystemCPUSeconds: state.SystemTime().Seconds(),
+	}
+	if rss, ok := maxRSSBytes(state); ok {
+		usage.MaxRSSBytes = &rss
+	}
+	return usage
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskUsage(t *testing.T) {
+	usage := resourceUsage{}
+	err := runTaskProcWithOutput(context.Background(), kewpie.Task{Body: "true"}, procOutput{usage: &usage})
+	assert.Nil(t, err)
+	assert.Contains(t, []string{"cgroup", "rusage"}, usage.Source)
+	if usage.Source == "rusage" {
+		assert.NotNil(t, usage.MaxRSSBytes)
+	}
+}
+
+func TestProcessUsageWithoutProcess(t *testing.T) {
+	assert.Equal(t, resourceUsage{}, processUsage(nil))
+}
+
+func TestUsageOmittedBeforeRun(t *testing.T) {
+	payload := newWebhookPayload(kewpie.Task{}).withUsage(&resourceUsage{})
+	assert.Nil(t, payload.Usage)
+}
+
+func TestEnergyEstimate(t *testing.T) {
+	config.ENERGY_TELEMETRY = true
+	config.ENERGY_WATTS_PER_CPU = 10
+	config.CARBON_INTENSITY = 360
+	defer func() {
+		config.ENERGY_TELEMETRY = false
+		config.ENERGY_WATTS_PER_CPU = 0
+		config.CARBON_INTENSITY = 0
+	}()
+
+	usage := resourceUsage{Source: "rusage", UserCPUSeconds: 1.5, SystemCPUSeconds: 0.5}
+	(&energyMeter{}).account(&usage)
+	assert.Equal(t, "estimate", usage.EnergySource)
+	assert.Equal(t, 20.0, *usage.EnergyJoules)
+	assert.InDelta(t, 0.002, *usage.CO2Grams, 1e-9)
+}
+
+func TestEnergyDisabled(t *testing.T) {
+	assert.Nil(t, startEnergyMeter())
+
+	usage := resourceUsage{Source: "rusage", UserCPUSeconds: 1}
+	startEnergyMeter().account(&usage)
+	assert.Nil(t, usage.EnergyJoules)
+}
+
+func TestEnergyCounterWrap(t *testing.T) {
+	earlier := energySample{microjoules: map[string]uint64{"a": 900, "b": 100}}
+	later := energySample{
+		microjoules: map[string]uint64{"a": 100, "b": 300},
+		ranges:      map[string]uint64{"a": 1000, "b": 1000},
+	}
+	assert.InDelta(t, 0.0004, later.joulesSince(earlier), 1e-12)
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+/*
+ * The largest resident set size of the process or any child it waited for.
+ */
+func maxRSSBytes(state *os.ProcessState) (int64, bool) {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, false
+	}
+	// Darwin reports bytes, everything else kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss), true
+	}
+	return int64(rusage.Maxrss) * 1024, true
+}
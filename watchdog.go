@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// outputWatchdog kills a task that has gone quiet for too long, on the
+// assumption that it is wedged.
+type outputWatchdog struct {
+	timeout time.Duration
+	kill    func()
+
+	mu           sync.Mutex
+	lastActivity time.Time
+	stalled      bool
+	done         chan struct{}
+}
+
+/*
+ * Start watching for output. kill is called if none is seen for timeout. For
+ * tasks it cancels the command's context, which kills the task's whole process
+ * group.
+ */
+func newOutputWatchdog(timeout time.Duration, kill func()) *outputWatchdog {
+	w := &outputWatchdog{
+		timeout:      timeout,
+		kill:         kill,
+		lastActivity: time.Now(),
+		done:         make(chan struct{}),
+	}
+
+	go w.watch()
+
+	return w
+}
+
+func (w *outputWatchdog) watch() {
+	interval := w.timeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			quiet := time.Since(w.lastActivity)
+			if quiet >= w.timeout {
+				w.stalled = true
+			}
+			w.mu.Unlock()
+
+			if quiet >= w.timeout {
+				w.kill()
+				return
+			}
+		}
+	}
+}
+
+/*
+ * Wrap a writer so that anything written to it counts as activity.
+ */
+func (w *outputWatchdog) wrap(out io.Writer) io.Writer {
+	return activityWriter{out: out, watchdog: w}
+}
+
+/*
+ * Stop watching once the task has exited.
+ */
+func (w *outputWatchdog) stop() {
+	close(w.done)
+}
+
+/*
+ * If the watchdog killed the task, describe that in place of the error from
+ * waiting on it.
+ */
+func (w *outputWatchdog) classify(waitErr error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.stalled {
+		return waitErr
+	}
+
+	return TaskError{
+		Code:    errCodeStalled,
+		Message: "The task produced no output for " + w.timeout.String() + " and was killed",
+		Details: map[string]string{
+			"no_output_timeout": w.timeout.String(),
+		},
+		Retryable: true,
+	}
+}
+
+type activityWriter struct {
+	out      io.Writer
+	watchdog *outputWatchdog
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.watchdog.mu.Lock()
+	a.watchdog.lastActivity = time.Now()
+	a.watchdog.mu.Unlock()
+
+	return a.out.Write(p)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputWatchdogKillsQuietTask(t *testing.T) {
+	config.NO_OUTPUT_TIMEOUT = 100 * time.Millisecond
+	defer func() {
+		config.NO_OUTPUT_TIMEOUT = 0
+	}()
+
+	started := time.Now()
+	err := runProc(context.Background(), "sleep 5")
+
+	assert.True(t, time.Since(started) < 5*time.Second)
+	assert.Equal(t, errCodeStalled, newTaskError(err).Code)
+}
+
+func TestOutputWatchdogKillsQuietTaskWithChildren(t *testing.T) {
+	config.NO_OUTPUT_TIMEOUT = 200 * time.Millisecond
+	defer func() {
+		config.NO_OUTPUT_TIMEOUT = 0
+	}()
+
+	dir, err := ioutil.TempDir("", "sonic-watchdog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The children hold the output open, and one would outlive the task
+	script := filepath.Join(dir, "task.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+(sleep 1; echo survived > "$(dirname "$0")/survived") &
+sleep 30 &
+wait
+`), 0755))
+
+	started := time.Now()
+	err = runTaskProc(context.Background(), kewpie.Task{Body: script})
+	assert.True(t, time.Since(started) < 5*time.Second)
+	assert.Equal(t, errCodeStalled, newTaskError(err).Code)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "survived"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOutputWatchdogAllowsChattyTask(t *testing.T) {
+	config.NO_OUTPUT_TIMEOUT = 1 * time.Second
+	defer func() {
+		config.NO_OUTPUT_TIMEOUT = 0
+	}()
+
+	assert.Nil(t, runProc(context.Background(), "echo hai"))
+}
+
+func TestOutputWatchdogActivity(t *testing.T) {
+	killed := false
+	watchdog := newOutputWatchdog(100*time.Millisecond, func() {
+		killed = true
+	})
+	defer watchdog.stop()
+
+	out := watchdog.wrap(&nopWriter{})
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		out.Write([]byte("still going"))
+	}
+
+	assert.False(t, killed)
+	assert.Nil(t, watchdog.classify(nil))
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
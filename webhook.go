@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// webhookHeaderTagPrefix marks tags whose values are sent as webhook headers.
+const webhookHeaderTagPrefix = "webhook_header_"
+
+// webhookExitTagPrefix marks tags that receive the fail webhook in place of
+// webhook_fail when the command exits with the code that follows it.
+const webhookExitTagPrefix = "webhook_exit_"
+
+// webhookMethodTag overrides WEBHOOK_METHOD for a task, and with an event
+// suffix, eg. webhook_method_success, for a single webhook.
+const webhookMethodTag = "webhook_method"
+
+// webhookAuthTokenTag overrides WEBHOOK_AUTH_TOKEN for a task.
+const webhookAuthTokenTag = "webhook_auth_token"
+
+// webhookClient makes every webhook request.
+var webhookClient = http.DefaultClient
+
+// Formats webhook bodies can be sent in.
+const (
+	webhookFormatSonic       = "sonic"
+	webhookFormatCloudEvents = "cloudevents"
+)
+
+// webhookPayload is the body POSTed to webhooks. The task is embedded so its
+// fields stay at the top level for receivers that predate the extra fields.
+type webhookPayload struct {
+	kewpie.Task
+	Error      *TaskError `json:"error,omitempty"`
+	Attempt    int        `json:"attempt,omitempty"`
+	Redelivery bool       `json:"redelivery,omitempty"`
+
+	// Only set once the command has run. WebhookSeconds is how long the task
+	// waited on its start webhook, which isn't included in DurationSeconds.
+	WebhookSeconds  float64        `json:"webhook_seconds,omitempty"`
+	ExitCode        *int           `json:"exit_code,omitempty"`
+	StartedAt       *time.Time     `json:"started_at,omitempty"`
+	FinishedAt      *time.Time     `json:"finished_at,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds,omitempty"`
+	Stdout          *string        `json:"stdout,omitempty"`
+	Stderr          *string        `json:"stderr,omitempty"`
+	OutputTruncated bool           `json:"output_truncated,omitempty"`
+	Usage           *resourceUsage `json:"usage,omitempty"`
+
+	// Only set for heartbeats
+	ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+	Output         *string `json:"output,omitempty"`
+
+	// Only set for retries
+	NextAttempt       int      `json:"next_attempt,omitempty"`
+	RetryDelaySeconds *float64 `json:"retry_delay_seconds,omitempty"`
+}
+
+func newWebhookPayload(task kewpie.Task) webhookPayload {
+	return webhookPayload{
+		Task:       task,
+		Attempt:    task.Attempts + 1,
+		Redelivery: task.Attempts > 0,
+	}
+}
+
+/*
+ * Describe a run of the task's command in the payload.
+ */
+func (p webhookPayload) withRun(started, finished time.Time, err error) webhookPayload {
+	code := exitCode(err)
+	p.ExitCode = &code
+	p.StartedAt = &started
+	p.FinishedAt = &finished
+	p.DurationSeconds = finished.Sub(started).Seconds()
+	return p
+}
+
+/*
+ * The exit code used to pick a webhook_exit_<code> tag for a failed task.
+ * Commands killed by a signal use the shell convention of 128 plus the
+ * signal number, eg. 137 for SIGKILL, and containers report their own exit
+ * code. The bool is false if the command didn't run to an exit.
+ */
+func routingExitCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case *exec.ExitError:
+		if status, ok := e.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), true
+		}
+		return e.ExitCode(), true
+	case TaskError:
+		code, err := strconv.Atoi(e.Details["exit_code"])
+		return code, err == nil
+	}
+	return 0, false
+}
+
+/*
+ * Record how long the task spent waiting on webhooks before its command ran.
+ */
+func (p webhookPayload) withWebhookTime(elapsed time.Duration) webhookPayload {
+	p.WebhookSeconds = elapsed.Seconds()
+	return p
+}
+
+/*
+ * Attach what the command consumed to the payload, if it ran far enough for
+ * that to be known.
+ */
+func (p webhookPayload) withUsage(usage *resourceUsage) webhookPayload {
+	if usage != nil && usage.Source != "" {
+		p.Usage = usage
+	}
+	return p
+}
+
+/*
+ * Attach the end of the command's output to the payload.
+ */
+func (p webhookPayload) withOutput(stdout, stderr *tailBuffer) webhookPayload {
+	out, outTruncated := stdout.String()
+	errOut, errTruncated := stderr.String()
+	p.Stdout = &out
+	p.Stderr = &errOut
+	p.OutputTruncated = outTruncated || errTruncated
+	return p
+}
+
+/*
+ * When kewpie pulls a message of a queue, it communicates the progress
+ * of Sonic's execution via webhooks, start, heartbeat, fail and success which
+ * issues a HTTP post to an end point defined in the task.Tags map.
+ */
+func sendWebhook(event Webhook, task kewpie.Task) error {
+	return sendWebhookPayload(event, newWebhookPayload(task))
+}
+
+func sendWebhookPayload(event Webhook, body webhookPayload) error {
+	evt, err := webhookToString(event)
+	if err != nil {
+		return err
+	}
+
+	return sendTaggedWebhook(evt, "webhook_"+evt, body)
+}
+
+/*
+ * Send the webhook for an event to the URL in the named tag, which needn't be
+ * the event's own, eg. a fail webhook routed by exit code. Tasks with a
+ * callback_queue tag have their events published there instead, and with
+ * GRPC_CALLBACK_ENDPOINT set every event is delivered there over gRPC.
+ */
+func sendTaggedWebhook(evt, tagName string, body webhookPayload) error {
+	task := body.Task
+	if task.Tags[callbackQueueTag] != "" {
+		return publishCallback(evt, body)
+	}
+	if config.GRPC_CALLBACK_ENDPOINT != "" {
+		return sendGRPCCallback(evt, body)
+	}
+	if task.Tags[tagName] == "" {
+		return nil
+	}
+
+	if !webhookURLAllowed(task.Tags[tagName]) {
+		log.Printf("ERROR refusing to send %s webhook to %s, which isn't in WEBHOOK_URL_ALLOWLIST \n", evt, task.Tags[tagName])
+		incCounter("sonic_webhook_policy_violations_total", map[string]string{"event": evt})
+		return ErrWebhookNotAllowed
+	}
+
+	payload, headers, err := buildWebhook(evt, body)
+	if err != nil {
+		return err
+	}
+
+	method := webhookMethod(task, evt)
+	if journaledEvents[evt] {
+		// A failed success webhook requeues the task when it can be retried,
+		// and the rerun will report its own outcome
+		keep := evt != "success" || !retryEnabled(task)
+		return deliverJournaled(journaledWebhook{
+			Event:   evt,
+			TagName: tagName,
+			TaskID:  task.ID,
+			Method:  method,
+			URL:     task.Tags[tagName],
+			Headers: headers,
+			Payload: payload,
+		}, keep)
+	}
+	return deliverWebhook(method, tagName, task.Tags[tagName], headers, payload)
+}
+
+/*
+ * Render the body of an event's webhook, and the headers to send with it,
+ * in the format set by WEBHOOK_TEMPLATE and WEBHOOK_FORMAT.
+ */
+func buildWebhook(evt string, body webhookPayload) ([]byte, http.Header, error) {
+	task := body.Task
+	payload, err := renderWebhook(evt, excludeWebhookTags(body))
+	if err != nil {
+		log.Printf("Error rendering webhook %+v\n", err)
+		return nil, nil, err
+	}
+
+	headers := webhookHeaders(task)
+	if webhookTemplate != nil {
+		headers.Set("Content-Type", config.WEBHOOK_TEMPLATE_CONTENT_TYPE)
+	}
+	if config.WEBHOOK_FORMAT == webhookFormatCloudEvents {
+		payload, err = wrapCloudEvent(evt, task, payload)
+		if err != nil {
+			log.Printf("Error marshalling JSON %+v\n", err)
+			return nil, nil, err
+		}
+		headers.Set("Content-Type", "application/cloudevents+json")
+	}
+	return payload, headers, nil
+}
+
+// webhookTemplate renders webhook bodies in place of the default JSON, if
+// WEBHOOK_TEMPLATE is set.
+var webhookTemplate *template.Template
+
+// webhookTemplateData is what a WEBHOOK_TEMPLATE is rendered with.
+type webhookTemplateData struct {
+	webhookPayload
+	Event string
+}
+
+/*
+ * Parse WEBHOOK_TEMPLATE, a Go template for webhook bodies. Besides the usual
+ * functions, json renders a value as JSON, so strings are safely quoted.
+ */
+func parseWebhookTemplate() (*template.Template, error) {
+	if config.WEBHOOK_TEMPLATE == "" {
+		return nil, nil
+	}
+
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}).Parse(config.WEBHOOK_TEMPLATE)
+}
+
+/*
+ * Render the body of a webhook, from WEBHOOK_TEMPLATE if it is set, or as the
+ * payload's JSON.
+ */
+func renderWebhook(evt string, body webhookPayload) ([]byte, error) {
+	if webhookTemplate == nil {
+		return marshalWebhookPayload(body)
+	}
+
+	rendered := &bytes.Buffer{}
+	if err := webhookTemplate.Execute(rendered, webhookTemplateData{webhookPayload: body, Event: evt}); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+/*
+ * Whether a tag or payload field name matches one of WEBHOOK_EXCLUDE's
+ * patterns.
+ */
+func excludedFromWebhooks(name string) bool {
+	for _, pattern := range config.WEBHOOK_EXCLUDE {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Strip tags matching WEBHOOK_EXCLUDE from a payload, so sensitive parameters
+ * aren't echoed back over the network. The task's own tags are left alone, as
+ * they still say where the webhook goes.
+ */
+func excludeWebhookTags(body webhookPayload) webhookPayload {
+	if len(config.WEBHOOK_EXCLUDE) == 0 {
+		return body
+	}
+
+	tags := kewpie.Tags{}
+	for name, value := range body.Tags {
+		if !excludedFromWebhooks(name) {
+			tags[name] = value
+		}
+	}
+	body.Tags = tags
+	return body
+}
+
+/*
+ * Marshal a payload to JSON, leaving out any top level fields matching
+ * WEBHOOK_EXCLUDE.
+ */
+func marshalWebhookPayload(body webhookPayload) ([]byte, error) {
+	payload, err := json.Marshal(body)
+	if err != nil || len(config.WEBHOOK_EXCLUDE) == 0 {
+		return payload, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	for name := range fields {
+		if excludedFromWebhooks(name) {
+			delete(fields, name)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// cloudEvent is the CloudEvents 1.0 structured mode envelope.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+/*
+ * Wrap a webhook payload in a CloudEvents envelope, so it can feed event
+ * pipelines such as Knative or EventBridge directly. The type is
+ * com.paidright.sonic.task.<event> and the subject is the task ID.
+ */
+func wrapCloudEvent(evt string, task kewpie.Task, payload []byte) ([]byte, error) {
+	source := config.CLOUDEVENTS_SOURCE
+	if source == "" {
+		source = "/sonic/" + config.QUEUE
+	}
+
+	return json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            "com.paidright.sonic.task." + evt,
+		Source:          source,
+		ID:              uuid.NewV4().String(),
+		Time:            time.Now().UTC(),
+		Subject:         task.ID,
+		DataContentType: "application/json",
+		Data:            payload,
+	})
+}
+
+/*
+ * The HTTP method for a task's webhook. webhook_method_<event> overrides
+ * webhook_method, which overrides WEBHOOK_METHOD. Invalid methods fall back
+ * to POST.
+ */
+func webhookMethod(task kewpie.Task, evt string) string {
+	method := config.WEBHOOK_METHOD
+	if task.Tags[webhookMethodTag] != "" {
+		method = task.Tags[webhookMethodTag]
+	}
+	if task.Tags[webhookMethodTag+"_"+evt] != "" {
+		method = task.Tags[webhookMethodTag+"_"+evt]
+	}
+
+	method = strings.ToUpper(method)
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return method
+	}
+
+	log.Printf("ERROR unsupported webhook method %s, using POST \n", method)
+	return http.MethodPost
+}
+
+/*
+ * Collect the extra headers to send with a task's webhooks. WEBHOOK_HEADERS
+ * applies to every task, and each webhook_header_<Name> tag sets Name,
+ * overriding the config. A bearer token from the webhook_auth_token tag or
+ * WEBHOOK_AUTH_TOKEN is sent as the Authorization header.
+ */
+func webhookHeaders(task kewpie.Task) http.Header {
+	headers := http.Header{}
+	for name, value := range config.WEBHOOK_HEADERS {
+		headers.Set(name, value)
+	}
+	for tag, value := range task.Tags {
+		if strings.HasPrefix(tag, webhookHeaderTagPrefix) && len(tag) > len(webhookHeaderTagPrefix) {
+			headers.Set(strings.TrimPrefix(tag, webhookHeaderTagPrefix), value)
+		}
+	}
+
+	token := config.WEBHOOK_AUTH_TOKEN
+	if task.Tags[webhookAuthTokenTag] != "" {
+		token = task.Tags[webhookAuthTokenTag]
+	}
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	// The content type follows WEBHOOK_FORMAT
+	headers.Del("Content-Type")
+
+	return headers
+}
+
+/*
+ * Deliver a webhook, retrying network errors, server failures and statuses
+ * in WEBHOOK_RETRY_STATUSES up to WEBHOOK_RETRIES times with exponential
+ * backoff. A 429 or 503 with a Retry-After header is retried after the delay
+ * the receiver asked for instead, up to WEBHOOK_RETRY_MAX. With
+ * WEBHOOK_DEADLINE set, every attempt and the delays between them must fit
+ * within it.
+ */
+func deliverWebhook(method, tagName, url string, headers http.Header, payload []byte) error {
+	ctx := context.Background()
+	if config.WEBHOOK_DEADLINE > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.WEBHOOK_DEADLINE)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		status, retryAfter, err := postWebhook(ctx, method, tagName, url, headers, payload)
+		retryable := err == ErrWebhookServerFailed &&
+			(status == 0 || status >= 500 || retryAfter > 0 || config.WEBHOOK_RETRY_STATUSES[status])
+		if !retryable || attempt >= config.WEBHOOK_RETRIES {
+			return err
+		}
+
+		delay := webhookBackoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+			if delay > config.WEBHOOK_RETRY_MAX {
+				delay = config.WEBHOOK_RETRY_MAX
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			log.Printf("ERROR giving up on %s webhook, retrying would exceed WEBHOOK_DEADLINE of %s \n", tagName, config.WEBHOOK_DEADLINE)
+			return err
+		}
+		log.Printf("INFO retrying %s webhook in %s \n", tagName, delay)
+		time.Sleep(delay)
+	}
+}
+
+/*
+ * Make a single webhook request, abandoning it if ctx is done. A status in
+ * WEBHOOK_ABORT_STATUSES returns ErrWebhookBadRequest, and one in
+ * WEBHOOK_IGNORE_STATUSES is treated as success. The status code is zero if
+ * no response was received, and the delay is how long a 429 or 503
+ * response's Retry-After header asked Sonic to wait before retrying, if it
+ * had one.
+ */
+func postWebhook(ctx context.Context, method, tagName, url string, headers http.Header, payload []byte) (int, time.Duration, error) {
+	log.Printf("INFO Sending a http %s for event %+v on the url %+v\n", strings.ToLower(method), tagName, url)
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("ERROR webhook error %+v\n", err)
+		return 0, 0, ErrWebhookServerFailed
+	}
+	req = req.WithContext(ctx)
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if config.WEBHOOK_SECRET != "" {
+		req.Header.Set("X-Sonic-Signature", signWebhook(payload))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		if blockedAddressError(err) {
+			log.Printf("ERROR refusing to send %s webhook to %s, which resolves to a private address \n", tagName, url)
+			incCounter("sonic_webhook_policy_violations_total", map[string]string{"event": strings.TrimPrefix(tagName, "webhook_")})
+			return 0, 0, ErrWebhookNotAllowed
+		}
+		if refusedRedirectError(err) {
+			log.Printf("ERROR refusing to follow %s webhook redirect from %s to a URL outside WEBHOOK_URL_ALLOWLIST \n", tagName, url)
+			incCounter("sonic_webhook_policy_violations_total", map[string]string{"event": strings.TrimPrefix(tagName, "webhook_")})
+			return 0, 0, ErrWebhookNotAllowed
+		}
+		log.Printf("ERROR webhook error %+v\n", err)
+		return 0, 0, ErrWebhookServerFailed
+	}
+	defer res.Body.Close()
+
+	log.Printf("INFO Response code from post %+v\n", res.StatusCode)
+	if config.WEBHOOK_ABORT_STATUSES[res.StatusCode] {
+		return res.StatusCode, 0, ErrWebhookBadRequest
+	}
+
+	if tagName == "webhook_heartbeat" && abortRequested(res) {
+		return res.StatusCode, 0, ErrWebhookAbortRequested
+	}
+
+	if config.WEBHOOK_IGNORE_STATUSES[res.StatusCode] {
+		log.Printf("INFO ignoring http %d response to %s webhook \n", res.StatusCode, tagName)
+		return res.StatusCode, 0, nil
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res.StatusCode, 0, nil
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		return res.StatusCode, parseRetryAfter(res.Header.Get("Retry-After"), time.Now()), ErrWebhookServerFailed
+	}
+
+	return res.StatusCode, 0, ErrWebhookServerFailed
+}
+
+/*
+ * Parse a Retry-After header, which is either a number of seconds or an HTTP
+ * date, into a delay from now. Zero means there was no usable delay.
+ */
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+/*
+ * Whether a heartbeat receiver wants the task aborted, by responding with a
+ * 409 or a JSON body of {"abort": true}.
+ */
+func abortRequested(res *http.Response) bool {
+	if res.StatusCode == http.StatusConflict {
+		return true
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false
+	}
+
+	body := struct {
+		Abort bool `json:"abort"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return false
+	}
+	return body.Abort
+}
+
+/*
+ * Build the HTTP client for webhooks. Every request is limited to
+ * WEBHOOK_TIMEOUT, so one slow receiver can't stall a worker, and connecting
+ * to WEBHOOK_DIAL_TIMEOUT and WEBHOOK_TLS_HANDSHAKE_TIMEOUT. If
+ * WEBHOOK_TLS_CERT and WEBHOOK_TLS_KEY are set it presents that client
+ * certificate, for receivers that require mutual TLS. WEBHOOK_TLS_CA
+ * replaces the system roots used to verify receivers, WEBHOOK_CA_FILE adds to
+ * them, and WEBHOOK_TLS_INSECURE_SKIP_VERIFY turns verification off. With
+ * WEBHOOK_BLOCK_PRIVATE set it refuses to connect to private addresses.
+ * Redirects are followed up to WEBHOOK_MAX_REDIRECTS deep, and requests go
+ * through the proxy chosen by webhookProxy.
+ */
+func newWebhookClient() (*http.Client, error) {
+	tlsConfig, err := webhookTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:               webhookProxy,
+		DialContext:         webhookDialer().DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.WEBHOOK_TLS_HANDSHAKE_TIMEOUT,
+		MaxIdleConns:        config.WEBHOOK_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost: config.WEBHOOK_MAX_IDLE_CONNS,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       config.WEBHOOK_TIMEOUT,
+		CheckRedirect: checkWebhookRedirect,
+	}, nil
+}
+
+/*
+ * The TLS config for connecting to webhook receivers, with the client
+ * certificate and CAs from the WEBHOOK_TLS_* settings and WEBHOOK_CA_FILE.
+ */
+func webhookTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.WEBHOOK_TLS_CERT != "" || config.WEBHOOK_TLS_KEY != "" {
+		cert, err := tls.LoadX509KeyPair(config.WEBHOOK_TLS_CERT, config.WEBHOOK_TLS_KEY)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.WEBHOOK_TLS_CA != "" {
+		bundle, err := ioutil.ReadFile(config.WEBHOOK_TLS_CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in %s", config.WEBHOOK_TLS_CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.WEBHOOK_CA_FILE != "" {
+		bundle, err := ioutil.ReadFile(config.WEBHOOK_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		pool := tlsConfig.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("Unable to load the system roots to add WEBHOOK_CA_FILE to, set WEBHOOK_TLS_CA instead: %s", err)
+			}
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in %s", config.WEBHOOK_CA_FILE)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.WEBHOOK_TLS_INSECURE_SKIP_VERIFY {
+		log.Printf("ERROR WEBHOOK_TLS_INSECURE_SKIP_VERIFY is set, webhook receivers' certificates will not be verified \n")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
+/*
+ * The dialer for connecting to webhook receivers, which refuses private
+ * addresses if WEBHOOK_BLOCK_PRIVATE is set.
+ */
+func webhookDialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   config.WEBHOOK_DIAL_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}
+	if config.WEBHOOK_BLOCK_PRIVATE {
+		dialer.Control = checkWebhookAddress
+	}
+	return dialer
+}
+
+/*
+ * Pick the proxy for a webhook request. WEBHOOK_PROXY sends every webhook
+ * through that proxy, or none at all if it's "direct". Otherwise the usual
+ * HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables apply.
+ */
+func webhookProxy(req *http.Request) (*url.URL, error) {
+	switch config.WEBHOOK_PROXY {
+	case "":
+		return http.ProxyFromEnvironment(req)
+	case "direct":
+		return nil, nil
+	}
+	return url.Parse(config.WEBHOOK_PROXY)
+}
+
+/*
+ * Sign a webhook body with WEBHOOK_SECRET, so receivers can verify it came
+ * from a worker. The signature is the hex encoded HMAC-SHA256 of the body,
+ * prefixed with the algorithm in the same form GitHub uses.
+ */
+func signWebhook(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.WEBHOOK_SECRET))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * The delay before retrying a webhook for the nth time. It doubles with each
+ * attempt up to WEBHOOK_RETRY_MAX, with jitter so a fleet of workers doesn't
+ * retry in lockstep against a recovering receiver.
+ */
+func webhookBackoff(attempt int) time.Duration {
+	delay := config.WEBHOOK_RETRY_BASE
+	for i := 0; i < attempt && delay < config.WEBHOOK_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > config.WEBHOOK_RETRY_MAX {
+		delay = config.WEBHOOK_RETRY_MAX
+	}
+
+	// Full jitter over the upper half of the window
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+/*
+ * We represent Webhooks a using integers to make the code a bit safer. golang is a bit
+ * loose with it's enums.
+ */
+func webhookToString(hook Webhook) (string, error) {
+	switch hook {
+	case 1:
+		return "start", nil
+	case 2:
+		return "success", nil
+	case 3:
+		return "fail", nil
+	case 4:
+		return "timeout", nil
+	case 5:
+		return "heartbeat", nil
+	case 6:
+		return "cancel", nil
+	case 7:
+		return "retry", nil
+	case 8:
+		return "expired", nil
+	default:
+		return "", ErrUnknownWebhook
+	}
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go/v3"
+	"github.com/paidright/sonic/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func withWebhookRetries(retries int) func() {
+	config.WEBHOOK_RETRIES = retries
+	config.WEBHOOK_RETRY_BASE = time.Millisecond
+	return func() {
+		config.WEBHOOK_RETRIES = 0
+		config.WEBHOOK_RETRY_BASE = 500 * time.Millisecond
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	defer withWebhookRetries(3)()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	calls := 0
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	defer withWebhookRetries(3)()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	calls := 0
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+		},
+	})
+	assert.Equal(t, ErrWebhookServerFailed, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	config.WEBHOOK_RETRY_BASE = 100 * time.Millisecond
+	config.WEBHOOK_RETRY_MAX = time.Second
+	defer func() {
+		config.WEBHOOK_RETRY_BASE = 500 * time.Millisecond
+		config.WEBHOOK_RETRY_MAX = 30 * time.Second
+	}()
+
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		delay := webhookBackoff(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, attempt)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	config.WEBHOOK_SECRET = "hunter2"
+	defer func() {
+		config.WEBHOOK_SECRET = ""
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	signature := ""
+	body := []byte{}
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Sonic-Signature")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+		},
+	})
+	assert.Nil(t, err)
+
+	mac := hmac.New(sha256.New, []byte("hunter2"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+}
+
+func TestWebhookHeaders(t *testing.T) {
+	config.WEBHOOK_HEADERS = map[string]string{
+		"X-Api-Key": "from-config",
+		"X-Route":   "billing",
+	}
+	defer func() {
+		config.WEBHOOK_HEADERS = map[string]string{}
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	headers := http.Header{}
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success":          "http://localhost:" + port + "/" + uniq + "/success",
+			"webhook_header_X-Api-Key": "from-tag",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "from-tag", headers.Get("X-Api-Key"))
+	assert.Equal(t, "billing", headers.Get("X-Route"))
+	assert.Equal(t, "application/json", headers.Get("Content-Type"))
+}
+
+func TestWebhookAuthToken(t *testing.T) {
+	config.WEBHOOK_AUTH_TOKEN = "from-config"
+	defer func() {
+		config.WEBHOOK_AUTH_TOKEN = ""
+	}()
+
+	assert.Equal(t, "Bearer from-config", webhookHeaders(kewpie.Task{}).Get("Authorization"))
+	assert.Equal(t, "Bearer from-tag", webhookHeaders(kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_auth_token": "from-tag",
+		},
+	}).Get("Authorization"))
+
+	config.WEBHOOK_AUTH_TOKEN = ""
+	assert.Equal(t, "", webhookHeaders(kewpie.Task{}).Get("Authorization"))
+}
+
+/*
+ * Write a PEM encoded certificate signed by parent, or self signed if parent
+ * is nil, and its key to dir.
+ */
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return cert, key
+}
+
+func TestWebhookMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	expiry := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sonic test ca"},
+		NotAfter:              expiry,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     expiry,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "sonic"},
+		NotAfter:     expiry,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	config.WEBHOOK_TLS_CA = filepath.Join(dir, "ca.crt")
+	defer func() {
+		config.WEBHOOK_TLS_CERT = ""
+		config.WEBHOOK_TLS_KEY = ""
+		config.WEBHOOK_TLS_CA = ""
+		webhookClient = http.DefaultClient
+	}()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL + "/success",
+		},
+	}
+
+	// Without a client certificate the receiver refuses the connection
+	webhookClient, err = newWebhookClient()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrWebhookServerFailed, sendWebhook(successWebhook, task))
+
+	config.WEBHOOK_TLS_CERT = filepath.Join(dir, "client.crt")
+	config.WEBHOOK_TLS_KEY = filepath.Join(dir, "client.key")
+	webhookClient, err = newWebhookClient()
+	assert.Nil(t, err)
+	assert.Nil(t, sendWebhook(successWebhook, task))
+}
+
+func TestWebhookCAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonic-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	expiry := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sonic test ca"},
+		NotAfter:              expiry,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotAfter:     expiry,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.StartTLS()
+	defer server.Close()
+
+	defer func() {
+		config.WEBHOOK_CA_FILE = ""
+		config.WEBHOOK_TLS_INSECURE_SKIP_VERIFY = false
+		webhookClient = http.DefaultClient
+	}()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL + "/success",
+		},
+	}
+
+	webhookClient, err = newWebhookClient()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrWebhookServerFailed, sendWebhook(successWebhook, task))
+
+	config.WEBHOOK_CA_FILE = filepath.Join(dir, "ca.crt")
+	webhookClient, err = newWebhookClient()
+	assert.Nil(t, err)
+	assert.Nil(t, sendWebhook(successWebhook, task))
+
+	config.WEBHOOK_CA_FILE = ""
+	config.WEBHOOK_TLS_INSECURE_SKIP_VERIFY = true
+	webhookClient, err = newWebhookClient()
+	assert.Nil(t, err)
+	assert.Nil(t, sendWebhook(successWebhook, task))
+}
+
+func TestWebhookMethod(t *testing.T) {
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_method":         "put",
+			"webhook_method_success": "PATCH",
+		},
+	}
+
+	assert.Equal(t, http.MethodPut, webhookMethod(task, "start"))
+	assert.Equal(t, http.MethodPatch, webhookMethod(task, "success"))
+	assert.Equal(t, http.MethodPost, webhookMethod(kewpie.Task{}, "fail"))
+	assert.Equal(t, http.MethodPost, webhookMethod(kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_method": "DELETE",
+		},
+	}, "fail"))
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	method := ""
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.WriteHeader(http.StatusOK)
+	})
+
+	task.Tags["webhook_success"] = "http://localhost:" + port + "/" + uniq + "/success"
+	assert.Nil(t, sendWebhook(successWebhook, task))
+	assert.Equal(t, http.MethodPatch, method)
+}
+
+func TestWebhookCloudEvents(t *testing.T) {
+	config.WEBHOOK_FORMAT = webhookFormatCloudEvents
+	defer func() {
+		config.WEBHOOK_FORMAT = webhookFormatSonic
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	contentType := ""
+	event := map[string]interface{}{}
+	http.HandleFunc("/"+uniq+"/start", func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	err := sendWebhook(startWebhook, kewpie.Task{
+		ID:   "task-1",
+		Body: "echo hai",
+		Tags: kewpie.Tags{
+			"webhook_start": "http://localhost:" + port + "/" + uniq + "/start",
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "application/cloudevents+json", contentType)
+	assert.Equal(t, "1.0", event["specversion"])
+	assert.Equal(t, "com.paidright.sonic.task.start", event["type"])
+	assert.Equal(t, "/sonic/"+config.QUEUE, event["source"])
+	assert.Equal(t, "task-1", event["subject"])
+	assert.NotEmpty(t, event["id"])
+	assert.NotEmpty(t, event["time"])
+	assert.Equal(t, "echo hai", event["data"].(map[string]interface{})["body"])
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	config.WEBHOOK_TEMPLATE = `{"state": "{{.Event}}", "job": {{json .ID}}, "customer": {{json .Tags.customer}}{{if .Error}}, "reason": {{json .Error.Code}}{{end}}}`
+	tmpl, err := parseWebhookTemplate()
+	assert.Nil(t, err)
+	webhookTemplate = tmpl
+	defer func() {
+		config.WEBHOOK_TEMPLATE = ""
+		webhookTemplate = nil
+	}()
+
+	task := kewpie.Task{
+		ID: "task-1",
+		Tags: kewpie.Tags{
+			"customer": `Bobby "Tables"`,
+		},
+	}
+
+	rendered, err := renderWebhook("success", webhookPayload{Task: task})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"state": "success", "job": "task-1", "customer": "Bobby \"Tables\""}`, string(rendered))
+
+	rendered, err = renderWebhook("fail", webhookPayload{Task: task, Error: &TaskError{Code: errCodeProcExited}})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"state": "fail", "job": "task-1", "customer": "Bobby \"Tables\"", "reason": "proc_exited"}`, string(rendered))
+}
+
+func TestWebhookExitCodeRouting(t *testing.T) {
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	calls := make(chan string, 4)
+	for _, name := range []string{"fail", "exit_1", "exit_137"} {
+		name := name
+		http.HandleFunc("/"+uniq+"/"+name, func(w http.ResponseWriter, r *http.Request) {
+			received := webhookPayload{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+			assert.NotNil(t, received.Error)
+			calls <- name
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+
+	tags := kewpie.Tags{
+		"webhook_fail":     "http://localhost:" + port + "/" + uniq + "/fail",
+		"webhook_exit_1":   "http://localhost:" + port + "/" + uniq + "/exit_1",
+		"webhook_exit_137": "http://localhost:" + port + "/" + uniq + "/exit_137",
+	}
+
+	failTask(kewpie.Task{Tags: tags}, exec.Command("false").Run())
+	assert.Equal(t, "exit_1", <-calls)
+
+	failTask(kewpie.Task{Tags: tags}, exec.Command("sh", "-c", "exit 2").Run())
+	assert.Equal(t, "fail", <-calls)
+
+	failTask(kewpie.Task{Tags: tags}, exec.Command("sh", "-c", "kill -9 $$").Run())
+	assert.Equal(t, "exit_137", <-calls)
+
+	failTask(kewpie.Task{Tags: tags}, ErrWebhookServerFailed)
+	assert.Equal(t, "fail", <-calls)
+}
+
+func TestRetryWebhook(t *testing.T) {
+	config.RETRY = true
+	defer func() {
+		config.RETRY = false
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	retries := make(chan webhookPayload, 2)
+	http.HandleFunc("/"+uniq+"/retry", func(w http.ResponseWriter, r *http.Request) {
+		received := webhookPayload{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		retries <- received
+		w.WriteHeader(http.StatusOK)
+	})
+
+	task := kewpie.Task{
+		Body:     "false",
+		Attempts: 1,
+		Tags: kewpie.Tags{
+			"webhook_retry": "http://localhost:" + port + "/" + uniq + "/retry",
+		},
+	}
+
+	requeue, err := handleTask(context.Background(), task)
+	assert.True(t, requeue)
+	assert.NotNil(t, err)
+
+	received := <-retries
+	assert.Equal(t, 2, received.Attempt)
+	assert.Equal(t, 3, received.NextAttempt)
+	if assert.NotNil(t, received.RetryDelaySeconds) {
+		assert.Equal(t, 80.0, *received.RetryDelaySeconds)
+	}
+	if assert.NotNil(t, received.Error) {
+		assert.Equal(t, errCodeProcExited, received.Error.Code)
+	}
+
+	task.NoExpBackoff = true
+	handleTask(context.Background(), task)
+	received = <-retries
+	if assert.NotNil(t, received.RetryDelaySeconds) {
+		assert.Equal(t, 0.0, *received.RetryDelaySeconds)
+	}
+
+	config.RETRY = false
+	requeue, _ = handleTask(context.Background(), task)
+	assert.False(t, requeue)
+	assert.Len(t, retries, 0)
+}
+
+func TestWebhookExclude(t *testing.T) {
+	config.WEBHOOK_EXCLUDE = []string{"*_secret", "env_*", "body"}
+	defer func() {
+		config.WEBHOOK_EXCLUDE = []string{}
+	}()
+
+	uniq := uuid.NewV4().String()
+	listener, port := createListener(t)
+	go (func() {
+		assert.Nil(t, http.Serve(listener, nil))
+	})()
+
+	received := map[string]interface{}{}
+	http.HandleFunc("/"+uniq+"/success", func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	task := kewpie.Task{
+		ID:   uniq,
+		Body: "deploy --password hunter2",
+		Tags: kewpie.Tags{
+			"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+			"api_secret":      "hunter2",
+			"env_PASSWORD":    "hunter2",
+			"customer_id":     "123",
+		},
+	}
+	assert.Nil(t, sendWebhook(successWebhook, task))
+
+	assert.Equal(t, uniq, received["id"])
+	assert.NotContains(t, received, "body")
+	assert.Equal(t, map[string]interface{}{
+		"webhook_success": "http://localhost:" + port + "/" + uniq + "/success",
+		"customer_id":     "123",
+	}, received["tags"])
+	assert.Equal(t, "hunter2", task.Tags["api_secret"])
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config.WEBHOOK_TIMEOUT = 100 * time.Millisecond
+	client, err := newWebhookClient()
+	assert.Nil(t, err)
+	webhookClient = client
+	defer func() {
+		config.WEBHOOK_TIMEOUT = 30 * time.Second
+		webhookClient = http.DefaultClient
+	}()
+
+	started := time.Now()
+	err = sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL,
+		},
+	})
+	assert.Equal(t, ErrWebhookServerFailed, err)
+	assert.True(t, time.Since(started) < time.Second)
+}
+
+func TestWebhookRetryAfter(t *testing.T) {
+	defer withWebhookRetries(1)()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	started := time.Now()
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.True(t, time.Since(started) >= time.Second)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	assert.Equal(t, 2*time.Minute, parseRetryAfter(now.Add(2*time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+}
+
+func TestWebhookRedirects(t *testing.T) {
+	client, err := newWebhookClient()
+	assert.Nil(t, err)
+	webhookClient = client
+	defer func() {
+		config.WEBHOOK_MAX_REDIRECTS = 3
+		webhookClient = http.DefaultClient
+	}()
+
+	hops := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/done" {
+			hops++
+			http.Redirect(w, r, server.URL+"/done", http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL + "/start",
+		},
+	}
+	assert.Nil(t, sendWebhook(successWebhook, task))
+	assert.Equal(t, 1, hops)
+
+	config.WEBHOOK_MAX_REDIRECTS = 0
+	assert.Equal(t, ErrWebhookServerFailed, sendWebhook(successWebhook, task))
+}
+
+func TestWebhookStatusClassification(t *testing.T) {
+	defer withWebhookRetries(1)()
+	config.WEBHOOK_ABORT_STATUSES = map[int]bool{409: true}
+	config.WEBHOOK_RETRY_STATUSES = map[int]bool{425: true}
+	config.WEBHOOK_IGNORE_STATUSES = map[int]bool{404: true}
+	config.WEBHOOK_RETRY_BASE = time.Millisecond
+	defer func() {
+		config.WEBHOOK_ABORT_STATUSES = map[int]bool{400: true}
+		config.WEBHOOK_RETRY_STATUSES = map[int]bool{}
+		config.WEBHOOK_IGNORE_STATUSES = map[int]bool{}
+		config.WEBHOOK_RETRY_BASE = 500 * time.Millisecond
+	}()
+
+	calls := 0
+	status := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	task := kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL,
+		},
+	}
+
+	for _, c := range []struct {
+		status int
+		err    error
+		calls  int
+	}{
+		{409, ErrWebhookBadRequest, 1},
+		{400, ErrWebhookServerFailed, 1},
+		{404, nil, 1},
+		{425, ErrWebhookServerFailed, 2},
+	} {
+		calls = 0
+		status = c.status
+		assert.Equal(t, c.err, sendWebhook(successWebhook, task), c.status)
+		assert.Equal(t, c.calls, calls, c.status)
+	}
+}
+
+func TestWebhookProxy(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	config.WEBHOOK_PROXY = proxy.URL
+	client, err := newWebhookClient()
+	assert.Nil(t, err)
+	webhookClient = client
+	defer func() {
+		config.WEBHOOK_PROXY = ""
+		webhookClient = http.DefaultClient
+	}()
+
+	err = sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": "http://receiver.invalid/success",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://receiver.invalid/success", proxied)
+}
+
+func TestWebhookDeadline(t *testing.T) {
+	defer withWebhookRetries(5)()
+	config.WEBHOOK_RETRY_BASE = 200 * time.Millisecond
+	config.WEBHOOK_DEADLINE = 300 * time.Millisecond
+	defer func() {
+		config.WEBHOOK_RETRY_BASE = 500 * time.Millisecond
+		config.WEBHOOK_DEADLINE = 0
+	}()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	started := time.Now()
+	err := sendWebhook(successWebhook, kewpie.Task{
+		Tags: kewpie.Tags{
+			"webhook_success": server.URL,
+		},
+	})
+	assert.Equal(t, ErrWebhookServerFailed, err)
+	assert.True(t, calls < 6)
+	assert.True(t, time.Since(started) < 300*time.Millisecond)
+}
+
+func TestWebhookSecondsReported(t *testing.T) {
+	var received webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			time.Sleep(50 * time.Millisecond)
+		} else {
+			json.NewDecoder(r.Body).Decode(&received)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, err := handleTask(context.Background(), kewpie.Task{
+		Body: "true",
+		Tags: kewpie.Tags{
+			"webhook_start":   server.URL + "/start",
+			"webhook_success": server.URL + "/success",
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, received.WebhookSeconds >= 0.05)
+}